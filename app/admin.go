@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// adminAuthenticator guards /api/admin. It is nil, and the admin API
+	// off, when no admin key is configured.
+	adminAuthenticator Authenticator
+
+	// adminRate is ADMIN_RATE_LIMIT requests/sec per client, in buckets of
+	// ADMIN_RATE_BURST, counted apart from RATE_LIMIT; 0 disables it.
+	adminRate rateSetting
+
+	// maintenance makes new runs fail fast with 503 while the supervisor is
+	// being upgraded. Health checks and the UI keep working.
+	maintenance atomic.Bool
+	// maintenanceRetryAfter is the Retry-After sent during maintenance.
+	maintenanceRetryAfter time.Duration
+
+	// safeMode is SAFE_MODE, the incident lockdown: whatever else is
+	// configured, every run becomes a read-only dry run on the read-only
+	// backends, and no job can be started.
+	safeMode bool
+)
+
+// adminKeyAuth accepts any of ADMIN_KEYS, or the older single ADMIN_TOKEN,
+// as a bearer token. The principal names the key by a hash prefix.
+type adminKeyAuth struct {
+	keys [][]byte
+}
+
+func (a adminKeyAuth) Authenticate(r *http.Request) (string, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return "", errUnauthenticated
+	}
+	match := 0
+	for _, key := range a.keys {
+		match |= subtle.ConstantTimeCompare([]byte(token), key)
+	}
+	if match != 1 {
+		return "", errUnauthenticated
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "admin:" + hex.EncodeToString(sum[:4]), nil
+}
+
+// initAdminAuth sets adminAuthenticator from ADMIN_KEYS and ADMIN_TOKEN. An
+// admin key must not also be a user key in API_KEYS, so a user's key never
+// opens the admin API.
+func initAdminAuth(keys []string, token string) error {
+	if token != "" {
+		keys = append(keys, token)
+	}
+	if len(keys) == 0 {
+		adminAuthenticator = nil
+		return nil
+	}
+	a := adminKeyAuth{}
+	for _, k := range keys {
+		for _, user := range apiKeys {
+			if subtle.ConstantTimeCompare([]byte(k), user) == 1 {
+				return errors.New("ADMIN_KEYS: an admin key is also listed in API_KEYS")
+			}
+		}
+		a.keys = append(a.keys, []byte(k))
+	}
+	adminAuthenticator = a
+	return nil
+}
+
+// requireAdmin guards the /api/admin group: it applies ADMIN_RATE_LIMIT,
+// then requires an admin key, refusing everything when none is configured.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		if adminRate.limit > 0 {
+			if delay := take(adminBuckets.get(clientIP(r), &adminRate), 1); delay > 0 {
+				writeRateLimited(w, r, delay, "admin rate limit exceeded")
+				return
+			}
+		}
+		if adminAuthenticator == nil {
+			writeError(w, http.StatusForbidden, "admin API disabled")
+			return
+		}
+		principal, err := adminAuthenticator.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mcp-gateway-admin"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if rc := requestContext(r.Context()); rc != nil {
+			rc.Principal = principal
+		}
+		next(w, r)
+	}
+}
+
+// handleMaintenance serves /api/admin/maintenance: GET reports the mode,
+// POST {"enabled":bool} switches it.
+func handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodGet:
+	case http.MethodPost:
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil || req.Enabled == nil {
+			writeError(w, http.StatusBadRequest, `body must be {"enabled":true|false}`)
+			return
+		}
+		maintenance.Store(*req.Enabled)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"maintenance": maintenance.Load()})
+}
+
+// drained is set by POST /api/admin/drain: readiness fails so the load
+// balancer stops sending traffic, but runs are still served. Unlike the
+// shutdown drain it can be undone.
+var drained atomic.Bool
+
+// handleDrain serves POST /api/admin/drain (on) and /api/admin/undrain (off).
+func handleDrain(on bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		enableCORS(w, r)
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if drained.Swap(on) != on {
+			logger.Info("admin: drain", "draining", on)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"draining": on || draining.Load()})
+	}
+}
+
+// handleProviderSwitch serves POST /api/admin/providers/{name}/disable
+// (enabled false) and .../enable (enabled true). Runs already under way are
+// left alone.
+func handleProviderSwitch(enabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		enableCORS(w, r)
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		name := strings.ToLower(r.PathValue("name"))
+		off, ok := providerDisabled[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "unknown provider")
+			return
+		}
+		if off.Swap(!enabled) == enabled {
+			logger.Info("admin: provider switched", "provider", name, "enabled", enabled)
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"provider": name, "enabled": enabled})
+	}
+}
+
+// handleInflight serves GET /api/admin/inflight so a deploy script can wait
+// for the runs to finish after draining, before it kills the process.
+func handleInflight(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"inflight": inflightRuns(),
+		"draining": draining.Load() || drained.Load(),
+	})
+}
+
+// refuseInMaintenance answers 503 instead of starting a run while
+// maintenance mode is on.
+func refuseInMaintenance(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !maintenance.Load() || r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		enableCORS(w, r)
+		secs := int(maintenanceRetryAfter.Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{
+			"error":       "maintenance in progress",
+			"status":      http.StatusServiceUnavailable,
+			"retry_after": secs,
+		})
+	}
+}
+
+// handleTail serves /api/admin/tail: a WebSocket that receives each audit
+// entry, as JSON, from the moment it connects.
+func handleTail(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	defer trackStream()()
+	conn.NetConn().SetDeadline(time.Time{})
+
+	entries, unsubscribe := subscribeAudit()
+	defer unsubscribe()
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case e := <-entries:
+			if err := conn.WriteJSON(e); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		case <-streamShutdown:
+			conn.WriteJSON(map[string]any{"shutdown": true})
+			closeWS(conn)
+			return
+		}
+	}
+}
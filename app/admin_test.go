@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	gwclient "mcpgui/client"
+)
+
+const adminKey = "admin-secret"
+
+// asAdmin is the header that authenticates as adminKey.
+var asAdmin = []string{"Authorization", "Bearer " + adminKey}
+
+func TestMaintenanceMode(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, `{"status":"done"}`))
+	dir := webDir(t, "index.html", "<h1>console</h1>")
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "ADMIN_KEYS", adminKey, "WEB_DIR", dir, "MAINTENANCE_RETRY_AFTER", "2m")
+
+	if resp := postJSON(t, gw.URL+"/api/admin/maintenance", map[string]any{"enabled": true}); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("toggle without an admin key: status = %d, want 401", resp.StatusCode)
+	}
+	resp := postJSON(t, gw.URL+"/api/admin/maintenance", map[string]any{"enabled": true}, asAdmin...)
+	if resp.StatusCode != http.StatusOK || decode(t, resp)["maintenance"] != true {
+		t.Fatalf("toggle on: status = %d, want 200 with maintenance true", resp.StatusCode)
+	}
+	if got := decode(t, get(t, gw.URL+"/api/admin/maintenance", asAdmin...))["maintenance"]; got != true {
+		t.Errorf("GET while on: maintenance = %v, want true", got)
+	}
+
+	resp = postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "upgrade the cluster"})
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("run during maintenance: status = %d, want 503", resp.StatusCode)
+	}
+	if ra := resp.Header.Get("Retry-After"); ra != "120" {
+		t.Errorf("Retry-After = %q, want 120", ra)
+	}
+	if got := decode(t, resp); got["error"] != "maintenance in progress" || got["retry_after"] != float64(120) {
+		t.Errorf("body = %v, want the maintenance error with retry_after 120", got)
+	}
+	if resp := get(t, gw.URL+"/api/health"); resp.StatusCode != http.StatusOK {
+		t.Errorf("health during maintenance: status = %d, want 200", resp.StatusCode)
+	}
+	if resp := get(t, gw.URL+"/"); resp.StatusCode != http.StatusOK {
+		t.Errorf("UI during maintenance: status = %d, want 200", resp.StatusCode)
+	}
+
+	resp = postJSON(t, gw.URL+"/api/admin/maintenance", map[string]any{"enabled": false}, asAdmin...)
+	if resp.StatusCode != http.StatusOK || decode(t, resp)["maintenance"] != false {
+		t.Fatalf("toggle off: status = %d, want 200 with maintenance false", resp.StatusCode)
+	}
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "upgrade the cluster"}); resp.StatusCode != http.StatusOK {
+		t.Errorf("run after maintenance: status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestAdminTailStreamsAuditEntries(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "ADMIN_KEYS", adminKey)
+	tail := "ws" + strings.TrimPrefix(gw.URL, "http") + "/api/admin/tail"
+
+	if _, resp, err := websocket.DefaultDialer.Dial(tail, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("dial without an admin key: %v, want 401", err)
+	}
+	postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "before the tail"})
+
+	conn, _, err := websocket.DefaultDialer.Dial(tail, http.Header{"Authorization": {"Bearer " + adminKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return subscribers() == 1 })
+	postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "snapshot the database"}, "X-Request-ID", "tailed")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var e auditEntry
+	if err := conn.ReadJSON(&e); err != nil {
+		t.Fatalf("no entry over the tail: %v", err)
+	}
+	if e.Goal != "snapshot the database" || e.RequestID != "tailed" || e.Status != http.StatusOK {
+		t.Errorf("entry = %+v, want the run made after connecting", e)
+	}
+
+	conn.Close()
+	waitFor(t, func() bool { return subscribers() == 0 })
+}
+
+// subscribers counts the live audit tails.
+func subscribers() int {
+	auditSubs.Lock()
+	defer auditSubs.Unlock()
+	return len(auditSubs.chans)
+}
+
+func TestDrainFlipsReadiness(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "ADMIN_KEYS", adminKey)
+	ready := func() int { return get(t, gw.URL+"/api/readyz").StatusCode }
+	run := func() int { return postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}).StatusCode }
+
+	if got := ready(); got != http.StatusOK {
+		t.Fatalf("readyz before drain = %d, want 200", got)
+	}
+	if resp := postJSON(t, gw.URL+"/api/admin/drain", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("drain without an admin key: status = %d, want 401", resp.StatusCode)
+	}
+	if resp := postJSON(t, gw.URL+"/api/admin/drain", nil, asAdmin...); resp.StatusCode != http.StatusOK {
+		t.Fatalf("drain: status = %d, want 200", resp.StatusCode)
+	}
+	if got := ready(); got != http.StatusServiceUnavailable {
+		t.Errorf("readyz after drain = %d, want 503", got)
+	}
+	if got := run(); got != http.StatusOK {
+		t.Errorf("run while drained = %d, want 200", got)
+	}
+	if resp := postJSON(t, gw.URL+"/api/admin/undrain", nil, asAdmin...); resp.StatusCode != http.StatusOK {
+		t.Fatalf("undrain: status = %d, want 200", resp.StatusCode)
+	}
+	if got := ready(); got != http.StatusOK {
+		t.Errorf("readyz after undrain = %d, want 200", got)
+	}
+}
+
+func TestAdminInflight(t *testing.T) {
+	hold := make(chan struct{})
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-hold:
+		case <-r.Context().Done():
+		}
+		w.Write([]byte(`{"status":"done"}`))
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "ADMIN_KEYS", adminKey, "ADMIN_RATE_LIMIT", "1000", "ADMIN_RATE_BURST", "1000")
+	released := false
+	release := func() {
+		if !released {
+			released = true
+			close(hold)
+		}
+	}
+	t.Cleanup(release)
+	inflight := func() map[string]any {
+		t.Helper()
+		resp := get(t, gw.URL+"/api/admin/inflight", asAdmin...)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		return decode(t, resp)
+	}
+
+	if resp := get(t, gw.URL+"/api/admin/inflight"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without an admin key: status = %d, want 401", resp.StatusCode)
+	}
+	if got := inflight(); got["inflight"] != float64(0) || got["draining"] != false {
+		t.Errorf("idle: %v, want inflight 0 and draining false", got)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := doJSON(gw.URL+"/api/run", map[string]any{"goal": "provision cluster"}); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	waitFor(t, func() bool { return inflight()["inflight"] == float64(1) })
+	postJSON(t, gw.URL+"/api/admin/drain", nil, asAdmin...)
+	if got := inflight(); got["inflight"] != float64(1) || got["draining"] != true {
+		t.Errorf("draining with a run going: %v, want inflight 1 and draining true", got)
+	}
+
+	release()
+	<-done
+	if got := inflight(); got["inflight"] != float64(0) {
+		t.Errorf("after the run: inflight = %v, want 0", got["inflight"])
+	}
+}
+
+func TestDisableProvider(t *testing.T) {
+	aws := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gcp := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", gcp, "SUPERVISOR_AWS", aws, "SUPERVISOR_GCP", gcp, "ADMIN_KEYS", adminKey,
+		"TENANTS", fmt.Sprintf(`{"team-a": %q}`, aws), "ADMIN_RATE_LIMIT", "100", "ADMIN_RATE_BURST", "100")
+	run := func(provider string, header ...string) *http.Response {
+		return postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets", "provider": provider}, header...)
+	}
+
+	if resp := postJSON(t, gw.URL+"/api/admin/providers/aws/disable", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("disable without an admin key: status = %d, want 401", resp.StatusCode)
+	}
+	if resp := postJSON(t, gw.URL+"/api/admin/providers/oci/disable", nil, asAdmin...); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("disable an unknown provider: status = %d, want 404", resp.StatusCode)
+	}
+	resp := postJSON(t, gw.URL+"/api/admin/providers/AWS/disable", nil, asAdmin...)
+	if got := decode(t, resp); resp.StatusCode != http.StatusOK || got["provider"] != "aws" || got["enabled"] != false {
+		t.Fatalf("disable aws: status = %d, body = %v", resp.StatusCode, got)
+	}
+
+	// However the run would be routed, a disabled provider is refused.
+	for name, resp := range map[string]*http.Response{
+		"aws":         run("aws"),
+		"aws, tenant": run("aws", "X-Tenant", "team-a"),
+	} {
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s: status = %d, want 503", name, resp.StatusCode)
+		} else if got := decode(t, resp)["error"]; got != "provider temporarily disabled" {
+			t.Errorf("%s: error = %v", name, got)
+		}
+	}
+	if resp := run("gcp"); resp.StatusCode != http.StatusOK {
+		t.Errorf("gcp while aws is disabled: status = %d, want 200", resp.StatusCode)
+	}
+	if got := fmt.Sprint(decode(t, get(t, gw.URL+"/api/health"))["disabled_providers"]); got != "[aws]" {
+		t.Errorf("health disabled_providers = %s, want [aws]", got)
+	}
+
+	postJSON(t, gw.URL+"/api/admin/providers/aws/enable", nil, asAdmin...)
+	if resp := run("aws"); resp.StatusCode != http.StatusOK {
+		t.Errorf("aws after enable: status = %d, want 200", resp.StatusCode)
+	}
+	if got := fmt.Sprint(decode(t, get(t, gw.URL+"/api/health"))["disabled_providers"]); got != "[]" {
+		t.Errorf("health disabled_providers = %s, want []", got)
+	}
+}
+
+func TestSafeMode(t *testing.T) {
+	def, defSeen := recordingSupervisor(t)
+	ro, roSeen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", def, "SUPERVISOR_READONLY_URL", ro, "SUPERVISOR_AWS", def,
+		"TENANTS", fmt.Sprintf(`{"team-a": %q}`, def), "ADMIN_KEYS", adminKey, "SAFE_MODE", "true")
+	for name, header := range map[string][]string{"provider run": nil, "tenant run": {"X-Tenant", "team-a"}} {
+		resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "delete the bucket", "provider": "aws"}, header...)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Safe-Mode") != "true" {
+			t.Errorf("%s: status = %d, X-Safe-Mode %q, want 200 marked safe", name, resp.StatusCode, resp.Header.Get("X-Safe-Mode"))
+		}
+		sent := nextRequest(t, roSeen)
+		var fields map[string]any
+		json.Unmarshal(sent.body, &fields)
+		if fields["dry_run"] != true || fields["readonly"] != true || sent.header.Get("X-Dry-Run") != "true" {
+			t.Errorf("%s: supervisor got %s, X-Dry-Run %q, want a read-only dry run", name, sent.body, sent.header.Get("X-Dry-Run"))
+		}
+	}
+	if len(defSeen) != 0 {
+		t.Error("a run reached a mutating supervisor in safe mode")
+	}
+
+	// Switching a provider back on changes nothing: the run stays a dry run.
+	postJSON(t, gw.URL+"/api/admin/providers/aws/enable", nil, asAdmin...)
+	postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "delete the bucket", "provider": "aws"})
+	if sent := nextRequest(t, roSeen); sent.header.Get("X-Dry-Run") != "true" {
+		t.Error("a run after enabling a provider was not a dry run")
+	}
+
+	resp := postJSON(t, gw.URL+"/api/jobs", map[string]any{"goal": "tag volumes"})
+	if resp.StatusCode != http.StatusServiceUnavailable || decode(t, resp)["error"] != "job creation disabled in safe mode" {
+		t.Errorf("new job: status = %d, want 503", resp.StatusCode)
+	}
+	// Jobs from before the lockdown can still be polled.
+	before := job{Job: gwclient.Job{ID: newID(), Status: jobDone}}
+	if err := jobStore.Save(before); err != nil {
+		t.Fatal(err)
+	}
+	pollJob(t, gw.URL, before.ID, jobDone)
+}
+
+func TestAdminGroupGuard(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "API_KEYS", "user-key", "ADMIN_KEYS", "other-admin,"+adminKey,
+		"ADMIN_RATE_LIMIT", "1000", "ADMIN_RATE_BURST", "1000")
+	asUser := []string{"Authorization", "Bearer user-key"}
+	paths := []string{"/api/admin/maintenance", "/api/admin/inflight", "/api/admin/overview"}
+
+	for _, p := range paths {
+		if resp := get(t, gw.URL+p, asUser...); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s with a user key: status = %d, want 401", p, resp.StatusCode)
+		}
+		resp := get(t, gw.URL+p)
+		if resp.StatusCode != http.StatusUnauthorized || !strings.Contains(resp.Header.Get("WWW-Authenticate"), "mcp-gateway-admin") {
+			t.Errorf("%s without a key: status = %d, WWW-Authenticate %q, want an admin challenge", p, resp.StatusCode, resp.Header.Get("WWW-Authenticate"))
+		}
+		resp = get(t, gw.URL+p, asAdmin...)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s with an admin key: status = %d, want 200", p, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("%s Access-Control-Allow-Origin = %q, want no wildcard", p, got)
+		}
+	}
+	if resp := get(t, gw.URL+"/api/admin/maintenance", "Authorization", "Bearer other-admin"); resp.StatusCode != http.StatusOK {
+		t.Errorf("second admin key: status = %d, want 200", resp.StatusCode)
+	}
+	// An admin key is no user key.
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, asAdmin...); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("/api/run with an admin key: status = %d, want 401", resp.StatusCode)
+	}
+	if got := get(t, gw.URL+"/api/health").Header.Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("/api/health Access-Control-Allow-Origin = %q, want the wildcard", got)
+	}
+
+	gw = testGateway(t, "SUPERVISOR_URL", sup, "API_KEYS", "user-key", "ADMIN_KEYS", "")
+	for _, header := range [][]string{nil, asUser, asAdmin} {
+		resp := get(t, gw.URL+"/api/admin/maintenance", header...)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("without ADMIN_KEYS: status = %d, want 403", resp.StatusCode)
+		}
+		if got := decode(t, resp)["error"]; got != "admin API disabled" {
+			t.Errorf("error = %v, want admin API disabled", got)
+		}
+	}
+
+	gw = testGateway(t, "SUPERVISOR_URL", sup, "API_KEYS", "", "ADMIN_KEYS", adminKey, "ADMIN_RATE_LIMIT", "0.001", "ADMIN_RATE_BURST", "2")
+	var statuses []int
+	for range 3 {
+		statuses = append(statuses, get(t, gw.URL+"/api/admin/maintenance", asAdmin...).StatusCode)
+	}
+	if statuses[0] != http.StatusOK || statuses[1] != http.StatusOK || statuses[2] != http.StatusTooManyRequests {
+		t.Errorf("statuses = %v, want two 200 then 429 past ADMIN_RATE_BURST", statuses)
+	}
+	// Runs draw on their own buckets.
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}); resp.StatusCode != http.StatusOK {
+		t.Errorf("run after the admin limit: status = %d, want 200", resp.StatusCode)
+	}
+}
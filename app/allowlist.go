@@ -0,0 +1,45 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// goalAllowlist holds the compiled GOAL_ALLOWLIST entries. When it is empty
+// every goal is allowed. A reload may replace it.
+var goalAllowlist atomic.Pointer[[]*regexp.Regexp]
+
+// loadGoalAllowlist parses GOAL_ALLOWLIST, a comma-separated list of entries
+// matched case-insensitively against the trimmed goal. An entry without
+// wildcards is a prefix: "list" allows "List buckets". In an entry with
+// wildcards, "*" matches any run of characters and "?" exactly one, and the
+// pattern has to cover the whole goal: "describe * in us-*".
+func loadGoalAllowlist(val string) {
+	var list []*regexp.Regexp
+	for _, entry := range splitList(val) {
+		entry = strings.ToLower(entry)
+		if !strings.ContainsAny(entry, "*?") {
+			entry += "*"
+		}
+		expr := regexp.QuoteMeta(entry)
+		expr = strings.NewReplacer(`\*`, `.*`, `\?`, `.`).Replace(expr)
+		list = append(list, regexp.MustCompile(`(?s)^`+expr+`$`))
+	}
+	goalAllowlist.Store(&list)
+}
+
+// goalAllowed reports whether goal matches an allowlist entry.
+func goalAllowed(goal string) bool {
+	list := goalAllowlist.Load()
+	if list == nil || len(*list) == 0 {
+		return true
+	}
+	goal = strings.ToLower(goal)
+	for _, re := range *list {
+		if re.MatchString(goal) {
+			return true
+		}
+	}
+	return false
+}
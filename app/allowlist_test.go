@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGoalAllowlist(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "GOAL_ALLOWLIST", "list, describe * in us-*, get ?pu usage")
+
+	for goal, allowed := range map[string]bool{
+		"List buckets":                    true,
+		"describe instances in us-east-1": true,
+		"Describe VMs in eu-west-1":       false,
+		"get cpu usage":                   true,
+		"get gpu usage today":             false,
+		"delete every bucket":             false,
+		"please list buckets":             false,
+	} {
+		resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": goal})
+		if allowed {
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("%q: status = %d, want 200", goal, resp.StatusCode)
+			}
+			nextRequest(t, seen)
+			continue
+		}
+		if resp.StatusCode != http.StatusForbidden || decode(t, resp)["error"] != "goal not permitted" {
+			t.Errorf("%q: status = %d, want 403 goal not permitted", goal, resp.StatusCode)
+		}
+	}
+	if len(seen) != 0 {
+		t.Errorf("%d refused goals reached the supervisor", len(seen))
+	}
+}
+
+func TestGoalAllowlistUnsetAllowsAll(t *testing.T) {
+	testGateway(t)
+	if !goalAllowed("delete every bucket") {
+		t.Error("goal refused without GOAL_ALLOWLIST")
+	}
+}
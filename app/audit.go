@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxAuditGoal bounds the goal text written to the audit log, in characters.
+const maxAuditGoal = 500
+
+type auditEntry struct {
+	Time       string  `json:"time"`
+	RequestID  string  `json:"request_id"`
+	ClientIP   string  `json:"client_ip"`
+	Principal  string  `json:"principal,omitempty"`
+	Goal       string  `json:"goal"`
+	GoalHash   string  `json:"goal_hash,omitempty"`
+	Status     int     `json:"status"`
+	DurationMS float64 `json:"duration_ms"`
+}
+
+// auditCh feeds the audit writer and the /api/admin/tail subscribers.
+// Closing auditStop retires the writer behind it once its queue is empty.
+var (
+	auditCh   chan auditEntry
+	auditStop chan struct{}
+)
+
+// auditSubs are the live tails; each gets every entry that fits its buffer.
+var auditSubs = struct {
+	sync.Mutex
+	chans map[chan auditEntry]struct{}
+}{chans: map[chan auditEntry]struct{}{}}
+
+// startAudit starts the audit dispatcher, writing to the log at path unless
+// it is empty, and retires the one a previous call started. The file is
+// reopened on SIGHUP so logrotate can move it away.
+func startAudit(path string) error {
+	var f *os.File
+	if path != "" {
+		var err error
+		if f, err = openAudit(path); err != nil {
+			return err
+		}
+	}
+	if auditStop != nil {
+		close(auditStop)
+	}
+	ch, stop := make(chan auditEntry, 1024), make(chan struct{})
+	auditCh, auditStop = ch, stop
+	hup := make(chan os.Signal, 1)
+	if path != "" {
+		signal.Notify(hup, syscall.SIGHUP)
+	}
+
+	go func() {
+		var enc *json.Encoder
+		if f != nil {
+			enc = json.NewEncoder(f)
+		}
+		write := func(e auditEntry) {
+			if enc != nil {
+				if err := enc.Encode(e); err != nil {
+					logger.Error("audit: write failed", "err", err)
+				}
+			}
+			publishAudit(e)
+		}
+		for {
+			select {
+			case e := <-ch:
+				write(e)
+			case <-stop:
+				signal.Stop(hup)
+				for {
+					select {
+					case e := <-ch:
+						write(e)
+					default:
+						if f != nil {
+							f.Close()
+						}
+						return
+					}
+				}
+			case <-hup:
+				nf, err := openAudit(path)
+				if err != nil {
+					logger.Error("audit: reopen failed, keeping the old file", "path", path, "err", err)
+					continue
+				}
+				f.Close()
+				f, enc = nf, json.NewEncoder(nf)
+			}
+		}
+	}()
+	return nil
+}
+
+func publishAudit(e auditEntry) {
+	auditSubs.Lock()
+	defer auditSubs.Unlock()
+	for ch := range auditSubs.chans {
+		select {
+		case ch <- e:
+		default: // a slow tail misses entries rather than stalling the log
+		}
+	}
+}
+
+// subscribeAudit returns a channel of entries audited from now on, and a
+// func that ends the subscription.
+func subscribeAudit() (<-chan auditEntry, func()) {
+	ch := make(chan auditEntry, 64)
+	auditSubs.Lock()
+	auditSubs.chans[ch] = struct{}{}
+	auditSubs.Unlock()
+	return ch, func() {
+		auditSubs.Lock()
+		delete(auditSubs.chans, ch)
+		auditSubs.Unlock()
+	}
+}
+
+func openAudit(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+}
+
+// audit queues an entry without ever blocking the request; entries are
+// dropped when the writer falls behind.
+func audit(e auditEntry) {
+	if auditCh == nil {
+		return
+	}
+	select {
+	case auditCh <- e:
+	default:
+		logger.Warn("audit: queue full, dropping entry", "request_id", e.RequestID)
+	}
+}
+
+// truncateRunes cuts s to at most n characters.
+func truncateRunes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "..."
+}
+
+func auditRun(r *http.Request, goal, goalHash string, status int, start time.Time) {
+	audit(auditEntry{
+		Time:       start.UTC().Format(time.RFC3339Nano),
+		RequestID:  requestID(r.Context()),
+		ClientIP:   clientIP(r),
+		Principal:  requestContext(r.Context()).principal(),
+		Goal:       loggableGoal(goal, maxAuditGoal),
+		GoalHash:   goalHash,
+		Status:     status,
+		DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+	})
+}
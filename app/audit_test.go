@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// auditLines returns the entries in the audit log at path.
+func auditLines(t *testing.T, path string) []auditEntry {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var out []auditEntry
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var e auditEntry
+		if len(line) > 0 && json.Unmarshal(line, &e) == nil {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "AUDIT_LOG_PATH", path)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "snapshot the database"})
+	resp.Body.Close()
+	waitFor(t, func() bool { return len(auditLines(t, path)) == 1 })
+	e := auditLines(t, path)[0]
+	if e.Goal != "snapshot the database" || e.Status != http.StatusOK || e.ClientIP != "127.0.0.1" {
+		t.Errorf("entry = %+v, want the goal, status 200 and client IP", e)
+	}
+	if e.RequestID == "" || e.Time == "" || e.DurationMS <= 0 {
+		t.Errorf("entry = %+v, want a request ID, time and duration", e)
+	}
+
+	// Like logrotate: move the file away, then SIGHUP.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	waitFor(t, func() bool {
+		resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "snapshot again"})
+		resp.Body.Close()
+		return len(auditLines(t, path)) > 0
+	})
+	// Runs that beat the signal may still land in the old file.
+	if old := auditLines(t, path+".1"); len(old) == 0 || old[0].RequestID != e.RequestID {
+		t.Errorf("rotated file = %+v, want it to keep the first entry", old)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// Authenticator decides who sent a request. It returns the principal that
+// the access and audit logs report, or an error when the request must be
+// refused with a 401.
+type Authenticator interface {
+	Authenticate(r *http.Request) (principal string, err error)
+}
+
+var errUnauthenticated = errors.New("unauthorized")
+
+// apiKeys holds the accepted API_KEYS, for AUTH_MODE=apikey.
+var apiKeys [][]byte
+
+var (
+	// authenticator is the AUTH_MODE backend requireAuth consults.
+	authenticator Authenticator = noAuth{}
+	// authChallenge is the WWW-Authenticate sent with a 401.
+	authChallenge = `Bearer realm="mcp-gateway"`
+)
+
+// initAuth selects the AUTH_MODE authenticator: none, apikey (API_KEYS),
+// basic (BASIC_AUTH_USERS), jwt (JWT_SECRET and/or JWT_JWKS_URL) or
+// trusted-header (TRUSTED_AUTH_HEADER from TRUSTED_CIDRS).
+func initAuth(mode, basicUsers, jwtSecret, jwksURL, trustedHeader, trustedCIDRs string) error {
+	authChallenge = `Bearer realm="mcp-gateway"`
+	switch mode {
+	case "none":
+		authenticator = noAuth{}
+	case "apikey":
+		if len(apiKeys) == 0 {
+			return errors.New("AUTH_MODE=apikey: API_KEYS is empty")
+		}
+		authenticator = apiKeyAuth{}
+	case "basic":
+		a, err := newBasicAuth(basicUsers)
+		if err != nil {
+			return err
+		}
+		authenticator = a
+		authChallenge = `Basic realm="mcp-gateway"`
+	case "jwt":
+		a, err := newJWTAuth(jwtSecret, jwksURL)
+		if err != nil {
+			return err
+		}
+		authenticator = a
+	case "trusted-header":
+		a, err := newTrustedHeaderAuth(trustedHeader, trustedCIDRs)
+		if err != nil {
+			return err
+		}
+		authenticator = a
+	default:
+		return fmt.Errorf("AUTH_MODE: unknown mode %q", mode)
+	}
+	return nil
+}
+
+// requireAuth rejects requests the authenticator refuses, and records the
+// principal of the others on their RequestContext. CORS preflights pass
+// through since browsers never send credentials on them.
+func requireAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		principal, err := authenticator.Authenticate(r)
+		if err != nil {
+			enableCORS(w, r)
+			w.Header().Set("WWW-Authenticate", authChallenge)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if rc := requestContext(r.Context()); rc != nil {
+			rc.Principal = principal
+		}
+		next(w, r)
+	}
+}
+
+// bearerToken returns the "Authorization: Bearer <token>" token.
+func bearerToken(r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return strings.TrimSpace(token), ok
+}
+
+// noAuth lets every request through anonymously.
+type noAuth struct{}
+
+func (noAuth) Authenticate(*http.Request) (string, error) { return "", nil }
+
+// apiKeyAuth accepts any of API_KEYS as a bearer token. The principal names
+// the key by a hash prefix, never the key itself.
+type apiKeyAuth struct{}
+
+func (apiKeyAuth) Authenticate(r *http.Request) (string, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return "", errUnauthenticated
+	}
+	// Compare against every key so timing doesn't reveal which one matched.
+	match := 0
+	for _, key := range apiKeys {
+		match |= subtle.ConstantTimeCompare([]byte(token), key)
+	}
+	if match != 1 {
+		return "", errUnauthenticated
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "apikey:" + hex.EncodeToString(sum[:4]), nil
+}
+
+// basicAuth checks HTTP basic credentials against BASIC_AUTH_USERS, a list
+// of user:password pairs. The principal is the user name.
+type basicAuth struct {
+	users map[string][]byte
+}
+
+func newBasicAuth(list string) (*basicAuth, error) {
+	a := &basicAuth{users: map[string][]byte{}}
+	for _, entry := range splitList(list) {
+		user, pass, ok := strings.Cut(entry, ":")
+		if !ok || user == "" || pass == "" {
+			return nil, fmt.Errorf("BASIC_AUTH_USERS: entry %q is not user:password", user)
+		}
+		a.users[user] = []byte(pass)
+	}
+	if len(a.users) == 0 {
+		return nil, errors.New("AUTH_MODE=basic: BASIC_AUTH_USERS is empty")
+	}
+	return a, nil
+}
+
+func (a *basicAuth) Authenticate(r *http.Request) (string, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", errUnauthenticated
+	}
+	want, known := a.users[user]
+	if !known {
+		want = []byte{} // still compare, so unknown users take as long
+	}
+	if subtle.ConstantTimeCompare([]byte(pass), want) != 1 || !known {
+		return "", errUnauthenticated
+	}
+	return user, nil
+}
+
+// trustedHeaderAuth takes the principal from a header a proxy in front has
+// already authenticated, such as Envoy's X-Authenticated-User. The header is
+// believed only on connections from the proxy, one from TRUSTED_CIDRS; the
+// connection's own address decides, never TRUST_PROXY's forwarded one.
+type trustedHeaderAuth struct {
+	header  string
+	sources []netip.Prefix
+}
+
+func newTrustedHeaderAuth(header, cidrs string) (*trustedHeaderAuth, error) {
+	a := &trustedHeaderAuth{header: http.CanonicalHeaderKey(header)}
+	if a.header == "" {
+		return nil, errors.New("AUTH_MODE=trusted-header: TRUSTED_AUTH_HEADER is empty")
+	}
+	for _, cidr := range splitList(cidrs) {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, aerr := netip.ParseAddr(cidr)
+			if aerr != nil {
+				return nil, fmt.Errorf("TRUSTED_CIDRS: invalid CIDR %q", cidr)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		a.sources = append(a.sources, prefix.Masked())
+	}
+	if len(a.sources) == 0 {
+		return nil, errors.New("AUTH_MODE=trusted-header: TRUSTED_CIDRS is empty")
+	}
+	return a, nil
+}
+
+func (a *trustedHeaderAuth) Authenticate(r *http.Request) (string, error) {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return "", errUnauthenticated
+	}
+	addr := addrPort.Addr().Unmap()
+	if !slices.ContainsFunc(a.sources, func(p netip.Prefix) bool { return p.Contains(addr) }) {
+		return "", fmt.Errorf("%w: %s is not a trusted source", errUnauthenticated, addr)
+	}
+	principal := strings.TrimSpace(r.Header.Get(a.header))
+	if principal == "" {
+		return "", errUnauthenticated
+	}
+	return principal, nil
+}
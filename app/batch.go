@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type batchReq struct {
+	Goals    []string `json:"goals"`
+	Provider string   `json:"provider,omitempty"`
+}
+
+// maxBatchGoals is MAX_BATCH_GOALS, the most goals one batch may hold.
+var maxBatchGoals int
+
+// decodeBatch parses a batch body, refusing one without goals or with more
+// than maxBatchGoals before any of them runs.
+func decodeBatch(body []byte) (batchReq, *validationError) {
+	var batch batchReq
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return batch, fieldInvalid(http.StatusBadRequest, "", "invalid_json", "invalid JSON body")
+	}
+	if len(batch.Goals) == 0 {
+		return batch, fieldInvalid(http.StatusBadRequest, "goals", "required", "goals is empty")
+	}
+	if len(batch.Goals) > maxBatchGoals {
+		verr := fieldInvalid(http.StatusUnprocessableEntity, "goals", "too_many", "too many goals").withLimit(maxBatchGoals)
+		verr.Extra = map[string]any{"max": maxBatchGoals}
+		return batch, verr
+	}
+	return batch, nil
+}
+
+type batchResult struct {
+	Goal   string          `json:"goal"`
+	Status int             `json:"status,omitempty"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Errors []fieldError    `json:"errors,omitempty"`
+}
+
+// handleBatch serves POST /api/run/batch, running every goal concurrently
+// and answering once all of them finished, in input order, with how many
+// completed and how many were canceled. Every goal runs under the request's
+// context, so a client that goes away or, with X-Cancelable, cancels the
+// batch's token stops the goals in flight and those not started yet.
+func handleBatch(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	batch, verr := decodeBatch(body)
+	if verr != nil {
+		verr.write(w)
+		return
+	}
+	recordBatchProvider(r, batch.Provider)
+	if wantsCancelToken(r) {
+		ctx, cw, done := startCancelable(r.Context(), &statusRecorder{ResponseWriter: w}, "application/json")
+		defer done()
+		r, w = r.WithContext(ctx), cw
+	}
+
+	results := make([]batchResult, len(batch.Goals))
+	// Never take more slots than the limiter has, so a large batch queues
+	// behind itself instead of timing out on its own runs.
+	workers := min(len(batch.Goals), maxConcurrent)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = runBatchGoal(r, batch.Goals[i], batch.Provider)
+			}
+		}()
+	}
+	for i := range batch.Goals {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	completed, canceled := countBatch(results)
+	writeJSON(w, http.StatusOK, map[string]any{"results": results, "completed": completed, "canceled": canceled})
+}
+
+// countBatch tells the goals that ran to an end, failed or not, from those
+// canceled.
+func countBatch(results []batchResult) (completed, canceled int) {
+	for _, res := range results {
+		if res.Status == statusCanceled {
+			canceled++
+		} else {
+			completed++
+		}
+	}
+	return completed, canceled
+}
+
+// handleBatchStream serves POST /api/run/stream: like handleBatch, but each
+// result is written as a line of NDJSON as soon as its run finishes, in
+// completion order and tagged with the goal's index in the request. A last
+// {"done":true,...} line gives the completed and canceled counts.
+func handleBatchStream(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	batch, verr := decodeBatch(body)
+	if verr != nil {
+		verr.write(w)
+		return
+	}
+	recordBatchProvider(r, batch.Provider)
+	// clientCtx ends once the client is gone; a canceled batch's context
+	// ends sooner, while its results still go out.
+	clientCtx := r.Context()
+	if wantsCancelToken(r) {
+		ctx, cw, done := startCancelable(r.Context(), &statusRecorder{ResponseWriter: w}, "application/x-ndjson")
+		defer done()
+		r, w, flusher = r.WithContext(ctx), cw, cw.(http.Flusher)
+	}
+
+	type indexedResult struct {
+		Index int `json:"index"`
+		batchResult
+	}
+	next := make(chan int)
+	done := make(chan indexedResult)
+	var wg sync.WaitGroup
+	for range min(len(batch.Goals), maxConcurrent) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				done <- indexedResult{i, runBatchGoal(r, batch.Goals[i], batch.Provider)}
+			}
+		}()
+	}
+	go func() {
+		// Goals left once ctx is done come straight back canceled.
+		for i := range batch.Goals {
+			next <- i
+		}
+		close(next)
+	}()
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	enc := json.NewEncoder(w)
+	// Keep draining after the client is gone so the workers can exit.
+	var completed, canceled int
+	for res := range done {
+		if res.Status == statusCanceled {
+			canceled++
+		} else {
+			completed++
+		}
+		if clientCtx.Err() == nil && enc.Encode(res) == nil {
+			flusher.Flush()
+		}
+	}
+	if clientCtx.Err() == nil {
+		enc.Encode(map[string]any{"done": true, "completed": completed, "canceled": canceled})
+	}
+}
+
+// runBatchGoal runs one goal of a batch; failures are reported in the result.
+// Once the batch is canceled, a goal not started yet isn't, and one in
+// flight is reported canceled. Each goal is watched on its own, and one the
+// watchdog stops fails with 504.
+func runBatchGoal(r *http.Request, goal, provider string) batchResult {
+	res := batchResult{Goal: goal}
+	if r.Context().Err() != nil {
+		res.Status, res.Error = statusCanceled, errRunCanceled.Error()
+		return res
+	}
+	ctx, unwatch := watchRun(goalContext(r.Context()))
+	defer unwatch()
+	raw, _ := json.Marshal(runReq{Message: goal, Provider: provider})
+	_, call, verr := prepareRun(r.WithContext(ctx), raw)
+	if verr != nil {
+		res.Status, res.Error, res.Errors = verr.Status, verr.Msg, verr.Errors
+		return res
+	}
+	res.Status, res.Body, res.Error = callSupervisor(ctx, call)
+	if res.Status == 0 && r.Context().Err() != nil {
+		res.Status, res.Error = statusCanceled, errRunCanceled.Error()
+	} else if res.Status == 0 && context.Cause(ctx) == errHardDeadline {
+		res.Status, res.Error = http.StatusGatewayTimeout, errHardDeadline.Error()
+	}
+	return res
+}
+
+// recordBatchProvider notes the provider all of a batch's goals go to on
+// its RequestContext, for the access log. The goals can't: they run side by
+// side, each on its own copy (see goalContext).
+func recordBatchProvider(r *http.Request, provider string) {
+	if rc := requestContext(r.Context()); rc != nil {
+		req := runReq{Provider: provider}
+		applyDefaultProvider(&req)
+		rc.Provider = strings.ToLower(strings.TrimSpace(req.Provider))
+	}
+}
+
+// goalContext gives one goal of a batch its own copy of the request's
+// RequestContext, which prepareRun writes to.
+func goalContext(ctx context.Context) context.Context {
+	rc := requestContext(ctx)
+	if rc == nil {
+		return ctx
+	}
+	own := *rc
+	return context.WithValue(ctx, requestContextKey, &own)
+}
+
+// callSupervisor performs one limited run and returns the upstream status and
+// body, or an error message.
+func callSupervisor(ctx context.Context, call *upstreamCall) (int, json.RawMessage, string) {
+	release, err := acquireRun(ctx, call.backends, call.priority)
+	if err != nil {
+		return 0, nil, err.Error()
+	}
+	defer release()
+
+	resp, _, err := forward(ctx, call)
+	if err != nil {
+		return 0, nil, err.Error()
+	}
+	defer resp.Body.Close()
+	if upstreamSuccess(resp.StatusCode) {
+		if err := collapseProgress(resp); err != nil {
+			return http.StatusBadGateway, nil, err.Error()
+		}
+		if err := processResponse(ctx, resp); err != nil {
+			return http.StatusBadGateway, nil, err.Error()
+		}
+	}
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, err.Error()
+	}
+	return resp.StatusCode, rawJSON(out), ""
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// goalOf reads the goal of a supervisor request, sent as message or goal.
+func goalOf(r *http.Request) string {
+	var req struct {
+		Message string `json:"message"`
+		Goal    string `json:"goal"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	if req.Message != "" {
+		return req.Message
+	}
+	return req.Goal
+}
+
+// goalStatus is a supervisor that answers each goal with the status the
+// goal names: "ok", "fail" or "missing".
+func goalStatus(w http.ResponseWriter, r *http.Request) {
+	goal := goalOf(r)
+	switch goal {
+	case "fail":
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"detail": "boom"})
+	case "missing":
+		writeJSON(w, http.StatusNotFound, map[string]any{"detail": "no such stack"})
+	default:
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true, "answer": goal})
+	}
+}
+
+func TestBatchReportsEachGoal(t *testing.T) {
+	sup := fakeSupervisor(t, goalStatus)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_RETRIES", "0")
+
+	goals := []string{"ok", "fail", "missing", "ok again"}
+	resp := postJSON(t, gw.URL+"/api/run/batch", map[string]any{"goals": goals})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var out struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := []int{http.StatusOK, http.StatusInternalServerError, http.StatusNotFound, http.StatusOK}
+	if len(out.Results) != len(goals) {
+		t.Fatalf("got %d results, want %d", len(out.Results), len(goals))
+	}
+	for i, res := range out.Results {
+		if res.Goal != goals[i] || res.Status != want[i] {
+			t.Errorf("result %d = %s %d, want %s %d", i, res.Goal, res.Status, goals[i], want[i])
+		}
+	}
+	if !strings.Contains(string(out.Results[1].Body), "boom") {
+		t.Errorf("failed goal body = %s, want the supervisor's error", out.Results[1].Body)
+	}
+}
+
+func TestBatchStreamAnswersInCompletionOrder(t *testing.T) {
+	release := make(chan struct{})
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		goal := goalOf(r)
+		if goal == "slow" {
+			<-release
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true, "answer": goal})
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	resp := postJSON(t, gw.URL+"/api/run/stream", map[string]any{"goals": []string{"slow", "fast", "faster"}})
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Fatalf("Content-Type = %q, want application/x-ndjson", ct)
+	}
+	lines := bufio.NewScanner(resp.Body)
+	next := func() map[string]any {
+		t.Helper()
+		if !lines.Scan() {
+			t.Fatalf("stream ended early: %v", lines.Err())
+		}
+		var line map[string]any
+		if err := json.Unmarshal(lines.Bytes(), &line); err != nil {
+			t.Fatalf("line %q: %v", lines.Bytes(), err)
+		}
+		return line
+	}
+
+	// Both fast goals arrive while the slow one is still running.
+	seen := map[float64]bool{}
+	for range 2 {
+		line := next()
+		seen[line["index"].(float64)] = true
+		if line["status"] != float64(http.StatusOK) {
+			t.Errorf("line %v, want status 200", line)
+		}
+	}
+	if !seen[1] || !seen[2] {
+		t.Fatalf("first results are indexes %v, want 1 and 2", seen)
+	}
+	close(release)
+	if line := next(); line["index"] != float64(0) || line["goal"] != "slow" {
+		t.Errorf("third line = %v, want the slow goal at index 0", line)
+	}
+	if line := next(); line["done"] != true || line["completed"] != float64(3) || line["canceled"] != float64(0) {
+		t.Errorf("last line = %v, want done with 3 completed", line)
+	}
+}
+
+func TestBatchGoalLimit(t *testing.T) {
+	var runs atomic.Int32
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		runs.Add(1)
+		goalStatus(w, r)
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_BATCH_GOALS", "3")
+	goals := func(n int) []string {
+		out := make([]string, n)
+		for i := range out {
+			out[i] = fmt.Sprintf("ok %d", i)
+		}
+		return out
+	}
+
+	for _, path := range []string{"/api/run/batch", "/api/run/stream"} {
+		runs.Store(0)
+		resp := postJSON(t, gw.URL+path, map[string]any{"goals": goals(4)})
+		if got := decode(t, resp); resp.StatusCode != http.StatusUnprocessableEntity || got["error"] != "too many goals" || got["max"] != float64(3) {
+			t.Errorf("%s over the limit: status = %d, body = %v, want 422 with max 3", path, resp.StatusCode, got)
+		}
+		for _, empty := range []map[string]any{{"goals": []string{}}, {}} {
+			if resp := postJSON(t, gw.URL+path, empty); resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("%s with %v: status = %d, want 400", path, empty, resp.StatusCode)
+			}
+		}
+		if n := runs.Load(); n != 0 {
+			t.Errorf("%s: %d runs reached the supervisor from refused batches", path, n)
+		}
+		if resp := postJSON(t, gw.URL+path, map[string]any{"goals": goals(3)}); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s at the limit: status = %d, want 200", path, resp.StatusCode)
+		} else {
+			io.Copy(io.Discard, resp.Body)
+		}
+		if n := runs.Load(); n != 3 {
+			t.Errorf("%s at the limit: %d runs, want 3", path, n)
+		}
+	}
+}
+
+// heldGoals is a supervisor that answers "quick" at once and holds every
+// other goal until its call is canceled. It counts the calls that arrived
+// and the held ones that were let go.
+func heldGoals(t *testing.T) (url string, calls, freed *atomic.Int32) {
+	calls, freed = &atomic.Int32{}, &atomic.Int32{}
+	url = fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if goal := goalOf(r); goal == "quick" {
+			writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+			return
+		}
+		<-r.Context().Done()
+		freed.Add(1)
+	})
+	return url, calls, freed
+}
+
+func TestCancelBatchMidFlight(t *testing.T) {
+	sup, calls, freed := heldGoals(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_CONCURRENT_RUNS", "2", "MAX_RETRIES", "0")
+	goals := []string{"quick", "scale web", "scale api", "scale db", "scale cache", "scale queue"}
+
+	resp, err := doJSON(gw.URL+"/api/run/batch", map[string]any{"goals": goals}, "X-Cancelable", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	token := resp.Header.Get("X-Cancel-Token")
+	if token == "" {
+		t.Fatal("no X-Cancel-Token")
+	}
+	// Two workers: one finished "quick" and took "scale api".
+	waitFor(t, func() bool { return calls.Load() == 3 })
+	if cancel := postJSON(t, gw.URL+"/api/run/cancel", map[string]any{"token": token}); cancel.StatusCode != http.StatusOK {
+		t.Fatalf("cancel status = %d, want 200", cancel.StatusCode)
+	}
+
+	var out struct {
+		Results   []batchResult `json:"results"`
+		Completed int           `json:"completed"`
+		Canceled  int           `json:"canceled"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Completed != 1 || out.Canceled != 5 {
+		t.Errorf("completed %d, canceled %d, want 1 and 5", out.Completed, out.Canceled)
+	}
+	for i, res := range out.Results {
+		want := statusCanceled
+		if i == 0 {
+			want = http.StatusOK
+		}
+		if res.Status != want {
+			t.Errorf("goal %d (%s) status = %d, want %d", i, res.Goal, res.Status, want)
+		}
+	}
+	waitFor(t, func() bool { return freed.Load() == 2 })
+	if got := calls.Load(); got != 3 {
+		t.Errorf("supervisor got %d calls, want the goals left after the cancel never started", got)
+	}
+}
+
+func TestBatchStreamStopsWhenClientLeaves(t *testing.T) {
+	sup, calls, freed := heldGoals(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_CONCURRENT_RUNS", "2", "MAX_RETRIES", "0")
+
+	ctx, leave := context.WithCancel(t.Context())
+	defer leave()
+	raw, _ := json.Marshal(map[string]any{"goals": []string{"scale web", "scale api", "scale db", "scale cache"}})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, gw.URL+"/api/run/stream", bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	waitFor(t, func() bool { return calls.Load() == 2 })
+	leave()
+
+	waitFor(t, func() bool { return freed.Load() == 2 })
+	time.Sleep(50 * time.Millisecond)
+	if got := calls.Load(); got != 2 {
+		t.Errorf("supervisor got %d calls, want the goals left after the client went never started", got)
+	}
+}
+
+func TestCancelBatchStreamReportsCounts(t *testing.T) {
+	sup, calls, _ := heldGoals(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_CONCURRENT_RUNS", "1", "MAX_RETRIES", "0")
+
+	resp, err := doJSON(gw.URL+"/api/run/stream", map[string]any{"goals": []string{"quick", "scale web", "scale api"}}, "X-Cancelable", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	waitFor(t, func() bool { return calls.Load() == 2 })
+	postJSON(t, gw.URL+"/api/run/cancel", map[string]any{"token": resp.Header.Get("X-Cancel-Token")})
+
+	var last map[string]any
+	sc := bufio.NewScanner(resp.Body)
+	for sc.Scan() {
+		last = nil
+		if err := json.Unmarshal(sc.Bytes(), &last); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+	}
+	if last["done"] != true || last["completed"] != float64(1) || last["canceled"] != float64(2) {
+		t.Errorf("last line = %v, want done with 1 completed and 2 canceled", last)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("supervisor got %d calls, want 2", got)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+var errCircuitOpen = errors.New("upstream circuit open")
+
+// circuitBreaker stops dialing the supervisor after threshold consecutive
+// failures. Once cooldown has passed a single probe request is let through,
+// and its outcome closes or re-opens the circuit.
+//
+// With slowThreshold set, a successful answer also counts as a failure while
+// most of the last slowWindow answers took longer than slowThreshold, so a
+// supervisor that is merely very slow opens the circuit too.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	probing   bool
+
+	slowThreshold time.Duration
+	latencies     []time.Duration // ring of recent answer latencies
+	next          int
+}
+
+var breaker = &circuitBreaker{state: circuitClosed}
+
+// allow reports errCircuitOpen while the circuit is open or a half-open probe
+// is already in flight.
+func (cb *circuitBreaker) allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case circuitOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return errCircuitOpen
+		}
+		cb.state = circuitHalfOpen
+		cb.probing = true
+		return nil
+	case circuitHalfOpen:
+		if cb.probing {
+			return errCircuitOpen
+		}
+		cb.probing = true
+	}
+	return nil
+}
+
+// record feeds the outcome of an allowed request, and how long its answer
+// took, back into the breaker.
+func (cb *circuitBreaker) record(ok bool, latency time.Duration) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.probing = false
+	if ok && cb.tooSlow(latency) {
+		ok = false
+	}
+	if ok {
+		if cb.state != circuitClosed {
+			logger.Info("circuit closed")
+		}
+		cb.state, cb.failures = circuitClosed, 0
+		return
+	}
+	cb.failures++
+	if cb.threshold > 0 && (cb.state == circuitHalfOpen || cb.failures >= cb.threshold) {
+		if cb.state != circuitOpen {
+			logger.Warn("circuit open after consecutive upstream failures or slow answers", "failures", cb.failures)
+		}
+		cb.state, cb.openedAt = circuitOpen, time.Now()
+		clear(cb.latencies) // judge the supervisor afresh once it is back
+	}
+}
+
+// tooSlow adds latency to the window and reports whether most of the
+// window, once full, is above slowThreshold.
+func (cb *circuitBreaker) tooSlow(latency time.Duration) bool {
+	if cb.slowThreshold <= 0 || len(cb.latencies) == 0 {
+		return false
+	}
+	cb.latencies[cb.next] = latency
+	cb.next = (cb.next + 1) % len(cb.latencies)
+	slow := 0
+	for _, l := range cb.latencies {
+		if l == 0 {
+			return false // window not full yet
+		}
+		if l > cb.slowThreshold {
+			slow++
+		}
+	}
+	return slow*2 > len(cb.latencies)
+}
+
+func (cb *circuitBreaker) State() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == circuitOpen && time.Since(cb.openedAt) >= cb.cooldown {
+		return circuitHalfOpen
+	}
+	return cb.state
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakerOpensAndRecovers(t *testing.T) {
+	var failing atomic.Bool
+	var calls atomic.Int32
+	failing.Store(true)
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if failing.Load() {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"detail": "down"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "CB_THRESHOLD", "2", "CB_COOLDOWN", "100ms", "MAX_RETRIES", "0")
+	run := func() int {
+		return postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}).StatusCode
+	}
+
+	if breaker.State() != circuitClosed {
+		t.Fatalf("state = %s, want closed", breaker.State())
+	}
+	run()
+	run()
+	if breaker.State() != circuitOpen {
+		t.Fatalf("state after 2 failures = %s, want open", breaker.State())
+	}
+	if got := run(); got != http.StatusServiceUnavailable || calls.Load() != 2 {
+		t.Fatalf("open circuit: status = %d after %d calls, want 503 without calling", got, calls.Load())
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if breaker.State() != circuitHalfOpen {
+		t.Fatalf("state after cooldown = %s, want half-open", breaker.State())
+	}
+	failing.Store(false)
+	if got := run(); got != http.StatusOK {
+		t.Fatalf("probe status = %d, want 200", got)
+	}
+	if breaker.State() != circuitClosed {
+		t.Errorf("state after a good probe = %s, want closed", breaker.State())
+	}
+}
+
+func TestBreakerOpensOnSlowAnswers(t *testing.T) {
+	sup := fakeSupervisor(t, slow(60*time.Millisecond))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "CB_THRESHOLD", "2", "CB_COOLDOWN", "1m",
+		"SLOW_OPEN_THRESHOLD", "30ms", "SLOW_OPEN_WINDOW", "3")
+	run := func() int {
+		return postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}).StatusCode
+	}
+
+	// The window fills on the third answer; it and the fourth count as failures.
+	for i := range 4 {
+		if got := run(); got != http.StatusOK {
+			t.Fatalf("run %d: status = %d, want 200", i+1, got)
+		}
+	}
+	if breaker.State() != circuitOpen {
+		t.Fatalf("state after 4 slow answers = %s, want open", breaker.State())
+	}
+	if got := run(); got != http.StatusServiceUnavailable {
+		t.Errorf("open circuit: status = %d, want 503", got)
+	}
+}
+
+func TestBreakerIgnoresSlownessByDefault(t *testing.T) {
+	sup := fakeSupervisor(t, slow(60*time.Millisecond))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "CB_THRESHOLD", "2", "SLOW_OPEN_WINDOW", "3")
+
+	for range 5 {
+		postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"})
+	}
+	if breaker.State() != circuitClosed {
+		t.Errorf("state after slow answers without SLOW_OPEN_THRESHOLD = %s, want closed", breaker.State())
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/sha256"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheTTL is how long a cacheable run's answer is served from memory;
+// CACHE_TTL. Zero disables the cache.
+var cacheTTL time.Duration
+
+type cacheEntry struct {
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+}
+
+var responseCache = struct {
+	sync.Mutex
+	byKey map[[32]byte]*cacheEntry
+}{byKey: map[[32]byte]*cacheEntry{}}
+
+// cacheKey is the callKey of a cacheable run.
+func cacheKey(r *http.Request, call *upstreamCall) [32]byte {
+	return callKey(r, call)
+}
+
+// callKey covers everything that can make two runs' answers differ: the
+// goalHash, where the run is routed, the caller's principal, the headers
+// forwarded with it, such as a user's own Authorization, and the body, plus
+// any extra parts. Tenants, providers and callers never share entries.
+func callKey(r *http.Request, call *upstreamCall, extra ...string) [32]byte {
+	body := call.bodySum()
+	parts := []string{call.goalHash, strings.Join(call.backends, ","), requestContext(r.Context()).principal(), string(body[:])}
+	for _, k := range slices.Sorted(maps.Keys(call.header)) {
+		for _, v := range call.header[k] {
+			parts = append(parts, k+": "+v)
+		}
+	}
+	h := sha256.New()
+	for _, p := range append(parts, extra...) {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return [32]byte(h.Sum(nil))
+}
+
+// serveCached answers a cacheable run from memory, reporting whether it did.
+func serveCached(w http.ResponseWriter, key [32]byte) bool {
+	responseCache.Lock()
+	e, ok := responseCache.byKey[key]
+	if ok && time.Now().After(e.expires) {
+		delete(responseCache.byKey, key)
+		ok = false
+	}
+	responseCache.Unlock()
+	if !ok {
+		coalesceStats.cacheMisses.Add(1)
+		w.Header().Set("X-Cache", "MISS")
+		return false
+	}
+	coalesceStats.cacheHits.Add(1)
+	w.Header().Set("Content-Type", e.contentType)
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+	return true
+}
+
+// storeCached keeps a 2xx answer for cacheTTL.
+func storeCached(key [32]byte, c *captureWriter) {
+	if c.status < 200 || c.status > 299 || c.overflow {
+		return
+	}
+	now := time.Now()
+	responseCache.Lock()
+	defer responseCache.Unlock()
+	for k, e := range responseCache.byKey {
+		if now.After(e.expires) {
+			delete(responseCache.byKey, k)
+		}
+	}
+	responseCache.byKey[key] = &cacheEntry{
+		status:      c.status,
+		contentType: c.Header().Get("Content-Type"),
+		body:        c.buf.Bytes(),
+		expires:     now.Add(cacheTTL),
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingSupervisor answers every run with the number of runs so far.
+func countingSupervisor(t *testing.T) (string, *atomic.Int32) {
+	var calls atomic.Int32
+	url := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		answer(http.StatusOK, map[string]any{"ok": true, "call": calls.Add(1)})(w, r)
+	})
+	return url, &calls
+}
+
+func TestResponseCache(t *testing.T) {
+	sup, calls := countingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "CACHE_TTL", "200ms")
+	describe := map[string]any{"goal": "describe vpc-1", "cacheable": true}
+
+	first := postJSON(t, gw.URL+"/api/run", describe)
+	if got := first.Header.Get("X-Cache"); got != "MISS" {
+		t.Errorf("first run X-Cache = %q, want MISS", got)
+	}
+	want := body(t, first)
+	again := postJSON(t, gw.URL+"/api/run", describe)
+	if got := again.Header.Get("X-Cache"); got != "HIT" || body(t, again) != want {
+		t.Errorf("repeat X-Cache = %q, want a HIT with the first answer", got)
+	}
+	postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "describe vpc-1"}).Body.Close()
+	if n := calls.Load(); n != 2 {
+		t.Errorf("supervisor called %d times, want 2: one miss and one uncacheable run", n)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if got := postJSON(t, gw.URL+"/api/run", describe).Header.Get("X-Cache"); got != "MISS" {
+		t.Errorf("after CACHE_TTL X-Cache = %q, want MISS", got)
+	}
+}
+
+func TestResponseCacheNotShared(t *testing.T) {
+	sup, calls := countingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "CACHE_TTL", "1m", "API_KEYS", "key-one,key-two", "FORWARD_HEADERS", "X-User-Token")
+	describe := map[string]any{"goal": "describe my buckets", "cacheable": true}
+	run := func(key, token string) string {
+		resp := postJSON(t, gw.URL+"/api/run", describe, "Authorization", "Bearer "+key, "X-User-Token", token)
+		resp.Body.Close()
+		return resp.Header.Get("X-Cache")
+	}
+
+	run("key-one", "alice")
+	if got := run("key-one", "bob"); got != "MISS" {
+		t.Errorf("another forwarded X-User-Token got X-Cache %q, want MISS", got)
+	}
+	if got := run("key-two", "alice"); got != "MISS" {
+		t.Errorf("another principal got X-Cache %q, want MISS", got)
+	}
+	if got := run("key-one", "alice"); got != "HIT" {
+		t.Errorf("the same caller again got X-Cache %q, want HIT", got)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("supervisor called %d times, want 3", n)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// callbackSecret signs job callbacks; CALLBACK_SECRET.
+var callbackSecret []byte
+
+const callbackAttempts = 3
+
+// validCallbackURL accepts absolute http(s) URLs only.
+func validCallbackURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// signPayload returns the X-MCP-Signature value for body.
+func signPayload(body []byte) string {
+	mac := hmac.New(sha256.New, callbackSecret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyJob POSTs a finished job's result to its callback URL, retrying a
+// couple of times with backoff.
+func notifyJob(ctx context.Context, target string, j job) {
+	payload, _ := json.Marshal(map[string]any{
+		"job_id": j.ID,
+		"status": j.Status,
+		"body":   j.Body,
+		"error":  j.Error,
+	})
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := postCallback(ctx, target, payload)
+		if err == nil {
+			return
+		}
+		if attempt == callbackAttempts {
+			logger.Warn("job callback failed", "job_id", j.ID, "target", target, "err", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func postCallback(ctx context.Context, target string, payload []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := newOutboundRequest(ctx, http.MethodPost, target, bytes.NewReader(payload), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(callbackSecret) > 0 {
+		req.Header.Set("X-MCP-Signature", signPayload(payload))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	drainBody(resp)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("receiver answered %d", resp.StatusCode)
+	}
+	return nil
+}
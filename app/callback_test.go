@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestJobCallbackIsSigned(t *testing.T) {
+	type delivery struct {
+		signature string
+		body      []byte
+	}
+	got := make(chan delivery, 1)
+	hold := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- delivery{r.Header.Get("X-MCP-Signature"), body}
+		<-hold
+	}))
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true, "answer": "done"}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "CALLBACK_SECRET", "s3cret", "JOB_WORKERS", "1")
+	t.Cleanup(receiver.Close)
+	t.Cleanup(func() { close(hold) })
+
+	first := submitJob(t, gw.URL, map[string]any{"goal": "tag volumes", "callback_url": receiver.URL})
+	var d delivery
+	select {
+	case d = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("receiver got no callback")
+	}
+	if want := signPayload(d.body); d.signature != want {
+		t.Errorf("X-MCP-Signature = %q, want %q", d.signature, want)
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(d.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["job_id"] != first || payload["status"] != jobDone {
+		t.Errorf("payload = %v, want job %s done", payload, first)
+	}
+
+	// The receiver is still holding the first callback; the only worker
+	// must be free for the next job regardless.
+	second := submitJob(t, gw.URL, map[string]any{"goal": "tag snapshots"})
+	pollJob(t, gw.URL, second, jobDone)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// errRunCanceled is the cause of a run stopped through /api/run/cancel.
+var errRunCanceled = errors.New("run canceled")
+
+// statusCanceled is what a canceled run is recorded with: nginx's "client
+// closed request", as the client asked for it to stop.
+const statusCanceled = 499
+
+// cancelTokens maps the X-Cancel-Token of each running cancelable run to
+// its cancel func. A token is dropped once used or once its run ends.
+var cancelTokens = struct {
+	sync.Mutex
+	byToken map[string]context.CancelCauseFunc
+}{byToken: map[string]context.CancelCauseFunc{}}
+
+// wantsCancelToken reports whether the client sent X-Cancelable: true (or 1)
+// to get an X-Cancel-Token before the run finishes. SSE runs are excluded.
+func wantsCancelToken(r *http.Request) bool {
+	v := r.Header.Get("X-Cancelable")
+	return (v == "true" || v == "1") && !wantsEventStream(r)
+}
+
+// startCancelable registers a cancel token for the run on ctx and sends it,
+// with a 200, before the supervisor is called. The status can't change
+// after that, so failures are only reported in the body, and X-Proxy-Retries
+// and Server-Timing are sent as trailers; the returned writer keeps the
+// real outcome on rec for the audit log and stats. The returned func drops
+// the token.
+func startCancelable(ctx context.Context, rec *statusRecorder, contentType string) (context.Context, http.ResponseWriter, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	token := newID()
+	cancelTokens.Lock()
+	cancelTokens.byToken[token] = cancel
+	cancelTokens.Unlock()
+
+	rec.Header().Set("X-Cancel-Token", token)
+	// Set once the supervisor answers, so they follow the body instead.
+	rec.Header().Set("Trailer", "X-Proxy-Retries, Server-Timing")
+	rec.Header().Add("Access-Control-Expose-Headers", "X-Cancel-Token")
+	rec.Header().Set("Content-Type", contentType)
+	rec.WriteHeader(http.StatusOK)
+	rec.Flush()
+	return ctx, &committedWriter{rec}, func() {
+		cancelTokens.Lock()
+		delete(cancelTokens.byToken, token)
+		cancelTokens.Unlock()
+		cancel(nil)
+	}
+}
+
+// committedWriter follows startCancelable: headers are out, so WriteHeader
+// only records the status the run would have had.
+type committedWriter struct {
+	rec *statusRecorder
+}
+
+func (c *committedWriter) Header() http.Header         { return c.rec.Header() }
+func (c *committedWriter) Write(b []byte) (int, error) { return c.rec.Write(b) }
+func (c *committedWriter) WriteHeader(code int)        { c.rec.status = code }
+func (c *committedWriter) Flush()                      { c.rec.Flush() }
+
+// handleCancelRun serves POST /api/run/cancel {"token":"..."}, stopping the
+// run that was handed that X-Cancel-Token.
+func handleCancelRun(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.Token == "" {
+		writeError(w, http.StatusBadRequest, `body must be {"token":"..."}`)
+		return
+	}
+	cancelTokens.Lock()
+	cancel, ok := cancelTokens.byToken[req.Token]
+	delete(cancelTokens.byToken, req.Token)
+	cancelTokens.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown or finished run")
+		return
+	}
+	cancel(errRunCanceled)
+	writeJSON(w, http.StatusOK, map[string]any{"canceled": true})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCancelRunWithToken(t *testing.T) {
+	gone := make(chan struct{})
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		slow(time.Minute)(w, r)
+		close(gone)
+	})
+	path := t.TempDir() + "/audit.log"
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "AUDIT_LOG_PATH", path)
+
+	resp, err := doJSON(gw.URL+"/api/run", map[string]any{"goal": "provision cluster"}, "X-Cancelable", "true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// The headers arrive while the supervisor is still working.
+	token := resp.Header.Get("X-Cancel-Token")
+	if resp.StatusCode != http.StatusOK || token == "" {
+		t.Fatalf("status = %d, token %q, want 200 with an X-Cancel-Token up front", resp.StatusCode, token)
+	}
+
+	cancel := postJSON(t, gw.URL+"/api/run/cancel", map[string]any{"token": token})
+	if cancel.StatusCode != http.StatusOK || decode(t, cancel)["canceled"] != true {
+		t.Fatalf("cancel: status = %d, want 200 with canceled true", cancel.StatusCode)
+	}
+	select {
+	case <-gone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the supervisor call was not canceled")
+	}
+	var got map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got["error"] != "run canceled" || got["status"] != float64(statusCanceled) {
+		t.Errorf("body = %v, want the run canceled with status %d", got, statusCanceled)
+	}
+	waitFor(t, func() bool { return len(auditLines(t, path)) == 1 })
+	if e := auditLines(t, path)[0]; e.Status != statusCanceled {
+		t.Errorf("audited status = %d, want %d", e.Status, statusCanceled)
+	}
+
+	if again := postJSON(t, gw.URL+"/api/run/cancel", map[string]any{"token": token}); again.StatusCode != http.StatusNotFound {
+		t.Errorf("reusing the token: status = %d, want 404", again.StatusCode)
+	}
+	if bad := postJSON(t, gw.URL+"/api/run/cancel", map[string]any{}); bad.StatusCode != http.StatusBadRequest {
+		t.Errorf("no token: status = %d, want 400", bad.StatusCode)
+	}
+}
+
+func TestCancelTokenOnlyWhenAsked(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"status": "done"}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}); resp.Header.Get("X-Cancel-Token") != "" {
+		t.Error("a run without X-Cancelable got a cancel token")
+	}
+	body(t, postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, "X-Cancelable", "true"))
+	waitFor(t, func() bool {
+		cancelTokens.Lock()
+		defer cancelTokens.Unlock()
+		return len(cancelTokens.byToken) == 0
+	})
+}
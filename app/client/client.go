@@ -0,0 +1,217 @@
+// Package client calls the gateway's HTTP API from Go services. The request
+// and job types are the ones the gateway itself decodes and stores, so the
+// two can't drift apart.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout bounds each call made with the default HTTP client. It
+// leaves a run room for the gateway's default RUN_TIMEOUT of a minute.
+const DefaultTimeout = 2 * time.Minute
+
+// maxErrorBody caps how much of an error answer is read for its message.
+const maxErrorBody = 64 << 10
+
+// RunRequest is the body of POST /api/run and POST /api/jobs.
+type RunRequest struct {
+	Goal      string  `json:"goal,omitempty"`
+	Message   string  `json:"message,omitempty"`
+	ThreadID  *string `json:"thread_id,omitempty"`
+	Provider  string  `json:"provider,omitempty"`
+	DryRun    bool    `json:"dry_run,omitempty"`
+	ReadOnly  bool    `json:"readonly,omitempty"`
+	Cacheable bool    `json:"cacheable,omitempty"`
+	Priority  string  `json:"priority,omitempty"`
+	Region    string  `json:"region,omitempty"`
+	// Tags are "key:value" labels kept with the run's history entry, to
+	// filter GET /api/history by.
+	Tags []string `json:"tags,omitempty"`
+	// Idempotent lets the gateway retry the run after the supervisor may
+	// already have received it.
+	Idempotent bool `json:"idempotent,omitempty"`
+}
+
+// RunResponse is the supervisor's answer, passed through as JSON.
+type RunResponse map[string]any
+
+// Job statuses.
+const (
+	JobPending  = "pending"
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobError    = "error"
+	JobCanceled = "canceled"
+
+	// JobInterrupted is a job that was still pending or running when the
+	// gateway restarted; it will not finish.
+	JobInterrupted = "interrupted"
+)
+
+// Job is an asynchronous run, as GET /api/jobs/{id} reports it.
+type Job struct {
+	ID         string          `json:"job_id"`
+	Status     string          `json:"status"`
+	Created    time.Time       `json:"created"`
+	Finished   *time.Time      `json:"finished,omitempty"`
+	HTTPStatus int             `json:"http_status,omitempty"`
+	Body       json.RawMessage `json:"body,omitempty"`
+	Error      string          `json:"error,omitempty"`
+
+	// Progress is the latest {"progress":...} line the supervisor sent and
+	// ProgressSeq counts them.
+	Progress    json.RawMessage `json:"progress,omitempty"`
+	ProgressSeq int             `json:"progress_seq,omitempty"`
+}
+
+// Health is the answer of GET /api/health.
+type Health struct {
+	OK                bool     `json:"ok"`
+	Status            string   `json:"status"`
+	Supervisor        string   `json:"supervisor"`
+	Supervisors       []string `json:"supervisors"`
+	Inflight          int      `json:"inflight"`
+	Circuit           string   `json:"circuit"`
+	Providers         []string `json:"providers"`
+	DisabledProviders []string `json:"disabled_providers"`
+	Error             string   `json:"error,omitempty"`
+}
+
+// Error is a non-2xx answer from the gateway. A transport failure is
+// returned as is, never as an *Error.
+type Error struct {
+	StatusCode int
+	// Message is the "error" field of the answer, or its status text.
+	Message string
+	// Body is the start of the raw answer.
+	Body []byte
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("gateway: %d %s", e.StatusCode, e.Message)
+}
+
+// IsClientError reports whether err is a 4xx answer: the gateway refused the
+// request as sent, and repeating it unchanged won't help. Anything else, a
+// 5xx or a failed connection, may succeed on a later attempt.
+func IsClientError(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// Client calls one gateway. Its fields are read on every call and must not
+// change while calls are in flight.
+type Client struct {
+	// BaseURL is where the gateway is mounted, BASE_PATH included, e.g.
+	// "https://gateway.internal/mcp".
+	BaseURL string
+	// Token is sent as a bearer token when set, for AUTH_MODE=apikey or jwt.
+	Token string
+	// HTTPClient makes the calls; nil uses one with DefaultTimeout.
+	HTTPClient *http.Client
+}
+
+var defaultHTTPClient = &http.Client{Timeout: DefaultTimeout}
+
+// New returns a Client for the gateway at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/")}
+}
+
+// Run runs req and returns the supervisor's answer.
+func (c *Client) Run(ctx context.Context, req RunRequest) (RunResponse, error) {
+	var out RunResponse
+	if err := c.do(ctx, http.MethodPost, "/api/run", req, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Health reports the gateway's health. When the gateway answers that it is
+// unhealthy, the decoded report comes back along with an *Error.
+func (c *Client) Health(ctx context.Context) (Health, error) {
+	var out Health
+	err := c.do(ctx, http.MethodGet, "/api/health", nil, &out)
+	return out, err
+}
+
+// SubmitJob starts req in the background and returns the job's ID, to poll
+// with GetJob.
+func (c *Client) SubmitJob(ctx context.Context, req RunRequest) (string, error) {
+	var out struct {
+		ID string `json:"job_id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/api/jobs", req, &out); err != nil {
+		return "", err
+	}
+	return out.ID, nil
+}
+
+// GetJob returns the job with the given ID.
+func (c *Client) GetJob(ctx context.Context, id string) (Job, error) {
+	var out Job
+	if err := c.do(ctx, http.MethodGet, "/api/jobs/"+url.PathEscape(id), nil, &out); err != nil {
+		return Job{}, err
+	}
+	return out, nil
+}
+
+// do sends in, when non-nil, as the JSON body of method path and decodes the
+// answer into out. A non-2xx answer is still decoded into out when it is
+// JSON, and returned as an *Error.
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = defaultHTTPClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("gateway: decode %s %s: %w", method, path, err)
+		}
+		return nil
+	}
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	apiErr := &Error{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode), Body: raw}
+	var msg struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(raw, &msg) == nil && msg.Error != "" {
+		apiErr.Message = msg.Error
+	}
+	_ = json.Unmarshal(raw, out)
+	return apiErr
+}
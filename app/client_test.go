@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	gwclient "mcpgui/client"
+)
+
+func TestClientRun(t *testing.T) {
+	sup := fakeSupervisor(t, goalStatus)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "API_KEYS", "key-one", "MAX_RETRIES", "0")
+	c := gwclient.New(gw.URL + "/")
+	c.Token = "key-one"
+	ctx := t.Context()
+
+	out, err := c.Run(ctx, gwclient.RunRequest{Goal: "list buckets"})
+	if err != nil || out["answer"] != "list buckets" {
+		t.Fatalf("Run = %v, %v, want the supervisor's answer", out, err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		client    *gwclient.Client
+		req       gwclient.RunRequest
+		status    int
+		msg       string
+		client4xx bool
+	}{
+		{"no goal", c, gwclient.RunRequest{}, http.StatusBadRequest, "goal is required", true},
+		{"no token", gwclient.New(gw.URL), gwclient.RunRequest{Goal: "list buckets"}, http.StatusUnauthorized, "unauthorized", true},
+		{"supervisor failed", c, gwclient.RunRequest{Goal: "fail"}, http.StatusInternalServerError, "", false},
+	} {
+		_, err := tc.client.Run(ctx, tc.req)
+		var apiErr *gwclient.Error
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != tc.status || (tc.msg != "" && apiErr.Message != tc.msg) {
+			t.Errorf("%s: err = %v, want %d %s", tc.name, err, tc.status, tc.msg)
+		}
+		if got := gwclient.IsClientError(err); got != tc.client4xx {
+			t.Errorf("%s: IsClientError = %v, want %v", tc.name, got, tc.client4xx)
+		}
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.Run(canceled, gwclient.RunRequest{Goal: "list buckets"}); !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled context: err = %v, want context.Canceled", err)
+	}
+	gone := *c
+	gone.BaseURL = "http://127.0.0.1:1"
+	if _, err := gone.Run(ctx, gwclient.RunRequest{Goal: "list buckets"}); err == nil || gwclient.IsClientError(err) {
+		t.Errorf("unreachable gateway: err = %v, want a transport error", err)
+	} else if errors.As(err, new(*gwclient.Error)) {
+		t.Errorf("unreachable gateway: err = %v, want no *Error", err)
+	}
+}
+
+func TestClientHealth(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+	h, err := gwclient.New(gw.URL).Health(t.Context())
+	if err != nil || !h.OK || len(h.Supervisors) != 1 {
+		t.Errorf("Health = %+v, %v, want ok with one supervisor", h, err)
+	}
+
+	gw = testGateway(t, "SUPERVISOR_URL", "http://127.0.0.1:1/run")
+	h, err = gwclient.New(gw.URL).Health(t.Context())
+	var apiErr *gwclient.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable || h.OK || h.Status == "" {
+		t.Errorf("Health = %+v, %v, want the 503 report along with the error", h, err)
+	}
+}
+
+func TestClientJobs(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true, "answer": "tagged"}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+	c := gwclient.New(gw.URL)
+
+	id, err := c.SubmitJob(t.Context(), gwclient.RunRequest{Goal: "tag volumes"})
+	if err != nil || id == "" {
+		t.Fatalf("SubmitJob = %q, %v", id, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	var j gwclient.Job
+	for j.Status != gwclient.JobDone {
+		if j, err = c.GetJob(t.Context(), id); err != nil {
+			t.Fatal(err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job is %s, want done", j.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if j.ID != id || j.HTTPStatus != http.StatusOK || string(j.Body) == "" || j.Finished == nil {
+		t.Errorf("job = %+v, want it finished with the answer", j)
+	}
+
+	if _, err := c.GetJob(t.Context(), "no/such job"); !gwclient.IsClientError(err) {
+		t.Errorf("unknown job: err = %v, want a 404", err)
+	}
+}
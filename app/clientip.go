@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustProxy makes clientIP honor X-Forwarded-For and X-Real-IP. Leave it
+// off unless a proxy that overwrites those headers sits in front, or any
+// caller can pick its own address.
+var trustProxy bool
+
+// clientIP is the caller's address, used for logging, rate limiting and
+// auditing, as resolved once by withRequestContext.
+func clientIP(r *http.Request) string {
+	if rc := requestContext(r.Context()); rc != nil {
+		return rc.ClientIP
+	}
+	return resolveClientIP(r)
+}
+
+// resolveClientIP works out clientIP: RemoteAddr, or with TRUST_PROXY the
+// leftmost X-Forwarded-For entry (else X-Real-IP) when it parses as an IP.
+func resolveClientIP(r *http.Request) string {
+	if trustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			first, _, _ := strings.Cut(xff, ",")
+			if ip, ok := parseIP(first); ok {
+				return ip
+			}
+		}
+		if ip, ok := parseIP(r.Header.Get("X-Real-IP")); ok {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func parseIP(s string) (string, bool) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(s))
+	if err != nil {
+		return "", false
+	}
+	return addr.Unmap().String(), true
+}
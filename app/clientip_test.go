@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		name, trust string
+		header      []string
+		want        string
+	}{
+		{"remote addr", "", nil, "127.0.0.1"},
+		{"spoofed XFF ignored", "", []string{"X-Forwarded-For", "198.51.100.9"}, "127.0.0.1"},
+		{"leftmost XFF", "true", []string{"X-Forwarded-For", "203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{"X-Real-IP", "true", []string{"X-Real-IP", "203.0.113.8"}, "203.0.113.8"},
+		{"unparsable XFF", "true", []string{"X-Forwarded-For", "not-an-ip"}, "127.0.0.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gw := testGateway(t, "TRUST_PROXY", tc.trust)
+			logs := captureLogs(t)
+			get(t, gw.URL+"/api/version", tc.header...).Body.Close()
+			waitFor(t, func() bool { return logs.find("request") != nil })
+			if got := logs.find("request")["client_ip"]; got != tc.want {
+				t.Errorf("client_ip = %v, want %s", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+// Command fakesupervisor stands in for the supervisor, so the gateway can run
+// end to end without agents or a model behind it. It answers POST /run with
+// a canned result, after an optional ?delay=, and GET /health with ok. It
+// listens where the gateway looks for a supervisor by default:
+//
+//	go run ./cmd/fakesupervisor &
+//	go run .
+//
+// -status and -fail-rate make runs fail, and -stream answers in the ndjson
+// progress format the gateway reads with SUPERVISOR_FORMAT=ndjson.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+type config struct {
+	answer   string
+	status   int
+	failRate float64
+	stream   bool
+	progress int
+	delay    time.Duration
+}
+
+func main() {
+	addr := flag.String("addr", ":9000", "listen address")
+	var c config
+	flag.StringVar(&c.answer, "answer", "done (fake supervisor)", "answer returned by every run")
+	flag.IntVar(&c.status, "status", http.StatusOK, "HTTP status of every run; non-2xx answers carry an error detail")
+	flag.Float64Var(&c.failRate, "fail-rate", 0, "fraction of runs, 0 to 1, answered with 503 instead")
+	flag.BoolVar(&c.stream, "stream", false, "answer in ndjson: -progress lines, then the result")
+	flag.IntVar(&c.progress, "progress", 3, "progress lines sent with -stream")
+	flag.DurationVar(&c.delay, "delay", 0, "how long each run takes, unless the request's ?delay= says otherwise")
+	flag.Parse()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	})
+	mux.HandleFunc("POST /run", c.handleRun)
+	slog.Info("fake supervisor listening", "addr", *addr)
+	if err := http.ListenAndServe(*addr, mux); err != nil {
+		slog.Error("listen failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+// handleRun answers one run the way the supervisor's /run does: it needs a
+// message (or goal) and echoes the thread_id it was given.
+func (c config) handleRun(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Message  string  `json:"message"`
+		Goal     string  `json:"goal"`
+		ThreadID *string `json:"thread_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"detail": "invalid JSON body"})
+		return
+	}
+	goal := strings.TrimSpace(req.Message)
+	if goal == "" {
+		goal = strings.TrimSpace(req.Goal)
+	}
+	if goal == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]any{"detail": "Message is required."})
+		return
+	}
+	delay := c.delay
+	if v := r.URL.Query().Get("delay"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]any{"detail": "invalid delay"})
+			return
+		}
+		delay = d
+	}
+	slog.Info("run", "goal", goal, "delay", delay.String(), "request_id", r.Header.Get("X-Request-ID"))
+
+	status := c.status
+	if c.failRate > 0 && rand.Float64() < c.failRate {
+		status = http.StatusServiceUnavailable
+	}
+	if status < 200 || status > 299 {
+		if !sleep(r, delay) {
+			return
+		}
+		writeJSON(w, status, map[string]any{"detail": "simulated failure"})
+		return
+	}
+
+	threadID := "default"
+	if req.ThreadID != nil {
+		threadID = *req.ThreadID
+	}
+	result := map[string]any{"ok": true, "answer": c.answer, "thread_id": threadID, "goal": goal}
+	if !c.stream {
+		if !sleep(r, delay) {
+			return
+		}
+		writeJSON(w, status, result)
+		return
+	}
+
+	// Spread the delay over the progress lines, flushing each one.
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(status)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	for i := range c.progress {
+		if !sleep(r, delay/time.Duration(c.progress+1)) {
+			return
+		}
+		enc.Encode(map[string]any{"progress": i})
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if !sleep(r, delay/time.Duration(c.progress+1)) {
+		return
+	}
+	enc.Encode(result)
+}
+
+// sleep waits d, reporting false when the gateway gave up on the run first.
+func sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	select {
+	case <-time.After(d):
+		return true
+	case <-r.Context().Done():
+		slog.Info("run abandoned by the caller", "request_id", r.Header.Get("X-Request-ID"))
+		return false
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
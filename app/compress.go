@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressMinSize is COMPRESS_MIN_SIZE, the smallest response worth
+// compressing.
+var compressMinSize = 1024
+
+// compressEncodings is COMPRESS_ENCODINGS, the response encodings the
+// gateway offers, most preferred first. A client gets the first one its
+// Accept-Encoding allows, or an uncompressed reply if it allows none.
+var compressEncodings = []string{"br", "gzip"}
+
+// encoder is what a response encoding compresses through; both
+// *gzip.Writer and *brotli.Writer are one.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// newEncoders builds the writer for each encoding the gateway knows.
+var newEncoders = map[string]func(io.Writer) encoder{
+	"br":   func(w io.Writer) encoder { return brotli.NewWriter(w) },
+	"gzip": func(w io.Writer) encoder { return gzip.NewWriter(w) },
+}
+
+// loadCompressEncodings parses COMPRESS_ENCODINGS, e.g. "gzip,br" to
+// prefer gzip. Every entry must be an encoding the gateway knows.
+func loadCompressEncodings(val string) error {
+	var out []string
+	for _, name := range splitList(strings.ToLower(val)) {
+		if newEncoders[name] == nil {
+			return fmt.Errorf("COMPRESS_ENCODINGS: unknown encoding %q, want br or gzip", name)
+		}
+		if !slices.Contains(out, name) {
+			out = append(out, name)
+		}
+	}
+	if len(out) == 0 {
+		return fmt.Errorf("COMPRESS_ENCODINGS: no encodings in %q", val)
+	}
+	compressEncodings = out
+	return nil
+}
+
+// withCompression compresses responses with the encoding negotiateEncoding
+// picks. Output is held back until compressMinSize bytes are written so
+// small replies go out as-is, and event streams are never compressed.
+func withCompression(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		enc := negotiateEncoding(r)
+		if enc == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressResponseWriter{ResponseWriter: w, encoding: enc}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding returns the first of compressEncodings the request's
+// Accept-Encoding allows, by name or through "*", or "" for identity. An
+// encoding given q=0 is refused, even if "*" would allow it.
+func negotiateEncoding(r *http.Request) string {
+	accepted := map[string]bool{}
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(enc), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != "" {
+			accepted[name] = !refused(params)
+		}
+	}
+	for _, enc := range compressEncodings {
+		if ok, named := accepted[enc]; named && ok || !named && accepted["*"] {
+			return enc
+		}
+	}
+	return ""
+}
+
+// refused reports whether an Accept-Encoding entry's parameters give it a
+// quality of zero.
+func refused(params string) bool {
+	for _, p := range strings.Split(params, ";") {
+		if v, ok := strings.CutPrefix(strings.ReplaceAll(p, " ", ""), "q="); ok {
+			q, err := strconv.ParseFloat(v, 64)
+			return err == nil && q == 0
+		}
+	}
+	return false
+}
+
+type compressResponseWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	buf      bytes.Buffer
+	zw       encoder
+	decided  bool // true once we've committed to compressed or plain output
+}
+
+func (g *compressResponseWriter) WriteHeader(code int) {
+	if g.status == 0 {
+		g.status = code
+	}
+}
+
+func (g *compressResponseWriter) Write(b []byte) (int, error) {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	if !g.decided {
+		if !g.compressible() {
+			g.commit(false)
+		} else {
+			g.buf.Write(b)
+			if g.buf.Len() < compressMinSize {
+				return len(b), nil
+			}
+			g.commit(true)
+			return len(b), nil
+		}
+	}
+	if g.zw != nil {
+		return g.zw.Write(b)
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+// compressible rules out streams and bodies the handler already encoded.
+func (g *compressResponseWriter) compressible() bool {
+	h := g.Header()
+	return h.Get("Content-Encoding") == "" &&
+		!strings.HasPrefix(h.Get("Content-Type"), "text/event-stream")
+}
+
+// commit writes the real headers and flushes anything buffered so far.
+func (g *compressResponseWriter) commit(compress bool) {
+	g.decided = true
+	if compress {
+		g.Header().Set("Content-Encoding", g.encoding)
+		g.Header().Del("Content-Length")
+	}
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	if compress {
+		g.zw = newEncoders[g.encoding](g.ResponseWriter)
+		g.zw.Write(g.buf.Bytes())
+	} else if g.buf.Len() > 0 {
+		g.ResponseWriter.Write(g.buf.Bytes())
+	}
+	g.buf.Reset()
+}
+
+func (g *compressResponseWriter) Flush() {
+	if !g.decided {
+		g.commit(false)
+	}
+	if g.zw != nil {
+		g.zw.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close sends whatever is still buffered; small bodies go out uncompressed.
+func (g *compressResponseWriter) Close() {
+	if !g.decided {
+		if g.status == 0 {
+			return
+		}
+		g.commit(false)
+	}
+	if g.zw != nil {
+		g.zw.Close()
+	}
+}
+
+func (g *compressResponseWriter) Unwrap() http.ResponseWriter { return g.ResponseWriter }
+
+// compressUpstream gzips run bodies of at least compressUpstreamMin bytes on
+// their way to the supervisor, which must then accept Content-Encoding:
+// gzip; COMPRESS_UPSTREAM and COMPRESS_UPSTREAM_MIN.
+var (
+	compressUpstream    bool
+	compressUpstreamMin int
+)
+
+// compress gzips the call body once, up front, so every retry and a spooled
+// copy resend the same compressed bytes.
+func (c *upstreamCall) compress() {
+	if !compressUpstream || len(c.body) < compressUpstreamMin {
+		return
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(c.body)
+	zw.Close()
+	c.body = buf.Bytes()
+	c.header.Set("Content-Encoding", "gzip")
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+// bigAnswer is a supervisor answer well over compressMinSize.
+var bigAnswer = map[string]any{"ok": true, "answer": strings.Repeat("a plan step; ", 1000)}
+
+func TestLargeResponseIsGzipped(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, bigAnswer))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "plan"}, "Accept-Encoding", "gzip")
+	if enc := resp.Header.Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", enc)
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.NewDecoder(zr).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got["answer"] != bigAnswer["answer"] {
+		t.Error("decoded answer differs from the supervisor's")
+	}
+
+	small := get(t, gw.URL+"/api/version", "Accept-Encoding", "gzip")
+	io.Copy(io.Discard, small.Body)
+	if enc := small.Header.Get("Content-Encoding"); enc != "" {
+		t.Errorf("small reply Content-Encoding = %q, want none", enc)
+	}
+}
+
+func TestCompressUpstream(t *testing.T) {
+	type attempt struct {
+		encoding string
+		body     []byte
+	}
+	attempts := make(chan attempt, 10)
+	var calls atomic.Int32
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		attempts <- attempt{r.Header.Get("Content-Encoding"), raw}
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status":"done"}`))
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "COMPRESS_UPSTREAM", "true", "COMPRESS_UPSTREAM_MIN", "512", "MAX_RETRIES", "1")
+
+	goal := strings.Repeat("tag every bucket in the account ", 40)
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": goal, "idempotent": true})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200 after a retry", resp.StatusCode)
+	}
+	first, second := <-attempts, <-attempts
+	if first.encoding != "gzip" || !bytes.Equal(first.body, second.body) {
+		t.Fatalf("attempts sent %q then %q encodings, want the same gzip body twice", first.encoding, second.encoding)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(second.body))
+	if err != nil {
+		t.Fatalf("retried body is not gzip: %v", err)
+	}
+	plain, _ := io.ReadAll(zr)
+	var sent map[string]any
+	if json.Unmarshal(plain, &sent) != nil || sent["goal"] != strings.TrimSpace(goal) {
+		t.Errorf("decoded body = %.80s..., want the run", plain)
+	}
+
+	resp = postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets", "idempotent": true})
+	if small := <-attempts; small.encoding != "" {
+		t.Errorf("small body sent with Content-Encoding %q, want none", small.encoding)
+	}
+}
+
+// gzipSupervisor answers every run with body, gzipped whatever the gateway
+// asked for.
+func gzipSupervisor(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		io.WriteString(zw, body)
+		zw.Close()
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(buf.Bytes())
+	}
+}
+
+func TestGzipAnswerIsDecoded(t *testing.T) {
+	sup := fakeSupervisor(t, gzipSupervisor(`{"status":"done","_trace":"abc"}`))
+	for _, tc := range []struct {
+		name, processors, want string
+	}{
+		{"relayed", "", `"_trace":"abc"`},
+		{"transformed", "strip-internal", `"status":"done"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gw := testGateway(t, "SUPERVISOR_URL", sup, "RESPONSE_PROCESSORS", tc.processors)
+			resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, "Accept-Encoding", "identity")
+			if ce := resp.Header.Get("Content-Encoding"); ce != "" {
+				t.Errorf("Content-Encoding = %q, want none for a client that takes no gzip", ce)
+			}
+			b, _ := io.ReadAll(resp.Body)
+			if !json.Valid(b) || !strings.Contains(string(b), tc.want) {
+				t.Fatalf("body = %q, want decoded JSON holding %s", b, tc.want)
+			}
+			if tc.processors != "" && strings.Contains(string(b), "_trace") {
+				t.Errorf("body = %s, want strip-internal applied to the decoded answer", b)
+			}
+		})
+	}
+}
+
+// decodeAnswer reads a run answer sent with Content-Encoding enc.
+func decodeAnswer(t *testing.T, resp *http.Response, enc string) map[string]any {
+	t.Helper()
+	var r io.Reader = resp.Body
+	switch enc {
+	case "br":
+		r = brotli.NewReader(resp.Body)
+	case "gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+	var got map[string]any
+	if err := json.NewDecoder(r).Decode(&got); err != nil {
+		t.Fatalf("decoding a %q answer: %v", enc, err)
+	}
+	return got
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, bigAnswer))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+	run := func(accept string) *http.Response {
+		return postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "plan"}, "Accept-Encoding", accept)
+	}
+
+	for _, tc := range []struct{ accept, want string }{
+		{"br, gzip", "br"},
+		{"gzip, deflate, br", "br"},
+		{"gzip", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"GZIP;q=0.5", "gzip"},
+		{"*", "br"},
+		{"br;q=0, *", "gzip"},
+		{"gzip;q=0, br;q=0", ""},
+		{"identity", ""},
+	} {
+		resp := run(tc.accept)
+		if enc := resp.Header.Get("Content-Encoding"); enc != tc.want {
+			t.Errorf("Accept-Encoding %q: Content-Encoding = %q, want %q", tc.accept, enc, tc.want)
+			continue
+		}
+		if !slices.Contains(resp.Header.Values("Vary"), "Accept-Encoding") {
+			t.Errorf("Accept-Encoding %q: Vary = %q, want Accept-Encoding", tc.accept, resp.Header.Values("Vary"))
+		}
+		if got := decodeAnswer(t, resp, tc.want); got["answer"] != bigAnswer["answer"] {
+			t.Errorf("Accept-Encoding %q: decoded answer differs from the supervisor's", tc.accept)
+		}
+	}
+
+	gw = testGateway(t, "SUPERVISOR_URL", sup, "COMPRESS_ENCODINGS", "gzip, br")
+	if enc := run("br, gzip").Header.Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("COMPRESS_ENCODINGS=gzip,br: Content-Encoding = %q, want gzip", enc)
+	}
+	gw = testGateway(t, "SUPERVISOR_URL", sup, "COMPRESS_ENCODINGS", "gzip")
+	if enc := run("br").Header.Get("Content-Encoding"); enc != "" {
+		t.Errorf("COMPRESS_ENCODINGS=gzip, br-only client: Content-Encoding = %q, want none", enc)
+	}
+	gw = testGateway(t, "SUPERVISOR_URL", sup, "COMPRESS_ENCODINGS", "", "COMPRESS_MIN_SIZE", "100000")
+	if enc := run("br, gzip").Header.Get("Content-Encoding"); enc != "" {
+		t.Errorf("below COMPRESS_MIN_SIZE: Content-Encoding = %q, want none", enc)
+	}
+
+	for _, bad := range []string{"zstd", "br,deflate", ","} {
+		if err := loadCompressEncodings(bad); err == nil {
+			t.Errorf("COMPRESS_ENCODINGS=%q: no error", bad)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings read from CONFIG_FILE, keyed by the name of the
+// environment variable they stand in for. getenv consults it after the
+// real environment, so env vars always win over the file.
+type Config map[string]string
+
+var (
+	fileConfig Config
+	// configMu guards fileConfig, which a reload replaces.
+	configMu sync.RWMutex
+)
+
+// settings lists every variable the gateway reads, so a misspelled key in
+// CONFIG_FILE is caught at startup. SUPERVISOR_<PROVIDER>,
+// MAX_CONCURRENT_<PROVIDER>, RUN_TIMEOUT_<PROVIDER> and
+// ALLOWED_REGIONS_<PROVIDER> are added per provider in loadConfig.
+var settings = []string{
+	"ADDR", "ADMIN_KEYS", "ADMIN_RATE_BURST", "ADMIN_RATE_LIMIT",
+	"ADMIN_TOKEN", "ALLOW_GET_RUN", "API_KEYS", "AUDIT_LOG_PATH",
+	"AUTH_MODE", "BASE_PATH", "BASIC_AUTH_USERS", "CACHE_TTL",
+	"CALLBACK_SECRET", "CB_COOLDOWN", "CB_THRESHOLD", "CHECK_CONFIG",
+	"CLIENT_WRITE_TIMEOUT", "COMPRESS_ENCODINGS", "COMPRESS_MIN_SIZE",
+	"COMPRESS_UPSTREAM", "COMPRESS_UPSTREAM_MIN", "CORS_HEADERS",
+	"CORS_MAX_AGE", "CORS_METHODS", "CORS_ORIGINS", "DEBUG_CAPTURE",
+	"DEBUG_CAPTURE_SIZE", "DEBUG_SAMPLE_RATE", "DEDUP_INFLIGHT",
+	"DEFAULT_PROVIDER", "ERROR_PAGE", "FORWARD_HEADERS", "GOAL_ALLOWLIST",
+	"GOAL_TEMPLATE", "HARD_DEADLINE", "HISTORY_SIZE", "IDEMPOTENCY_TTL",
+	"IDLE_TIMEOUT", "JOB_QUEUE_LEN", "JOB_STORE", "JOB_STORE_DIR",
+	"JOB_TTL", "JOB_WORKERS", "JSON_MAX_DEPTH", "JSON_MAX_ELEMENTS",
+	"JWT_JWKS_URL", "JWT_SECRET", "LISTEN_ADDR", "LISTEN_NETWORK",
+	"LISTEN_SOCKET_MODE", "LOG_FORMAT", "LOG_LEVEL", "MAINTENANCE",
+	"MAINTENANCE_RETRY_AFTER", "MAX_BATCH_GOALS", "MAX_BODY_BYTES",
+	"MAX_CONCURRENT_RUNS", "MAX_GOAL_LEN", "MAX_QUEUE_LEN",
+	"MAX_RESPONSE_BYTES", "MAX_RETRIES", "OTEL_EXPORTER_OTLP_ENDPOINT",
+	"OVERRIDE_SECRET", "PRIORITY_QUEUE", "QUEUE_TIMEOUT", "RATE_BURST",
+	"RATE_LIMIT", "READ_HEADER_TIMEOUT", "READ_TIMEOUT", "REDACT_PATTERNS",
+	"RESPONSE_PROCESSORS", "RETRY_BUDGET", "RETRY_BUDGET_WINDOW",
+	"REWRITE_FROM", "REWRITE_TO", "RUN_TIMEOUT", "SAFE_MODE",
+	"SANITIZE_GOALS", "SHUTDOWN_TIMEOUT", "SLOW_OPEN_THRESHOLD",
+	"SLOW_OPEN_WINDOW", "SLOW_THRESHOLD", "SPOOL_THRESHOLD",
+	"STARTUP_CHECK", "STARTUP_CHECK_FATAL", "STREAM_DRAIN_TIMEOUT",
+	"STREAM_REQUEST_BODY", "STRIP_HEADERS", "SUCCESS_STATUSES",
+	"SUPERVISOR_BASE", "SUPERVISOR_FORMAT", "SUPERVISOR_READONLY_URL",
+	"SUPERVISOR_RUN_PATH", "SUPERVISOR_TIMEOUT", "SUPERVISOR_URL",
+	"TENANTS", "TENANT_RATE_BURST", "TENANT_RATE_LIMIT", "TLS_CERT_FILE",
+	"TLS_KEY_FILE", "TRANSFORMER", "TRUSTED_AUTH_HEADER", "TRUSTED_CIDRS",
+	"TRUST_PROXY", "UI_ADDR", "UPSTREAM_ALLOWED_HOSTS",
+	"UPSTREAM_ALLOW_PRIVATE", "UPSTREAM_CA_CERT", "UPSTREAM_CLIENT_CERT",
+	"UPSTREAM_CLIENT_KEY", "UPSTREAM_CONNECT_TIMEOUT", "UPSTREAM_H2C",
+	"UPSTREAM_PROXY", "UPSTREAM_TLS_HANDSHAKE_TIMEOUT",
+	"VALIDATE_RESPONSE", "WEB_DIR", "WRITE_TIMEOUT",
+}
+
+// secretSettings are masked when the effective config is logged.
+var secretSettings = []string{"ADMIN_KEYS", "ADMIN_TOKEN", "API_KEYS", "BASIC_AUTH_USERS", "CALLBACK_SECRET", "JWT_SECRET", "OVERRIDE_SECRET", "UPSTREAM_PROXY"}
+
+// loadConfig reads CONFIG_FILE, a JSON or YAML object of settings. Keys are
+// the env var names, in either case; values may be strings, numbers,
+// booleans, lists (joined with commas) or, for TENANTS, an object.
+func loadConfig(path string) error {
+	for _, p := range providers {
+		if name := "SUPERVISOR_" + strings.ToUpper(p); !slices.Contains(settings, name) {
+			settings = append(settings, name, "MAX_CONCURRENT_"+strings.ToUpper(p), "RUN_TIMEOUT_"+strings.ToUpper(p),
+				"ALLOWED_REGIONS_"+strings.ToUpper(p))
+		}
+	}
+	cfg := Config{}
+	if path != "" {
+		var err error
+		if cfg, err = readConfigFile(path); err != nil {
+			return err
+		}
+	}
+	configMu.Lock()
+	fileConfig = cfg
+	configMu.Unlock()
+	return nil
+}
+
+// readConfigFile parses the CONFIG_FILE at path.
+func readConfigFile(path string) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("CONFIG_FILE: %w", err)
+	}
+	var raw map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		err = json.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("CONFIG_FILE %s: %w", path, err)
+	}
+
+	cfg := Config{}
+	for k, v := range raw {
+		key := strings.ToUpper(k)
+		if !slices.Contains(settings, key) {
+			return nil, fmt.Errorf("CONFIG_FILE %s: unknown setting %q", path, k)
+		}
+		val, err := settingString(v)
+		if err != nil {
+			return nil, fmt.Errorf("CONFIG_FILE %s: %s: %w", path, k, err)
+		}
+		cfg[key] = val
+	}
+	return cfg, nil
+}
+
+// fileSetting returns k's value in CONFIG_FILE, "" when it has none.
+func fileSetting(k string) string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return fileConfig[k]
+}
+
+func settingString(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []any:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			s, err := settingString(item)
+			if err != nil {
+				return "", err
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, ","), nil
+	case map[string]any:
+		out, err := json.Marshal(v)
+		return string(out), err
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
+
+// configSetting is a setting given through the environment or CONFIG_FILE.
+type configSetting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`  // "****" for secrets
+	Source string `json:"source"` // "env" or "file"
+}
+
+// configSummary lists every setting given through the environment or
+// CONFIG_FILE, by name, with secrets masked. Settings left at their default
+// are omitted.
+func configSummary() []configSetting {
+	names := slices.Clone(settings)
+	sort.Strings(names)
+	out := []configSetting{}
+	for _, k := range names {
+		val, src := os.Getenv(k), "env"
+		if val == "" {
+			val, src = fileSetting(k), "file"
+		}
+		if val == "" {
+			continue
+		}
+		if slices.Contains(secretSettings, k) {
+			val = "****"
+		}
+		out = append(out, configSetting{Name: k, Value: val, Source: src})
+	}
+	return out
+}
+
+// invalidSettings names the settings whose value didn't parse, so the
+// getenv helpers fell back to the default; --check fails on them.
+var invalidSettings []string
+
+// checkConfig is what --check (or CHECK_CONFIG=true) verifies on top of
+// the checks startup already makes fatal: no setting fell back to its
+// default, every backend is an http(s) URL, and the TLS pair and WEB_DIR
+// can be read.
+func checkConfig(certFile, keyFile, webDir string) []error {
+	var errs []error
+	for _, k := range invalidSettings {
+		errs = append(errs, fmt.Errorf("%s: invalid value %q", k, getenv(k, "")))
+	}
+	checkURLs := func(setting string, urls []string) {
+		for _, raw := range urls {
+			u, err := url.Parse(raw)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, fmt.Errorf("%s: %q is not an http(s) URL", setting, raw))
+			}
+		}
+	}
+	checkURLs("SUPERVISOR_URL", supervisors)
+	for _, p := range providers {
+		checkURLs("SUPERVISOR_"+strings.ToUpper(p), providerBackends[p])
+	}
+	checkURLs("SUPERVISOR_READONLY_URL", readonlyBackends)
+	tenants := make([]string, 0, len(tenantBackends))
+	for id := range tenantBackends {
+		tenants = append(tenants, id)
+	}
+	sort.Strings(tenants)
+	for _, id := range tenants {
+		checkURLs("TENANTS["+id+"]", tenantBackends[id])
+	}
+	if certFile != "" {
+		if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			errs = append(errs, fmt.Errorf("TLS_CERT_FILE/TLS_KEY_FILE: %v", err))
+		}
+	}
+	if webDir != "" {
+		if info, err := os.Stat(webDir); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Errorf("WEB_DIR: %q is not a readable directory", webDir))
+		}
+	}
+	return errs
+}
+
+// logConfig prints configSummary at startup.
+func logConfig() {
+	for _, c := range configSummary() {
+		logger.Info("config", "name", c.Name, "value", c.Value, "source", c.Source)
+	}
+}
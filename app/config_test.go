@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// configFile writes content to a CONFIG_FILE named name.
+func configFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFileOnly(t *testing.T) {
+	for name, content := range map[string]string{
+		"gateway.json": `{"run_timeout":"30s","MAX_GOAL_LEN":120,"CORS_ORIGINS":["https://a.example","https://b.example"],"API_KEYS":"file-key"}`,
+		"gateway.yaml": "run_timeout: 30s\nMAX_GOAL_LEN: 120\nCORS_ORIGINS:\n  - https://a.example\n  - https://b.example\nAPI_KEYS: file-key\n",
+	} {
+		testGateway(t, "CONFIG_FILE", configFile(t, name, content))
+		if runTimeout != 30*time.Second || maxGoalLen != 120 {
+			t.Errorf("%s: RUN_TIMEOUT = %v, MAX_GOAL_LEN = %d, want 30s and 120", name, runTimeout, maxGoalLen)
+		}
+		if got := getenv("CORS_ORIGINS", ""); got != "https://a.example,https://b.example" {
+			t.Errorf("%s: CORS_ORIGINS = %q, want the list joined with commas", name, got)
+		}
+		for _, c := range configSummary() {
+			if c.Name == "API_KEYS" && (c.Value != "****" || c.Source != "file") {
+				t.Errorf("%s: API_KEYS summarized as %+v, want it masked from file", name, c)
+			}
+			if c.Name == "RUN_TIMEOUT" && (c.Value != "30s" || c.Source != "file") {
+				t.Errorf("%s: RUN_TIMEOUT summarized as %+v, want 30s from file", name, c)
+			}
+		}
+	}
+}
+
+func TestConfigEnvOverridesFile(t *testing.T) {
+	path := configFile(t, "gateway.json", `{"RUN_TIMEOUT":"30s","MAX_GOAL_LEN":120}`)
+	testGateway(t, "CONFIG_FILE", path, "RUN_TIMEOUT", "45s")
+	if runTimeout != 45*time.Second {
+		t.Errorf("RUN_TIMEOUT = %v, want the env's 45s", runTimeout)
+	}
+	if maxGoalLen != 120 {
+		t.Errorf("MAX_GOAL_LEN = %d, want the file's 120", maxGoalLen)
+	}
+	i := slices.IndexFunc(configSummary(), func(c configSetting) bool { return c.Name == "RUN_TIMEOUT" })
+	if i < 0 || configSummary()[i].Source != "env" {
+		t.Error("RUN_TIMEOUT not summarized as coming from env")
+	}
+}
+
+func TestConfigDefaults(t *testing.T) {
+	testGateway(t, "CONFIG_FILE", configFile(t, "gateway.json", `{"MAX_GOAL_LEN":120}`))
+	if runTimeout != time.Minute || maxConcurrent != 10 {
+		t.Errorf("RUN_TIMEOUT = %v, MAX_CONCURRENT_RUNS = %d, want the defaults 1m and 10", runTimeout, maxConcurrent)
+	}
+}
+
+func TestConfigFileRejectsUnknownSettings(t *testing.T) {
+	t.Setenv("CONFIG_FILE", configFile(t, "gateway.json", `{"RUN_TIMEOUT":"30s","RUN_TIMEUOT":"45s"}`))
+	err := configure()
+	if err == nil || !strings.Contains(err.Error(), `unknown setting "RUN_TIMEUOT"`) {
+		t.Errorf("configure = %v, want an unknown setting error", err)
+	}
+	t.Setenv("CONFIG_FILE", "")
+	if err := configure(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkConfigProcess runs the gateway binary, this test binary standing in
+// for it, with CHECK_CONFIG=true and env, and returns its log and exit code.
+func checkConfigProcess(t *testing.T, env ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCheckConfigMain$")
+	cmd.Env = append(os.Environ(), "RUN_GATEWAY_MAIN=1", "CHECK_CONFIG=true")
+	for i := 0; i+1 < len(env); i += 2 {
+		cmd.Env = append(cmd.Env, env[i]+"="+env[i+1])
+	}
+	out, err := cmd.CombinedOutput()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return string(out), exit.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), 0
+}
+
+// TestCheckConfigMain is the process checkConfigProcess starts.
+func TestCheckConfigMain(t *testing.T) {
+	if os.Getenv("RUN_GATEWAY_MAIN") != "1" {
+		t.Skip("only run by checkConfigProcess")
+	}
+	main()
+}
+
+func TestCheckConfig(t *testing.T) {
+	// The port is taken, so a check that tried to listen would fail.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	out, code := checkConfigProcess(t, "SUPERVISOR_URL", "http://supervisor:8000/run", "RUN_TIMEOUT", "30s",
+		"LISTEN_ADDR", ln.Addr().String())
+	if code != 0 || !strings.Contains(out, "config check passed") {
+		t.Errorf("valid config: exit %d, output:\n%s", code, out)
+	}
+
+	for _, tc := range []struct {
+		env  []string
+		want string
+	}{
+		{[]string{"SUPERVISOR_URL", "ftp://supervisor/run"}, `SUPERVISOR_URL: \"ftp://supervisor/run\" is not an http(s) URL`},
+		{[]string{"RUN_TIMEOUT", "soon"}, `RUN_TIMEOUT: invalid value \"soon\"`},
+		{[]string{"WEB_DIR", filepath.Join(t.TempDir(), "missing")}, "WEB_DIR:"},
+		{[]string{"TLS_CERT_FILE", filepath.Join(t.TempDir(), "cert.pem"), "TLS_KEY_FILE", filepath.Join(t.TempDir(), "key.pem")}, "TLS_CERT_FILE/TLS_KEY_FILE:"},
+	} {
+		env := append([]string{"SUPERVISOR_URL", "http://supervisor:8000/run", "LISTEN_ADDR", ln.Addr().String()}, tc.env...)
+		out, code := checkConfigProcess(t, env...)
+		if code == 0 || !strings.Contains(out, "config check failed") || !strings.Contains(out, tc.want) {
+			t.Errorf("%v: exit %d, want nonzero with %s; output:\n%s", tc.env, code, tc.want, out)
+		}
+	}
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	path := configFile(t, "gateway.json", `{"RATE_LIMIT":0.001,"RATE_BURST":1,"LISTEN_ADDR":":8088"}`)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "CONFIG_FILE", path)
+	logs := captureLogs(t)
+	watchReload()
+	run := func() int {
+		return postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}).StatusCode
+	}
+
+	if first, second := run(), run(); first != http.StatusOK || second != http.StatusTooManyRequests {
+		t.Fatalf("before the reload: statuses %d, %d, want 200 then 429", first, second)
+	}
+	if err := os.WriteFile(path, []byte(`{"RATE_LIMIT":100,"RATE_BURST":100,"LISTEN_ADDR":":9099"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := func() (names []any) {
+		for _, l := range logs.lines() {
+			if l["msg"] == "setting reloaded" {
+				names = append(names, l["name"])
+			}
+		}
+		return names
+	}
+	waitFor(t, func() bool { return len(reloaded()) == 2 })
+	if got := fmt.Sprint(reloaded()); got != "[RATE_BURST RATE_LIMIT]" {
+		t.Errorf("reloaded %s, want RATE_BURST and RATE_LIMIT", got)
+	}
+
+	// The old limit would refill the bucket in 1000s, the new one in 10ms.
+	time.Sleep(100 * time.Millisecond)
+	for range 5 {
+		if got := run(); got != http.StatusOK {
+			t.Fatalf("after the reload: status = %d, want the new limit to let runs through", got)
+		}
+	}
+	if l := logs.find("setting changed in CONFIG_FILE but needs a restart, ignored"); l == nil || l["name"] != "LISTEN_ADDR" {
+		t.Errorf("log = %v, want LISTEN_ADDR ignored with a warning", l)
+	}
+	if got := getenv("LISTEN_ADDR", ""); got != ":8088" {
+		t.Errorf("LISTEN_ADDR = %q after the reload, want it unchanged", got)
+	}
+}
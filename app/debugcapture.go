@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxCapturedBody bounds each request and response body kept by the debug
+// capture, in bytes.
+const maxCapturedBody = 4 << 10
+
+// redactedHeaders never appear in captured exchanges.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+type capturedMessage struct {
+	Header    http.Header `json:"header"`
+	Body      string      `json:"body"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+type exchange struct {
+	RequestID  string           `json:"request_id"`
+	Time       time.Time        `json:"time"`
+	Method     string           `json:"method"`
+	URL        string           `json:"url"`
+	Request    capturedMessage  `json:"request"`
+	Status     int              `json:"status,omitempty"`
+	Response   *capturedMessage `json:"response,omitempty"`
+	Error      string           `json:"error,omitempty"`
+	DurationMS float64          `json:"duration_ms"`
+}
+
+// exchanges is a ring buffer of the last DEBUG_CAPTURE_SIZE supervisor
+// calls, kept only when DEBUG_CAPTURE is on. It is a diagnostics aid: it
+// holds raw bodies, so it is off by default and admin-only.
+var exchanges struct {
+	mu      sync.Mutex
+	entries []*exchange
+	next    int
+	full    bool
+}
+
+// debugSampleRate is DEBUG_SAMPLE_RATE, the fraction of requests, 0 to 1,
+// whose supervisor calls the debug capture records.
+var debugSampleRate = 1.0
+
+// sampleRand makes the sampling draws. Tests seed it for a repeatable
+// draw; a *rand.Rand is not safe for concurrent use, so it is shared under
+// sampleRandMu.
+var (
+	sampleRandMu sync.Mutex
+	sampleRand   = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+)
+
+// initDebugCapture sizes the ring, emptying it; a size of zero turns the
+// capture off.
+func initDebugCapture(size int, sampleRate float64) {
+	exchanges.mu.Lock()
+	exchanges.entries = make([]*exchange, max(size, 0))
+	exchanges.next, exchanges.full = 0, false
+	exchanges.mu.Unlock()
+	debugSampleRate = min(sampleRate, 1)
+}
+
+// sampleCapture picks whether a request's supervisor calls are captured,
+// with a cheap random draw from sampleRand against debugSampleRate.
+func sampleCapture() bool {
+	if len(exchanges.entries) == 0 || debugSampleRate <= 0 {
+		return false
+	}
+	if debugSampleRate >= 1 {
+		return true
+	}
+	sampleRandMu.Lock()
+	defer sampleRandMu.Unlock()
+	return sampleRand.Float64() < debugSampleRate
+}
+
+// sampled reports whether the request behind ctx was picked for capture.
+// Calls made outside a request draw on their own.
+func sampled(ctx context.Context) bool {
+	if rc := requestContext(ctx); rc != nil {
+		return rc.Sampled
+	}
+	return sampleCapture()
+}
+
+// captureExchange records one supervisor attempt of a sampled request. body
+// is the request body when it is held in memory. The returned func completes
+// the entry with the outcome; a response body is captured as the caller
+// reads it.
+func captureExchange(req *http.Request, body []byte) func(*http.Response, error) {
+	if len(exchanges.entries) == 0 || !sampled(req.Context()) {
+		return func(*http.Response, error) {}
+	}
+	start := time.Now()
+	ex := &exchange{
+		RequestID: requestID(req.Context()),
+		Time:      start.UTC(),
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Request:   capturedMessage{Header: redactHeaders(req.Header)},
+	}
+	if body != nil {
+		ex.Request.Body, ex.Request.Truncated = truncatedBody(body)
+	} else {
+		ex.Request.Body = "(not captured: body streamed or spooled)"
+	}
+	return func(resp *http.Response, err error) {
+		exchanges.mu.Lock()
+		ex.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+		if err != nil {
+			ex.Error = err.Error()
+		} else {
+			ex.Status = resp.StatusCode
+			ex.Response = &capturedMessage{Header: redactHeaders(resp.Header)}
+			resp.Body = &teeBody{ReadCloser: resp.Body, msg: ex.Response}
+		}
+		exchanges.entries[exchanges.next] = ex
+		exchanges.next = (exchanges.next + 1) % len(exchanges.entries)
+		if exchanges.next == 0 {
+			exchanges.full = true
+		}
+		exchanges.mu.Unlock()
+	}
+}
+
+// teeBody copies the start of a response body into its captured message as
+// it is read.
+type teeBody struct {
+	io.ReadCloser
+	msg *capturedMessage
+	buf bytes.Buffer
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if room := maxCapturedBody + 1 - t.buf.Len(); room > 0 {
+		t.buf.Write(p[:min(n, room)])
+		exchanges.mu.Lock()
+		t.msg.Body, t.msg.Truncated = truncatedBody(t.buf.Bytes())
+		exchanges.mu.Unlock()
+	}
+	return n, err
+}
+
+func truncatedBody(b []byte) (string, bool) {
+	if len(b) > maxCapturedBody {
+		return string(b[:maxCapturedBody]), true
+	}
+	return string(b), false
+}
+
+func redactHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range redactedHeaders {
+		if out.Get(name) != "" {
+			out.Set(name, "[REDACTED]")
+		}
+	}
+	return out
+}
+
+// recentExchanges returns copies of the buffered exchanges, newest first.
+func recentExchanges() []exchange {
+	exchanges.mu.Lock()
+	defer exchanges.mu.Unlock()
+	n := exchanges.next
+	if exchanges.full {
+		n = len(exchanges.entries)
+	}
+	out := make([]exchange, 0, n)
+	for i := 1; i <= n; i++ {
+		ex := *exchanges.entries[(exchanges.next-i+len(exchanges.entries))%len(exchanges.entries)]
+		if ex.Response != nil {
+			resp := *ex.Response
+			ex.Response = &resp
+		}
+		out = append(out, ex)
+	}
+	return out
+}
+
+// handleExchanges serves GET /api/admin/debug/exchanges.
+func handleExchanges(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if len(exchanges.entries) == 0 {
+		writeError(w, http.StatusNotFound, "debug capture disabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"exchanges": recentExchanges()})
+}
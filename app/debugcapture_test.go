@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDebugCaptureKeepsExchanges(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"status": "done"}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "ADMIN_KEYS", adminKey, "DEBUG_CAPTURE", "true",
+		"DEBUG_CAPTURE_SIZE", "2", "FORWARD_HEADERS", "Authorization")
+
+	for _, goal := range []string{"first goal", "second goal", "third goal"} {
+		resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": goal}, "Authorization", "Bearer caller-token")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("run %q: status = %d, want 200", goal, resp.StatusCode)
+		}
+	}
+
+	if resp := get(t, gw.URL+"/api/admin/debug/exchanges"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without an admin key: status = %d, want 401", resp.StatusCode)
+	}
+	resp := get(t, gw.URL+"/api/admin/debug/exchanges", asAdmin...)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	list, _ := decode(t, resp)["exchanges"].([]any)
+	if len(list) != 2 {
+		t.Fatalf("got %d exchanges, want the last 2", len(list))
+	}
+	for i, want := range []string{"third goal", "second goal"} {
+		ex := list[i].(map[string]any)
+		req := ex["request"].(map[string]any)
+		if body, _ := req["body"].(string); !strings.Contains(body, want) {
+			t.Errorf("exchange %d request body = %q, want it to hold %q", i, body, want)
+		}
+		if auth := req["header"].(map[string]any)["Authorization"]; auth == nil || auth.([]any)[0] != "[REDACTED]" {
+			t.Errorf("exchange %d Authorization = %v, want [REDACTED]", i, auth)
+		}
+		if ex["status"] != float64(http.StatusOK) || ex["method"] != http.MethodPost {
+			t.Errorf("exchange %d: method %v status %v, want POST 200", i, ex["method"], ex["status"])
+		}
+		if body, _ := ex["response"].(map[string]any)["body"].(string); body != "{\"status\":\"done\"}\n" {
+			t.Errorf("exchange %d response body = %q", i, body)
+		}
+	}
+}
+
+func TestDebugCaptureOffByDefault(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"status": "done"}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "ADMIN_KEYS", adminKey)
+
+	postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "check the disks"})
+	resp := get(t, gw.URL+"/api/admin/debug/exchanges", asAdmin...)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", resp.StatusCode)
+	}
+	if got := decode(t, resp)["error"]; got != "debug capture disabled" {
+		t.Errorf("error = %v, want debug capture disabled", got)
+	}
+}
+
+// seedSampling gives sampleCapture a fixed seed for the rest of the test.
+func seedSampling(t *testing.T, seed uint64) {
+	sampleRandMu.Lock()
+	prev := sampleRand
+	sampleRand = rand.New(rand.NewPCG(seed, seed))
+	sampleRandMu.Unlock()
+	t.Cleanup(func() {
+		sampleRandMu.Lock()
+		sampleRand = prev
+		sampleRandMu.Unlock()
+	})
+}
+
+func TestDebugSampleRate(t *testing.T) {
+	testGateway(t, "DEBUG_CAPTURE", "true", "DEBUG_SAMPLE_RATE", "0.1")
+	seedSampling(t, 1)
+	n := 0
+	for range 10000 {
+		if sampleCapture() {
+			n++
+		}
+	}
+	if n < 900 || n > 1100 {
+		t.Errorf("sampled %d of 10000 at rate 0.1, want about 1000", n)
+	}
+
+	for rate, want := range map[string]int{"0": 0, "1": 100} {
+		testGateway(t, "DEBUG_CAPTURE", "true", "DEBUG_SAMPLE_RATE", rate)
+		n := 0
+		for range 100 {
+			if sampleCapture() {
+				n++
+			}
+		}
+		if n != want {
+			t.Errorf("DEBUG_SAMPLE_RATE=%s: sampled %d of 100, want %d", rate, n, want)
+		}
+	}
+}
+
+func TestDebugCaptureSamplesRequests(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"status": "done"}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "ADMIN_KEYS", adminKey, "DEBUG_CAPTURE", "true",
+		"DEBUG_CAPTURE_SIZE", "500", "DEBUG_SAMPLE_RATE", "0.25")
+	logs := captureLogs(t)
+	seedSampling(t, 7)
+
+	const runs = 400
+	for i := range runs {
+		if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": fmt.Sprintf("check disk %d", i)}); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+	}
+	list, _ := decode(t, get(t, gw.URL+"/api/admin/debug/exchanges", asAdmin...))["exchanges"].([]any)
+	if len(list) < 70 || len(list) > 130 {
+		t.Errorf("captured %d of %d runs at rate 0.25, want about 100", len(list), runs)
+	}
+
+	captured := map[string]bool{}
+	for _, ex := range list {
+		captured[ex.(map[string]any)["request_id"].(string)] = true
+	}
+	logged := 0
+	for _, l := range logs.lines() {
+		if l["msg"] != "request" || l["path"] != "/api/run" {
+			continue
+		}
+		logged++
+		if id, _ := l["request_id"].(string); l["sampled"] != captured[id] {
+			t.Errorf("request %s logged sampled=%v, captured %v", id, l["sampled"], captured[id])
+		}
+	}
+	if logged != runs {
+		t.Errorf("%d request lines for %d runs", logged, runs)
+	}
+}
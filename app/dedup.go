@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// dedupInflight collapses concurrent identical runs into one supervisor
+// call; DEDUP_INFLIGHT. Unlike Idempotency-Key it needs nothing from the
+// client and only lasts while the first run is in flight.
+var dedupInflight bool
+
+// sharedRun is a run in flight whose answer later identical runs wait for.
+type sharedRun struct {
+	done        chan struct{}
+	status      int
+	contentType string
+	body        []byte
+}
+
+var sharedRuns = struct {
+	sync.Mutex
+	byKey map[[32]byte]*sharedRun
+}{byKey: map[[32]byte]*sharedRun{}}
+
+// dedupKey is the run's callKey, so only runs of the same caller with the
+// same forwarded headers share an answer, plus whether the client wants
+// plain text or indented JSON, since that changes the answer.
+func dedupKey(r *http.Request, call *upstreamCall) [32]byte {
+	text := "json"
+	if wantsText(r) {
+		text = "text"
+	} else if wantsPretty(r) {
+		text = "pretty"
+	}
+	return callKey(r, call, text)
+}
+
+// joinSharedRun returns the identical run already in flight, or registers a
+// new one; leader reports which.
+func joinSharedRun(key [32]byte) (run *sharedRun, leader bool) {
+	sharedRuns.Lock()
+	defer sharedRuns.Unlock()
+	if run, ok := sharedRuns.byKey[key]; ok {
+		return run, false
+	}
+	run = &sharedRun{done: make(chan struct{})}
+	sharedRuns.byKey[key] = run
+	return run, true
+}
+
+// finish publishes the leader's captured answer and releases the waiters.
+func (s *sharedRun) finish(key [32]byte, c *captureWriter) {
+	sharedRuns.Lock()
+	delete(sharedRuns.byKey, key)
+	sharedRuns.Unlock()
+	if c.status != 0 && !c.overflow {
+		s.status = c.status
+		s.contentType = c.Header().Get("Content-Type")
+		s.body = c.buf.Bytes()
+	}
+	close(s.done)
+}
+
+// share waits for the leader and replays its answer. It reports false when
+// the leader had nothing to share (its client went away or the body was too
+// large), in which case the caller runs on its own.
+func (s *sharedRun) share(ctx context.Context, w http.ResponseWriter) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	case <-s.done:
+	}
+	if s.status == 0 {
+		return false
+	}
+	coalesceStats.collapsed.Add(1)
+	w.Header().Set("Content-Type", s.contentType)
+	w.Header().Set("X-Dedup", "shared")
+	w.WriteHeader(s.status)
+	w.Write(s.body)
+	return true
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// heldSupervisor counts its calls and answers none until release is closed.
+func heldSupervisor(t *testing.T) (url string, calls *atomic.Int32, release chan struct{}) {
+	calls, release = &atomic.Int32{}, make(chan struct{})
+	url = fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		<-release
+		answer(http.StatusOK, map[string]any{"ok": true, "call": n})(w, r)
+	})
+	return url, calls, release
+}
+
+// runsTogether starts one run per header set while the supervisor is held,
+// then releases it and returns each run's body and X-Dedup header.
+func runsTogether(t *testing.T, gw string, calls *atomic.Int32, release chan struct{}, headers ...[]string) (bodies, dedup []string) {
+	t.Helper()
+	bodies, dedup = make([]string, len(headers)), make([]string, len(headers))
+	var wg sync.WaitGroup
+	start := func(i int) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := doJSON(gw+"/api/run", map[string]any{"goal": "create the staging bucket"}, headers[i]...)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			bodies[i], dedup[i] = string(b), resp.Header.Get("X-Dedup")
+		}()
+	}
+	start(0)
+	waitFor(t, func() bool { return calls.Load() == 1 })
+	for i := 1; i < len(headers); i++ {
+		start(i)
+	}
+	// Give the later runs time to reach the supervisor or join the first.
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	return bodies, dedup
+}
+
+func TestDedupCollapsesIdenticalRuns(t *testing.T) {
+	sup, calls, release := heldSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "DEDUP_INFLIGHT", "true")
+
+	bodies, dedup := runsTogether(t, gw.URL, calls, release, nil, nil, nil)
+	if n := calls.Load(); n != 1 {
+		t.Errorf("supervisor called %d times, want once", n)
+	}
+	if bodies[1] != bodies[0] || bodies[2] != bodies[0] {
+		t.Errorf("bodies = %q, want the first run's answer shared", bodies)
+	}
+	if dedup[0] != "" || dedup[1] != "shared" || dedup[2] != "shared" {
+		t.Errorf("X-Dedup = %q, want the later two shared", dedup)
+	}
+}
+
+func TestDedupNotShared(t *testing.T) {
+	sup, calls, release := heldSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "DEDUP_INFLIGHT", "true",
+		"API_KEYS", "key-one,key-two", "FORWARD_HEADERS", "X-User-Token")
+
+	_, dedup := runsTogether(t, gw.URL, calls, release,
+		[]string{"Authorization", "Bearer key-one", "X-User-Token", "alice"},
+		[]string{"Authorization", "Bearer key-one", "X-User-Token", "bob"},
+		[]string{"Authorization", "Bearer key-two", "X-User-Token", "alice"},
+	)
+	if n := calls.Load(); n != 3 {
+		t.Errorf("supervisor called %d times, want once per caller and token", n)
+	}
+	for i, d := range dedup {
+		if d != "" {
+			t.Errorf("run %d: X-Dedup = %q, want its own call", i, d)
+		}
+	}
+}
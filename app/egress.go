@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// upstreamAllowedHosts is UPSTREAM_ALLOWED_HOSTS. When set, outbound calls
+// may only reach these hosts, besides the configured supervisors and proxy.
+// An entry "*.example.com" matches every subdomain of example.com.
+var upstreamAllowedHosts []string
+
+// upstreamAllowPrivate is UPSTREAM_ALLOW_PRIVATE, letting outbound calls
+// reach loopback, private and link-local addresses.
+var upstreamAllowPrivate bool
+
+// trustedHosts are the hosts of the backends and proxies named in the
+// configuration. The operator chose them, so they pass the guard unchecked;
+// it is there for destinations derived from input, such as a job's
+// callback_url or where a supervisor redirects to. Fixed after initEgress.
+var trustedHosts = map[string]bool{}
+
+// errDestinationBlocked is the cause of an outbound call the guard refused.
+var errDestinationBlocked = errors.New("destination not allowed")
+
+// initEgress reads UPSTREAM_ALLOWED_HOSTS and UPSTREAM_ALLOW_PRIVATE and
+// trusts the hosts of every configured backend and proxy. It runs after the
+// backend lists are loaded.
+func initEgress(allowed []string, allowPrivate bool, proxy string) {
+	upstreamAllowedHosts = nil
+	for _, h := range allowed {
+		upstreamAllowedHosts = append(upstreamAllowedHosts, canonicalHost(h))
+	}
+	upstreamAllowPrivate = allowPrivate
+
+	trustedHosts = map[string]bool{}
+	trust := func(urls ...string) {
+		for _, raw := range urls {
+			if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+				trustedHosts[canonicalHost(u.Hostname())] = true
+			}
+		}
+	}
+	trust(supervisors...)
+	trust(readonlyBackends...)
+	for _, urls := range providerBackends {
+		trust(urls...)
+	}
+	for _, urls := range tenantBackends {
+		trust(urls...)
+	}
+	trust(proxy)
+	for _, k := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+		trust(os.Getenv(k))
+	}
+}
+
+func canonicalHost(h string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(h)), ".")
+}
+
+// hostAllowed reports whether host matches UPSTREAM_ALLOWED_HOSTS, which
+// allows everything when unset.
+func hostAllowed(host string) bool {
+	if len(upstreamAllowedHosts) == 0 {
+		return true
+	}
+	for _, a := range upstreamAllowedHosts {
+		if suffix, ok := strings.CutPrefix(a, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == a {
+			return true
+		}
+	}
+	return false
+}
+
+// privateAddr reports whether ip is one an outbound call must not reach
+// without UPSTREAM_ALLOW_PRIVATE: loopback, private, link-local or
+// unspecified.
+func privateAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()
+}
+
+// checkDestination vets host before an outbound call dials it. It returns
+// the addresses host resolved to, all of them allowed, or nil for a trusted
+// host, which is dialed as usual. A refusal wraps errDestinationBlocked.
+func checkDestination(ctx context.Context, host string) ([]netip.Addr, error) {
+	host = canonicalHost(host)
+	if trustedHosts[host] {
+		return nil, nil
+	}
+	if !hostAllowed(host) {
+		return nil, fmt.Errorf("%w: %s is not in UPSTREAM_ALLOWED_HOSTS", errDestinationBlocked, host)
+	}
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip}
+	} else if ips, err = net.DefaultResolver.LookupNetIP(ctx, "ip", host); err != nil {
+		return nil, err
+	}
+	if !upstreamAllowPrivate {
+		for _, ip := range ips {
+			if privateAddr(ip) {
+				return nil, fmt.Errorf("%w: %s resolves to private address %s", errDestinationBlocked, host, ip.Unmap())
+			}
+		}
+	}
+	return ips, nil
+}
+
+// guardDial wraps the transport's dialer with checkDestination. It dials
+// the addresses it checked rather than the name, so a second lookup can't
+// swap in one the guard never saw.
+func guardDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips, err := checkDestination(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if ips == nil {
+			return dial(ctx, network, addr)
+		}
+		for _, ip := range ips {
+			var conn net.Conn
+			if conn, err = dial(ctx, network, net.JoinHostPort(ip.Unmap().String(), port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// guardProxy wraps the transport's proxy func so a call that goes out
+// through a proxy, whose dial only reaches the proxy, still has its target
+// checked.
+func guardProxy(proxy func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := proxy(req)
+		if err != nil || u == nil {
+			return u, err
+		}
+		if _, err := checkDestination(req.Context(), req.URL.Hostname()); err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestCheckDestination(t *testing.T) {
+	testGateway(t)
+	ctx := t.Context()
+
+	ips, err := checkDestination(ctx, "93.184.216.34")
+	if err != nil || len(ips) != 1 || ips[0] != netip.MustParseAddr("93.184.216.34") {
+		t.Errorf("public address: ips = %v, err = %v, want it allowed", ips, err)
+	}
+	for _, host := range []string{"10.0.0.5", "192.168.1.10", "169.254.169.254", "::1", "0.0.0.0", "::ffff:10.0.0.5"} {
+		if _, err := checkDestination(ctx, host); !errors.Is(err, errDestinationBlocked) {
+			t.Errorf("%s: err = %v, want it blocked", host, err)
+		}
+	}
+	if ips, err := checkDestination(ctx, "127.0.0.1"); err != nil || ips != nil {
+		t.Errorf("configured supervisor host: ips = %v, err = %v, want it trusted", ips, err)
+	}
+
+	testGateway(t, "UPSTREAM_ALLOW_PRIVATE", "true")
+	if _, err := checkDestination(ctx, "10.0.0.5"); err != nil {
+		t.Errorf("UPSTREAM_ALLOW_PRIVATE: err = %v, want 10.0.0.5 allowed", err)
+	}
+
+	testGateway(t, "UPSTREAM_ALLOW_PRIVATE", "", "UPSTREAM_ALLOWED_HOSTS", "93.184.216.34, *.Example.com")
+	for host, allowed := range map[string]bool{
+		"93.184.216.34":   true,
+		"api.example.com": true,
+		"example.com":     false,
+		"evil.test":       false,
+		"93.184.216.35":   false,
+	} {
+		if got := hostAllowed(canonicalHost(host)); got != allowed {
+			t.Errorf("hostAllowed(%q) = %v, want %v", host, got, allowed)
+		}
+	}
+	if _, err := checkDestination(ctx, "evil.test"); !errors.Is(err, errDestinationBlocked) || !strings.Contains(err.Error(), "UPSTREAM_ALLOWED_HOSTS") {
+		t.Errorf("host off the allowlist: err = %v, want it blocked", err)
+	}
+}
+
+// redirectingSupervisor answers every run with a redirect to target, a
+// destination the gateway did not configure.
+func redirectingSupervisor(t *testing.T, target string) string {
+	return fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target, http.StatusFound)
+	})
+}
+
+func TestRedirectToPrivateAddressIsBlocked(t *testing.T) {
+	sup := redirectingSupervisor(t, "http://10.0.0.5/run")
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_RETRIES", "0")
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", resp.StatusCode)
+	}
+	if got, _ := decode(t, resp)["error"].(string); !strings.Contains(got, "private address 10.0.0.5") {
+		t.Errorf("error = %q, want the blocked address", got)
+	}
+}
+
+func TestRedirectToAllowedHost(t *testing.T) {
+	target := httptest.NewServer(answer(http.StatusOK, map[string]any{"ok": true, "from": "target"}))
+	t.Cleanup(target.Close)
+	// Named as localhost, the target is not one of the configured hosts.
+	targetURL := strings.Replace(target.URL, "127.0.0.1", "localhost", 1) + "/run"
+	sup := redirectingSupervisor(t, targetURL)
+
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_RETRIES", "0",
+		"UPSTREAM_ALLOWED_HOSTS", "localhost", "UPSTREAM_ALLOW_PRIVATE", "true")
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("allowed host: status = %d, want 200", resp.StatusCode)
+	}
+	if got := decode(t, resp)["from"]; got != "target" {
+		t.Errorf("from = %v, want the answer of the redirect target", got)
+	}
+
+	gw = testGateway(t, "SUPERVISOR_URL", sup, "MAX_RETRIES", "0",
+		"UPSTREAM_ALLOWED_HOSTS", "supervisor.internal", "UPSTREAM_ALLOW_PRIVATE", "true")
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("host off the allowlist: status = %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestCallbackToPrivateAddressIsRefused(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	resp := postJSON(t, gw.URL+"/api/jobs", map[string]any{"goal": "tag volumes", "callback_url": "http://169.254.169.254/hook"})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", resp.StatusCode)
+	}
+	if got, _ := decode(t, resp)["error"].(string); !strings.HasPrefix(got, "callback_url: ") {
+		t.Errorf("error = %q, want it to name callback_url", got)
+	}
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(receiver.Close)
+	hook := strings.Replace(receiver.URL, "127.0.0.1", "localhost", 1) + "/hook"
+	if resp := postJSON(t, gw.URL+"/api/jobs", map[string]any{"goal": "tag volumes", "callback_url": hook}); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("localhost callback: status = %d, want 403", resp.StatusCode)
+	}
+	gw = testGateway(t, "SUPERVISOR_URL", sup, "UPSTREAM_ALLOW_PRIVATE", "true")
+	submitJob(t, gw.URL, map[string]any{"goal": "tag volumes", "callback_url": hook})
+}
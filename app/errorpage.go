@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// errorPage is the ERROR_PAGE HTML served to browsers in place of the JSON
+// error when a run fails in or beyond the supervisor; nil when unset.
+var errorPage []byte
+
+func loadErrorPage(path string) error {
+	errorPage = nil
+	if path == "" {
+		return nil
+	}
+	page, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("ERROR_PAGE: %w", err)
+	}
+	errorPage = page
+	return nil
+}
+
+// wantsHTML reports whether the client is a browser asking for a page
+// rather than an API client expecting JSON.
+func wantsHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/html") && !strings.Contains(accept, "application/json")
+}
+
+// serveErrorPage answers with errorPage and the failing status when one is
+// set and the client wants HTML, reporting whether it did.
+func serveErrorPage(w http.ResponseWriter, r *http.Request, code int) bool {
+	if errorPage == nil || !wantsHTML(r) {
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(errorPage)
+	return true
+}
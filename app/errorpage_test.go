@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const browserAccept = "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"
+
+func TestErrorPage(t *testing.T) {
+	page := filepath.Join(t.TempDir(), "error.html")
+	if err := os.WriteFile(page, []byte("<h1>We'll be right back</h1>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name, supervisor string
+		status           int
+	}{
+		{"supervisor down", "http://127.0.0.1:1/run", http.StatusBadGateway},
+		{"supervisor failing", "", http.StatusInternalServerError},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sup := tc.supervisor
+			if sup == "" {
+				sup = fakeSupervisor(t, answer(tc.status, map[string]any{"error": "boom"}))
+			}
+			gw := testGateway(t, "SUPERVISOR_URL", sup, "ERROR_PAGE", page, "MAX_RETRIES", "0")
+
+			resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, "Accept", browserAccept)
+			if resp.StatusCode != tc.status {
+				t.Errorf("browser: status = %d, want %d", resp.StatusCode, tc.status)
+			}
+			if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+				t.Errorf("browser: Content-Type = %q, want HTML", ct)
+			}
+			if b, _ := io.ReadAll(resp.Body); string(b) != "<h1>We'll be right back</h1>" {
+				t.Errorf("browser: body = %q, want the error page", b)
+			}
+
+			for _, accept := range []string{"application/json", "", "text/html, application/json"} {
+				resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, "Accept", accept)
+				if resp.StatusCode != tc.status {
+					t.Errorf("Accept %q: status = %d, want %d", accept, resp.StatusCode, tc.status)
+				}
+				if decode(t, resp)["error"] == nil {
+					t.Errorf("Accept %q: no JSON error", accept)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorPageOnlyForFailures(t *testing.T) {
+	page := filepath.Join(t.TempDir(), "error.html")
+	os.WriteFile(page, []byte("<h1>down</h1>"), 0o600)
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		if goalOf(r) == "delete everything" {
+			answer(http.StatusBadRequest, map[string]any{"error": "refused"})(w, r)
+			return
+		}
+		answer(http.StatusOK, map[string]any{"status": "done"})(w, r)
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "ERROR_PAGE", page)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, "Accept", browserAccept)
+	if b, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || strings.Contains(string(b), "<h1>") {
+		t.Errorf("a successful run: status %d, body %q, want the supervisor's answer", resp.StatusCode, b)
+	}
+	resp = postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "delete everything"}, "Accept", browserAccept)
+	if resp.StatusCode != http.StatusBadRequest || decode(t, resp)["error"] == nil {
+		t.Errorf("a 400 from the supervisor: status %d, want it relayed as JSON", resp.StatusCode)
+	}
+
+	gw = testGateway(t, "SUPERVISOR_URL", "http://127.0.0.1:1/run", "ERROR_PAGE", "")
+	resp = postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, "Accept", browserAccept)
+	if decode(t, resp)["error"] == nil {
+		t.Error("with ERROR_PAGE unset, a browser did not get the JSON error")
+	}
+}
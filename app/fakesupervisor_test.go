@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startFakeSupervisor builds cmd/fakesupervisor and runs it with args,
+// returning its run URL once it answers /health.
+func startFakeSupervisor(t *testing.T, bin string, args ...string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	cmd := exec.Command(bin, append([]string{"-addr", addr}, args...)...)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	base := "http://" + addr
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if resp, err := http.Get(base + "/health"); err == nil {
+			resp.Body.Close()
+			return base + "/run"
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the fake supervisor never came up")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestFakeSupervisorEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds cmd/fakesupervisor")
+	}
+	bin := filepath.Join(t.TempDir(), "fakesupervisor")
+	if out, err := exec.Command("go", "build", "-o", bin, "./cmd/fakesupervisor").CombinedOutput(); err != nil {
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+
+	sup := startFakeSupervisor(t, bin, "-answer", "42 buckets")
+	gw := testGateway(t, "SUPERVISOR_URL", sup+"?delay=50ms")
+	start := time.Now()
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "count buckets", "thread_id": "t-1"})
+	got := decode(t, resp)
+	if resp.StatusCode != http.StatusOK || got["answer"] != "42 buckets" || got["goal"] != "count buckets" || got["thread_id"] != "t-1" {
+		t.Errorf("run: status = %d, body = %v, want the canned answer", resp.StatusCode, got)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("run took %v, want at least the ?delay= of 50ms", d)
+	}
+
+	stream := startFakeSupervisor(t, bin, "-stream", "-progress", "2")
+	gw = testGateway(t, "SUPERVISOR_URL", stream, "SUPERVISOR_FORMAT", "ndjson")
+	if got := decode(t, postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "count buckets"})); got["ok"] != true || got["progress"] != nil {
+		t.Errorf("ndjson run: body = %v, want the final result", got)
+	}
+
+	failing := startFakeSupervisor(t, bin, "-status", "500")
+	gw = testGateway(t, "SUPERVISOR_URL", failing, "MAX_RETRIES", "0", "SUPERVISOR_FORMAT", "")
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "count buckets"}); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("-status 500: status = %d, want 500", resp.StatusCode)
+	}
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"message": " "}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("no goal: status = %d, want the gateway's 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// goalTemplate is GOAL_TEMPLATE, a text/template every goal is rendered
+// through before it is forwarded, e.g. to add a standard preamble; nil
+// forwards goals verbatim.
+var goalTemplate *template.Template
+
+// goalData is what GOAL_TEMPLATE sees.
+type goalData struct {
+	Goal string
+}
+
+// loadGoalTemplate parses src and renders a sample goal through it, so a
+// template naming a field that doesn't exist fails at startup rather than
+// on the first run.
+func loadGoalTemplate(src string) error {
+	goalTemplate = nil
+	if src == "" {
+		return nil
+	}
+	t, err := template.New("goal").Parse(src)
+	if err != nil {
+		return fmt.Errorf("GOAL_TEMPLATE: %w", err)
+	}
+	if err := t.Execute(&strings.Builder{}, goalData{Goal: "example"}); err != nil {
+		return fmt.Errorf("GOAL_TEMPLATE: %w", err)
+	}
+	goalTemplate = t
+	return nil
+}
+
+// renderGoal returns goal as the supervisor should receive it.
+func renderGoal(goal string) (string, error) {
+	if goalTemplate == nil {
+		return goal, nil
+	}
+	var b strings.Builder
+	if err := goalTemplate.Execute(&b, goalData{Goal: goal}); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
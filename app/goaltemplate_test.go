@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// forwardedGoal runs goal through gw and returns the goal the supervisor got.
+func forwardedGoal(t *testing.T, gw string, seen chan seenRequest, goal string) string {
+	t.Helper()
+	if resp := postJSON(t, gw+"/api/run", map[string]any{"goal": goal}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var fwd map[string]any
+	if err := json.Unmarshal(nextRequest(t, seen).body, &fwd); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := fwd["goal"].(string)
+	return got
+}
+
+func TestGoalTemplate(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "GOAL_TEMPLATE", "You run in production. Never delete data.\n\nTask: {{.Goal}}")
+
+	got := forwardedGoal(t, gw.URL, seen, "rotate the logs")
+	if want := "You run in production. Never delete data.\n\nTask: rotate the logs"; got != want {
+		t.Errorf("forwarded goal = %q, want %q", got, want)
+	}
+}
+
+func TestGoalTemplateUnset(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	testGateway(t, "SUPERVISOR_URL", sup, "GOAL_TEMPLATE", "Task: {{.Goal}}")
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "GOAL_TEMPLATE", "")
+
+	if got := forwardedGoal(t, gw.URL, seen, "rotate the logs"); got != "rotate the logs" {
+		t.Errorf("forwarded goal = %q, want it verbatim", got)
+	}
+}
+
+func TestGoalTemplateFailsFast(t *testing.T) {
+	for _, src := range []string{"Task: {{.Goal", "Task: {{.Owner}}"} {
+		if err := loadGoalTemplate(src); err == nil || !strings.HasPrefix(err.Error(), "GOAL_TEMPLATE: ") {
+			t.Errorf("%q: err = %v, want a GOAL_TEMPLATE error", src, err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// forwardHeaders are the FORWARD_HEADERS copied from a run request onto the
+// supervisor call, in canonical form. Nothing is forwarded by default, and
+// Authorization only goes through when listed here; hop-by-hop headers never
+// do, see cleanHeaders.
+var forwardHeaders []string
+
+// hopHeaders are the RFC 7230 hop-by-hop headers: they describe one
+// connection, so a proxy must not pass them on.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// stripHeaders are the STRIP_HEADERS, in canonical form, that never reach
+// an upstream whoever set them.
+var stripHeaders []string
+
+// reservedHeaders are set by the gateway itself and never copied.
+var reservedHeaders = map[string]bool{
+	"Content-Encoding": true,
+	"Content-Length":   true,
+	"Content-Type":     true,
+	"Host":             true,
+	"X-Request-Id":     true,
+}
+
+func loadForwardHeaders(val string) {
+	forwardHeaders = nil
+	for _, h := range splitList(val) {
+		if h = http.CanonicalHeaderKey(h); !reservedHeaders[h] {
+			forwardHeaders = append(forwardHeaders, h)
+		}
+	}
+}
+
+func loadStripHeaders(val string) {
+	stripHeaders = nil
+	for _, h := range splitList(val) {
+		stripHeaders = append(stripHeaders, http.CanonicalHeaderKey(h))
+	}
+}
+
+// cleanHeaders removes from h the hop-by-hop headers, the ones its
+// Connection header names, any other Proxy-* header and STRIP_HEADERS.
+func cleanHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			h.Del(strings.TrimSpace(name))
+		}
+	}
+	for k := range h {
+		if slices.Contains(hopHeaders, k) || strings.HasPrefix(k, "Proxy-") || slices.Contains(stripHeaders, k) {
+			delete(h, k)
+		}
+	}
+}
+
+// newOutboundRequest builds every request the gateway sends upstream, to a
+// supervisor or a callback receiver, with header passed through
+// cleanHeaders.
+func newOutboundRequest(ctx context.Context, method, target string, body io.Reader, header http.Header) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	cleanHeaders(req.Header)
+	return req, nil
+}
+
+// forwardedHeaders starts the outbound header set for a run with the
+// allowlisted headers the client sent.
+func forwardedHeaders(r *http.Request) http.Header {
+	h := http.Header{}
+	for _, k := range forwardHeaders {
+		if v := r.Header.Values(k); len(v) > 0 {
+			h[k] = v
+		}
+	}
+	return h
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestForwardHeaders(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "FORWARD_HEADERS", "x-region, Keep-Alive")
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"},
+		"X-Region", "eu-west-1", "X-Debug", "1", "Authorization", "Bearer user-token", "Keep-Alive", "timeout=5")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	h := nextRequest(t, seen).header
+	if got := h.Get("X-Region"); got != "eu-west-1" {
+		t.Errorf("X-Region = %q, want it forwarded", got)
+	}
+	for _, name := range []string{"X-Debug", "Authorization", "Keep-Alive"} {
+		if got := h.Get(name); got != "" {
+			t.Errorf("%s = %q reached the supervisor", name, got)
+		}
+	}
+}
+
+func TestForwardHeadersAuthorizationWhenListed(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "FORWARD_HEADERS", "Authorization")
+
+	postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, "Authorization", "Bearer user-token")
+	if got := nextRequest(t, seen).header.Get("Authorization"); got != "Bearer user-token" {
+		t.Errorf("Authorization = %q, want it forwarded when listed", got)
+	}
+}
+
+func TestNoHeadersForwardedByDefault(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, "X-Region", "eu-west-1")
+	if got := nextRequest(t, seen).header.Get("X-Region"); got != "" {
+		t.Errorf("X-Region = %q reached the supervisor without FORWARD_HEADERS", got)
+	}
+}
+
+func TestStrippedHeadersNeverReachTheSupervisor(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup,
+		"FORWARD_HEADERS", "X-Region, X-Internal-Token, X-Hop, Connection, Proxy-Client, Keep-Alive",
+		"STRIP_HEADERS", "x-internal-token")
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"},
+		"X-Region", "eu-west-1", "X-Internal-Token", "secret", "X-Hop", "1",
+		"Connection", "X-Hop", "Proxy-Client", "10.0.0.1", "Keep-Alive", "timeout=5")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	h := nextRequest(t, seen).header
+	if got := h.Get("X-Region"); got != "eu-west-1" {
+		t.Errorf("X-Region = %q, want it forwarded", got)
+	}
+	// Forwarding a header does not let it past the cleaner.
+	for _, name := range []string{"X-Internal-Token", "X-Hop", "Proxy-Client", "Keep-Alive"} {
+		if got := h.Get(name); got != "" {
+			t.Errorf("%s = %q reached the supervisor", name, got)
+		}
+	}
+}
+
+func TestNewOutboundRequestCleansHeaders(t *testing.T) {
+	loadStripHeaders("X-Internal-Token")
+	t.Cleanup(func() { loadStripHeaders("") })
+	header := http.Header{}
+	for k, v := range map[string]string{
+		"Connection": "close, X-Hop", "X-Hop": "1", "Keep-Alive": "timeout=5", "Te": "trailers",
+		"Transfer-Encoding": "chunked", "Upgrade": "websocket", "Proxy-Authorization": "Basic eDp5",
+		"Proxy-Anything": "1", "X-Internal-Token": "secret", "X-Region": "eu-west-1",
+	} {
+		header.Set(k, v)
+	}
+
+	req, err := newOutboundRequest(t.Context(), http.MethodPost, "http://supervisor/run", nil, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Header) != 1 || req.Header.Get("X-Region") != "eu-west-1" {
+		t.Errorf("outbound headers = %v, want only X-Region", req.Header)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	probeTimeout = 2 * time.Second
+	probeTTL     = 2 * time.Second
+)
+
+// draining flips once shutdown starts so readiness fails while requests finish.
+var draining atomic.Bool
+
+// probeCache remembers the last supervisor probe so bursts of health checks
+// only reach the supervisor once per probeTTL.
+var probeCache struct {
+	sync.Mutex
+	at       time.Time
+	backends []backendHealth
+	overall  string
+}
+
+// backendHealth is one default backend's probe result.
+type backendHealth struct {
+	URL    string `json:"url"`
+	Status string `json:"status"` // "up" or "down"
+	Error  string `json:"error,omitempty"`
+}
+
+// Overall supervisor states reported by /api/health and /api/readyz.
+const (
+	healthOK       = "ok"       // every backend is up
+	healthDegraded = "degraded" // some are down, runs still go through
+	healthDown     = "down"     // none is up
+)
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	resp := map[string]any{
+		"ok":                 true,
+		"sup":                supervisors[0],
+		"supervisors":        supervisors,
+		"supervisor":         "up",
+		"inflight":           inflightRuns(),
+		"pools":              inflightByPool(),
+		"circuit":            breaker.State(),
+		"providers":          configuredProviders(),
+		"disabled_providers": disabledProviders(),
+	}
+	code := http.StatusOK
+	backends, overall := probeSupervisors(r.Context())
+	resp["status"] = overall
+	resp["backends"] = backends
+	if overall == healthDown {
+		resp["ok"] = false
+		resp["supervisor"] = "down"
+		resp["error"] = backends[0].Error
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, resp)
+}
+
+// handleLivez reports that the process is up, without touching the supervisor.
+func handleLivez(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+}
+
+// handleReadyz reports whether this instance should receive traffic.
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if draining.Load() || drained.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"ok": false, "draining": true})
+		return
+	}
+	backends, overall := probeSupervisors(r.Context())
+	if overall == healthDown {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{
+			"ok": false, "supervisor": "down", "error": backends[0].Error, "status": overall, "backends": backends,
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"ok": true, "status": overall, "backends": backends})
+}
+
+// probeSupervisors checks every default backend concurrently and sums them
+// up as healthOK, healthDegraded or healthDown, serving a cached result when
+// the last probe is recent enough.
+func probeSupervisors(ctx context.Context) ([]backendHealth, string) {
+	probeCache.Lock()
+	defer probeCache.Unlock()
+	if !probeCache.at.IsZero() && time.Since(probeCache.at) < probeTTL {
+		return probeCache.backends, probeCache.overall
+	}
+
+	backends := make([]backendHealth, len(supervisors))
+	var wg sync.WaitGroup
+	for i, target := range supervisors {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			backends[i] = backendHealth{URL: target, Status: "up"}
+			if err := probe(ctx, target); err != nil {
+				backends[i].Status, backends[i].Error = "down", err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	up := 0
+	for _, b := range backends {
+		if b.Status == "up" {
+			up++
+		}
+	}
+	overall := healthDegraded
+	switch up {
+	case len(backends):
+		overall = healthOK
+	case 0:
+		overall = healthDown
+	}
+	probeCache.at, probeCache.backends, probeCache.overall = time.Now(), backends, overall
+	return backends, overall
+}
+
+// probe GETs /health on the supervisor's base URL: the run URL without
+// supervisorRunPath, or the bare host when the URL doesn't end in it. Any
+// answer below 500 counts as up.
+func probe(ctx context.Context, target string) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	prefix := ""
+	if run := "/" + strings.Trim(supervisorRunPath, "/"); run != "/" && strings.HasSuffix(strings.TrimRight(u.Path, "/"), run) {
+		prefix = strings.TrimSuffix(strings.TrimRight(u.Path, "/"), run)
+	}
+	base := url.URL{Scheme: u.Scheme, Host: u.Host, Path: joinPath(prefix, "/health")}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	req, err := newOutboundRequest(ctx, http.MethodGet, base.String(), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	drainBody(resp)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("%s answered %d", base.String(), resp.StatusCode)
+	}
+	return nil
+}
+
+// startupCheck probes every default backend once before the gateway starts
+// serving, so a wrong SUPERVISOR_URL shows up at deploy time rather than on
+// the first run.
+func startupCheck(ctx context.Context) error {
+	var errs []error
+	for _, target := range supervisors {
+		if err := probe(ctx, target); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkAtStartup runs startupCheck when STARTUP_CHECK is on. Unreachable
+// supervisors are only a warning, unless STARTUP_CHECK_FATAL makes them the
+// error main exits with.
+func checkAtStartup(ctx context.Context) error {
+	if getenv("STARTUP_CHECK", "") != "true" {
+		return nil
+	}
+	err := startupCheck(ctx)
+	if err != nil && getenv("STARTUP_CHECK_FATAL", "") == "true" {
+		return err
+	}
+	if err != nil {
+		logger.Warn("startup check found unreachable supervisors", "err", err)
+	}
+	return nil
+}
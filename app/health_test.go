@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthReportsDownSupervisor(t *testing.T) {
+	sup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(sup.Close)
+	gw := testGateway(t, "SUPERVISOR_URL", sup.URL+"/run")
+
+	resp := get(t, gw.URL+"/api/health")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", resp.StatusCode)
+	}
+	body := decode(t, resp)
+	if body["ok"] != false || body["supervisor"] != "down" || body["error"] == nil {
+		t.Errorf("body = %v, want ok false, supervisor down and an error", body)
+	}
+}
+
+func TestLivezAndReadyz(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	check := func(path string, want int) {
+		t.Helper()
+		if resp := get(t, gw.URL+path); resp.StatusCode != want {
+			t.Errorf("%s status = %d, want %d", path, resp.StatusCode, want)
+		}
+	}
+	check("/api/livez", http.StatusOK)
+	check("/api/readyz", http.StatusOK)
+
+	draining.Store(true)
+	check("/api/livez", http.StatusOK)
+	check("/api/readyz", http.StatusServiceUnavailable)
+}
+
+func TestStartupCheck(t *testing.T) {
+	up := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	for _, tc := range []struct {
+		supervisor, fatal string
+		wantErr           bool
+	}{
+		{"http://127.0.0.1:1/run", "true", true},
+		{"http://127.0.0.1:1/run", "", false},
+		{up, "true", false},
+	} {
+		testGateway(t, "SUPERVISOR_URL", tc.supervisor, "STARTUP_CHECK", "true", "STARTUP_CHECK_FATAL", tc.fatal)
+		logs := captureLogs(t)
+		err := checkAtStartup(context.Background())
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s, fatal %q: err = %v, want error %v", tc.supervisor, tc.fatal, err, tc.wantErr)
+		}
+		warned := logs.find("startup check found unreachable supervisors") != nil
+		if want := tc.supervisor != up && !tc.wantErr; warned != want {
+			t.Errorf("%s, fatal %q: warned = %v, want %v", tc.supervisor, tc.fatal, warned, want)
+		}
+	}
+
+	testGateway(t, "SUPERVISOR_URL", "http://127.0.0.1:1/run", "STARTUP_CHECK", "", "STARTUP_CHECK_FATAL", "true")
+	if err := checkAtStartup(context.Background()); err != nil {
+		t.Errorf("without STARTUP_CHECK: err = %v, want none", err)
+	}
+}
+
+func TestHealthAggregatesBackends(t *testing.T) {
+	up := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	up2 := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	down := "http://127.0.0.1:1/run"
+
+	for _, tc := range []struct {
+		name     string
+		backends []string
+		status   string
+		code     int
+	}{
+		{"all up", []string{up, up2}, healthOK, http.StatusOK},
+		{"one down", []string{up, down}, healthDegraded, http.StatusOK},
+		{"all down", []string{down, "http://127.0.0.1:2/run"}, healthDown, http.StatusServiceUnavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gw := testGateway(t, "SUPERVISOR_URL", strings.Join(tc.backends, ","))
+			for _, path := range []string{"/api/health", "/api/readyz"} {
+				resp := get(t, gw.URL+path)
+				if resp.StatusCode != tc.code {
+					t.Errorf("%s: status = %d, want %d", path, resp.StatusCode, tc.code)
+				}
+				body := decode(t, resp)
+				if body["status"] != tc.status {
+					t.Errorf("%s: status = %v, want %s", path, body["status"], tc.status)
+				}
+				backends, _ := body["backends"].([]any)
+				if len(backends) != len(tc.backends) {
+					t.Fatalf("%s: backends = %v, want one per supervisor", path, body["backends"])
+				}
+				for i, b := range backends {
+					b := b.(map[string]any)
+					want := "up"
+					if tc.backends[i] != up && tc.backends[i] != up2 {
+						want = "down"
+					}
+					if b["url"] != tc.backends[i] || b["status"] != want {
+						t.Errorf("%s: backend %d = %v, want %s %s", path, i, b, tc.backends[i], want)
+					}
+					if (b["error"] != nil) != (want == "down") {
+						t.Errorf("%s: backend %d error = %v", path, i, b["error"])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestHealthProbesBackendsConcurrently(t *testing.T) {
+	var backends []string
+	for range 3 {
+		backends = append(backends, fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(300 * time.Millisecond)
+		}))
+	}
+	gw := testGateway(t, "SUPERVISOR_URL", strings.Join(backends, ","))
+
+	start := time.Now()
+	if resp := get(t, gw.URL+"/api/health"); decode(t, resp)["status"] != healthOK {
+		t.Fatal("status is not ok")
+	}
+	if took := time.Since(start); took > 800*time.Millisecond {
+		t.Errorf("health took %v, want the backends probed at once", took)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxHistoryGoal bounds the goal text kept per history entry, in characters.
+const maxHistoryGoal = 200
+
+type historyEntry struct {
+	RequestID  string    `json:"request_id"`
+	RunID      string    `json:"run_id,omitempty"`
+	Time       time.Time `json:"time"`
+	Goal       string    `json:"goal"`
+	Provider   string    `json:"provider,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+	Status     int       `json:"status"`
+	DurationMS float64   `json:"duration_ms"`
+
+	// tenant and principal are who ran it; only they are shown the entry.
+	tenant, principal string
+}
+
+// visibleTo reports whether r comes from the tenant and principal that made
+// the run, so one caller can't read another's goals.
+func (e historyEntry) visibleTo(r *http.Request) bool {
+	return e.tenant == tenantOf(r) && e.principal == requestContext(r.Context()).principal()
+}
+
+// history is a ring buffer of the last HISTORY_SIZE runs, indexed by run ID.
+// It lives in memory only and starts empty on every restart.
+var history struct {
+	mu      sync.Mutex
+	entries []historyEntry
+	byRunID map[string]int // run ID → index into entries
+	next    int
+	full    bool
+}
+
+func initHistory(size int) {
+	history.entries = make([]historyEntry, max(size, 0))
+	history.byRunID = map[string]int{}
+	history.next, history.full = 0, false
+}
+
+func recordHistory(r *http.Request, runID, goal string, tags []string, status int, start time.Time) {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	if len(history.entries) == 0 {
+		return
+	}
+	delete(history.byRunID, history.entries[history.next].RunID)
+	if runID != "" {
+		history.byRunID[runID] = history.next
+	}
+	history.entries[history.next] = historyEntry{
+		RequestID:  requestID(r.Context()),
+		RunID:      runID,
+		Time:       start.UTC(),
+		Goal:       loggableGoal(goal, maxHistoryGoal),
+		Provider:   requestContext(r.Context()).provider(),
+		Tags:       tags,
+		Status:     status,
+		DurationMS: float64(time.Since(start).Microseconds()) / 1000,
+		tenant:     tenantOf(r),
+		principal:  requestContext(r.Context()).principal(),
+	}
+	history.next = (history.next + 1) % len(history.entries)
+	if history.next == 0 {
+		history.full = true
+	}
+}
+
+// recentRuns returns the buffered runs, newest first.
+func recentRuns() []historyEntry {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	n := history.next
+	if history.full {
+		n = len(history.entries)
+	}
+	out := make([]historyEntry, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, history.entries[(history.next-i+len(history.entries))%len(history.entries)])
+	}
+	return out
+}
+
+// historyRun returns the buffered run with the given run ID.
+func historyRun(runID string) (historyEntry, bool) {
+	history.mu.Lock()
+	defer history.mu.Unlock()
+	i, ok := history.byRunID[runID]
+	if !ok {
+		return historyEntry{}, false
+	}
+	return history.entries[i], true
+}
+
+// handleHistory serves GET /api/history, the caller's own recent runs.
+// ?provider= and ?status= keep the runs matching them, and each ?tag= the
+// runs carrying that tag.
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	status := 0
+	if v := q.Get("status"); v != "" {
+		var err error
+		if status, err = strconv.Atoi(v); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid status")
+			return
+		}
+	}
+	provider, tags := strings.ToLower(strings.TrimSpace(q.Get("provider"))), q["tag"]
+	runs := slices.DeleteFunc(recentRuns(), func(e historyEntry) bool {
+		if !e.visibleTo(r) || provider != "" && e.Provider != provider || status != 0 && e.Status != status {
+			return true
+		}
+		for _, t := range tags {
+			if !slices.Contains(e.Tags, t) {
+				return true
+			}
+		}
+		return false
+	})
+	writeJSON(w, http.StatusOK, map[string]any{"runs": runs})
+}
+
+// handleHistoryRun serves GET /api/runs/{run_id}, the history entry of the
+// run whose response carried that run_id, while it is still buffered. Runs
+// made by another tenant or principal are not found.
+func handleHistoryRun(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	entry, ok := historyRun(r.PathValue("run_id"))
+	if !ok || !entry.visibleTo(r) {
+		writeError(w, http.StatusNotFound, "run not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, entry)
+}
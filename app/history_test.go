@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// historyGoals lists the goals /api/history shows the caller, newest first.
+func historyGoals(t *testing.T, gw string, header ...string) []string {
+	t.Helper()
+	runs, _ := decode(t, get(t, gw+"/api/history", header...))["runs"].([]any)
+	var goals []string
+	for _, r := range runs {
+		goals = append(goals, r.(map[string]any)["goal"].(string))
+	}
+	return goals
+}
+
+func TestHistoryListsRunsNewestFirst(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "API_KEYS", "key-one,key-two")
+	one, two := []string{"Authorization", "Bearer key-one"}, []string{"Authorization", "Bearer key-two"}
+
+	var runID string
+	for _, goal := range []string{"list buckets", "list queues"} {
+		resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": goal}, one...)
+		runID = resp.Header.Get("X-Run-ID")
+		resp.Body.Close()
+	}
+	if got := historyGoals(t, gw.URL, one...); len(got) != 2 || got[0] != "list queues" || got[1] != "list buckets" {
+		t.Errorf("history = %q, want both runs, newest first", got)
+	}
+	if resp := get(t, gw.URL+"/api/runs/"+runID, one...); resp.StatusCode != http.StatusOK {
+		t.Errorf("own run status = %d, want 200", resp.StatusCode)
+	}
+
+	// Another caller sees none of it.
+	if got := historyGoals(t, gw.URL, two...); len(got) != 0 {
+		t.Errorf("another key's history = %q, want none", got)
+	}
+	if resp := get(t, gw.URL+"/api/runs/"+runID, two...); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("another key's run status = %d, want 404", resp.StatusCode)
+	}
+}
+
+// historyFiltered lists the goals /api/history shows for query.
+func historyFiltered(t *testing.T, gw, query string) []string {
+	t.Helper()
+	resp := get(t, gw+"/api/history?"+query)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("?%s: status = %d, want 200", query, resp.StatusCode)
+	}
+	runs, _ := decode(t, resp)["runs"].([]any)
+	var goals []string
+	for _, r := range runs {
+		goals = append(goals, r.(map[string]any)["goal"].(string))
+	}
+	return goals
+}
+
+func TestHistoryFilters(t *testing.T) {
+	supervisor := func(w http.ResponseWriter, r *http.Request) {
+		var req runReq
+		json.NewDecoder(r.Body).Decode(&req)
+		if strings.HasPrefix(req.goal(), "fail") {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"error": "boom"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	}
+	aws, gcp := fakeSupervisor(t, supervisor), fakeSupervisor(t, supervisor)
+	gw := testGateway(t, "SUPERVISOR_AWS", aws, "SUPERVISOR_GCP", gcp, "MAX_RETRIES", "0")
+
+	var tagged string
+	for _, run := range []map[string]any{
+		{"goal": "list buckets", "provider": "aws", "tags": []string{"team:infra", "env:staging"}},
+		{"goal": "list vms", "provider": "gcp", "tags": []string{"team:data"}},
+		{"goal": "fail over the db", "provider": "aws", "tags": []string{"team:infra"}},
+		{"goal": "fail the vm check", "provider": "gcp"},
+	} {
+		resp := postJSON(t, gw.URL+"/api/run", run)
+		if run["goal"] == "list buckets" {
+			tagged = resp.Header.Get("X-Run-ID")
+		}
+		resp.Body.Close()
+	}
+
+	entry := decode(t, get(t, gw.URL+"/api/runs/"+tagged))
+	if tags, _ := entry["tags"].([]any); len(tags) != 2 || tags[0] != "team:infra" || tags[1] != "env:staging" {
+		t.Errorf("stored tags = %v, want [team:infra env:staging]", entry["tags"])
+	}
+
+	for query, want := range map[string][]string{
+		"":                                       {"fail the vm check", "fail over the db", "list vms", "list buckets"},
+		"tag=team:infra":                         {"fail over the db", "list buckets"},
+		"tag=team:infra&tag=env:staging":         {"list buckets"},
+		"tag=team:ops":                           nil,
+		"provider=aws":                           {"fail over the db", "list buckets"},
+		"provider=GCP":                           {"fail the vm check", "list vms"},
+		"status=500":                             {"fail the vm check", "fail over the db"},
+		"status=200&provider=gcp":                {"list vms"},
+		"provider=aws&status=500&tag=team:infra": {"fail over the db"},
+		"provider=gcp&tag=team:infra":            nil,
+	} {
+		if got := historyFiltered(t, gw.URL, query); !slices.Equal(got, want) {
+			t.Errorf("?%s = %q, want %q", query, got, want)
+		}
+	}
+	if resp := get(t, gw.URL+"/api/history?status=bad"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("?status=bad: status = %d, want 400", resp.StatusCode)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxIdempotentBody is the largest response kept for replay.
+const maxIdempotentBody = 10 << 20
+
+// idempotencyTTL is how long a response stays replayable; IDEMPOTENCY_TTL.
+var idempotencyTTL time.Duration
+
+type idempotentEntry struct {
+	bodyHash    [32]byte
+	status      int
+	contentType string
+	body        []byte
+	expires     time.Time
+	ready       chan struct{} // closed once the response is in, or the run ended without one
+}
+
+var idempotent = struct {
+	sync.Mutex
+	byKey map[string]*idempotentEntry
+}{byKey: map[string]*idempotentEntry{}}
+
+// replayIdempotent answers a repeated Idempotency-Key from the cache. It
+// reports false when the request must actually run.
+func replayIdempotent(w http.ResponseWriter, key string, bodyHash [32]byte) bool {
+	e, ok := lookupIdempotent(key)
+	if !ok {
+		return false
+	}
+	e.replay(w, bodyHash)
+	return true
+}
+
+// lookupIdempotent returns the unexpired entry kept for key. A key whose
+// run is still in flight has no entry yet.
+func lookupIdempotent(key string) (*idempotentEntry, bool) {
+	idempotent.Lock()
+	defer idempotent.Unlock()
+	e, ok := idempotent.byKey[key]
+	if ok && e.pending() {
+		return nil, false
+	}
+	if ok && time.Now().After(e.expires) {
+		delete(idempotent.byKey, key)
+		ok = false
+	}
+	return e, ok
+}
+
+// claimIdempotent is replayIdempotent for a run: when no response is kept
+// for key it reserves the key, so a concurrent request with the same key
+// waits for this one and replays its answer instead of reaching the
+// supervisor too. It returns the reserved entry, to be finished with
+// storeIdempotent, or nil once the request has been answered.
+func claimIdempotent(ctx context.Context, w http.ResponseWriter, key string, bodyHash [32]byte) *idempotentEntry {
+	for {
+		idempotent.Lock()
+		e, ok := idempotent.byKey[key]
+		if ok && !e.pending() && time.Now().After(e.expires) {
+			delete(idempotent.byKey, key)
+			ok = false
+		}
+		if !ok {
+			e = &idempotentEntry{bodyHash: bodyHash, ready: make(chan struct{})}
+			idempotent.byKey[key] = e
+			idempotent.Unlock()
+			return e
+		}
+		idempotent.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-e.ready:
+		}
+		// A run that left nothing to keep frees the key for the next try.
+		if e.status != 0 {
+			e.replay(w, bodyHash)
+			return nil
+		}
+	}
+}
+
+// pending reports whether e is reserved by a run that hasn't finished.
+func (e *idempotentEntry) pending() bool {
+	select {
+	case <-e.ready:
+		return false
+	default:
+		return true
+	}
+}
+
+// replay writes the kept response, or a 422 when the repeated request's
+// body differs from the original's.
+func (e *idempotentEntry) replay(w http.ResponseWriter, bodyHash [32]byte) {
+	if e.bodyHash != bodyHash {
+		writeError(w, http.StatusUnprocessableEntity, "idempotency key reused with different body")
+		return
+	}
+	w.Header().Set("Content-Type", e.contentType)
+	w.Header().Set("X-Idempotent-Replay", "true")
+	w.WriteHeader(e.status)
+	w.Write(e.body)
+}
+
+// storeIdempotent remembers a finished response for replay in the entry
+// claimIdempotent reserved, and releases the requests waiting on it.
+// Gateway and supervisor 5xx answers are not kept so the client can retry
+// them.
+func storeIdempotent(key string, e *idempotentEntry, c *captureWriter) {
+	if c.status == 0 || c.status >= http.StatusInternalServerError || c.overflow {
+		idempotent.Lock()
+		if idempotent.byKey[key] == e {
+			delete(idempotent.byKey, key)
+		}
+		idempotent.Unlock()
+		close(e.ready)
+		return
+	}
+	e.status = c.status
+	e.contentType = c.Header().Get("Content-Type")
+	e.body = c.buf.Bytes()
+	keepIdempotent(key, e)
+}
+
+// keepIdempotent stores e under key for idempotencyTTL, dropping expired
+// entries on the way.
+func keepIdempotent(key string, e *idempotentEntry) {
+	now := time.Now()
+	idempotent.Lock()
+	defer idempotent.Unlock()
+	for k, e := range idempotent.byKey {
+		if !e.pending() && now.After(e.expires) {
+			delete(idempotent.byKey, k)
+		}
+	}
+	e.expires = now.Add(idempotencyTTL)
+	idempotent.byKey[key] = e
+	if e.ready == nil {
+		e.ready = make(chan struct{})
+	}
+	close(e.ready)
+}
+
+// captureWriter tees a response into memory while it is being sent.
+type captureWriter struct {
+	http.ResponseWriter
+	status   int
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (c *captureWriter) WriteHeader(code int) {
+	if c.status == 0 {
+		c.status = code
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if !c.overflow {
+		if c.buf.Len()+len(b) > maxIdempotentBody {
+			c.overflow = true
+			c.buf.Reset()
+		} else {
+			c.buf.Write(b)
+		}
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *captureWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *captureWriter) Unwrap() http.ResponseWriter { return c.ResponseWriter }
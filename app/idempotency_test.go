@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	var calls atomic.Int32
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		answer(http.StatusOK, map[string]any{"ok": true, "call": n})(w, r)
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "IDEMPOTENCY_TTL", "200ms")
+	create := map[string]any{"goal": "create a bucket"}
+	key := "Idempotency-Key"
+
+	first := postJSON(t, gw.URL+"/api/run", create, key, "k-1")
+	firstBody := body(t, first)
+	again := postJSON(t, gw.URL+"/api/run", create, key, "k-1")
+	if again.Header.Get("X-Idempotent-Replay") != "true" || body(t, again) != firstBody {
+		t.Errorf("repeat = %q replay=%q, want %q replayed", body(t, again), again.Header.Get("X-Idempotent-Replay"), firstBody)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("supervisor called %d times, want 1", n)
+	}
+
+	other := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "delete a bucket"}, key, "k-1")
+	if other.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("reused key with another body status = %d, want 422", other.StatusCode)
+	} else if msg := decode(t, other)["error"]; msg != "idempotency key reused with different body" {
+		t.Errorf("error = %v", msg)
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	expired := postJSON(t, gw.URL+"/api/run", create, key, "k-1")
+	if expired.Header.Get("X-Idempotent-Replay") != "" || calls.Load() != 2 {
+		t.Errorf("after IDEMPOTENCY_TTL: replay=%q calls=%d, want a fresh run", expired.Header.Get("X-Idempotent-Replay"), calls.Load())
+	}
+}
+
+func TestIdempotencyKeyConcurrent(t *testing.T) {
+	sup, calls, release := heldSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	key := []string{"Idempotency-Key", "k-2"}
+	bodies, _ := runsTogether(t, gw.URL, calls, release, key, key)
+	if n := calls.Load(); n != 1 {
+		t.Errorf("supervisor called %d times, want 1", n)
+	}
+	if bodies[1] != bodies[0] {
+		t.Errorf("bodies = %q, want the first run's answer replayed", bodies)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// maxProgressLine bounds a buffered partial supervisor line; longer lines
+// are not inspected for progress.
+const maxProgressLine = 64 << 10
+
+// progressReader watches a job's supervisor body as it is read and records
+// each {"progress":...} line on the job, numbering the updates.
+type progressReader struct {
+	io.ReadCloser
+	jobID string
+	line  []byte
+	long  bool // the current line outgrew maxProgressLine
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	chunk := b[:n]
+	for len(chunk) > 0 {
+		i := bytes.IndexByte(chunk, '\n')
+		if i < 0 {
+			p.buffer(chunk)
+			break
+		}
+		p.buffer(chunk[:i])
+		if !p.long {
+			p.record(p.line)
+		}
+		p.line, p.long = p.line[:0], false
+		chunk = chunk[i+1:]
+	}
+	return n, err
+}
+
+func (p *progressReader) buffer(b []byte) {
+	if p.long || len(p.line)+len(b) > maxProgressLine {
+		p.long = true
+		return
+	}
+	p.line = append(p.line, b...)
+}
+
+func (p *progressReader) record(line []byte) {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(bytes.TrimSpace(line), &obj) != nil {
+		return
+	}
+	if _, ok := obj["progress"]; !ok {
+		return
+	}
+	snapshot := json.RawMessage(bytes.Clone(bytes.TrimSpace(line)))
+	updateJob(p.jobID, func(j *job) {
+		j.Progress = snapshot
+		j.ProgressSeq++
+	})
+}
+
+// handleJobProgress serves GET /api/jobs/{id}/progress: the latest progress
+// line the supervisor sent for the job and its sequence number. With
+// ?since=N it answers 204 until there is an update newer than N.
+func handleJobProgress(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	since := -1
+	if v := r.URL.Query().Get("since"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, "invalid since")
+			return
+		}
+		since = n
+	}
+	j, ok := jobStore.Get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if j.ProgressSeq <= since {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"job_id":   j.ID,
+		"status":   j.Status,
+		"seq":      j.ProgressSeq,
+		"progress": j.Progress,
+	})
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	gwclient "mcpgui/client"
+)
+
+const (
+	jobPending     = gwclient.JobPending
+	jobRunning     = gwclient.JobRunning
+	jobDone        = gwclient.JobDone
+	jobError       = gwclient.JobError
+	jobCanceled    = gwclient.JobCanceled
+	jobInterrupted = gwclient.JobInterrupted
+)
+
+// job is an asynchronous /api/run whose result is fetched by polling.
+type job struct {
+	gwclient.Job
+
+	callbackURL string
+}
+
+// jobs serializes job updates and holds the cancel funcs of jobs in flight,
+// along with the Idempotency-Key each was submitted with. The jobs
+// themselves live in jobStore until they have been finished for longer than
+// jobTTL.
+var jobs = struct {
+	sync.Mutex
+	cancels map[string]context.CancelFunc
+	byKey   map[string]keyedJob // Idempotency-Key → job in flight
+	keys    map[string]string   // job ID → Idempotency-Key
+}{cancels: map[string]context.CancelFunc{}, byKey: map[string]keyedJob{}, keys: map[string]string{}}
+
+// keyedJob is a job in flight that was submitted with an Idempotency-Key.
+type keyedJob struct {
+	id       string
+	bodyHash [32]byte
+}
+
+// jobTTL is how long finished jobs stay pollable.
+var jobTTL time.Duration
+
+// jobTask is a submitted job waiting in jobQueue for a worker.
+type jobTask struct {
+	ctx  context.Context
+	id   string
+	call *upstreamCall
+}
+
+// jobQueue holds up to JOB_QUEUE_LEN jobs not yet picked up by one of the
+// JOB_WORKERS workers; POST /api/jobs answers 503 when it is full.
+var jobQueue chan jobTask
+
+// startJobWorkers creates jobQueue and runs workers that take jobs from it
+// until ctx is done. Each worker keeps to the queue it was started with, so
+// workers of an earlier call never see a later one. The returned func waits
+// for the workers, and the callbacks they started, to return.
+func startJobWorkers(ctx context.Context, workers, queueLen int) (wait func()) {
+	q := make(chan jobTask, queueLen)
+	jobQueue = q
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case t := <-q:
+					runJob(t.ctx, t.id, t.call)
+					// A slow or retrying receiver doesn't hold the worker
+					// back from the next job.
+					if j, ok := callbackDue(t.id); ok {
+						wg.Go(func() { notifyJob(context.Background(), j.callbackURL, j) })
+					}
+				}
+			}
+		})
+	}
+	return wg.Wait
+}
+
+// handleJobs serves POST /api/jobs, starting a supervisor run in the background.
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if safeMode {
+		writeError(w, http.StatusServiceUnavailable, "job creation disabled in safe mode")
+		return
+	}
+
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	var opts struct {
+		CallbackURL string `json:"callback_url"`
+	}
+	_ = json.Unmarshal(body, &opts)
+	if opts.CallbackURL != "" && !validCallbackURL(opts.CallbackURL) {
+		writeError(w, http.StatusBadRequest, "invalid callback_url")
+		return
+	}
+	if opts.CallbackURL != "" {
+		u, _ := url.Parse(opts.CallbackURL)
+		if _, err := checkDestination(r.Context(), u.Hostname()); errors.Is(err, errDestinationBlocked) {
+			writeError(w, http.StatusForbidden, "callback_url: "+err.Error())
+			return
+		}
+	}
+	_, call, verr := prepareRun(r, body)
+	if verr != nil {
+		verr.write(w)
+		return
+	}
+
+	key := r.Header.Get("Idempotency-Key")
+	sum := sha256.Sum256(call.body)
+	j := job{Job: gwclient.Job{ID: newID(), Status: jobPending, Created: time.Now().UTC()}, callbackURL: opts.CallbackURL}
+	jobs.Lock()
+	if key != "" && replayJob(w, key, sum) {
+		jobs.Unlock()
+		return
+	}
+	if err := jobStore.Save(j); err != nil {
+		jobs.Unlock()
+		logger.Error("job store failed", "job_id", j.ID, "err", err)
+		writeError(w, http.StatusInternalServerError, "could not store job")
+		return
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	select {
+	case jobQueue <- jobTask{ctx: ctx, id: j.ID, call: call}:
+	default:
+		cancel()
+		if err := jobStore.Delete(j.ID); err != nil {
+			logger.Error("job store failed", "job_id", j.ID, "err", err)
+		}
+		jobs.Unlock()
+		writeError(w, http.StatusServiceUnavailable, "job queue full")
+		return
+	}
+	jobs.cancels[j.ID] = cancel
+	if key != "" {
+		jobs.byKey[key] = keyedJob{id: j.ID, bodyHash: sum}
+		jobs.keys[j.ID] = key
+	}
+	jobs.Unlock()
+
+	w.Header().Set("Location", basePath+"/api/jobs/"+j.ID)
+	writeJSON(w, http.StatusAccepted, map[string]any{"job_id": j.ID})
+}
+
+// replayJob answers a submission whose Idempotency-Key belongs to a job in
+// flight with that job's ID, and one whose job already finished from the
+// idempotency cache. It reports false when the job must be created. The
+// caller holds the jobs lock, so two submissions can't both start one.
+func replayJob(w http.ResponseWriter, key string, bodyHash [32]byte) bool {
+	if kj, ok := jobs.byKey[key]; ok {
+		if kj.bodyHash != bodyHash {
+			writeError(w, http.StatusUnprocessableEntity, "idempotency key reused with different body")
+			return true
+		}
+		w.Header().Set("X-Idempotent-Replay", "true")
+		w.Header().Set("Location", basePath+"/api/jobs/"+kj.id)
+		writeJSON(w, http.StatusAccepted, map[string]any{"job_id": kj.id})
+		return true
+	}
+	return replayIdempotent(w, key, bodyHash)
+}
+
+// handleJob serves GET /api/jobs/{id} to poll a job and DELETE to cancel it.
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodGet, http.MethodDelete:
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	jobs.Lock()
+	j, ok := jobStore.Get(r.PathValue("id"))
+	if !ok {
+		jobs.Unlock()
+		writeError(w, http.StatusNotFound, "job not found")
+		return
+	}
+	if r.Method == http.MethodDelete {
+		if j.Status != jobPending && j.Status != jobRunning {
+			status := j.Status
+			jobs.Unlock()
+			writeJSON(w, http.StatusConflict, map[string]any{"error": "job already finished", "status": http.StatusConflict, "job_status": status})
+			return
+		}
+		finishJob(&j, jobCanceled)
+		saveJob(j)
+	}
+	jobs.Unlock()
+	writeJSON(w, http.StatusOK, j)
+}
+
+// runJob performs a job a worker has picked up, unless it was canceled
+// while it waited in jobQueue.
+func runJob(ctx context.Context, id string, call *upstreamCall) {
+	if ctx.Err() != nil {
+		return
+	}
+	defer call.spool()()
+	ctx, unwatch := watchRun(ctx)
+	defer unwatch()
+	updateJob(id, func(j *job) { j.Status = jobRunning })
+	status, out, err := execJob(ctx, id, call)
+	if err != nil {
+		if ctx.Err() == nil {
+			logger.Warn("job failed", "job_id", id, "err", err)
+		}
+		updateJob(id, func(j *job) {
+			j.Error = err.Error()
+			finishJob(j, jobError)
+		})
+		return
+	}
+	updateJob(id, func(j *job) {
+		j.HTTPStatus = status
+		j.Body = rawJSON(out)
+		finishJob(j, jobDone)
+	})
+}
+
+// callbackDue returns the job whose callback is to be delivered, once it
+// ended in done or error.
+func callbackDue(id string) (job, bool) {
+	j, ok := jobStore.Get(id)
+	return j, ok && j.callbackURL != "" && (j.Status == jobDone || j.Status == jobError)
+}
+
+// execJob waits for a supervisor slot, then performs the run.
+func execJob(ctx context.Context, id string, call *upstreamCall) (int, []byte, error) {
+	release, err := acquireRun(ctx, call.backends, call.priority)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer release()
+
+	resp, _, err := forward(ctx, call)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	if upstreamSuccess(resp.StatusCode) {
+		resp.Body = &progressReader{ReadCloser: resp.Body, jobID: id}
+		if err := collapseProgress(resp); err != nil {
+			return 0, nil, err
+		}
+		if err := processResponse(ctx, resp); err != nil {
+			return 0, nil, err
+		}
+	}
+	out, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, out, err
+}
+
+// updateJob applies fn to a job that is still in flight; jobs canceled in the
+// meantime keep their final state.
+func updateJob(id string, fn func(*job)) {
+	jobs.Lock()
+	defer jobs.Unlock()
+	if j, ok := jobStore.Get(id); ok && (j.Status == jobPending || j.Status == jobRunning) {
+		fn(&j)
+		saveJob(j)
+	}
+}
+
+// finishJob moves j to a terminal status. The caller holds the jobs lock.
+func finishJob(j *job, status string) {
+	now := time.Now().UTC()
+	j.Status = status
+	j.Finished = &now
+	if cancel, ok := jobs.cancels[j.ID]; ok {
+		cancel()
+		delete(jobs.cancels, j.ID)
+	}
+	if key, ok := jobs.keys[j.ID]; ok {
+		// A job that ran to the end stays the answer to its key; canceled
+		// or failed ones free it for a retry.
+		if status == jobDone {
+			body, _ := json.Marshal(map[string]any{"job_id": j.ID})
+			keepIdempotent(key, &idempotentEntry{bodyHash: jobs.byKey[key].bodyHash, status: http.StatusAccepted,
+				contentType: "application/json", body: append(body, '\n')})
+		}
+		delete(jobs.byKey, key)
+		delete(jobs.keys, j.ID)
+	}
+}
+
+// saveJob writes j back to jobStore. The caller holds the jobs lock.
+func saveJob(j job) {
+	if err := jobStore.Save(j); err != nil {
+		logger.Error("job store failed", "job_id", j.ID, "err", err)
+	}
+}
+
+// evictJobs drops finished jobs older than jobTTL until ctx is done.
+func evictJobs(ctx context.Context) {
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		cutoff := time.Now().Add(-jobTTL)
+		jobs.Lock()
+		for _, j := range jobStore.List() {
+			if j.Finished != nil && j.Finished.Before(cutoff) {
+				if err := jobStore.Delete(j.ID); err != nil {
+					logger.Error("job store failed", "job_id", j.ID, "err", err)
+				}
+			}
+		}
+		jobs.Unlock()
+	}
+}
+
+// rawJSON keeps a supervisor body as-is when it is JSON and wraps it as a
+// JSON string otherwise.
+func rawJSON(b []byte) json.RawMessage {
+	if json.Valid(b) {
+		return b
+	}
+	quoted, _ := json.Marshal(string(b))
+	return quoted
+}
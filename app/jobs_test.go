@@ -0,0 +1,272 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// submitJob starts a job and returns its ID.
+func submitJob(t *testing.T, gw string, body any, header ...string) string {
+	t.Helper()
+	resp := postJSON(t, gw+"/api/jobs", body, header...)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("POST /api/jobs status = %d, want 202", resp.StatusCode)
+	}
+	id, _ := decode(t, resp)["job_id"].(string)
+	if id == "" {
+		t.Fatal("no job_id")
+	}
+	return id
+}
+
+// pollJob polls a job until its status is want, or fails after a few
+// seconds.
+func pollJob(t *testing.T, gw, id, want string) map[string]any {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		j := decode(t, get(t, gw+"/api/jobs/"+id))
+		if j["status"] == want {
+			return j
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s is %v, want %s", id, j["status"], want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJobRunsToCompletion(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true, "answer": "42 buckets"}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	id := submitJob(t, gw.URL, map[string]any{"goal": "count buckets"})
+	j := pollJob(t, gw.URL, id, jobDone)
+	body, _ := j["body"].(map[string]any)
+	if body["answer"] != "42 buckets" {
+		t.Errorf("body = %v, want the supervisor's answer", j["body"])
+	}
+	if j["http_status"] != float64(http.StatusOK) || j["finished"] == nil {
+		t.Errorf("job = %v, want http_status 200 and a finished time", j)
+	}
+	if resp := get(t, gw.URL+"/api/jobs/nope"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown job status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	started, gone := make(chan struct{}), make(chan struct{})
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		slow(time.Minute)(w, r)
+		close(gone)
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	id := submitJob(t, gw.URL, map[string]any{"goal": "provision cluster"})
+	<-started
+	del := func() *http.Response {
+		req, _ := http.NewRequest(http.MethodDelete, gw.URL+"/api/jobs/"+id, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+	resp := del()
+	if resp.StatusCode != http.StatusOK || decode(t, resp)["status"] != jobCanceled {
+		t.Fatalf("DELETE status = %d, want 200 with the job canceled", resp.StatusCode)
+	}
+	select {
+	case <-gone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the supervisor call was not canceled")
+	}
+	pollJob(t, gw.URL, id, jobCanceled)
+	if resp := del(); resp.StatusCode != http.StatusConflict {
+		t.Errorf("second DELETE status = %d, want 409", resp.StatusCode)
+	}
+}
+
+func TestJobProgressPoll(t *testing.T) {
+	step := make(chan struct{})
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for _, line := range []string{`{"progress":"planning"}`, `{"progress":"applying","step":2}`, `{"result":{"status":"done"}}`} {
+			select {
+			case <-step:
+			case <-r.Context().Done():
+				return
+			}
+			io.WriteString(w, line+"\n")
+			w.(http.Flusher).Flush()
+		}
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "SUPERVISOR_FORMAT", "ndjson")
+
+	id := submitJob(t, gw.URL, map[string]any{"goal": "roll the fleet"})
+	progress := gw.URL + "/api/jobs/" + id + "/progress"
+	// waitSeq polls until the progress sequence reaches seq.
+	waitSeq := func(seq int) map[string]any {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			url := progress
+			if seq > 0 {
+				url += "?since=" + strconv.Itoa(seq-1)
+			}
+			resp := get(t, url)
+			if resp.StatusCode == http.StatusOK {
+				if p := decode(t, resp); p["seq"] == float64(seq) {
+					return p
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("progress never reached seq %d", seq)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if p := waitSeq(0); p["progress"] != nil {
+		t.Errorf("progress before any update = %v, want null", p["progress"])
+	}
+	if resp := get(t, progress+"?since=0"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("no update since 0: status = %d, want 204", resp.StatusCode)
+	}
+	step <- struct{}{}
+	p := waitSeq(1)
+	if snap, _ := p["progress"].(map[string]any); snap["progress"] != "planning" || p["status"] != jobRunning {
+		t.Errorf("seq 1 = %v, want the planning line on a running job", p)
+	}
+	if resp := get(t, progress+"?since=1"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("no update since 1: status = %d, want 204", resp.StatusCode)
+	}
+	step <- struct{}{}
+	if snap, _ := waitSeq(2)["progress"].(map[string]any); snap["step"] != float64(2) {
+		t.Errorf("seq 2 progress = %v, want the applying line", snap)
+	}
+	step <- struct{}{}
+	pollJob(t, gw.URL, id, jobDone)
+	if resp := get(t, progress+"?since=2"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("the result line counted as progress: status = %d, want 204", resp.StatusCode)
+	}
+
+	if resp := get(t, progress+"?since=soon"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad since: status = %d, want 400", resp.StatusCode)
+	}
+	if resp := get(t, gw.URL+"/api/jobs/nope/progress"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown job: status = %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestJobQueueOverflow(t *testing.T) {
+	started := make(chan struct{}, 10)
+	hold := make(chan struct{})
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		started <- struct{}{}
+		select {
+		case <-hold:
+		case <-r.Context().Done():
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "JOB_WORKERS", "2", "JOB_QUEUE_LEN", "2")
+	t.Cleanup(func() { close(hold) })
+
+	var running, queued []string
+	for range 2 {
+		running = append(running, submitJob(t, gw.URL, map[string]any{"goal": "tag volumes"}))
+	}
+	for range 2 {
+		select {
+		case <-started:
+		case <-time.After(2 * time.Second):
+			t.Fatal("both workers should have picked up a job")
+		}
+	}
+	for _, id := range running {
+		pollJob(t, gw.URL, id, jobRunning)
+	}
+	for range 2 {
+		queued = append(queued, submitJob(t, gw.URL, map[string]any{"goal": "tag volumes"}))
+	}
+	// A queued job stays pending until a worker is free.
+	for _, id := range queued {
+		if got := decode(t, get(t, gw.URL+"/api/jobs/"+id))["status"]; got != jobPending {
+			t.Errorf("queued job %s is %v, want pending", id, got)
+		}
+	}
+
+	resp := postJSON(t, gw.URL+"/api/jobs", map[string]any{"goal": "tag volumes"})
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("overflow status = %d, want 503", resp.StatusCode)
+	}
+	if got := decode(t, resp)["error"]; got != "job queue full" {
+		t.Errorf("overflow error = %v, want job queue full", got)
+	}
+	if len(started) != 0 {
+		t.Errorf("%d more runs reached the supervisor, want only the workers'", len(started))
+	}
+}
+
+func TestConcurrentJobsWithOneIdempotencyKey(t *testing.T) {
+	var runs atomic.Int32
+	hold := make(chan struct{})
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		runs.Add(1)
+		<-hold
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+	var once sync.Once
+	release := func() { once.Do(func() { close(hold) }) }
+	t.Cleanup(release)
+
+	body := map[string]any{"goal": "tag volumes"}
+	resps := make([]*http.Response, 2)
+	var wg sync.WaitGroup
+	for i := range resps {
+		wg.Go(func() { resps[i] = postJSON(t, gw.URL+"/api/jobs", body, "Idempotency-Key", "tag-1") })
+	}
+	wg.Wait()
+	ids, replays := map[string]bool{}, 0
+	for _, resp := range resps {
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("status = %d, want 202", resp.StatusCode)
+		}
+		if resp.Header.Get("X-Idempotent-Replay") == "true" {
+			replays++
+		}
+		ids[decode(t, resp)["job_id"].(string)] = true
+	}
+	if len(ids) != 1 || replays != 1 {
+		t.Fatalf("got job IDs %v with %d replays, want one job and one replay", ids, replays)
+	}
+	var id string
+	for id = range ids {
+	}
+
+	if resp := postJSON(t, gw.URL+"/api/jobs", map[string]any{"goal": "tag snapshots"}, "Idempotency-Key", "tag-1"); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("same key, other body: status = %d, want 422", resp.StatusCode)
+	}
+	release()
+	pollJob(t, gw.URL, id, jobDone)
+	resp := postJSON(t, gw.URL+"/api/jobs", body, "Idempotency-Key", "tag-1")
+	if resp.Header.Get("X-Idempotent-Replay") != "true" || decode(t, resp)["job_id"] != id {
+		t.Errorf("after the job finished: want a replay of job %s", id)
+	}
+	if got := runs.Load(); got != 1 {
+		t.Errorf("supervisor got %d runs, want 1", got)
+	}
+}
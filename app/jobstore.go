@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JobStore persists async jobs. Implementations are safe for concurrent use
+// and hand out copies, so callers save a job again after changing it.
+type JobStore interface {
+	Save(j job) error
+	Get(id string) (job, bool)
+	List() []job
+	Delete(id string) error
+}
+
+// jobStore is selected by JOB_STORE: "memory" (default) or "file".
+var jobStore JobStore = newMemoryJobStore()
+
+// initJobStore sets jobStore to the JOB_STORE backend; the file store keeps
+// its jobs under dir (JOB_STORE_DIR).
+func initJobStore(kind, dir string) error {
+	lastRecovery = recovery{Store: "memory", Jobs: []interruptedJob{}}
+	switch kind {
+	case "", "memory":
+		jobStore = newMemoryJobStore()
+	case "file":
+		s, err := newFileJobStore(dir)
+		if err != nil {
+			return fmt.Errorf("JOB_STORE=file: %w", err)
+		}
+		jobStore = s
+	default:
+		return fmt.Errorf("unknown JOB_STORE %q (want memory or file)", kind)
+	}
+	return nil
+}
+
+// memoryJobStore keeps jobs in a map; they are lost on restart.
+type memoryJobStore struct {
+	mu   sync.Mutex
+	byID map[string]job
+}
+
+func newMemoryJobStore() *memoryJobStore {
+	return &memoryJobStore{byID: map[string]job{}}
+}
+
+func (s *memoryJobStore) Save(j job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID[j.ID] = j
+	return nil
+}
+
+func (s *memoryJobStore) Get(id string) (job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.byID[id]
+	return j, ok
+}
+
+func (s *memoryJobStore) List() []job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]job, 0, len(s.byID))
+	for _, j := range s.byID {
+		out = append(out, j)
+	}
+	return out
+}
+
+func (s *memoryJobStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.byID, id)
+	return nil
+}
+
+// fileJobStore writes each job to <dir>/<id>.json and serves reads from
+// memory. Jobs still pending or running when the gateway stopped come back
+// interrupted, since nothing is working on them any more.
+type fileJobStore struct {
+	dir string
+	mem *memoryJobStore
+}
+
+func newFileJobStore(dir string) (*fileJobStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	s := &fileJobStore{dir: dir, mem: newMemoryJobStore()}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		var j job
+		if err := json.Unmarshal(b, &j); err != nil || j.ID == "" {
+			return nil, fmt.Errorf("job store: %s is not a job", p)
+		}
+		if j.Status == jobPending || j.Status == jobRunning {
+			now := time.Now().UTC()
+			lastRecovery.Jobs = append(lastRecovery.Jobs, interruptedJob{ID: j.ID, Status: j.Status})
+			j.Status = jobInterrupted
+			j.Error = "gateway restarted before the job finished"
+			j.Finished = &now
+			if err := s.write(j); err != nil {
+				return nil, err
+			}
+		}
+		s.mem.Save(j)
+	}
+	lastRecovery.Store = "file"
+	lastRecovery.Loaded = len(paths)
+	lastRecovery.Interrupted = len(lastRecovery.Jobs)
+	if lastRecovery.Interrupted > 0 {
+		logger.Warn("jobs interrupted by the restart", "count", lastRecovery.Interrupted)
+	}
+	return s, nil
+}
+
+// recovery is what loading the job store at startup found, as GET
+// /api/admin/recovery reports it. Reported is set once it has been served.
+type recovery struct {
+	Store       string           `json:"store"`
+	Loaded      int              `json:"loaded"`
+	Interrupted int              `json:"interrupted"`
+	Jobs        []interruptedJob `json:"interrupted_jobs"`
+	Reported    bool             `json:"already_reported"`
+}
+
+// interruptedJob is a job the restart cut short, with the status it had.
+type interruptedJob struct {
+	ID     string `json:"job_id"`
+	Status string `json:"previous_status"`
+}
+
+// lastRecovery is filled in once, by initJobStore, and describes the
+// restart the gateway is running since. The memory store has nothing to
+// recover.
+var (
+	recoveryMu   sync.Mutex
+	lastRecovery = recovery{Store: "memory", Jobs: []interruptedJob{}}
+)
+
+// handleRecovery serves GET /api/admin/recovery, how many jobs the last
+// restart interrupted, so an operator can tell what work a deploy lost. The
+// interrupted jobs are handed out once: later calls report none, with
+// already_reported set, until the next restart. The jobs themselves stay
+// in the store.
+func handleRecovery(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	recoveryMu.Lock()
+	out := lastRecovery
+	lastRecovery.Interrupted, lastRecovery.Jobs, lastRecovery.Reported = 0, []interruptedJob{}, true
+	recoveryMu.Unlock()
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *fileJobStore) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", errors.New("job store: invalid job ID")
+	}
+	return filepath.Join(s.dir, id+".json"), nil
+}
+
+// write replaces the job's file atomically.
+func (s *fileJobStore) write(j job) error {
+	p, err := s.path(j.ID)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+func (s *fileJobStore) Save(j job) error {
+	if err := s.write(j); err != nil {
+		return err
+	}
+	return s.mem.Save(j)
+}
+
+func (s *fileJobStore) Get(id string) (job, bool) { return s.mem.Get(id) }
+
+func (s *fileJobStore) List() []job { return s.mem.List() }
+
+func (s *fileJobStore) Delete(id string) error {
+	p, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return s.mem.Delete(id)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	gwclient "mcpgui/client"
+)
+
+// testJobStore is the behaviour every JobStore must have.
+func testJobStore(t *testing.T, s JobStore) {
+	t.Helper()
+	created := time.Now().UTC().Truncate(time.Millisecond)
+	a := job{Job: gwclient.Job{ID: "job-a", Status: jobPending, Created: created}}
+	b := job{Job: gwclient.Job{ID: "job-b", Status: jobDone, Created: created, HTTPStatus: 200, Body: json.RawMessage(`{"ok":true}`)}}
+	for _, j := range []job{a, b} {
+		if err := s.Save(j); err != nil {
+			t.Fatalf("Save(%s): %v", j.ID, err)
+		}
+	}
+
+	got, ok := s.Get("job-b")
+	if !ok || got.Status != jobDone || got.HTTPStatus != 200 || string(got.Body) != `{"ok":true}` || !got.Created.Equal(created) {
+		t.Errorf("Get(job-b) = %+v, %v, want the saved job", got, ok)
+	}
+	if _, ok := s.Get("job-c"); ok {
+		t.Error("Get found a job never saved")
+	}
+
+	got, _ = s.Get("job-a")
+	got.Status = jobRunning
+	if j, _ := s.Get("job-a"); j.Status != jobPending {
+		t.Error("changing a job from Get changed the store")
+	}
+	s.Save(got)
+	if j, _ := s.Get("job-a"); j.Status != jobRunning {
+		t.Errorf("after saving again: status = %s, want running", j.Status)
+	}
+
+	var ids []string
+	for _, j := range s.List() {
+		ids = append(ids, j.ID)
+	}
+	slices.Sort(ids)
+	if !slices.Equal(ids, []string{"job-a", "job-b"}) {
+		t.Errorf("List = %v, want job-a and job-b", ids)
+	}
+
+	if err := s.Delete("job-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("job-a"); err != nil {
+		t.Errorf("deleting a deleted job: %v", err)
+	}
+	if _, ok := s.Get("job-a"); ok || len(s.List()) != 1 {
+		t.Error("job-a still listed after Delete")
+	}
+}
+
+func TestMemoryJobStore(t *testing.T) {
+	testJobStore(t, newMemoryJobStore())
+}
+
+func TestFileJobStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testJobStore(t, s)
+	if _, err := os.Stat(filepath.Join(dir, "job-a.json")); !os.IsNotExist(err) {
+		t.Errorf("deleted job's file still there: %v", err)
+	}
+	if err := s.Save(job{Job: gwclient.Job{ID: "../escape"}}); err == nil {
+		t.Error("saved a job whose ID leaves the directory")
+	}
+}
+
+func TestFileJobStoreSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newFileJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Save(job{Job: gwclient.Job{ID: "finished", Status: jobDone, HTTPStatus: 200}})
+	s.Save(job{Job: gwclient.Job{ID: "queued", Status: jobPending}})
+	s.Save(job{Job: gwclient.Job{ID: "working", Status: jobRunning}})
+
+	restarted, err := newFileJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j, ok := restarted.Get("finished"); !ok || j.Status != jobDone || j.HTTPStatus != 200 {
+		t.Errorf("finished job after restart = %+v, %v, want it unchanged", j, ok)
+	}
+	for _, id := range []string{"queued", "working"} {
+		j, ok := restarted.Get(id)
+		if !ok || j.Status != jobInterrupted || j.Error == "" || j.Finished == nil {
+			t.Errorf("%s after restart = %+v, want it interrupted", id, j)
+		}
+	}
+	// The interruption is written back, so a second restart finds it too.
+	again, err := newFileJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j, _ := again.Get("working"); j.Status != jobInterrupted {
+		t.Errorf("working after a second restart = %s, want interrupted", j.Status)
+	}
+}
+
+func TestFileJobStoreRejectsCorruptFiles(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{"), 0o640)
+	if _, err := newFileJobStore(dir); err == nil {
+		t.Error("loaded a directory with a corrupt job file")
+	}
+}
+
+func TestRecoverySummaryAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	before, err := newFileJobStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before.Save(job{Job: gwclient.Job{ID: "finished", Status: jobDone, HTTPStatus: 200}})
+	before.Save(job{Job: gwclient.Job{ID: "queued", Status: jobPending}})
+	before.Save(job{Job: gwclient.Job{ID: "working", Status: jobRunning}})
+
+	// The restart: configure loads the store again.
+	gw := testGateway(t, "ADMIN_KEYS", adminKey, "JOB_STORE", "file", "JOB_STORE_DIR", dir)
+	recovered := func() recovery {
+		t.Helper()
+		resp := get(t, gw.URL+"/api/admin/recovery", asAdmin...)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		var r recovery
+		if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	got := recovered()
+	want := []interruptedJob{{ID: "queued", Status: jobPending}, {ID: "working", Status: jobRunning}}
+	if got.Store != "file" || got.Loaded != 3 || got.Interrupted != 2 || !slices.Equal(got.Jobs, want) || got.Reported {
+		t.Errorf("summary = %+v, want 3 loaded and %v interrupted", got, want)
+	}
+	j := decode(t, get(t, gw.URL+"/api/jobs/working"))
+	if j["status"] != jobInterrupted || j["error"] == nil {
+		t.Errorf("working job = %v, want it interrupted with a note", j)
+	}
+
+	// Served once: the next call lists nothing, but the jobs stay put.
+	if got := recovered(); got.Interrupted != 0 || len(got.Jobs) != 0 || !got.Reported || got.Loaded != 3 {
+		t.Errorf("second summary = %+v, want none interrupted and already_reported", got)
+	}
+	if j := decode(t, get(t, gw.URL+"/api/jobs/queued")); j["status"] != jobInterrupted {
+		t.Errorf("queued job after the summary = %v, want still interrupted", j["status"])
+	}
+
+	// A second restart finds nothing new to interrupt.
+	gw = testGateway(t, "ADMIN_KEYS", adminKey, "JOB_STORE", "file", "JOB_STORE_DIR", dir)
+	if got := recovered(); got.Loaded != 3 || got.Interrupted != 0 || got.Reported {
+		t.Errorf("after a clean restart: summary = %+v, want 3 loaded, none interrupted", got)
+	}
+
+	gw = testGateway(t, "ADMIN_KEYS", adminKey, "JOB_STORE", "memory")
+	if got := recovered(); got.Store != "memory" || got.Loaded != 0 || got.Interrupted != 0 {
+		t.Errorf("memory store: summary = %+v, want nothing recovered", got)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+var (
+	// maxJSONDepth is JSON_MAX_DEPTH, how deeply objects and arrays may nest
+	// in a request body; 0 disables the check.
+	maxJSONDepth int
+	// maxJSONElements is JSON_MAX_ELEMENTS, how many values, containers
+	// included, a request body may hold; 0 disables the check.
+	maxJSONElements int
+)
+
+// checkJSONShape walks body token by token and refuses it once it nests
+// deeper than maxJSONDepth or holds more than maxJSONElements values, before
+// anything decodes it into memory. Malformed JSON passes: the handler's own
+// decode reports it.
+func checkJSONShape(body []byte) *validationError {
+	return checkJSONShapeFrom(bytes.NewReader(body))
+}
+
+// checkJSONShapeFrom is checkJSONShape for a body read from src, such as a
+// spooled one.
+func checkJSONShapeFrom(src io.Reader) *validationError {
+	if maxJSONDepth <= 0 && maxJSONElements <= 0 {
+		return nil
+	}
+	type frame struct{ object, wantKey bool }
+	var stack []frame
+	elements := 0
+	dec := json.NewDecoder(src)
+	dec.UseNumber()
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		if d, ok := tok.(json.Delim); ok && (d == '}' || d == ']') {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		if n := len(stack); n > 0 && stack[n-1].object {
+			if stack[n-1].wantKey {
+				stack[n-1].wantKey = false
+				continue
+			}
+			stack[n-1].wantKey = true
+		}
+		elements++
+		if maxJSONElements > 0 && elements > maxJSONElements {
+			return &validationError{Status: http.StatusUnprocessableEntity, Msg: "JSON body has too many elements"}
+		}
+		if d, ok := tok.(json.Delim); ok {
+			stack = append(stack, frame{object: d == '{', wantKey: d == '{'})
+			if maxJSONDepth > 0 && len(stack) > maxJSONDepth {
+				return &validationError{Status: http.StatusUnprocessableEntity, Msg: "JSON body nested too deeply"}
+			}
+		}
+	}
+}
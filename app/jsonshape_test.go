@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// nested is a run body whose "context" field nests depth arrays deep, so
+// the body as a whole nests depth+1 deep.
+func nested(depth int) string {
+	return `{"goal":"list buckets","context":` + strings.Repeat("[", depth) + strings.Repeat("]", depth) + `}`
+}
+
+// wide is a run body holding n array elements besides the goal.
+func wide(n int) string {
+	return `{"goal":"list buckets","context":[` + strings.TrimSuffix(strings.Repeat("1,", n), ",") + `]}`
+}
+
+func TestJSONShapeLimits(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	for _, spool := range []string{"0", "16"} {
+		t.Run("spool threshold "+spool, func(t *testing.T) {
+			gw := testGateway(t, "SUPERVISOR_URL", sup, "JSON_MAX_DEPTH", "5", "JSON_MAX_ELEMENTS", "50", "SPOOL_THRESHOLD", spool)
+			for _, tc := range []struct {
+				name, body string
+				want       int
+				msg        string
+			}{
+				{"at the depth limit", nested(4), http.StatusOK, ""},
+				{"too deep", nested(5), http.StatusUnprocessableEntity, "JSON body nested too deeply"},
+				// the object, the goal and the context array are 3 of the 50; keys are not counted
+				{"at the element limit", wide(47), http.StatusOK, ""},
+				{"too many elements", wide(48), http.StatusUnprocessableEntity, "JSON body has too many elements"},
+			} {
+				resp := post(t, gw.URL+"/api/run", "application/json", tc.body)
+				if resp.StatusCode != tc.want {
+					t.Fatalf("%s: status = %d, want %d", tc.name, resp.StatusCode, tc.want)
+				}
+				if tc.want == http.StatusOK {
+					nextRequest(t, seen)
+					continue
+				}
+				if got := decode(t, resp)["error"]; got != tc.msg {
+					t.Errorf("%s: error = %v, want %q", tc.name, got, tc.msg)
+				}
+			}
+			if len(seen) != 0 {
+				t.Error("a refused body reached the supervisor")
+			}
+		})
+	}
+}
+
+func TestJSONShapeDefaults(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	if resp := post(t, gw.URL+"/api/run", "application/json", nested(32)); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("33 levels deep: status = %d, want 422", resp.StatusCode)
+	}
+	if resp := post(t, gw.URL+"/api/run", "application/json", wide(10000)); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("10003 elements: status = %d, want 422", resp.StatusCode)
+	}
+	if len(seen) != 0 {
+		t.Error("a refused body reached the supervisor")
+	}
+
+	gw = testGateway(t, "SUPERVISOR_URL", sup, "JSON_MAX_DEPTH", "0", "JSON_MAX_ELEMENTS", "0")
+	if resp := post(t, gw.URL+"/api/run", "application/json", nested(100)); resp.StatusCode != http.StatusOK {
+		t.Errorf("with the limits off: status = %d, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwtLeeway absorbs clock skew when checking exp and nbf.
+	jwtLeeway = 30 * time.Second
+	// jwksRefresh is how often an unknown key ID may trigger a JWKS refetch.
+	jwksRefresh = time.Minute
+)
+
+// jwtAuth accepts bearer JWTs signed with JWT_SECRET (HS256/384/512) or a
+// key from JWT_JWKS_URL (RS256/384/512, ES256/384/512), that carry an exp
+// still in the future. The principal is the "sub" claim.
+type jwtAuth struct {
+	secret []byte
+	jwks   *jwksCache // nil without JWT_JWKS_URL
+}
+
+func newJWTAuth(secret, jwksURL string) (*jwtAuth, error) {
+	if secret == "" && jwksURL == "" {
+		return nil, errors.New("AUTH_MODE=jwt: set JWT_SECRET or JWT_JWKS_URL")
+	}
+	a := &jwtAuth{secret: []byte(secret)}
+	if jwksURL != "" {
+		a.jwks = &jwksCache{url: jwksURL}
+		if err := a.jwks.fetch(); err != nil {
+			return nil, fmt.Errorf("JWT_JWKS_URL: %w", err)
+		}
+	}
+	return a, nil
+}
+
+func (a *jwtAuth) Authenticate(r *http.Request) (string, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return "", errUnauthenticated
+	}
+	sub, err := a.verify(token, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errUnauthenticated, err)
+	}
+	return sub, nil
+}
+
+// verify checks token's signature and validity window at now, returning its
+// subject.
+func (a *jwtAuth) verify(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed signature")
+	}
+	if err := a.checkSignature(header.Alg, header.Kid, parts[0]+"."+parts[1], sig); err != nil {
+		return "", err
+	}
+	var claims struct {
+		Sub string   `json:"sub"`
+		Exp *float64 `json:"exp"`
+		Nbf *float64 `json:"nbf"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", err
+	}
+	if claims.Exp == nil {
+		return "", errors.New("token has no exp")
+	}
+	if now.Add(-jwtLeeway).After(unixTime(*claims.Exp)) {
+		return "", errors.New("token expired")
+	}
+	if claims.Nbf != nil && now.Add(jwtLeeway).Before(unixTime(*claims.Nbf)) {
+		return "", errors.New("token not yet valid")
+	}
+	return claims.Sub, nil
+}
+
+// checkSignature verifies sig over signed for alg. HMAC algorithms need
+// JWT_SECRET and public-key ones JWT_JWKS_URL, so a token can't pass off a
+// public key as an HMAC secret.
+func (a *jwtAuth) checkSignature(alg, kid, signed string, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	var hash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	switch alg[:2] {
+	case "HS":
+		if len(a.secret) == 0 {
+			return fmt.Errorf("alg %s needs JWT_SECRET", alg)
+		}
+		mac := hmac.New(hash.New, a.secret)
+		mac.Write([]byte(signed))
+		if subtle.ConstantTimeCompare(mac.Sum(nil), sig) != 1 {
+			return errors.New("bad signature")
+		}
+		return nil
+	case "RS", "ES":
+		if a.jwks == nil {
+			return fmt.Errorf("alg %s needs JWT_JWKS_URL", alg)
+		}
+		key, ok := a.jwks.key(kid)
+		if !ok {
+			return fmt.Errorf("unknown key %q", kid)
+		}
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest := h.Sum(nil)
+		switch pub := key.(type) {
+		case *rsa.PublicKey:
+			if alg[:2] == "RS" && rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil {
+				return nil
+			}
+		case *ecdsa.PublicKey:
+			n := len(sig) / 2
+			if alg[:2] == "ES" && len(sig)%2 == 0 &&
+				ecdsa.Verify(pub, digest, new(big.Int).SetBytes(sig[:n]), new(big.Int).SetBytes(sig[n:])) {
+				return nil
+			}
+		}
+		return errors.New("bad signature")
+	}
+	return fmt.Errorf("unsupported alg %q", alg)
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil || json.Unmarshal(b, v) != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+func unixTime(secs float64) time.Time {
+	return time.Unix(0, int64(secs*float64(time.Second)))
+}
+
+// jwksCache holds the keys published at JWT_JWKS_URL, refetched when a
+// token names a key it doesn't know, at most once per jwksRefresh.
+type jwksCache struct {
+	url string
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+var jwksClient = &http.Client{Timeout: 5 * time.Second}
+
+// key returns the key with ID kid, or the only key when kid is empty and
+// there is just one.
+func (c *jwksCache) key(kid string) (crypto.PublicKey, bool) {
+	c.mu.Lock()
+	key, ok := c.lookup(kid)
+	stale := !ok && time.Since(c.fetched) > jwksRefresh
+	c.mu.Unlock()
+	if !stale || c.fetch() != nil {
+		return key, ok
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lookup(kid)
+}
+
+func (c *jwksCache) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(c.keys) == 1 {
+		for _, k := range c.keys {
+			return k, true
+		}
+	}
+	k, ok := c.keys[kid]
+	return k, ok
+}
+
+func (c *jwksCache) fetch() error {
+	c.mu.Lock()
+	c.fetched = time.Now()
+	c.mu.Unlock()
+	resp, err := jwksClient.Get(c.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", c.url, resp.Status)
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("decode %s: %w", c.url, err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		var key crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = rsaKey(k.N, k.E)
+		case "EC":
+			key, err = ecKey(k.Crv, k.X, k.Y)
+		default:
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+	return nil
+}
+
+func rsaKey(n, e string) (*rsa.PublicKey, error) {
+	nb, err1 := base64.RawURLEncoding.DecodeString(n)
+	eb, err2 := base64.RawURLEncoding.DecodeString(e)
+	if err1 != nil || err2 != nil || len(eb) == 0 || len(eb) > 4 {
+		return nil, errors.New("malformed RSA key")
+	}
+	exp := 0
+	for _, b := range eb {
+		exp = exp<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(nb), E: exp}, nil
+}
+
+func ecKey(crv, x, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+	xb, err1 := base64.RawURLEncoding.DecodeString(x)
+	yb, err2 := base64.RawURLEncoding.DecodeString(y)
+	size := (curve.Params().BitSize + 7) / 8
+	if err1 != nil || err2 != nil || len(xb) != size || len(yb) != size {
+		return nil, errors.New("malformed EC key")
+	}
+	return ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, xb...), yb...))
+}
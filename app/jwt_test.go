@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const jwtSecret = "jwt-test-secret"
+
+// signedToken builds a JWT with the given header and claims, signed by sign.
+func signedToken(t *testing.T, header, claims map[string]any, sign func(signed string) []byte) string {
+	t.Helper()
+	seg := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := seg(header) + "." + seg(claims)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(signed))
+}
+
+func hmacSign(secret string) func(string) []byte {
+	return func(signed string) []byte {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(signed))
+		return mac.Sum(nil)
+	}
+}
+
+// hsToken is an HS256 token for sub, signed with jwtSecret, that expires in
+// ttl (in the past when negative).
+func hsToken(t *testing.T, sub string, ttl time.Duration) string {
+	return signedToken(t, map[string]any{"alg": "HS256", "typ": "JWT"},
+		map[string]any{"sub": sub, "exp": time.Now().Add(ttl).Unix()}, hmacSign(jwtSecret))
+}
+
+func TestJWTVerify(t *testing.T) {
+	a, err := newJWTAuth(jwtSecret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	hs := map[string]any{"alg": "HS256"}
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  string // the error, or "" to accept
+	}{
+		{"valid", hsToken(t, "carol", time.Hour), ""},
+		{"expired", hsToken(t, "carol", -time.Hour), "token expired"},
+		{"expired within leeway", hsToken(t, "carol", -10*time.Second), ""},
+		{"no exp", signedToken(t, hs, map[string]any{"sub": "carol"}, hmacSign(jwtSecret)), "token has no exp"},
+		{"not yet valid", signedToken(t, hs, map[string]any{"sub": "carol", "exp": now.Add(time.Hour).Unix(),
+			"nbf": now.Add(10 * time.Minute).Unix()}, hmacSign(jwtSecret)), "token not yet valid"},
+		{"wrong secret", signedToken(t, hs, map[string]any{"sub": "carol", "exp": now.Add(time.Hour).Unix()},
+			hmacSign("guessed")), "bad signature"},
+		{"alg none", signedToken(t, map[string]any{"alg": "none"}, map[string]any{"sub": "carol", "exp": now.Add(time.Hour).Unix()},
+			func(string) []byte { return nil }), "unsupported alg"},
+		{"RS256 without JWKS", signedToken(t, map[string]any{"alg": "RS256"}, map[string]any{"sub": "carol", "exp": now.Add(time.Hour).Unix()},
+			hmacSign(jwtSecret)), "needs JWT_JWKS_URL"},
+		{"malformed", "not.a-token", "malformed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sub, err := a.verify(tc.token, now)
+			if tc.want == "" {
+				if err != nil || sub != "carol" {
+					t.Errorf("got %q, %v, want carol", sub, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("err = %v, want %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestJWTFromJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"keys": []map[string]any{{
+		"kty": "RSA", "kid": "k1",
+		"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}))
+	rsSign := func(k *rsa.PrivateKey) func(string) []byte {
+		return func(signed string) []byte {
+			digest := sha256.Sum256([]byte(signed))
+			sig, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+			if err != nil {
+				t.Fatal(err)
+			}
+			return sig
+		}
+	}
+	claims := map[string]any{"sub": "dave", "exp": time.Now().Add(time.Hour).Unix()}
+
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "AUTH_MODE", "jwt", "JWT_JWKS_URL", jwks)
+	run := func(token string) int {
+		return postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, "Authorization", "Bearer "+token).StatusCode
+	}
+	if got := run(signedToken(t, map[string]any{"alg": "RS256", "kid": "k1"}, claims, rsSign(key))); got != http.StatusOK {
+		t.Errorf("token signed by the JWKS key: status = %d, want 200", got)
+	}
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	if got := run(signedToken(t, map[string]any{"alg": "RS256", "kid": "k1"}, claims, rsSign(other))); got != http.StatusUnauthorized {
+		t.Errorf("token signed by another key: status = %d, want 401", got)
+	}
+	if got := run(signedToken(t, map[string]any{"alg": "HS256"}, claims, hmacSign(jwtSecret))); got != http.StatusUnauthorized {
+		t.Errorf("HS256 token without JWT_SECRET: status = %d, want 401", got)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// maxConcurrent is MAX_CONCURRENT_RUNS, the size of every pool without
+	// a limit of its own.
+	maxConcurrent int
+	// queueTimeout is how long a run may wait for a free slot.
+	queueTimeout time.Duration
+	// priorityQueue is PRIORITY_QUEUE: runs waiting for a slot are served by
+	// priority, then in arrival order, instead of in whatever order the
+	// runtime wakes them.
+	priorityQueue bool
+	// maxQueueLen is MAX_QUEUE_LEN, how many runs may wait on one pool when
+	// priorityQueue is on.
+	maxQueueLen int
+
+	errBusy      = errors.New("server busy")
+	errQueueFull = errors.New("queue full")
+)
+
+// priorityLevels are the accepted "priority" values, most urgent first; a
+// run without one is normal.
+var priorityLevels = []string{"high", "normal", "low"}
+
+// priorityIndex maps a priority to its place in priorityLevels.
+func priorityIndex(p string) int {
+	if i := slices.Index(priorityLevels, p); i >= 0 {
+		return i
+	}
+	return 1
+}
+
+// runPool is a semaphore bounding concurrent calls to one set of backends,
+// so a flood of runs for one provider can't starve the others.
+type runPool struct {
+	name  string
+	slots chan struct{}
+
+	mu      sync.Mutex
+	waiting [3][]chan struct{} // by priorityIndex, oldest first
+}
+
+// pools maps a backend list, joined, to its pool; poolOrder keeps them in
+// registration order. Both are fixed after initPools.
+var (
+	pools     = map[string]*runPool{}
+	poolOrder []*runPool
+)
+
+// initPools gives each provider a MAX_CONCURRENT_<PROVIDER> pool, and the
+// default, read-only and tenant backends a MAX_CONCURRENT_RUNS one each.
+// Backend lists that are identical share the first pool registered.
+func initPools() {
+	pools, poolOrder = map[string]*runPool{}, nil
+	for _, p := range providers {
+		if urls, ok := providerBackends[p]; ok {
+			addPool(p, urls, getenvInt("MAX_CONCURRENT_"+strings.ToUpper(p), maxConcurrent))
+		}
+	}
+	addPool("default", supervisors, maxConcurrent)
+	if len(readonlyBackends) > 0 {
+		addPool("readonly", readonlyBackends, maxConcurrent)
+	}
+	for id, urls := range tenantBackends {
+		addPool("tenant:"+id, urls, maxConcurrent)
+	}
+}
+
+func addPool(name string, backends []string, size int) {
+	key := strings.Join(backends, ",")
+	if _, ok := pools[key]; ok {
+		return
+	}
+	p := &runPool{name: name, slots: make(chan struct{}, max(size, 1))}
+	pools[key] = p
+	poolOrder = append(poolOrder, p)
+}
+
+func poolFor(backends []string) *runPool {
+	if p, ok := pools[strings.Join(backends, ",")]; ok {
+		return p
+	}
+	return pools[strings.Join(supervisors, ",")]
+}
+
+// acquireRun blocks until a slot in the backends' pool frees up, giving up
+// after queueTimeout. The returned func releases the slot. priority only
+// matters with priorityQueue on. The time a run waited for its slot goes to
+// the queue wait histogram.
+func acquireRun(ctx context.Context, backends []string, priority string) (func(), error) {
+	start := time.Now()
+	release, err := poolFor(backends).acquire(ctx, priority)
+	if err == nil {
+		queueWait.Observe(time.Since(start).Seconds())
+	}
+	return release, err
+}
+
+// waitingRuns counts the runs blocked waiting for a slot, across pools.
+var waitingRuns atomic.Int64
+
+func (p *runPool) acquire(ctx context.Context, priority string) (func(), error) {
+	if priorityQueue {
+		return p.acquireQueued(ctx, priorityIndex(priority))
+	}
+	release := func() { <-p.slots }
+	select {
+	case p.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	waitingRuns.Add(1)
+	defer waitingRuns.Add(-1)
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		return release, nil
+	case <-timer.C:
+		return nil, errBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// acquireQueued takes a free slot when nobody is waiting, else joins the
+// queue for prio and waits for releaseQueued to hand it a slot.
+func (p *runPool) acquireQueued(ctx context.Context, prio int) (func(), error) {
+	p.mu.Lock()
+	if p.queued() == 0 {
+		select {
+		case p.slots <- struct{}{}:
+			p.mu.Unlock()
+			return p.releaseQueued, nil
+		default:
+		}
+	}
+	if p.queued() >= maxQueueLen {
+		p.mu.Unlock()
+		return nil, errQueueFull
+	}
+	ready := make(chan struct{})
+	p.waiting[prio] = append(p.waiting[prio], ready)
+	p.mu.Unlock()
+	waitingRuns.Add(1)
+	defer waitingRuns.Add(-1)
+
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		return p.releaseQueued, nil
+	case <-timer.C:
+		err = errBusy
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	p.mu.Lock()
+	i := slices.Index(p.waiting[prio], ready)
+	if i >= 0 {
+		p.waiting[prio] = slices.Delete(p.waiting[prio], i, i+1)
+	}
+	p.mu.Unlock()
+	if i < 0 {
+		// handed a slot as we gave up; pass it on
+		p.releaseQueued()
+	}
+	return nil, err
+}
+
+// releaseQueued hands the slot to the most urgent, oldest waiter, or frees
+// it when the queue is empty.
+func (p *runPool) releaseQueued() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, q := range p.waiting {
+		if len(q) > 0 {
+			close(q[0])
+			p.waiting[i] = q[1:]
+			return
+		}
+	}
+	<-p.slots
+}
+
+func (p *runPool) queued() int {
+	n := 0
+	for _, q := range p.waiting {
+		n += len(q)
+	}
+	return n
+}
+
+// queuedRuns is the number of runs waiting for a slot, across pools.
+func queuedRuns() int {
+	return int(waitingRuns.Load())
+}
+
+// inflightRuns is the number of supervisor calls holding a slot.
+func inflightRuns() int {
+	n := 0
+	for _, p := range poolOrder {
+		n += len(p.slots)
+	}
+	return n
+}
+
+// inflightByPool is inflightRuns broken down by pool name.
+func inflightByPool() map[string]int {
+	out := make(map[string]int, len(poolOrder))
+	for _, p := range poolOrder {
+		out[p.name] = len(p.slots)
+	}
+	return out
+}
+
+// writeBusy answers a run acquireRun turned away with err.
+func writeBusy(w http.ResponseWriter, err error) {
+	msg := errBusy.Error()
+	if errors.Is(err, errQueueFull) {
+		msg = err.Error()
+	}
+	w.Header().Set("Retry-After", "1")
+	writeError(w, http.StatusServiceUnavailable, msg)
+}
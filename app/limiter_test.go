@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// concurrentRuns posts n distinct goals at once and returns their statuses.
+func concurrentRuns(t *testing.T, gw string, n int, header ...string) []int {
+	t.Helper()
+	statuses := make([]int, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := doJSON(gw+"/api/run", map[string]any{"goal": fmt.Sprintf("provision cluster %d", i)}, header...)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			statuses[i] = resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	return statuses
+}
+
+// count returns how many of statuses are code.
+func count(statuses []int, code int) int {
+	n := 0
+	for _, s := range statuses {
+		if s == code {
+			n++
+		}
+	}
+	return n
+}
+
+func TestConcurrencyLimitAnswers503(t *testing.T) {
+	sup := fakeSupervisor(t, slow(300*time.Millisecond))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_CONCURRENT_RUNS", "2", "QUEUE_TIMEOUT", "50ms")
+
+	statuses := concurrentRuns(t, gw.URL, 3)
+	if count(statuses, http.StatusOK) != 2 || count(statuses, http.StatusServiceUnavailable) != 1 {
+		t.Errorf("statuses = %v, want two 200 and one 503", statuses)
+	}
+}
+
+func TestHealthReportsInflightRuns(t *testing.T) {
+	sup := fakeSupervisor(t, slow(300*time.Millisecond))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if resp, err := doJSON(gw.URL+"/api/run", map[string]any{"goal": "provision cluster"}); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	waitFor(t, func() bool { return inflightRuns() == 1 })
+	if got := decode(t, get(t, gw.URL+"/api/health"))["inflight"]; got != float64(1) {
+		t.Errorf("inflight = %v, want 1", got)
+	}
+	<-done
+}
+
+func TestProviderPoolsAreSeparate(t *testing.T) {
+	hold := make(chan struct{})
+	aws := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		<-hold
+		w.Write([]byte(`{"status":"done"}`))
+	})
+	gcp := fakeSupervisor(t, answer(http.StatusOK, `{"status":"done"}`))
+	gw := testGateway(t, "SUPERVISOR_AWS", aws, "SUPERVISOR_GCP", gcp,
+		"MAX_CONCURRENT_AWS", "1", "QUEUE_TIMEOUT", "50ms")
+	defer close(hold)
+
+	go func() {
+		if resp, err := doJSON(gw.URL+"/api/run", map[string]any{"goal": "list buckets", "provider": "aws"}); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	waitFor(t, func() bool { return inflightByPool()["aws"] == 1 })
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list instances", "provider": "aws"})
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("second AWS run: status = %d, want 503", resp.StatusCode)
+	}
+	began := time.Now()
+	resp = postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets", "provider": "gcp"})
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GCP run: status = %d, want 200", resp.StatusCode)
+	}
+	if waited := time.Since(began); waited > time.Second {
+		t.Errorf("GCP run took %v behind a full AWS pool", waited)
+	}
+	pools, _ := decode(t, get(t, gw.URL+"/api/health"))["pools"].(map[string]any)
+	if pools["aws"] != float64(1) || pools["gcp"] != float64(0) {
+		t.Errorf("health pools = %v, want aws 1 and gcp 0", pools)
+	}
+}
+
+func TestPriorityQueueServesUrgentRunsFirst(t *testing.T) {
+	hold := make(chan struct{})
+	ran := make(chan string, 10)
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		goal := goalOf(r)
+		if goal == "blocker" {
+			<-hold
+		} else {
+			ran <- goal
+		}
+		w.Write([]byte(`{"status":"done"}`))
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_CONCURRENT_RUNS", "1", "PRIORITY_QUEUE", "true",
+		"MAX_QUEUE_LEN", "4", "QUEUE_TIMEOUT", "5s")
+
+	var wg sync.WaitGroup
+	run := func(goal, priority string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := doJSON(gw.URL+"/api/run", map[string]any{"goal": goal, "priority": priority})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("%s: status = %d, want 200", goal, resp.StatusCode)
+			}
+		}()
+	}
+	run("blocker", "low")
+	waitFor(t, func() bool { return inflightRuns() == 1 })
+	queued := []struct{ goal, priority string }{
+		{"routine 1", ""}, {"cleanup", "low"}, {"routine 2", "normal"}, {"outage", "high"},
+	}
+	for i, q := range queued {
+		run(q.goal, q.priority)
+		waitFor(t, func() bool { return waitingRuns.Load() == int64(i+1) })
+	}
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "one too many", "priority": "high"})
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("with the queue full: status = %d, want 503", resp.StatusCode)
+	}
+	if got := decode(t, resp)["error"]; got != "queue full" {
+		t.Errorf("error = %v, want queue full", got)
+	}
+
+	close(hold)
+	wg.Wait()
+	close(ran)
+	var order []string
+	for goal := range ran {
+		order = append(order, goal)
+	}
+	if want := []string{"outage", "routine 1", "routine 2", "cleanup"}; fmt.Sprint(order) != fmt.Sprint(want) {
+		t.Errorf("runs went in order %q, want %q", order, want)
+	}
+}
+
+// queueMetrics reads the queue wait histogram's count and sum and the queue
+// depth gauge from /metrics.
+func queueMetrics(t *testing.T, gw string) map[string]float64 {
+	t.Helper()
+	b, err := io.ReadAll(get(t, gw+"/metrics").Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := map[string]float64{}
+	for _, l := range strings.Split(string(b), "\n") {
+		name, val, ok := strings.Cut(l, " ")
+		if ok && (strings.HasPrefix(name, "mcp_gateway_queue_wait_seconds_") || name == "mcp_gateway_queue_depth") {
+			out[name], _ = strconv.ParseFloat(val, 64)
+		}
+	}
+	return out
+}
+
+func TestQueueWaitIsRecorded(t *testing.T) {
+	sup, calls, release := heldSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_CONCURRENT_RUNS", "1", "QUEUE_TIMEOUT", "5s")
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+	before := queueMetrics(t, gw.URL)
+
+	first := make(chan struct{})
+	go func() {
+		defer close(first)
+		if resp, err := doJSON(gw.URL+"/api/run", map[string]any{"goal": "provision cluster 1"}); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	waitFor(t, func() bool { return calls.Load() == 1 })
+
+	queued := make(chan *http.Response, 1)
+	go func() {
+		resp, err := doJSON(gw.URL+"/api/run", map[string]any{"goal": "provision cluster 2"})
+		if err != nil {
+			t.Error(err)
+		}
+		queued <- resp
+	}()
+	waitFor(t, func() bool { return waitingRuns.Load() == 1 })
+	if got := queueMetrics(t, gw.URL)["mcp_gateway_queue_depth"]; got != 1 {
+		t.Errorf("mcp_gateway_queue_depth = %v while a run waits, want 1", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	<-first
+
+	resp := <-queued
+	if resp == nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("queued run status = %d, want 200", resp.StatusCode)
+	}
+	if got := serverTiming(t, resp.Header.Get("Server-Timing"))["queue"]; got < 100 {
+		t.Errorf("Server-Timing queue = %vms, want at least 100ms", got)
+	}
+	after := queueMetrics(t, gw.URL)
+	if got := after["mcp_gateway_queue_wait_seconds_count"] - before["mcp_gateway_queue_wait_seconds_count"]; got != 2 {
+		t.Errorf("mcp_gateway_queue_wait_seconds_count went up by %v, want 2", got)
+	}
+	if got := after["mcp_gateway_queue_wait_seconds_sum"] - before["mcp_gateway_queue_wait_seconds_sum"]; got < 0.1 {
+		t.Errorf("mcp_gateway_queue_wait_seconds_sum went up by %v, want at least 0.1", got)
+	}
+	if got := after["mcp_gateway_queue_depth"]; got != 0 {
+		t.Errorf("mcp_gateway_queue_depth = %v after the runs, want 0", got)
+	}
+}
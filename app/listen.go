@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listen opens the server socket. For "unix" networks addr is a socket
+// path: a stale socket left by a previous run is removed first, and the new
+// one gets LISTEN_SOCKET_MODE permissions. Closing the listener, which
+// srv.Shutdown does, removes the file again.
+func listen(network, addr string) (net.Listener, error) {
+	switch network {
+	case "tcp":
+		return net.Listen("tcp", addr)
+	case "unix":
+		if info, err := os.Lstat(addr); err == nil {
+			if info.Mode().Type() != fs.ModeSocket {
+				return nil, fmt.Errorf("%s exists and is not a socket", addr)
+			}
+			if err := os.Remove(addr); err != nil {
+				return nil, err
+			}
+		}
+		ln, err := net.Listen("unix", addr)
+		if err != nil {
+			return nil, err
+		}
+		mode, err := strconv.ParseUint(getenv("LISTEN_SOCKET_MODE", "0660"), 8, 32)
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("LISTEN_SOCKET_MODE: %w", err)
+		}
+		if err := os.Chmod(addr, fs.FileMode(mode)); err != nil {
+			ln.Close()
+			return nil, err
+		}
+		return ln, nil
+	default:
+		return nil, fmt.Errorf("LISTEN_NETWORK must be tcp or unix, not %q", network)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+var (
+	// logger carries every log line but the access log, to stderr. It is set
+	// up from LOG_FORMAT and LOG_LEVEL by initLogging.
+	logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+	// accessLog receives one line per request, to stdout, in the same format
+	// and subject to the same level as logger.
+	accessLog = slog.New(slog.NewTextHandler(os.Stdout, nil))
+	// logLevel is LOG_LEVEL, which a reload may change.
+	logLevel slog.LevelVar
+)
+
+// initLogging builds logger and accessLog for LOG_FORMAT (text or json) and
+// LOG_LEVEL (debug, info, warn or error). It also makes logger the slog and
+// log package default, so lines the standard library writes, such as
+// http.Server errors, come out the same way.
+func initLogging(format, level string) error {
+	if err := setLogLevel(level); err != nil {
+		return err
+	}
+	opts := slog.HandlerOptions{Level: &logLevel}
+	var newHandler func(io.Writer, *slog.HandlerOptions) slog.Handler
+	switch format {
+	case "text":
+		newHandler = func(w io.Writer, o *slog.HandlerOptions) slog.Handler { return slog.NewTextHandler(w, o) }
+	case "json":
+		newHandler = func(w io.Writer, o *slog.HandlerOptions) slog.Handler { return slog.NewJSONHandler(w, o) }
+	default:
+		return fmt.Errorf("LOG_FORMAT: unknown format %q", format)
+	}
+	logger = slog.New(newHandler(os.Stderr, &opts))
+	accessLog = slog.New(newHandler(os.Stdout, &opts))
+	slog.SetDefault(logger)
+	return nil
+}
+
+// setLogLevel sets logLevel to LOG_LEVEL's value.
+func setLogLevel(level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("LOG_LEVEL: unknown level %q", level)
+	}
+	logLevel.Set(lvl)
+	return nil
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
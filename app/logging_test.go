@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"testing"
+)
+
+func TestLogLevel(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	for _, tc := range []struct {
+		level           string
+		debug, requests bool
+	}{
+		{"debug", true, true},
+		{"info", false, true},
+		{"WARN", false, false},
+	} {
+		t.Run(tc.level, func(t *testing.T) {
+			gw := testGateway(t, "SUPERVISOR_URL", sup, "LOG_LEVEL", tc.level)
+			logs := captureLogs(t)
+			postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"})
+
+			if got := logs.find("upstream answered") != nil; got != tc.debug {
+				t.Errorf("debug line logged = %v, want %v", got, tc.debug)
+			}
+			if got := logs.find("request") != nil; got != tc.requests {
+				t.Errorf("request line logged = %v, want %v", got, tc.requests)
+			}
+		})
+	}
+}
+
+func TestLogFormat(t *testing.T) {
+	t.Cleanup(func() { initLogging("text", "info") })
+	for _, format := range []string{"json", "text"} {
+		if err := initLogging(format, "info"); err != nil {
+			t.Fatal(err)
+		}
+		for name, l := range map[string]*slog.Logger{"logger": logger, "accessLog": accessLog} {
+			_, isJSON := l.Handler().(*slog.JSONHandler)
+			_, isText := l.Handler().(*slog.TextHandler)
+			if isJSON != (format == "json") || isText != (format == "text") {
+				t.Errorf("LOG_FORMAT=%s: %s has a %T", format, name, l.Handler())
+			}
+		}
+	}
+	for _, tc := range [][2]string{{"yaml", "info"}, {"json", "loud"}} {
+		if err := initLogging(tc[0], tc[1]); err == nil {
+			t.Errorf("LOG_FORMAT=%s LOG_LEVEL=%s accepted", tc[0], tc[1])
+		}
+	}
+}
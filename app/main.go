@@ -1,92 +1,412 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
-	"io"
-	"log"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	gwclient "mcpgui/client"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/time/rate"
 )
 
-type runReq struct {
-	Goal string `json:"goal"`
-}
+// runReq is the /api/run body, shared with the client package.
+type runReq gwclient.RunRequest
+
 type runResp map[string]any // pass-through JSON
 
+var (
+	// supervisors lists the SUPERVISOR_URL backends, balanced round-robin.
+	supervisors []string
+	// client is shared by every outbound supervisor call.
+	client     *http.Client
+	runTimeout time.Duration
+	maxRetries int
+	// maxBodyBytes caps how much of a /api/run body is read.
+	maxBodyBytes int64
+	// basePath is the BASE_PATH prefix every route, the UI included, is
+	// mounted under, e.g. "/mcp"; empty for the root.
+	basePath string
+	// corsOrigins is CORS_ORIGINS, nil when any origin is allowed. A reload
+	// may replace it.
+	corsOrigins atomic.Pointer[[]string]
+	corsMethods string
+	corsHeaders string
+	corsMaxAge  string // seconds, sent on preflight responses only
+)
+
 func main() {
-	supervisorURL := getenv("SUPERVISOR_URL", "http://127.0.0.1:9000/run")
-	addr := getenv("UI_ADDR", ":8088")
-	client := &http.Client{Timeout: supervisorTimeout()}
+	if err := configure(); err != nil {
+		fatal(err.Error())
+	}
+	network := getenv("LISTEN_NETWORK", "tcp")
+	addr := getenv("LISTEN_ADDR", getenv("ADDR", getenv("UI_ADDR", ":8088")))
+	webDir := getenv("WEB_DIR", "")
+	handler := newHandler()
 
-	mux := http.NewServeMux()
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	shutdownTracing, err := initTracing(ctx, getenv("OTEL_EXPORTER_OTLP_ENDPOINT", ""))
+	if err != nil {
+		fatal("tracing", "err", err)
+	}
+	startJobWorkers(ctx, max(getenvInt("JOB_WORKERS", maxConcurrent), 1), max(getenvInt("JOB_QUEUE_LEN", 100), 1))
+	go evictJobs(ctx)
+	go evictBuckets(ctx)
+	watchReload()
 
-	// Health
-	mux.HandleFunc("/api/health", func(w http.ResponseWriter, r *http.Request) {
-		writeJSON(w, http.StatusOK, map[string]any{
-			"ok":  true,
-			"sup": supervisorURL,
-		})
-	})
+	certFile, keyFile, err := tlsFiles()
+	if err != nil {
+		fatal(err.Error())
+	}
+	scheme := "http"
+	if certFile != "" {
+		scheme = "https"
+	}
 
-	// Proxy /api/run -> SUPERVISOR_URL
-	mux.HandleFunc("/api/run", func(w http.ResponseWriter, r *http.Request) {
-		enableCORS(w, r)
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusNoContent)
-			return
+	srv := newServer(addr, handler)
+	if slices.Contains(os.Args[1:], "--check") || getenv("CHECK_CONFIG", "") == "true" {
+		errs := checkConfig(certFile, keyFile, webDir)
+		for _, err := range errs {
+			logger.Error("config check failed", "err", err)
 		}
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			return
+		if len(errs) > 0 {
+			os.Exit(1)
 		}
-
-		body, err := io.ReadAll(r.Body)
-		if err != nil {
-			http.Error(w, "bad request", http.StatusBadRequest)
-			return
+		logger.Info("config check passed", "supervisors", len(supervisors), "providers", configuredProviders(), "tenants", len(tenantBackends))
+		return
+	}
+	if err := checkAtStartup(context.Background()); err != nil {
+		fatal("startup check failed", "err", err)
+	}
+	ln, err := listen(network, addr)
+	if err != nil {
+		fatal(err.Error())
+	}
+	go func() {
+		if network == "unix" {
+			logger.Info("UI listening", "url", scheme+" over unix:"+addr+" at "+basePath+"/", "supervisors", strings.Join(supervisors, ","))
+		} else {
+			logger.Info("UI listening", "url", scheme+"://127.0.0.1"+addr+basePath+"/", "supervisors", strings.Join(supervisors, ","))
 		}
-
-		// forward to supervisor
-		req, err := http.NewRequest(http.MethodPost, supervisorURL, bytes.NewReader(body))
-		if err != nil {
-			http.Error(w, "upstream error (build)", http.StatusBadGateway)
-			return
+		var err error
+		if scheme == "https" {
+			err = srv.ServeTLS(ln, certFile, keyFile)
+		} else {
+			err = srv.Serve(ln)
 		}
-		req.Header.Set("Content-Type", "application/json")
-
-		resp, err := client.Do(req)
-		if err != nil {
-			http.Error(w, "upstream error (connect): "+err.Error(), http.StatusBadGateway)
-			return
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal(err.Error())
 		}
-		defer resp.Body.Close()
+	}()
 
-		out, err := io.ReadAll(resp.Body)
-		if err != nil {
-			http.Error(w, "upstream error (read)", http.StatusBadGateway)
-			return
-		}
-		// Pass-through status + body
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(resp.StatusCode)
-		w.Write(out)
-	})
+	// Let in-flight runs finish before exiting on SIGINT/SIGTERM.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	draining.Store(true)
+	grace := getenvDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	logger.Info("draining", "grace", grace.String())
+	closeStreamsAfter(getenvDuration("STREAM_DRAIN_TIMEOUT", 5*time.Second))
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error("shutdown", "err", err)
+	}
+	waitStreams(shutdownCtx)
+	if err := shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("tracing shutdown", "err", err)
+	}
+	logger.Info("shutdown complete")
+}
+
+// configure reads every setting but the listener's from the environment
+// and CONFIG_FILE into the package state the handlers use.
+func configure() error {
+	if err := loadConfig(os.Getenv("CONFIG_FILE")); err != nil {
+		return err
+	}
+	if err := initLogging(getenv("LOG_FORMAT", "text"), getenv("LOG_LEVEL", "info")); err != nil {
+		return err
+	}
+	logConfig()
+	supervisorRunPath = getenv("SUPERVISOR_RUN_PATH", "/run")
+	supervisors = defaultBackends()
+	if len(supervisors) == 0 {
+		return errors.New("SUPERVISOR_URL lists no backends")
+	}
+	runTimeout = supervisorTimeout()
+	loadProviders()
+	if err := initDefaultProvider(getenv("DEFAULT_PROVIDER", "")); err != nil {
+		return err
+	}
+	if err := initHardDeadline(getenv("HARD_DEADLINE", "")); err != nil {
+		return err
+	}
+	readonlyBackends = splitList(getenv("SUPERVISOR_READONLY_URL", ""))
+	tenantRateLimit = rate.Limit(getenvFloat("TENANT_RATE_LIMIT", 0))
+	tenantRateBurst = getenvInt("TENANT_RATE_BURST", max(1, int(math.Ceil(float64(tenantRateLimit)))))
+	if err := loadTenants(getenv("TENANTS", "")); err != nil {
+		return err
+	}
+	trustProxy = getenv("TRUST_PROXY", "") == "true"
+	loadClientRate()
+	breaker.threshold = getenvInt("CB_THRESHOLD", 5)
+	breaker.cooldown = getenvDuration("CB_COOLDOWN", 10*time.Second)
+	breaker.slowThreshold = getenvDuration("SLOW_OPEN_THRESHOLD", 0)
+	breaker.latencies = make([]time.Duration, max(getenvInt("SLOW_OPEN_WINDOW", 10), 1))
+	maxRetries = getenvInt("MAX_RETRIES", 2)
+	retries.ratio = getenvFloat("RETRY_BUDGET", 0.1)
+	retries.buckets = make([]budgetBucket, max(int(getenvDuration("RETRY_BUDGET_WINDOW", 10*time.Second)/time.Second), 1))
+	maxBodyBytes = int64(getenvInt("MAX_BODY_BYTES", 1<<20))
+	spoolThreshold = int64(getenvInt("SPOOL_THRESHOLD", 256<<10))
+	streamBodies = getenv("STREAM_REQUEST_BODY", "") == "true"
+	loadForwardHeaders(getenv("FORWARD_HEADERS", ""))
+	loadStripHeaders(getenv("STRIP_HEADERS", ""))
+	slowThreshold = getenvDuration("SLOW_THRESHOLD", 5*time.Second)
+	clientWriteTimeout = getenvDuration("CLIENT_WRITE_TIMEOUT", 30*time.Second)
+	compressUpstream = getenv("COMPRESS_UPSTREAM", "") == "true"
+	compressMinSize = getenvInt("COMPRESS_MIN_SIZE", 1024)
+	if err := loadCompressEncodings(getenv("COMPRESS_ENCODINGS", "br,gzip")); err != nil {
+		return err
+	}
+	compressUpstreamMin = getenvInt("COMPRESS_UPSTREAM_MIN", compressMinSize)
+	validateResponse = getenv("VALIDATE_RESPONSE", "") == "true"
+	supervisorFormat = getenv("SUPERVISOR_FORMAT", "")
+	jobTTL = getenvDuration("JOB_TTL", time.Hour)
+	if err := initJobStore(getenv("JOB_STORE", "memory"), getenv("JOB_STORE_DIR", "./jobs")); err != nil {
+		return err
+	}
+	callbackSecret = []byte(getenv("CALLBACK_SECRET", ""))
+	overrideSecret = []byte(getenv("OVERRIDE_SECRET", ""))
+	idempotencyTTL = getenvDuration("IDEMPOTENCY_TTL", 10*time.Minute)
+	cacheTTL = getenvDuration("CACHE_TTL", 5*time.Minute)
+	dedupInflight = getenv("DEDUP_INFLIGHT", "") == "true"
+	if err := startAudit(getenv("AUDIT_LOG_PATH", "")); err != nil {
+		return fmt.Errorf("audit log: %w", err)
+	}
+	maxGoalLen = getenvInt("MAX_GOAL_LEN", 4000)
+	if err := selectTransformer(getenv("TRANSFORMER", "identity")); err != nil {
+		return err
+	}
+	if err := selectResponseProcessors(getenv("RESPONSE_PROCESSORS", "")); err != nil {
+		return err
+	}
+	if err := loadURLRewrite(getenv("REWRITE_FROM", ""), getenv("REWRITE_TO", "")); err != nil {
+		return err
+	}
+	loadGoalAllowlist(getenv("GOAL_ALLOWLIST", ""))
+	sanitizeGoals = getenv("SANITIZE_GOALS", "reject")
+	if err := loadGoalTemplate(getenv("GOAL_TEMPLATE", "")); err != nil {
+		return err
+	}
+	if err := loadErrorPage(getenv("ERROR_PAGE", "")); err != nil {
+		return err
+	}
+	maxJSONDepth = getenvInt("JSON_MAX_DEPTH", 32)
+	maxJSONElements = getenvInt("JSON_MAX_ELEMENTS", 10000)
+	if err := loadRedactPatterns(getenv("REDACT_PATTERNS", "")); err != nil {
+		return err
+	}
+	initHistory(getenvInt("HISTORY_SIZE", 100))
+	if getenv("DEBUG_CAPTURE", "") == "true" {
+		initDebugCapture(getenvInt("DEBUG_CAPTURE_SIZE", 50), getenvFloat("DEBUG_SAMPLE_RATE", 1))
+	} else {
+		initDebugCapture(0, 1)
+	}
+	maxConcurrent = max(getenvInt("MAX_CONCURRENT_RUNS", 10), 1)
+	initPools()
+	maxResponseBytes = int64(max(getenvInt("MAX_RESPONSE_BYTES", 100<<20), 0))
+	maxBatchGoals = max(getenvInt("MAX_BATCH_GOALS", 20), 1)
+	if err := loadSuccessStatuses(getenv("SUCCESS_STATUSES", "200-299")); err != nil {
+		return err
+	}
+	transport := newTransport(maxConcurrent, getenv("UPSTREAM_H2C", "") == "true")
+	transport.DialContext = connectDialer(getenvDuration("UPSTREAM_CONNECT_TIMEOUT", 3*time.Second))
+	transport.TLSHandshakeTimeout = getenvDuration("UPSTREAM_TLS_HANDSHAKE_TIMEOUT", 10*time.Second)
+	tlsConf, err := upstreamTLS(getenv("UPSTREAM_CLIENT_CERT", ""), getenv("UPSTREAM_CLIENT_KEY", ""), getenv("UPSTREAM_CA_CERT", ""))
+	if err != nil {
+		return err
+	}
+	if tlsConf != nil {
+		transport.TLSClientConfig = tlsConf
+	}
+	if transport.Proxy, err = upstreamProxy(getenv("UPSTREAM_PROXY", "")); err != nil {
+		return err
+	}
+	initEgress(splitList(getenv("UPSTREAM_ALLOWED_HOSTS", "")), getenv("UPSTREAM_ALLOW_PRIVATE", "") == "true", getenv("UPSTREAM_PROXY", ""))
+	transport.Proxy = guardProxy(transport.Proxy)
+	transport.DialContext = guardDial(transport.DialContext)
+	client = &http.Client{Transport: transport}
+	queueTimeout = getenvDuration("QUEUE_TIMEOUT", 2*time.Second)
+	allowGetRun = getenv("ALLOW_GET_RUN", "") == "true"
+	priorityQueue = getenv("PRIORITY_QUEUE", "") == "true"
+	maxQueueLen = max(getenvInt("MAX_QUEUE_LEN", 100), 1)
+	safeMode = getenv("SAFE_MODE", "") == "true"
+	if safeMode {
+		logger.Warn("SAFE_MODE is on: runs are forced to read-only dry runs and jobs are disabled")
+	}
+	apiKeys = nil
+	for _, key := range splitList(getenv("API_KEYS", "")) {
+		apiKeys = append(apiKeys, []byte(key))
+	}
+	authMode := "none"
+	if len(apiKeys) > 0 {
+		authMode = "apikey"
+	}
+	if err := initAuth(getenv("AUTH_MODE", authMode), getenv("BASIC_AUTH_USERS", ""), getenv("JWT_SECRET", ""), getenv("JWT_JWKS_URL", ""),
+		getenv("TRUSTED_AUTH_HEADER", "X-Authenticated-User"), getenv("TRUSTED_CIDRS", "")); err != nil {
+		return err
+	}
+	loadCORSOrigins(getenv("CORS_ORIGINS", "*"))
+	corsMethods = strings.Join(splitList(getenv("CORS_METHODS", "GET, POST, OPTIONS")), ", ")
+	corsHeaders = strings.Join(splitList(getenv("CORS_HEADERS", "Content-Type, Authorization, Idempotency-Key, X-Tenant, X-Run-Timeout, X-Cancelable")), ", ")
+	corsMaxAge = strconv.Itoa(getenvInt("CORS_MAX_AGE", 600))
+	if err := initAdminAuth(splitList(getenv("ADMIN_KEYS", "")), getenv("ADMIN_TOKEN", "")); err != nil {
+		return err
+	}
+	adminRate.limit = rate.Limit(getenvFloat("ADMIN_RATE_LIMIT", 1))
+	adminRate.burst = getenvInt("ADMIN_RATE_BURST", 5)
+	maintenanceRetryAfter = getenvDuration("MAINTENANCE_RETRY_AFTER", time.Minute)
+	maintenance.Store(getenv("MAINTENANCE", "") == "true")
+
+	basePath = strings.TrimRight(getenv("BASE_PATH", ""), "/")
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+	return nil
+}
+
+// newHandler mounts every route under BASE_PATH and wraps them in the
+// middleware each request goes through.
+func newHandler() http.Handler {
+	base := basePath
+	mux := http.NewServeMux()
+
+	// Health
+	mux.HandleFunc(base+"/api/health", handleHealth)
+	mux.HandleFunc(base+"/api/livez", handleLivez)
+	mux.HandleFunc(base+"/api/readyz", handleReadyz)
+	mux.HandleFunc(base+"/api/version", handleVersion)
+	mux.HandleFunc(base+"/api/stats", handleStats)
+
+	// Proxy /api/run -> SUPERVISOR_URL
+	mux.HandleFunc(base+"/api/run", withSchema(rateLimited(requireAuth(refuseInMaintenance(handleRun)))))
+	mux.HandleFunc(base+"/api/run/validate", requireAuth(handleValidate))
+	mux.HandleFunc(base+"/api/run/batch", rateLimitedBy(batchCost, requireAuth(refuseInMaintenance(handleBatch))))
+	mux.HandleFunc(base+"/api/run/stream", rateLimitedBy(batchCost, requireAuth(refuseInMaintenance(handleBatchStream))))
+	mux.HandleFunc(base+"/api/run/cancel", requireAuth(handleCancelRun))
+	mux.HandleFunc(base+"/api/run/ws", rateLimited(requireAuth(refuseInMaintenance(handleRunWS))))
+
+	// Async runs, polled by job ID
+	mux.HandleFunc(base+"/api/history", requireAuth(handleHistory))
+	mux.HandleFunc(base+"/api/runs/{run_id}", requireAuth(handleHistoryRun))
+	mux.HandleFunc(base+"/api/jobs", rateLimited(requireAuth(refuseInMaintenance(handleJobs))))
+	mux.HandleFunc(base+"/api/jobs/{id}", requireAuth(handleJob))
+	mux.HandleFunc(base+"/api/jobs/{id}/progress", requireAuth(handleJobProgress))
+
+	mux.HandleFunc(base+"/api/admin/maintenance", requireAdmin(handleMaintenance))
+	mux.HandleFunc(base+"/api/admin/reload", requireAdmin(handleReload))
+	mux.HandleFunc(base+"/api/admin/drain", requireAdmin(handleDrain(true)))
+	mux.HandleFunc(base+"/api/admin/undrain", requireAdmin(handleDrain(false)))
+	mux.HandleFunc(base+"/api/admin/providers/{name}/disable", requireAdmin(handleProviderSwitch(false)))
+	mux.HandleFunc(base+"/api/admin/providers/{name}/enable", requireAdmin(handleProviderSwitch(true)))
+	mux.HandleFunc(base+"/api/admin/inflight", requireAdmin(handleInflight))
+	mux.HandleFunc(base+"/api/admin/overview", requireAdmin(handleOverview))
+	mux.HandleFunc(base+"/api/admin/tail", requireAdmin(handleTail))
+	mux.HandleFunc(base+"/api/admin/debug/exchanges", requireAdmin(handleExchanges))
+	mux.HandleFunc(base+"/api/admin/recovery", requireAdmin(handleRecovery))
+	mux.HandleFunc(base+"/api/", handleUnknownAPI)
+
+	mux.Handle(base+"/metrics", promhttp.Handler())
+	mux.HandleFunc(base+"/openapi.json", handleOpenAPI)
 
 	// Static UI
-	fs := http.FileServer(http.Dir("./web"))
-	mux.Handle("/", fs)
+	webDir := getenv("WEB_DIR", "")
+	if info, err := os.Stat(webDir); webDir != "" && (err != nil || !info.IsDir()) {
+		logger.Warn("WEB_DIR is not a readable directory; the UI will 404", "web_dir", webDir)
+	}
+	if base == "" {
+		mux.Handle("/", spaHandler(webRoot(webDir)))
+	} else {
+		mux.Handle(base+"/", http.StripPrefix(base, spaHandler(webRoot(webDir))))
+	}
+	return withRequestContext(withLogging(withRecover(withCompression(withCORS(mux)))))
+}
 
-	log.Printf("UI: http://127.0.0.1%s  (proxying to SUPERVISOR_URL=%s)", addr, supervisorURL)
-	log.Fatal(http.ListenAndServe(addr, withCORS(mux)))
+// tlsFiles reads TLS_CERT_FILE and TLS_KEY_FILE, which must be set together.
+// Both empty means plain HTTP.
+func tlsFiles() (certFile, keyFile string, err error) {
+	certFile, keyFile = getenv("TLS_CERT_FILE", ""), getenv("TLS_KEY_FILE", "")
+	if (certFile == "") != (keyFile == "") {
+		return "", "", errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	return certFile, keyFile, nil
 }
 
+// newServer builds the server for handler on addr, with the READ_*, WRITE_
+// and IDLE_TIMEOUT settings and at least TLS 1.2 when it serves HTTPS.
+func newServer(addr string, handler http.Handler) *http.Server {
+	// WriteTimeout bounds the whole response, SSE streams included, so it
+	// defaults to a little over the longest RUN_TIMEOUT[_<PROVIDER>];
+	// lowering it below that cuts off long streamed runs. WebSocket
+	// connections clear their deadlines after the upgrade and are not
+	// affected.
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		TLSConfig:         &tls.Config{MinVersion: tls.VersionTLS12},
+		ReadHeaderTimeout: getenvDuration("READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       getenvDuration("READ_TIMEOUT", time.Minute),
+		WriteTimeout:      getenvDuration("WRITE_TIMEOUT", longestRunTimeout()+30*time.Second),
+		IdleTimeout:       getenvDuration("IDLE_TIMEOUT", 2*time.Minute),
+	}
+}
+
+// enableCORS allows any origin unless CORS_ORIGINS narrows it to an allowlist,
+// in which case only a listed Origin is echoed back. The admin API is exempt
+// from the wildcard: only origins CORS_ORIGINS names may call it.
 func enableCORS(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	if origins := corsOrigins.Load(); origins == nil {
+		if !strings.HasPrefix(r.URL.Path, basePath+"/api/admin/") {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+	} else {
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); origin != "" && slices.Contains(*origins, origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+	}
+	w.Header().Set("Access-Control-Allow-Headers", corsHeaders)
+	w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+	}
+}
+
+// loadCORSOrigins sets corsOrigins from a CORS_ORIGINS list, where "*"
+// allows any origin.
+func loadCORSOrigins(val string) {
+	if origins := splitList(val); !slices.Contains(origins, "*") {
+		corsOrigins.Store(&origins)
+		return
+	}
+	corsOrigins.Store(nil)
 }
+
 func withCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		enableCORS(w, r)
@@ -100,12 +420,19 @@ func writeJSON(w http.ResponseWriter, code int, v any) {
 	_ = json.NewEncoder(w).Encode(v)
 }
 
+// writeError sends the JSON error envelope every endpoint uses.
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]any{"error": msg, "status": code})
+}
+
+// supervisorTimeout reads RUN_TIMEOUT, falling back to the older SUPERVISOR_TIMEOUT name.
 func supervisorTimeout() time.Duration {
-	const fallback = 5 * time.Minute
-	val := getenv("SUPERVISOR_TIMEOUT", "5m")
+	const fallback = time.Minute
+	val := getenv("RUN_TIMEOUT", getenv("SUPERVISOR_TIMEOUT", "60s"))
 	d, err := time.ParseDuration(val)
 	if err != nil {
-		log.Printf("Invalid SUPERVISOR_TIMEOUT %q, defaulting to %s", val, fallback)
+		invalidSettings = append(invalidSettings, "RUN_TIMEOUT")
+		logger.Warn("invalid setting, using the default", "name", "RUN_TIMEOUT", "value", val, "default", fallback.String())
 		return fallback
 	}
 	if d <= 0 {
@@ -113,9 +440,66 @@ func supervisorTimeout() time.Duration {
 	}
 	return d
 }
+
+// getenv reads a setting from the environment, then CONFIG_FILE, then
+// falls back to def.
 func getenv(k, def string) string {
 	if v := os.Getenv(k); v != "" {
 		return v
 	}
+	if v := fileSetting(k); v != "" {
+		return v
+	}
 	return def
 }
+func getenvInt(k string, def int) int {
+	val := getenv(k, "")
+	if val == "" {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 0 {
+		invalidSettings = append(invalidSettings, k)
+		logger.Warn("invalid setting, using the default", "name", k, "value", val, "default", def)
+		return def
+	}
+	return n
+}
+func getenvDuration(k string, def time.Duration) time.Duration {
+	val := getenv(k, "")
+	if val == "" {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		invalidSettings = append(invalidSettings, k)
+		logger.Warn("invalid setting, using the default", "name", k, "value", val, "default", def.String())
+		return def
+	}
+	return d
+}
+
+func getenvFloat(k string, def float64) float64 {
+	val := getenv(k, "")
+	if val == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil || f < 0 {
+		invalidSettings = append(invalidSettings, k)
+		logger.Warn("invalid setting, using the default", "name", k, "value", val, "default", def)
+		return def
+	}
+	return f
+}
+
+// splitList parses a comma-separated env value, dropping blank entries.
+func splitList(val string) []string {
+	var out []string
+	for _, part := range strings.Split(val, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testGateway configures the gateway from env, given as name, value pairs,
+// and serves it until the test ends. Where a test passes no SUPERVISOR_URL
+// the gateway points at an unused port.
+func testGateway(t *testing.T, env ...string) *httptest.Server {
+	t.Helper()
+	t.Setenv("SUPERVISOR_URL", "http://127.0.0.1:1/run")
+	for i := 0; i+1 < len(env); i += 2 {
+		t.Setenv(env[i], env[i+1])
+	}
+	resetState()
+	if err := configure(); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	waitJobs := startJobWorkers(ctx, max(getenvInt("JOB_WORKERS", maxConcurrent), 1), max(getenvInt("JOB_QUEUE_LEN", 100), 1))
+	// srv.Close stops waiting on a connection once it's hijacked, so the
+	// handlers are counted here as well, for the websocket ones.
+	var handlers sync.WaitGroup
+	h := newHandler()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+		handlers.Wait()
+		cancel()
+		waitJobs()
+	})
+	return srv
+}
+
+// resetState clears what earlier tests left behind that configure doesn't
+// set afresh.
+func resetState() {
+	probeCache.Lock()
+	probeCache.at = time.Time{}
+	probeCache.Unlock()
+	draining.Store(false)
+	drained.Store(false)
+	streamShutdown = make(chan struct{})
+	for _, off := range providerDisabled {
+		off.Store(false)
+	}
+	breaker.mu.Lock()
+	breaker.state, breaker.failures, breaker.probing = circuitClosed, 0, false
+	breaker.mu.Unlock()
+	for _, s := range []*bucketSet{buckets, adminBuckets} {
+		s.Lock()
+		clear(s.byIP)
+		s.Unlock()
+	}
+	idempotent.Lock()
+	clear(idempotent.byKey)
+	idempotent.Unlock()
+}
+
+// logBuffer collects log output written from several goroutines.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// lines returns the JSON log lines written so far.
+func (b *logBuffer) lines() []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []map[string]any
+	for _, l := range bytes.Split(b.buf.Bytes(), []byte("\n")) {
+		var m map[string]any
+		if json.Unmarshal(l, &m) == nil {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// find returns the first line whose msg is msg, or nil.
+func (b *logBuffer) find(msg string) map[string]any {
+	for _, l := range b.lines() {
+		if l["msg"] == msg {
+			return l
+		}
+	}
+	return nil
+}
+
+// captureLogs sends logger and accessLog to a buffer in JSON, at LOG_LEVEL,
+// for the rest of the test. It goes after testGateway, which sets them up.
+func captureLogs(t *testing.T) *logBuffer {
+	b := &logBuffer{}
+	prevLogger, prevAccess := logger, accessLog
+	logger = slog.New(slog.NewJSONHandler(b, &slog.HandlerOptions{Level: &logLevel}))
+	accessLog = logger
+	t.Cleanup(func() { logger, accessLog = prevLogger, prevAccess })
+	return b
+}
+
+// fakeSupervisor serves run on /run and answers /health with ok, the way
+// cmd/fakesupervisor does. The URL it returns is the run URL.
+func fakeSupervisor(t *testing.T, run http.HandlerFunc) string {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	})
+	mux.HandleFunc("/run", run)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv.URL + "/run"
+}
+
+// answer is a supervisor that answers every run with status and body.
+func answer(status int, body any) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, status, body)
+	}
+}
+
+// slow is a supervisor that takes d to answer ok, or gives up when the
+// gateway does. It reads the body first, which is what lets the server
+// notice the gateway hanging up.
+func slow(d time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-time.After(d):
+			writeJSON(w, http.StatusOK, map[string]any{"ok": true, "answer": "done"})
+		case <-r.Context().Done():
+		}
+	}
+}
+
+// seenRequest is a request a recording supervisor received.
+type seenRequest struct {
+	header http.Header
+	url    string
+	body   []byte
+}
+
+// recordingSupervisor answers every run ok and hands each request it got,
+// body read, to the returned channel.
+func recordingSupervisor(t *testing.T) (string, chan seenRequest) {
+	t.Helper()
+	seen := make(chan seenRequest, 100)
+	url := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		seen <- seenRequest{header: r.Header.Clone(), url: r.URL.String(), body: body}
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true, "answer": "done"})
+	})
+	return url, seen
+}
+
+// nextRequest returns the supervisor's next request, failing if none comes.
+func nextRequest(t *testing.T, seen chan seenRequest) seenRequest {
+	t.Helper()
+	select {
+	case r := <-seen:
+		return r
+	case <-time.After(2 * time.Second):
+		t.Fatal("the supervisor got no request")
+		return seenRequest{}
+	}
+}
+
+// waitFor polls cond until it holds, failing after a few seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition never held")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// postJSON posts body, marshaled unless it is a string, to url.
+func postJSON(t *testing.T, url string, body any, header ...string) *http.Response {
+	t.Helper()
+	resp, err := doJSON(url, body, header...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// doJSON is postJSON for goroutines other than the test's, which can't
+// fail it. The caller closes the body.
+func doJSON(url string, body any, header ...string) (*http.Response, error) {
+	b, ok := body.(string)
+	if !ok {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		b = string(raw)
+	}
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// get fetches url with the given header name, value pairs.
+func get(t *testing.T, url string, header ...string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// decode reads a JSON object body.
+func decode(t *testing.T, resp *http.Response) map[string]any {
+	t.Helper()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]any
+	if err := json.Unmarshal(bytes.TrimSpace(b), &out); err != nil {
+		t.Fatalf("body %q: %v", b, err)
+	}
+	return out
+}
+
+func TestHealthReportsSupervisorURLFromEnv(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	resp := get(t, gw.URL+"/api/health")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	body := decode(t, resp)
+	if body["sup"] != sup {
+		t.Errorf("sup = %v, want %s", body["sup"], sup)
+	}
+	if got, _ := body["supervisors"].([]any); len(got) != 1 || got[0] != sup {
+		t.Errorf("supervisors = %v, want [%s]", body["supervisors"], sup)
+	}
+	if body["status"] != healthOK {
+		t.Errorf("status = %v, want %s", body["status"], healthOK)
+	}
+}
+
+func TestCORSOrigins(t *testing.T) {
+	for _, tc := range []struct {
+		name, origins, origin, want string
+	}{
+		{"wildcard default", "", "https://any.example", "*"},
+		{"allowed origin", "https://ui.example,https://ops.example", "https://ops.example", "https://ops.example"},
+		{"disallowed origin", "https://ui.example", "https://evil.example", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			env := []string{}
+			if tc.origins != "" {
+				env = append(env, "CORS_ORIGINS", tc.origins)
+			}
+			gw := testGateway(t, env...)
+			resp := get(t, gw.URL+"/api/version", "Origin", tc.origin)
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != tc.want {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	preflight := func(t *testing.T, gw string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodOptions, gw+"/api/run", nil)
+		req.Header.Set("Origin", "https://ui.example")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("preflight status = %d, want 204", resp.StatusCode)
+		}
+		return resp
+	}
+
+	resp := preflight(t, testGateway(t).URL)
+	if got := resp.Header.Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("Access-Control-Max-Age = %q, want the 600s default", got)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Methods"); got != "GET, POST, OPTIONS" {
+		t.Errorf("Access-Control-Allow-Methods = %q, want the defaults", got)
+	}
+
+	resp = preflight(t, testGateway(t, "CORS_MAX_AGE", "60", "CORS_METHODS", "POST,OPTIONS", "CORS_HEADERS", "Content-Type").URL)
+	if got := resp.Header.Get("Access-Control-Max-Age"); got != "60" {
+		t.Errorf("Access-Control-Max-Age = %q, want CORS_MAX_AGE", got)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Methods"); got != "POST, OPTIONS" {
+		t.Errorf("Access-Control-Allow-Methods = %q, want CORS_METHODS", got)
+	}
+	if got := resp.Header.Get("Access-Control-Allow-Headers"); got != "Content-Type" {
+		t.Errorf("Access-Control-Allow-Headers = %q, want CORS_HEADERS", got)
+	}
+}
+
+// selfSignedCert writes a certificate for 127.0.0.1 and its key to dir and
+// returns their paths along with a pool that trusts it. It can sign for
+// clients as well as servers.
+func selfSignedCert(t *testing.T, dir, name string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, pool := selfSignedCert(t, t.TempDir(), "gateway")
+	testGateway(t, "TLS_CERT_FILE", certFile, "TLS_KEY_FILE", keyFile)
+	cert, key, err := tlsFiles()
+	if err != nil || cert != certFile || key != keyFile {
+		t.Fatalf("tlsFiles() = %q, %q, %v", cert, key, err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(ln.Addr().String(), newHandler())
+	go srv.ServeTLS(ln, cert, key)
+	t.Cleanup(func() { srv.Close() })
+
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	resp, err := c.Get("https://" + ln.Addr().String() + "/api/livez")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS == nil || resp.TLS.Version < tls.VersionTLS12 {
+		t.Errorf("status = %d, TLS = %v, want 200 over TLS 1.2 or later", resp.StatusCode, resp.TLS)
+	}
+
+	_, err = (&http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MaxVersion: tls.VersionTLS11}}}).Get("https://" + ln.Addr().String() + "/api/livez")
+	if err == nil {
+		t.Error("a TLS 1.1 client was served")
+	}
+}
+
+func TestTLSFilesMustBeSetTogether(t *testing.T) {
+	t.Setenv("TLS_CERT_FILE", "gateway.crt")
+	t.Setenv("TLS_KEY_FILE", "")
+	if _, _, err := tlsFiles(); err == nil {
+		t.Error("tlsFiles() accepted a certificate without a key")
+	}
+}
+
+func TestReadTimeoutDropsSlowBody(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	testGateway(t, "SUPERVISOR_URL", sup, "READ_TIMEOUT", "200ms")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(ln.Addr().String(), newHandler())
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Promise a body, send a bit of it and then stall.
+	fmt.Fprint(conn, "POST /api/run HTTP/1.1\r\nHost: gw\r\nContent-Type: application/json\r\nContent-Length: 100\r\n\r\n{\"goal\":")
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	start := time.Now()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("connection still open after %v: %v", time.Since(start), err)
+	}
+	select {
+	case r := <-seen:
+		t.Errorf("supervisor got %q from a half-sent body", r.body)
+	default:
+	}
+}
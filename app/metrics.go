@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mcp_gateway_requests_total",
+		Help: "HTTP requests handled by the gateway.",
+	}, []string{"path", "status", "tenant"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mcp_gateway_request_duration_seconds",
+		Help:    "Time spent handling HTTP requests.",
+		Buckets: []float64{.01, .05, .1, .5, 1, 5, 15, 30, 60, 120, 300},
+	}, []string{"path"})
+
+	inflightRequests = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mcp_gateway_inflight_requests",
+		Help: "HTTP requests currently being handled.",
+	})
+
+	queueWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "mcp_gateway_queue_wait_seconds",
+		Help:    "Time runs spent waiting for a concurrency slot.",
+		Buckets: []float64{.001, .01, .05, .1, .5, 1, 5, 15, 30},
+	})
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mcp_gateway_queue_depth",
+		Help: "Runs currently waiting for a concurrency slot.",
+	}, loadFloat(&waitingRuns))
+
+	// The cache and dedup counters read the coalesceStats behind /api/stats,
+	// so neither feature pays for a second set of counters.
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "mcp_gateway_cache_hits_total",
+		Help: "Runs answered from the response cache.",
+	}, loadFloat(&coalesceStats.cacheHits))
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "mcp_gateway_cache_misses_total",
+		Help: "Cacheable runs the response cache could not answer.",
+	}, loadFloat(&coalesceStats.cacheMisses))
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "mcp_gateway_dedup_collapsed_total",
+		Help: "Runs answered with an identical in-flight run's response.",
+	}, loadFloat(&coalesceStats.collapsed))
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "mcp_gateway_slow_client_disconnects_total",
+		Help: "SSE streams torn down because the client fell CLIENT_WRITE_TIMEOUT behind.",
+	}, loadFloat(&slowClients))
+)
+
+func loadFloat(n *atomic.Int64) func() float64 {
+	return func() float64 { return float64(n.Load()) }
+}
+
+// observeRequest records a finished request. path is the matched route
+// pattern so unknown URLs don't explode label cardinality.
+func observeRequest(path, tenant string, status int, d time.Duration) {
+	requestsTotal.WithLabelValues(path, strconv.Itoa(status), tenant).Inc()
+	requestDuration.WithLabelValues(path).Observe(d.Seconds())
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetricsCountRequests(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	get(t, gw.URL+"/api/health")
+	b, err := io.ReadAll(get(t, gw.URL+"/metrics").Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(b)
+	if !strings.Contains(out, `mcp_gateway_requests_total{path="/api/health",status="200",tenant=""}`) {
+		t.Errorf("no /api/health counter in:\n%s", grepLines(out, "mcp_gateway_requests_total"))
+	}
+	if strings.Contains(out, `path="/metrics"`) {
+		t.Error("/metrics counts itself")
+	}
+}
+
+// grepLines keeps the lines of s that contain sub.
+func grepLines(s, sub string) string {
+	var out []string
+	for _, l := range strings.Split(s, "\n") {
+		if strings.Contains(l, sub) {
+			out = append(out, l)
+		}
+	}
+	return strings.Join(out, "\n")
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// slowThreshold is SLOW_THRESHOLD: requests taking longer get an extra
+// "warn" line in the access log. Zero disables it.
+var slowThreshold time.Duration
+
+// statusRecorder captures the status code and body size written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Flush keeps SSE streaming working through the recorder.
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets WebSocket upgrades take over the connection.
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(rec.ResponseWriter).Hijack()
+	if err == nil && rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter { return rec.ResponseWriter }
+
+// withLogging writes the access log line and request metrics for everything
+// except /metrics itself.
+func withLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == basePath+"/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		if rc := requestContext(r.Context()); rc != nil {
+			start = rc.Start
+		}
+		inflightRequests.Inc()
+		defer inflightRequests.Dec()
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		elapsed := time.Since(start)
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		tenant := tenantLabel(r)
+		observeRequest(route, tenant, rec.status, elapsed)
+
+		accessLog.Info("request",
+			"request_id", requestID(r.Context()),
+			"method", r.Method,
+			"path", r.URL.Path,
+			"client_ip", clientIP(r),
+			"tenant", tenant,
+			"principal", requestContext(r.Context()).principal(),
+			"provider", requestContext(r.Context()).provider(),
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", float64(elapsed.Microseconds())/1000,
+			"sampled", requestContext(r.Context()).sampled(),
+		)
+
+		if slowThreshold > 0 && elapsed > slowThreshold {
+			accessLog.Warn("slow request",
+				"request_id", requestID(r.Context()),
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", rec.status,
+				"duration_ms", float64(elapsed.Microseconds())/1000,
+			)
+		}
+	})
+}
+
+type ctxKey int
+
+const requestContextKey ctxKey = iota
+
+// RequestContext is what every middleware and handler reports about a
+// request, worked out once by withRequestContext so logs, metrics, audit
+// entries and rate limits agree.
+type RequestContext struct {
+	RequestID string
+	ClientIP  string
+	Tenant    string    // X-Tenant, "" for the default tenant
+	Principal string    // who authenticated, set by requireAuth
+	Provider  string    // the run's provider, set by prepareRun
+	Start     time.Time // when the gateway received the request
+	Sampled   bool      // picked for debug capture, see DEBUG_SAMPLE_RATE
+}
+
+// withRequestContext tags every request with an X-Request-ID, reusing the
+// caller's when present, echoes it on the response and stores the request's
+// RequestContext for the handlers below.
+func withRequestContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := &RequestContext{
+			RequestID: r.Header.Get("X-Request-ID"),
+			ClientIP:  resolveClientIP(r),
+			Tenant:    strings.TrimSpace(r.Header.Get("X-Tenant")),
+			Start:     time.Now(),
+			Sampled:   sampleCapture(),
+		}
+		if rc.RequestID == "" || len(rc.RequestID) > 128 {
+			rc.RequestID = newID()
+		}
+		w.Header().Set("X-Request-ID", rc.RequestID)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestContextKey, rc)))
+	})
+}
+
+// requestContext returns the request's RequestContext, or nil outside
+// withRequestContext.
+func requestContext(ctx context.Context) *RequestContext {
+	rc, _ := ctx.Value(requestContextKey).(*RequestContext)
+	return rc
+}
+
+// principal, provider and sampled read rc's fields, "" or false for a nil rc.
+func (rc *RequestContext) principal() string {
+	if rc == nil {
+		return ""
+	}
+	return rc.Principal
+}
+
+func (rc *RequestContext) provider() string {
+	if rc == nil {
+		return ""
+	}
+	return rc.Provider
+}
+
+func (rc *RequestContext) sampled() bool {
+	return rc != nil && rc.Sampled
+}
+
+func requestID(ctx context.Context) string {
+	if rc := requestContext(ctx); rc != nil {
+		return rc.RequestID
+	}
+	return ""
+}
+
+// newID returns a random 16-byte hex identifier.
+func newID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// withRecover turns a handler panic into a logged stack trace and a JSON 500
+// instead of a dropped connection.
+func withRecover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			id := requestID(r.Context())
+			logger.Error("panic serving request", "method", r.Method, "path", r.URL.Path, "request_id", id, "panic", v, "stack", string(debug.Stack()))
+			if rec.status != 0 {
+				// Headers are already out; all we can do is cut the response short.
+				panic(http.ErrAbortHandler)
+			}
+			writeJSON(rec, http.StatusInternalServerError, map[string]any{
+				"error":      "internal server error",
+				"status":     http.StatusInternalServerError,
+				"request_id": id,
+			})
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogRecordsUnknownPath(t *testing.T) {
+	gw := testGateway(t)
+	logs := captureLogs(t)
+
+	resp := get(t, gw.URL+"/api/nope")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", resp.StatusCode)
+	}
+	line := logs.find("request")
+	if line == nil {
+		t.Fatal("no access log line")
+	}
+	if line["status"] != float64(404) || line["path"] != "/api/nope" || line["method"] != "GET" {
+		t.Errorf("line = %v, want GET /api/nope with status 404", line)
+	}
+	for _, k := range []string{"bytes", "duration_ms"} {
+		if _, ok := line[k]; !ok {
+			t.Errorf("line has no %s: %v", k, line)
+		}
+	}
+}
+
+func TestRecoverAnswersJSON500(t *testing.T) {
+	testGateway(t)
+	logs := captureLogs(t)
+	srv := httptest.NewServer(withRequestContext(withRecover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]int
+		m["boom"]++
+	}))))
+	t.Cleanup(srv.Close)
+
+	resp := get(t, srv.URL+"/panics")
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", resp.StatusCode)
+	}
+	body := decode(t, resp)
+	if body["error"] != "internal server error" || body["request_id"] != resp.Header.Get("X-Request-ID") {
+		t.Errorf("body = %v, want the error and the request ID", body)
+	}
+	line := logs.find("panic serving request")
+	if line == nil || !strings.Contains(line["stack"].(string), "TestRecoverAnswersJSON500") {
+		t.Errorf("no panic line with the stack: %v", line)
+	}
+}
+
+func TestSlowRequestsAreWarned(t *testing.T) {
+	sup := fakeSupervisor(t, slow(150*time.Millisecond))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "SLOW_THRESHOLD", "100ms")
+	logs := captureLogs(t)
+
+	postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "snapshot the database"}, "X-Request-ID", "slow-one")
+	get(t, gw.URL+"/api/livez")
+	waitFor(t, func() bool { return len(logs.lines()) >= 3 })
+
+	var warned []map[string]any
+	for _, l := range logs.lines() {
+		if l["msg"] == "slow request" {
+			warned = append(warned, l)
+		} else if l["msg"] == "request" && l["level"] != "INFO" {
+			t.Errorf("request logged at %v, want INFO", l["level"])
+		}
+	}
+	if len(warned) != 1 {
+		t.Fatalf("got %d slow request lines, want 1 for the run only", len(warned))
+	}
+	w := warned[0]
+	if w["level"] != "WARN" || w["path"] != "/api/run" || w["request_id"] != "slow-one" {
+		t.Errorf("slow request line = %v, want WARN for /api/run with its request ID", w)
+	}
+	if d, _ := w["duration_ms"].(float64); d < 100 {
+		t.Errorf("duration_ms = %v, want over the 100ms threshold", w["duration_ms"])
+	}
+}
+
+func TestRequestContextIsShared(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	teamA := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	path := filepath.Join(t.TempDir(), "audit.log")
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "SUPERVISOR_AWS", sup, "AUDIT_LOG_PATH", path,
+		"TRUST_PROXY", "true", "TENANTS", fmt.Sprintf(`{"team-a": %q}`, teamA))
+	logs := captureLogs(t)
+
+	for _, id := range []string{"corr-42", ""} {
+		resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets", "provider": "aws"},
+			"X-Request-ID", id, "X-Forwarded-For", "203.0.113.7")
+		want := resp.Header.Get("X-Request-ID")
+		if want == "" || id != "" && want != id {
+			t.Fatalf("X-Request-ID %q echoed as %q", id, want)
+		}
+		if got := nextRequest(t, seen).header.Get("X-Request-ID"); got != want {
+			t.Errorf("supervisor saw request ID %q, want %q", got, want)
+		}
+
+		var line map[string]any
+		for _, l := range logs.lines() {
+			if l["msg"] == "request" && l["request_id"] == want {
+				line = l
+			}
+		}
+		if line == nil {
+			t.Fatalf("no access log line for %q", want)
+		}
+		if line["client_ip"] != "203.0.113.7" || line["provider"] != "aws" {
+			t.Errorf("access log client_ip %v provider %v, want 203.0.113.7 and aws", line["client_ip"], line["provider"])
+		}
+
+		var entry *auditEntry
+		waitFor(t, func() bool {
+			for _, e := range auditLines(t, path) {
+				if e.RequestID == want {
+					entry = &e
+				}
+			}
+			return entry != nil
+		})
+		if entry.ClientIP != "203.0.113.7" {
+			t.Errorf("audit client_ip = %q, want the access log's", entry.ClientIP)
+		}
+		if runs := recentRuns(); runs[0].RequestID != want {
+			t.Errorf("history request_id = %q, want %q", runs[0].RequestID, want)
+		}
+	}
+
+	postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, "X-Tenant", "team-a", "X-Request-ID", "corr-43")
+	for _, l := range logs.lines() {
+		if l["msg"] == "request" && l["request_id"] == "corr-43" && l["tenant"] != "team-a" {
+			t.Errorf("access log tenant = %v, want team-a", l["tenant"])
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// supervisorFormat is SUPERVISOR_FORMAT. "ndjson" means a 2xx body is a
+// series of {"progress":...} lines ending in the final result; clients that
+// don't stream get only that last object. Anything else relays the body
+// as-is.
+var supervisorFormat string
+
+// collapseProgress replaces an ndjson supervisor body with its final result
+// line, dropping progress lines. It is a no-op in the default format.
+func collapseProgress(resp *http.Response) error {
+	if supervisorFormat != "ndjson" {
+		return nil
+	}
+	final, err := finalResult(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(final))
+	resp.ContentLength = int64(len(final))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(final)))
+	resp.Header.Set("Content-Type", "application/json")
+	return nil
+}
+
+// finalResult returns the last line that is not a progress update: one with
+// a "result" field, or any object without a "progress" field.
+func finalResult(body io.Reader) ([]byte, error) {
+	sc := bufio.NewScanner(body)
+	sc.Buffer(make([]byte, 64<<10), maxValidatedBody)
+	var final []byte
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(line, &obj); err != nil || obj == nil {
+			return nil, errors.New("supervisor sent a line that is not a JSON object")
+		}
+		_, progress := obj["progress"]
+		_, result := obj["result"]
+		if result || !progress {
+			final = append(final[:0], line...)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if final == nil {
+		return nil, errors.New("supervisor sent no final result")
+	}
+	return final, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// progressBody is what a supervisor in the ndjson format sends for one run.
+const progressBody = `{"progress":"planning"}
+{"progress":"applying","step":2}
+{"result":{"status":"done","changed":3}}
+`
+
+func progressSupervisor(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, body)
+	}
+}
+
+func TestNDJSONReturnsFinalResult(t *testing.T) {
+	sup := fakeSupervisor(t, progressSupervisor(progressBody))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "SUPERVISOR_FORMAT", "ndjson")
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "resize the pool"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	got := decode(t, resp)
+	if _, ok := got["progress"]; ok {
+		t.Errorf("body = %v, want progress lines dropped", got)
+	}
+	if result, _ := got["result"].(map[string]any); result["status"] != "done" || result["changed"] != float64(3) {
+		t.Errorf("result = %v, want the final line's", got["result"])
+	}
+}
+
+func TestNDJSONStreamingClientsGetEveryLine(t *testing.T) {
+	sup := fakeSupervisor(t, progressSupervisor(progressBody))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "SUPERVISOR_FORMAT", "ndjson")
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "resize the pool"}, "Accept", "text/event-stream")
+	got, _ := io.ReadAll(resp.Body)
+	for _, line := range strings.Split(strings.TrimSpace(progressBody), "\n") {
+		if !strings.Contains(string(got), line) {
+			t.Errorf("stream is missing %s:\n%s", line, got)
+		}
+	}
+}
+
+func TestNDJSONWithoutResult(t *testing.T) {
+	sup := fakeSupervisor(t, progressSupervisor("{\"progress\":\"planning\"}\n"))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "SUPERVISOR_FORMAT", "ndjson")
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "resize the pool"})
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", resp.StatusCode)
+	}
+	if got := decode(t, resp)["error"]; got != "invalid supervisor response: supervisor sent no final result" {
+		t.Errorf("error = %v", got)
+	}
+}
+
+func TestDefaultFormatPassesThrough(t *testing.T) {
+	sup := fakeSupervisor(t, progressSupervisor(progressBody))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "resize the pool"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	if string(got) != progressBody {
+		t.Errorf("body = %q, want the supervisor's body unchanged", got)
+	}
+}
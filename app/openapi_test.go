@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOpenAPISpec(t *testing.T) {
+	gw := testGateway(t)
+
+	resp := get(t, gw.URL+"/openapi.json")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	spec := decode(t, resp)
+	if v, _ := spec["openapi"].(string); !strings.HasPrefix(v, "3.") {
+		t.Errorf("openapi = %v, want a 3.x version", spec["openapi"])
+	}
+	paths, _ := spec["paths"].(map[string]any)
+	for _, p := range []string{"/api/health", "/api/run", "/api/run/batch", "/api/run/stream", "/api/history", "/api/jobs", "/metrics"} {
+		if paths[p] == nil {
+			t.Errorf("spec has no %s", p)
+		}
+	}
+	components, _ := spec["components"].(map[string]any)
+	schemas, _ := components["schemas"].(map[string]any)
+	for _, s := range []string{"RunRequest", "Error"} {
+		if schemas[s] == nil {
+			t.Errorf("spec has no %s schema", s)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// overrideSecret enables X-Supervisor-Override; OVERRIDE_SECRET. Without it
+// the header is refused outright.
+var overrideSecret []byte
+
+// supervisorOverride returns the backend named by a signed
+// X-Supervisor-Override header, or nil when the request carries none. The
+// X-Supervisor-Sig header must be "sha256=<hex>" (the prefix is optional),
+// the HMAC-SHA256 of the override URL under overrideSecret.
+func supervisorOverride(r *http.Request) ([]string, *validationError) {
+	target := r.Header.Get("X-Supervisor-Override")
+	if target == "" {
+		return nil, nil
+	}
+	if len(overrideSecret) == 0 {
+		return nil, &validationError{Status: http.StatusForbidden, Msg: "supervisor override disabled"}
+	}
+	sig, err := hex.DecodeString(strings.TrimPrefix(r.Header.Get("X-Supervisor-Sig"), "sha256="))
+	mac := hmac.New(sha256.New, overrideSecret)
+	mac.Write([]byte(target))
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, &validationError{Status: http.StatusForbidden, Msg: "invalid supervisor override signature"}
+	}
+	if !validCallbackURL(target) {
+		return nil, &validationError{Status: http.StatusBadRequest, Msg: "invalid supervisor override URL"}
+	}
+	return []string{target}, nil
+}
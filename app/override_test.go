@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+// overrideSig signs target the way X-Supervisor-Sig expects.
+func overrideSig(secret, target string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(target))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestSupervisorOverride(t *testing.T) {
+	usual, usualSeen := recordingSupervisor(t)
+	other, otherSeen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", usual, "OVERRIDE_SECRET", "shared-secret")
+	run := map[string]any{"goal": "list buckets"}
+
+	resp := postJSON(t, gw.URL+"/api/run", run, "X-Supervisor-Override", other, "X-Supervisor-Sig", overrideSig("shared-secret", other))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("signed override: status = %d, want 200", resp.StatusCode)
+	}
+	nextRequest(t, otherSeen)
+
+	resp = postJSON(t, gw.URL+"/api/run", run, "X-Supervisor-Override", other, "X-Supervisor-Sig", overrideSig("wrong-secret", other))
+	if resp.StatusCode != http.StatusForbidden || decode(t, resp)["error"] != "invalid supervisor override signature" {
+		t.Errorf("bad signature: status = %d, want 403", resp.StatusCode)
+	}
+	resp = postJSON(t, gw.URL+"/api/run", run, "X-Supervisor-Override", other)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("unsigned override: status = %d, want 403", resp.StatusCode)
+	}
+
+	postJSON(t, gw.URL+"/api/run", run)
+	nextRequest(t, usualSeen)
+	select {
+	case r := <-otherSeen:
+		t.Errorf("refused override still reached its target: %s", r.body)
+	default:
+	}
+}
+
+func TestSupervisorOverrideDisabledByDefault(t *testing.T) {
+	sup, _ := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"},
+		"X-Supervisor-Override", sup, "X-Supervisor-Sig", overrideSig("", sup))
+	if resp.StatusCode != http.StatusForbidden || decode(t, resp)["error"] != "supervisor override disabled" {
+		t.Errorf("status = %d, want 403 with the override disabled", resp.StatusCode)
+	}
+}
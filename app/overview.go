@@ -0,0 +1,39 @@
+package main
+
+import "net/http"
+
+// overviewRuns caps the history included in the overview.
+const overviewRuns = 20
+
+// handleOverview serves GET /api/admin/overview: what the version, health,
+// stats and history endpoints report, plus the configuration, in one
+// document for the ops dashboard. The supervisor probe is the cached one
+// /api/health uses.
+func handleOverview(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	backends, overall := probeSupervisors(r.Context())
+	runs := recentRuns()
+	writeJSON(w, http.StatusOK, map[string]any{
+		"version": map[string]string{"version": version, "commit": commit, "buildTime": buildTime},
+		"config":  configSummary(),
+		"health": map[string]any{"status": overall, "backends": backends, "providers": configuredProviders(),
+			"disabled_providers": disabledProviders()},
+		"inflight": map[string]any{
+			"total":    inflightRuns(),
+			"queued":   queuedRuns(),
+			"pools":    inflightByPool(),
+			"draining": draining.Load() || drained.Load(),
+		},
+		"circuit":     breaker.State(),
+		"maintenance": maintenance.Load(),
+		"history":     runs[:min(len(runs), overviewRuns)],
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAdminOverview(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"status": "done"}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "ADMIN_KEYS", adminKey)
+	for _, goal := range []string{"list buckets", "rotate the logs"} {
+		postJSON(t, gw.URL+"/api/run", map[string]any{"goal": goal})
+	}
+
+	if resp := get(t, gw.URL+"/api/admin/overview"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without an admin key: status = %d, want 401", resp.StatusCode)
+	}
+	resp := get(t, gw.URL+"/api/admin/overview", asAdmin...)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	got := decode(t, resp)
+	for _, section := range []string{"version", "config", "health", "inflight", "circuit", "maintenance", "history"} {
+		if _, ok := got[section]; !ok {
+			t.Errorf("overview has no %q section", section)
+		}
+	}
+
+	if v, _ := got["version"].(map[string]any); v["version"] != version {
+		t.Errorf("version = %v, want %q", got["version"], version)
+	}
+	var adminKeys any
+	for _, s := range got["config"].([]any) {
+		if s := s.(map[string]any); s["name"] == "ADMIN_KEYS" {
+			adminKeys = s["value"]
+		}
+	}
+	if adminKeys != "****" {
+		t.Errorf("ADMIN_KEYS in config = %v, want it masked", adminKeys)
+	}
+	if h, _ := got["health"].(map[string]any); h["status"] != healthOK {
+		t.Errorf("health = %v, want status ok", got["health"])
+	}
+	if in, _ := got["inflight"].(map[string]any); in["total"] != float64(0) || in["draining"] != false {
+		t.Errorf("inflight = %v, want total 0 and not draining", got["inflight"])
+	}
+	if got["circuit"] != circuitClosed || got["maintenance"] != false {
+		t.Errorf("circuit %v, maintenance %v, want closed and off", got["circuit"], got["maintenance"])
+	}
+	runs, _ := got["history"].([]any)
+	if len(runs) != 2 || runs[0].(map[string]any)["goal"] != "rotate the logs" {
+		t.Errorf("history = %v, want both runs, newest first", got["history"])
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "net/http"
+
+// streamBodies lets /api/run hand the client body to the supervisor as it
+// arrives instead of reading it first; STREAM_REQUEST_BODY.
+var streamBodies bool
+
+// canStreamBody reports whether nothing needs the run body before or more
+// than once: no retries, no Idempotency-Key, a JSON body, and no safe mode,
+// which has to rewrite it.
+func canStreamBody(r *http.Request) bool {
+	return streamBodies && !safeMode && maxRetries == 0 && r.Method == http.MethodPost && isJSON(r) && r.Header.Get("Idempotency-Key") == ""
+}
+
+// streamedCall forwards the request body unread. The gateway can't inspect
+// it, so the goal checks are left to the supervisor and the run goes to the
+// tenant's or the default backends: provider, readonly, dry_run,
+// cacheable and priority have no effect on a streamed body.
+func streamedCall(w http.ResponseWriter, r *http.Request) (*upstreamCall, *validationError) {
+	if r.ContentLength > maxBodyBytes {
+		return nil, &validationError{Status: http.StatusRequestEntityTooLarge, Msg: "request body too large"}
+	}
+	backends, verr := route(tenantOf(r), runReq{})
+	if verr != nil {
+		return nil, verr
+	}
+	return &upstreamCall{
+		backends: backends,
+		timeout:  runTimeoutFor(runReq{}, backends),
+		header:   forwardedHeaders(r),
+		stream:   http.MaxBytesReader(w, r.Body, maxBodyBytes),
+		size:     r.ContentLength,
+	}, nil
+}
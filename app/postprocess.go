@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ResponseProcessor rewrites a 2xx JSON supervisor answer before it reaches
+// the client.
+type ResponseProcessor interface {
+	Process(body []byte) ([]byte, error)
+}
+
+// responseProcessors are the RESPONSE_PROCESSORS choices. They are built per
+// run so a processor can carry run details such as the request ID.
+var responseProcessors = map[string]func(ctx context.Context) ResponseProcessor{
+	"strip-internal":   func(context.Context) ResponseProcessor { return stripInternal{} },
+	"add-gateway-meta": func(ctx context.Context) ResponseProcessor { return gatewayMeta{requestID: requestID(ctx)} },
+	"rewrite-urls":     func(context.Context) ResponseProcessor { return rewriteURLs{} },
+}
+
+// responseChain is the selected RESPONSE_PROCESSORS, applied in order.
+var responseChain []string
+
+func selectResponseProcessors(val string) error {
+	responseChain = nil
+	for _, name := range splitList(val) {
+		if _, ok := responseProcessors[name]; !ok {
+			return fmt.Errorf("RESPONSE_PROCESSORS: unknown processor %q", name)
+		}
+		responseChain = append(responseChain, name)
+	}
+	return nil
+}
+
+// processResponse runs the chain over a 2xx body that is a JSON object and
+// swaps in the result. Other bodies are left alone.
+func processResponse(ctx context.Context, resp *http.Response) error {
+	if len(responseChain) == 0 {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxValidatedBody+1))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if len(body) <= maxValidatedBody && isJSONObject(body) {
+		for _, name := range responseChain {
+			if body, err = responseProcessors[name](ctx).Process(body); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// stripInternal drops top-level keys starting with "_", which supervisors
+// use for debug output.
+type stripInternal struct{}
+
+func (stripInternal) Process(body []byte) ([]byte, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return nil, err
+	}
+	for k := range obj {
+		if strings.HasPrefix(k, "_") {
+			delete(obj, k)
+		}
+	}
+	return json.Marshal(obj)
+}
+
+// gatewayMeta adds a "_gateway" object naming the gateway version and the
+// run's request ID. Listed after strip-internal, it survives it.
+type gatewayMeta struct {
+	requestID string
+}
+
+func (m gatewayMeta) Process(body []byte) ([]byte, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return nil, err
+	}
+	meta, err := json.Marshal(map[string]string{"version": version, "request_id": m.requestID})
+	if err != nil {
+		return nil, err
+	}
+	obj["_gateway"] = meta
+	return json.Marshal(obj)
+}
+
+var (
+	// rewriteFrom are the REWRITE_FROM supervisor base URLs that leak into
+	// answers, such as http://127.0.0.1:9000.
+	rewriteFrom []string
+	// rewriteTo is REWRITE_TO, the public base they are replaced with.
+	rewriteTo string
+)
+
+// loadURLRewrite sets up rewrite-urls. Setting both REWRITE_FROM and
+// REWRITE_TO turns it on, at the end of the chain unless RESPONSE_PROCESSORS
+// already places it.
+func loadURLRewrite(from, to string) error {
+	if (from == "") != (to == "") {
+		return errors.New("REWRITE_FROM and REWRITE_TO must be set together")
+	}
+	rewriteFrom, rewriteTo = nil, ""
+	if from == "" {
+		return nil
+	}
+	for _, u := range splitList(from) {
+		rewriteFrom = append(rewriteFrom, strings.TrimRight(u, "/"))
+	}
+	rewriteTo = strings.TrimRight(to, "/")
+	if !slices.Contains(responseChain, "rewrite-urls") {
+		responseChain = append(responseChain, "rewrite-urls")
+	}
+	return nil
+}
+
+// rewriteURLs replaces the REWRITE_FROM bases with REWRITE_TO inside every
+// string value of the answer, however deeply nested, so links to the
+// supervisor's internal host work through the gateway. Keys are left alone.
+type rewriteURLs struct{}
+
+func (rewriteURLs) Process(body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(rewriteStrings(v))
+}
+
+func rewriteStrings(v any) any {
+	switch v := v.(type) {
+	case string:
+		for _, from := range rewriteFrom {
+			v = strings.ReplaceAll(v, from, rewriteTo)
+		}
+		return v
+	case map[string]any:
+		for k, e := range v {
+			v[k] = rewriteStrings(e)
+		}
+	case []any:
+		for i, e := range v {
+			v[i] = rewriteStrings(e)
+		}
+	}
+	return v
+}
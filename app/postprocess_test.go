@@ -0,0 +1,138 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// debugAnswer is a supervisor answer carrying internal debug keys.
+var debugAnswer = map[string]any{"status": "done", "_trace": "abc", "_timings": map[string]any{"plan_ms": 12}}
+
+func TestStripInternal(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, debugAnswer))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "RESPONSE_PROCESSORS", "strip-internal")
+
+	got := decode(t, postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}))
+	if got["status"] != "done" {
+		t.Errorf("status = %v, want done", got["status"])
+	}
+	for _, k := range []string{"_trace", "_timings"} {
+		if _, ok := got[k]; ok {
+			t.Errorf("%s survived strip-internal", k)
+		}
+	}
+}
+
+func TestAddGatewayMeta(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"status": "done"}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "RESPONSE_PROCESSORS", "add-gateway-meta")
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, "X-Request-ID", "meta-check")
+	meta, _ := decode(t, resp)["_gateway"].(map[string]any)
+	if meta["request_id"] != "meta-check" || meta["version"] != version {
+		t.Errorf("_gateway = %v, want request_id meta-check and version %q", meta, version)
+	}
+}
+
+func TestResponseProcessorChain(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, debugAnswer))
+	for _, tc := range []struct {
+		chain    string
+		withMeta bool
+	}{
+		{"strip-internal,add-gateway-meta", true},
+		{"add-gateway-meta,strip-internal", false},
+	} {
+		t.Run(tc.chain, func(t *testing.T) {
+			gw := testGateway(t, "SUPERVISOR_URL", sup, "RESPONSE_PROCESSORS", tc.chain)
+			got := decode(t, postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}))
+			if _, ok := got["_trace"]; ok {
+				t.Error("_trace survived strip-internal")
+			}
+			if _, ok := got["_gateway"]; ok != tc.withMeta {
+				t.Errorf("_gateway present = %v, want %v", ok, tc.withMeta)
+			}
+		})
+	}
+}
+
+func TestResponseProcessorsSkipOtherAnswers(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		sup  http.HandlerFunc
+		want string
+	}{
+		{"error", answer(http.StatusBadRequest, debugAnswer), "_trace"},
+		{"not an object", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `["_trace"]`)
+		}, `["_trace"]`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sup := fakeSupervisor(t, tc.sup)
+			gw := testGateway(t, "SUPERVISOR_URL", sup, "RESPONSE_PROCESSORS", "strip-internal,add-gateway-meta")
+			body, _ := io.ReadAll(postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}).Body)
+			if !strings.Contains(string(body), tc.want) || strings.Contains(string(body), "_gateway") {
+				t.Errorf("body = %s, want it left alone", body)
+			}
+		})
+	}
+}
+
+func TestUnknownResponseProcessor(t *testing.T) {
+	if err := selectResponseProcessors("strip-internal,add-disclaimer"); err == nil {
+		t.Fatal("an unknown processor was accepted")
+	}
+}
+
+func TestRewriteURLs(t *testing.T) {
+	internal := "http://127.0.0.1:9000"
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{
+		"report": internal + "/artifacts/report.pdf",
+		"steps": []any{
+			map[string]any{"log": "see " + internal + "/artifacts/1.log and http://10.0.0.5/artifacts/2.log"},
+			"plain text",
+			42,
+		},
+		"elsewhere":                   "https://example.com/artifacts/3.log",
+		internal + "/keys/stay/as-is": true,
+	}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "REWRITE_FROM", internal+"/, http://10.0.0.5", "REWRITE_TO", "https://gw.example.com/files/")
+
+	got := decode(t, postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "build the report"}))
+	if got["report"] != "https://gw.example.com/files/artifacts/report.pdf" {
+		t.Errorf("report = %v, want it rewritten", got["report"])
+	}
+	steps, _ := got["steps"].([]any)
+	if len(steps) != 3 {
+		t.Fatalf("steps = %v", got["steps"])
+	}
+	if log := steps[0].(map[string]any)["log"]; log != "see https://gw.example.com/files/artifacts/1.log and https://gw.example.com/files/artifacts/2.log" {
+		t.Errorf("nested log = %v, want both bases rewritten", log)
+	}
+	if steps[1] != "plain text" || steps[2] != float64(42) {
+		t.Errorf("steps = %v, want other values untouched", steps)
+	}
+	if got["elsewhere"] != "https://example.com/artifacts/3.log" {
+		t.Errorf("elsewhere = %v, want it untouched", got["elsewhere"])
+	}
+	if _, ok := got[internal+"/keys/stay/as-is"]; !ok {
+		t.Error("a key was rewritten")
+	}
+}
+
+func TestRewriteURLsNeedsBoth(t *testing.T) {
+	internal := "http://127.0.0.1:9000/artifacts/report.pdf"
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"report": internal}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+	if got := decode(t, postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "build the report"}))["report"]; got != internal {
+		t.Errorf("report = %v, want it untouched without REWRITE_FROM and REWRITE_TO", got)
+	}
+	for _, pair := range [][2]string{{"http://127.0.0.1:9000", ""}, {"", "https://gw.example.com"}} {
+		if err := loadURLRewrite(pair[0], pair[1]); err == nil {
+			t.Errorf("REWRITE_FROM=%q REWRITE_TO=%q accepted", pair[0], pair[1])
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// wantsPretty reports whether a human asked for indented JSON with
+// ?pretty=true or X-Pretty: true.
+func wantsPretty(r *http.Request) bool {
+	return r.URL.Query().Get("pretty") == "true" || r.Header.Get("X-Pretty") == "true"
+}
+
+// indentBody re-indents a JSON supervisor body in place. Bodies that are not
+// JSON, or too large to buffer, are passed on unchanged.
+func indentBody(resp *http.Response) error {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxValidatedBody+1))
+	if err != nil {
+		return err
+	}
+	var rest io.Reader = bytes.NewReader(body)
+	if len(body) > maxValidatedBody {
+		rest = io.MultiReader(rest, resp.Body) // relay the oversized body as is
+	} else if json.Valid(body) {
+		var buf bytes.Buffer
+		json.Indent(&buf, body, "", "  ")
+		buf.WriteByte('\n')
+		rest = &buf
+		resp.ContentLength = int64(buf.Len())
+		resp.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{rest, resp.Body}
+	return nil
+}
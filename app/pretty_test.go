@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPrettyJSON(t *testing.T) {
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"status":"done","items":[1,2]}`)
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	run := func(path string, header ...string) string {
+		t.Helper()
+		resp := postJSON(t, gw.URL+path, map[string]any{"goal": "list buckets"}, header...)
+		body, _ := io.ReadAll(resp.Body)
+		if !json.Valid(body) {
+			t.Fatalf("%s: body is not JSON: %s", path, body)
+		}
+		return string(body)
+	}
+	for _, tc := range []struct {
+		name   string
+		path   string
+		header []string
+	}{
+		{"query", "/api/run?pretty=true", nil},
+		{"header", "/api/run", []string{"X-Pretty", "true"}},
+	} {
+		if body := run(tc.path, tc.header...); !strings.Contains(body, "{\n  \"") || !strings.Contains(body, "\n    1,\n") {
+			t.Errorf("%s: body = %q, want it indented", tc.name, body)
+		}
+	}
+	if body := strings.TrimSuffix(run("/api/run"), "\n"); strings.Contains(body, "\n") || strings.Contains(body, "  ") {
+		t.Errorf("by default: body = %q, want it compact", body)
+	}
+	if body := strings.TrimSuffix(run("/api/run?pretty=false"), "\n"); strings.Contains(body, "\n") {
+		t.Errorf("pretty=false: body = %q, want it compact", body)
+	}
+}
+
+func TestPrettyLeavesOtherBodiesAlone(t *testing.T) {
+	const text = "line one\n  line two"
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, text)
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	resp := postJSON(t, gw.URL+"/api/run?pretty=true", map[string]any{"goal": "list buckets"})
+	if body, _ := io.ReadAll(resp.Body); string(body) != text {
+		t.Errorf("plain text body = %q, want it unchanged", body)
+	}
+
+	resp = postJSON(t, gw.URL+"/api/run?pretty=true", map[string]any{"goal": "list buckets"}, "Accept", "text/event-stream")
+	if body, _ := io.ReadAll(resp.Body); !strings.Contains(string(body), "data: line one\n") {
+		t.Errorf("stream = %q, want the body relayed as SSE frames", body)
+	}
+}
@@ -0,0 +1,908 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// retryBackoff is the delay before the first retry; it doubles on each attempt.
+const retryBackoff = 200 * time.Millisecond
+
+// maxValidatedBody caps the answer buffered when VALIDATE_RESPONSE is on.
+const maxValidatedBody = 10 << 20
+
+// maxResponseBytes is MAX_RESPONSE_BYTES, the most of a supervisor answer
+// the gateway reads once decompressed; zero means no limit.
+var maxResponseBytes int64
+
+// errResponseTooLarge fails reads past maxResponseBytes of an answer.
+var errResponseTooLarge = errors.New("upstream response too large")
+
+// validateResponse rejects 2xx supervisor answers that are not a JSON
+// object; VALIDATE_RESPONSE.
+var validateResponse bool
+
+// minRunTimeout is the shortest deadline X-Run-Timeout may ask for.
+const minRunTimeout = time.Second
+
+// nextBackend is the round-robin cursor into a backend list.
+var nextBackend atomic.Uint64
+
+// newTransport returns the pooled transport shared by all supervisor calls,
+// keeping enough idle connections per host for every concurrent run. With
+// h2c set, http:// supervisors are spoken to over cleartext HTTP/2 so
+// concurrent runs multiplex on one connection.
+func newTransport(perHost int, h2c bool) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = max(100, perHost)
+	t.MaxIdleConnsPerHost = perHost
+	t.IdleConnTimeout = 90 * time.Second
+	if h2c {
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetUnencryptedHTTP2(true)
+		t.Protocols.SetHTTP2(true)
+	}
+	return t
+}
+
+// errConnectTimeout is the cause of a supervisor call that could not even
+// connect within UPSTREAM_CONNECT_TIMEOUT. Unlike a run timeout it costs
+// seconds, so the call may still fail over and retry.
+var errConnectTimeout = errors.New("connect timeout")
+
+// connectDialer dials supervisors giving up after timeout, well before the
+// run's own deadline, so a dead supervisor is noticed in seconds.
+func connectDialer(timeout time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil && ctx.Err() == nil && isTimeout(err) {
+			return nil, fmt.Errorf("dial %s: %w after %s", addr, errConnectTimeout, timeout)
+		}
+		return conn, err
+	}
+}
+
+// handleRun proxies /api/run -> SUPERVISOR_URL.
+func handleRun(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	if safeMode {
+		w.Header().Set("X-Safe-Mode", "true")
+	}
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method == http.MethodHead {
+		checkRun(w, r)
+		return
+	}
+	if r.Method != http.MethodPost && (r.Method != http.MethodGet || !allowGetRun) {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	began := time.Now()
+	ctx, unwatch := watchRun(r.Context())
+	defer unwatch()
+	r = r.WithContext(ctx)
+	r, span := traceRun(r)
+	defer span.End()
+
+	var req runReq
+	var call *upstreamCall
+	var verr *validationError
+	if canStreamBody(r) {
+		call, verr = streamedCall(w, r)
+	} else if spoolsBody(r) {
+		req, call, verr = spooledRun(w, r)
+	} else {
+		var body []byte
+		var ok bool
+		switch {
+		case r.Method == http.MethodGet:
+			body, ok = queryBody(w, r)
+		case isJSON(r):
+			body, ok = readBody(w, r)
+		case isForm(r):
+			body, ok = formBody(w, r)
+		default:
+			writeError(w, http.StatusUnsupportedMediaType, "unsupported media type")
+			return
+		}
+		if !ok {
+			return
+		}
+		req, call, verr = prepareRun(r, body)
+	}
+	if verr != nil {
+		verr.write(w)
+		return
+	}
+	defer call.spool()()
+	if call.timeout, verr = runDeadline(r, call.timeout); verr != nil {
+		verr.write(w)
+		return
+	}
+	start := time.Now()
+	runID := newUUID()
+	w.Header().Set("X-Run-ID", runID)
+	rec := &statusRecorder{ResponseWriter: w}
+	defer func() {
+		setRunStatus(span, rec.status)
+		auditRun(r, req.goal(), call.goalHash, rec.status, start)
+		recordHistory(r, runID, req.goal(), req.Tags, rec.status, start)
+		recordRun(rec.status, time.Since(start))
+	}()
+	w = rec
+	cancelable := wantsCancelToken(r)
+	if key := r.Header.Get("Idempotency-Key"); key != "" && !wantsEventStream(r) && !cancelable {
+		e := claimIdempotent(r.Context(), w, key, call.bodySum())
+		if e == nil {
+			return
+		}
+		capture := &captureWriter{ResponseWriter: w}
+		defer storeIdempotent(key, e, capture)
+		w = capture
+	}
+	if req.Cacheable && cacheTTL > 0 && !wantsEventStream(r) && !wantsText(r) && !wantsPretty(r) && !cancelable {
+		key := cacheKey(r, call)
+		if serveCached(w, key) {
+			return
+		}
+		capture := &captureWriter{ResponseWriter: w}
+		defer storeCached(key, capture)
+		w = capture
+	}
+	if dedupInflight && call.stream == nil && !wantsEventStream(r) && !cancelable {
+		key := dedupKey(r, call)
+		if run, leader := joinSharedRun(key); !leader {
+			if run.share(r.Context(), w) {
+				return
+			}
+		} else {
+			capture := &captureWriter{ResponseWriter: w}
+			defer run.finish(key, capture)
+			w = capture
+		}
+	}
+
+	// forward to supervisor; a client that goes away cancels the call
+	ctx = r.Context()
+	if cancelable {
+		contentType := "application/json"
+		if wantsText(r) {
+			contentType = "text/plain; charset=utf-8"
+		}
+		var done func()
+		ctx, w, done = startCancelable(ctx, rec, contentType)
+		defer done()
+	}
+	queued := time.Now()
+	release, err := acquireRun(ctx, call.backends, call.priority)
+	if err != nil {
+		if context.Cause(ctx) == errRunCanceled {
+			writeError(w, statusCanceled, errRunCanceled.Error())
+			return
+		}
+		writeBusy(w, err)
+		return
+	}
+	defer release()
+
+	sent := time.Now()
+	resp, attempts, err := forward(ctx, call)
+	w.Header().Set("X-Proxy-Retries", strconv.Itoa(attempts))
+	setServerTiming(w, began, sent.Sub(queued), time.Since(sent))
+	if err != nil {
+		if context.Cause(ctx) == errRunCanceled {
+			logger.Info("run canceled by token, upstream call canceled", "request_id", requestID(ctx))
+			writeError(w, statusCanceled, errRunCanceled.Error())
+			return
+		}
+		if context.Cause(ctx) == errHardDeadline {
+			writeError(w, http.StatusGatewayTimeout, errHardDeadline.Error())
+			return
+		}
+		if ctx.Err() == context.Canceled {
+			logger.Info("client disconnected, upstream call canceled", "request_id", requestID(ctx))
+			return
+		}
+		code := http.StatusBadGateway
+		if errors.Is(err, errCircuitOpen) {
+			code = http.StatusServiceUnavailable
+		} else if errors.Is(err, errDestinationBlocked) {
+			code = http.StatusForbidden
+		} else if isTimeout(err) {
+			code = http.StatusGatewayTimeout
+		}
+		if serveErrorPage(w, r, code) {
+			return
+		}
+		switch code {
+		case http.StatusServiceUnavailable, http.StatusForbidden:
+			writeError(w, code, err.Error())
+		case http.StatusGatewayTimeout:
+			writeTimeout(w, call.timeout)
+		default:
+			writeError(w, code, "upstream error (connect): "+err.Error())
+		}
+		return
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("upstream.status_code", resp.StatusCode))
+	markAsync(w, resp)
+	if maxResponseBytes > 0 && resp.ContentLength > maxResponseBytes {
+		writeResponseTooLarge(w)
+		return
+	}
+
+	if wantsEventStream(r) {
+		streamSSE(w, r, resp)
+		return
+	}
+
+	if req.DryRun && resp.StatusCode == http.StatusNotImplemented {
+		// The supervisor can't dry-run; the gateway's own validation passed.
+		drainBody(resp)
+		writeJSON(w, http.StatusOK, map[string]any{"dry_run": true, "validated": true, "goal": req.goal(), "run_id": runID})
+		return
+	}
+	if !upstreamSuccess(resp.StatusCode) {
+		relayRetryAfter(w, resp)
+		if resp.StatusCode >= 500 && serveErrorPage(w, r, resp.StatusCode) {
+			drainBody(resp)
+			return
+		}
+		writeUpstreamError(w, resp)
+		return
+	}
+	if err := collapseProgress(resp); err != nil {
+		if errors.Is(err, errResponseTooLarge) {
+			writeResponseTooLarge(w)
+			return
+		}
+		logger.Warn("invalid supervisor response", "request_id", requestID(ctx), "err", err)
+		writeError(w, http.StatusBadGateway, "invalid supervisor response: "+err.Error())
+		return
+	}
+	if err := processResponse(ctx, resp); err != nil {
+		if errors.Is(err, errResponseTooLarge) {
+			writeResponseTooLarge(w)
+			return
+		}
+		logger.Error("response processor failed", "request_id", requestID(ctx), "err", err)
+		writeError(w, http.StatusBadGateway, "response processing failed")
+		return
+	}
+	if !wantsText(r) {
+		injectRunID(resp, runID)
+	}
+	if wantsPretty(r) && !wantsText(r) {
+		if err := indentBody(resp); err != nil {
+			if errors.Is(err, errResponseTooLarge) {
+				writeResponseTooLarge(w)
+				return
+			}
+			writeError(w, http.StatusBadGateway, "upstream error (read): "+err.Error())
+			return
+		}
+	}
+
+	if wantsText(r) {
+		writeText(w, resp)
+		return
+	}
+	if validateResponse {
+		writeValidated(w, resp)
+		return
+	}
+
+	// Pass-through status + body, streamed so big outputs aren't held in memory.
+	w.Header().Set("Content-Type", "application/json")
+	if resp.ContentLength >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	w.WriteHeader(resp.StatusCode)
+	relayBody(w, r, resp)
+}
+
+// setServerTiming reports how long the run waited for a concurrency slot, how
+// long the supervisor took to answer and how much of the rest of the handler
+// time so far was the gateway's own, e.g.
+// "queue;dur=0.0, upstream;dur=1234.0, gateway;dur=1.2". It must run before
+// the response headers go out, so time spent streaming the body is not
+// included.
+func setServerTiming(w http.ResponseWriter, began time.Time, queue, upstream time.Duration) {
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	gateway := max(time.Since(began)-queue-upstream, 0)
+	w.Header().Set("Server-Timing", fmt.Sprintf("queue;dur=%.1f, upstream;dur=%.1f, gateway;dur=%.1f", ms(queue), ms(upstream), ms(gateway)))
+}
+
+// maxErrorDetail bounds how much of a non-JSON supervisor error is echoed.
+const maxErrorDetail = 512
+
+// writeUpstreamError relays a supervisor answer outside SUCCESS_STATUSES,
+// wrapping bodies that aren't JSON (HTML error pages, plain strings) so
+// clients can always parse it. A status below 400 can't be relayed as a
+// failure, so it becomes a 502.
+func writeUpstreamError(w http.ResponseWriter, resp *http.Response) {
+	if resp.StatusCode < 400 {
+		drainBody(resp)
+		writeJSON(w, http.StatusBadGateway, map[string]any{"error": "unexpected supervisor status", "status": resp.StatusCode})
+		return
+	}
+	out, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if json.Valid(out) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(resp.StatusCode)
+		w.Write(out)
+		return
+	}
+	detail := strings.ToValidUTF8(string(out), "")
+	if len(detail) > maxErrorDetail {
+		detail = strings.ToValidUTF8(detail[:maxErrorDetail], "") + "..."
+	}
+	writeJSON(w, resp.StatusCode, map[string]any{
+		"error":  "supervisor error",
+		"status": resp.StatusCode,
+		"detail": strings.TrimSpace(detail),
+	})
+}
+
+// relayRetryAfter passes a 429 or 503 answer's Retry-After on to the
+// client, so it backs off as long as the supervisor asked the gateway to.
+func relayRetryAfter(w http.ResponseWriter, resp *http.Response) {
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	if v := resp.Header.Get("Retry-After"); v != "" {
+		w.Header().Set("Retry-After", v)
+	}
+}
+
+// writeValidated relays a 2xx answer only if it is a JSON object, and a 502
+// otherwise. Unlike the pass-through path it has to buffer the body.
+func writeValidated(w http.ResponseWriter, resp *http.Response) {
+	out, err := io.ReadAll(io.LimitReader(resp.Body, maxValidatedBody+1))
+	if errors.Is(err, errResponseTooLarge) {
+		writeResponseTooLarge(w)
+		return
+	}
+	if err != nil || len(out) > maxValidatedBody || !isJSONObject(out) {
+		logger.Warn("upstream sent an invalid response", "url", resp.Request.URL.String(), "bytes", len(out), "err", err)
+		writeError(w, http.StatusBadGateway, "invalid supervisor response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(out)
+}
+
+// wantsText reports whether the client asked for plain text over JSON, as
+// CLI users piping the result do.
+func wantsText(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "text/plain") && !strings.Contains(accept, "application/json")
+}
+
+// textFields are the answer fields writeText extracts, in order.
+var textFields = []string{"output", "message", "answer"}
+
+// writeText relays a 2xx answer as text/plain: just the answer when the JSON
+// carries one as a string, else the JSON pretty-printed. An answer over
+// maxValidatedBody is a 502 rather than a truncated text.
+func writeText(w http.ResponseWriter, resp *http.Response) {
+	out, err := io.ReadAll(io.LimitReader(resp.Body, maxValidatedBody+1))
+	if errors.Is(err, errResponseTooLarge) {
+		writeResponseTooLarge(w)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "upstream error (read): "+err.Error())
+		return
+	}
+	if len(out) > maxValidatedBody {
+		logger.Warn("upstream answer too large for text", "url", resp.Request.URL.String(), "limit", maxValidatedBody)
+		writeError(w, http.StatusBadGateway, "supervisor answer too large for text")
+		return
+	}
+	if text, ok := answerText(out); ok {
+		out = []byte(text)
+	} else if json.Valid(out) {
+		var buf bytes.Buffer
+		json.Indent(&buf, out, "", "  ")
+		out = buf.Bytes()
+	}
+	if !bytes.HasSuffix(out, []byte("\n")) {
+		out = append(out, '\n')
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(out)
+}
+
+func answerText(body []byte) (string, bool) {
+	var obj map[string]any
+	if json.Unmarshal(body, &obj) != nil {
+		return "", false
+	}
+	for _, k := range textFields {
+		if s, ok := obj[k].(string); ok {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// checkRun answers HEAD /api/run: the POST checks without a supervisor call,
+// 200 when the run would be accepted. A HEAD without a body only has its
+// headers checked: the tenant, the supervisor override and X-Run-Timeout.
+func checkRun(w http.ResponseWriter, r *http.Request) {
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	var verr *validationError
+	if len(bytes.TrimSpace(body)) == 0 {
+		var backends []string
+		if backends, verr = supervisorOverride(r); verr == nil && backends == nil {
+			_, verr = route(tenantOf(r), runReq{})
+		}
+	} else {
+		_, _, verr = prepareRun(r, body)
+	}
+	if verr == nil {
+		_, verr = runDeadline(r, runTimeout)
+	}
+	if verr != nil {
+		verr.write(w)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func isJSONObject(b []byte) bool {
+	var obj map[string]json.RawMessage
+	return json.Unmarshal(b, &obj) == nil && obj != nil
+}
+
+// isJSON reports whether the request declares a JSON body, with or without
+// a charset parameter.
+func isJSON(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == "application/json"
+}
+
+// decodeCharset transcodes a body whose Content-Type declares a charset
+// other than UTF-8, e.g. windows-1252 from an old Windows tool, to UTF-8.
+func decodeCharset(r *http.Request, body []byte) ([]byte, *validationError) {
+	name := bodyCharset(r)
+	if name == "" {
+		return body, nil
+	}
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, &validationError{Status: http.StatusUnsupportedMediaType, Msg: "unsupported charset",
+			Extra: map[string]any{"charset": name}}
+	}
+	out, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return nil, &validationError{Status: http.StatusBadRequest, Msg: "body is not valid " + name}
+	}
+	return out, nil
+}
+
+// bodyCharset is the charset r's Content-Type declares, or "" when it
+// declares none or one UTF-8 already covers.
+func bodyCharset(r *http.Request) string {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	name := strings.ToLower(params["charset"])
+	if err != nil || name == "utf-8" || name == "utf8" || name == "us-ascii" {
+		return ""
+	}
+	return name
+}
+
+func isForm(r *http.Request) bool {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mt == "application/x-www-form-urlencoded"
+}
+
+// formBody turns a plain HTML form post into the JSON body a run expects.
+// Only "goal" is required; "provider" and "thread_id" are optional.
+func formBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	if err := r.ParseForm(); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeTooLarge(w, tooLarge.Limit)
+		} else {
+			writeError(w, http.StatusBadRequest, "invalid form body")
+		}
+		return nil, false
+	}
+	if !r.PostForm.Has("goal") {
+		writeError(w, http.StatusBadRequest, "goal is required")
+		return nil, false
+	}
+	req := runReq{Message: r.PostForm.Get("goal"), Provider: r.PostForm.Get("provider")}
+	if r.PostForm.Has("thread_id") {
+		tid := r.PostForm.Get("thread_id")
+		req.ThreadID = &tid
+	}
+	body, _ := json.Marshal(req)
+	return body, true
+}
+
+// allowGetRun is ALLOW_GET_RUN: GET /api/run?goal=... starts a run, for
+// integrations that can only send GETs. It is off by default since anything
+// able to make the client fetch a URL, a link or an <img> tag included, can
+// then start one.
+var allowGetRun bool
+
+// queryBody is formBody for GET /api/run, reading the same fields from the
+// query string. Its response says, in a Warning header, that the GET had a
+// side effect, and forbids caching it.
+func queryBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	w.Header().Set("Warning", `299 mcp-gateway "GET /api/run starts a run on every request; it is neither safe nor idempotent"`)
+	w.Header().Set("Cache-Control", "no-store")
+	q := r.URL.Query()
+	if !q.Has("goal") {
+		writeError(w, http.StatusBadRequest, "goal is required")
+		return nil, false
+	}
+	req := runReq{Message: q.Get("goal"), Provider: q.Get("provider")}
+	if q.Has("thread_id") {
+		tid := q.Get("thread_id")
+		req.ThreadID = &tid
+	}
+	body, _ := json.Marshal(req)
+	return body, true
+}
+
+// readBody reads at most maxBodyBytes of the request body, transcoded to
+// UTF-8 from a declared charset, answering the client itself when that
+// fails or the body fails checkJSONShape.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		bodyError(err).write(w)
+		return nil, false
+	}
+	body, verr := decodeCharset(r, body)
+	if verr != nil {
+		verr.write(w)
+		return nil, false
+	}
+	if verr := checkJSONShape(body); verr != nil {
+		verr.write(w)
+		return nil, false
+	}
+	return body, true
+}
+
+// runDeadline honors an X-Run-Timeout header, clamped to
+// [minRunTimeout, limit], the run's own timeout.
+func runDeadline(r *http.Request, limit time.Duration) (time.Duration, *validationError) {
+	v := r.Header.Get("X-Run-Timeout")
+	if v == "" {
+		return limit, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, &validationError{Status: http.StatusBadRequest, Msg: "invalid X-Run-Timeout"}
+	}
+	return min(max(d, minRunTimeout), limit), nil
+}
+
+func writeTooLarge(w http.ResponseWriter, limit int64) {
+	writeJSON(w, http.StatusRequestEntityTooLarge, map[string]any{
+		"error":  "request body too large",
+		"status": http.StatusRequestEntityTooLarge,
+		"limit":  limit,
+	})
+}
+
+// forward POSTs the call's body to one of its backends, retrying connection errors and
+// 429/502/503/504 answers up to maxRetries times as far as mayRetry allows.
+// A Retry-After on a 429 or 503 replaces the backoff for the next attempt;
+// when the run's deadline would pass first, that answer is returned as is.
+// It returns the number of attempts made alongside the final response or
+// error.
+func forward(ctx context.Context, call *upstreamCall) (*http.Response, int, error) {
+	if err := breaker.allow(); err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, call.timeout)
+	retries.recordCall()
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		sent := time.Now()
+		resp, err := send(ctx, call)
+		wait := backoff
+		hint, hinted := retryAfter(resp)
+		if hinted {
+			wait = hint
+		}
+		if attempt > maxRetries || !call.mayRetry(resp, err) || (hinted && !beforeDeadline(ctx, wait)) || !retries.allowRetry() {
+			if !errors.Is(err, context.Canceled) {
+				breaker.record(err == nil && upstreamHealthy(resp.StatusCode), time.Since(sent))
+			}
+			if err != nil {
+				cancel()
+				return nil, attempt, err
+			}
+			recordLatency(time.Since(sent))
+			gunzipResponse(resp)
+			limitResponse(resp)
+			resp.Body = &cancelBody{resp.Body, cancel}
+			return resp, attempt, nil
+		}
+		if resp != nil {
+			drainBody(resp)
+			logger.Warn("upstream failed, retrying", "url", resp.Request.URL.String(), "status", resp.StatusCode, "backoff", wait.String())
+		} else {
+			logger.Warn("upstream unreachable, retrying", "err", err, "backoff", wait.String())
+		}
+
+		select {
+		case <-ctx.Done():
+			cancel()
+			if !errors.Is(ctx.Err(), context.Canceled) {
+				breaker.record(false, 0)
+			}
+			return nil, attempt, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// send makes a single attempt, starting at the next backend in round-robin
+// order and falling over to the following ones on connection errors.
+func send(ctx context.Context, call *upstreamCall) (*http.Response, error) {
+	backends := call.backends
+	start := int(nextBackend.Add(1) - 1)
+	var err error
+	for i := range backends {
+		target := backends[(start+i)%len(backends)]
+		var req *http.Request
+		body, size := call.reader()
+		req, err = newOutboundRequest(ctx, http.MethodPost, target, body, call.header)
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = size
+		req.Header.Set("Content-Type", "application/json")
+		if id := requestID(ctx); id != "" {
+			req.Header.Set("X-Request-ID", id)
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			setDeadline(req.Header, deadline)
+		}
+
+		var wrote atomic.Bool
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			WroteHeaders: func() { wrote.Store(true) },
+		}))
+		req, endSpan := traceUpstream(req)
+		captured := captureExchange(req, call.body)
+		var resp *http.Response
+		resp, err = client.Do(req)
+		if err != nil && !wrote.Load() {
+			err = unsentError{err}
+		}
+		endSpan(resp, err)
+		captured(resp, err)
+		if err == nil {
+			logger.Debug("upstream answered", "request_id", requestID(ctx), "url", target, "status", resp.StatusCode)
+		}
+		if err == nil || !call.mayRetry(nil, err) || call.stream != nil {
+			return resp, err
+		}
+		if len(backends) > 1 {
+			logger.Warn("upstream unreachable, falling over", "url", target, "err", err)
+		}
+	}
+	return nil, err
+}
+
+// setDeadline tells the supervisor when the gateway gives up on the run:
+// X-Deadline is the instant in RFC 3339 and X-Timeout-Ms the milliseconds
+// left as the attempt goes out, so a cooperative supervisor can wrap up in
+// time instead of being cut off.
+func setDeadline(h http.Header, deadline time.Time) {
+	h.Set("X-Deadline", deadline.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+	h.Set("X-Timeout-Ms", strconv.FormatInt(max(time.Until(deadline).Milliseconds(), 0), 10))
+}
+
+// drainBody reads what's left of a small body and closes it so the
+// connection goes back to the pool; large leftovers are simply dropped.
+func drainBody(resp *http.Response) {
+	io.CopyN(io.Discard, resp.Body, 64<<10)
+	resp.Body.Close()
+}
+
+// retryable reports whether an attempt failed transiently. Timeouts are not
+// retried since each one already consumed the full run budget.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return !isTimeout(err) && !errors.Is(err, context.Canceled) && !errors.Is(err, errDestinationBlocked)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return !upstreamSuccess(resp.StatusCode)
+	}
+	return false
+}
+
+// retryAfter reads the Retry-After, in seconds or as an HTTP date, of a 429
+// or 503 answer.
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil || (resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable) {
+		return 0, false
+	}
+	v := strings.TrimSpace(resp.Header.Get("Retry-After"))
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// beforeDeadline reports whether waiting d still leaves ctx time to run.
+func beforeDeadline(ctx context.Context, d time.Duration) bool {
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) > d
+}
+
+// unsentError marks an attempt that failed before its request headers were
+// written, so the supervisor cannot have acted on it.
+type unsentError struct{ error }
+
+func (e unsentError) Unwrap() error { return e.error }
+
+// mayRetry reports whether a failed attempt may be repeated, on the same
+// backend or the next one. Only calls flagged idempotent, by an
+// "idempotent":true body or an Idempotency-Key, retry every transient
+// failure; others retry only attempts that never reached the supervisor, as
+// a provisioning goal must not run twice, or ones the supervisor turned away
+// with a 429, which says it did not act on them.
+func (c *upstreamCall) mayRetry(resp *http.Response, err error) bool {
+	if !retryable(resp, err) {
+		return false
+	}
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return c.idempotent || errors.As(err, new(unsentError))
+}
+
+// gunzipResponse decodes a gzip supervisor body as it is read, so whatever
+// inspects or relays it sees plain JSON. The transport only does this itself
+// when it asked for gzip, not when the supervisor volunteers it or the
+// client's Accept-Encoding is in FORWARD_HEADERS. Clients that accept br or
+// gzip get the answer recompressed by withCompression.
+func gunzipResponse(resp *http.Response) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return
+	}
+	resp.Body = &gzipBody{body: resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+}
+
+// gzipBody opens its gzip stream on the first Read, so a corrupt one shows
+// up as a read error like any other broken body.
+type gzipBody struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+	err  error
+}
+
+func (b *gzipBody) Read(p []byte) (int, error) {
+	if b.zr == nil && b.err == nil {
+		b.zr, b.err = gzip.NewReader(b.body)
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.zr.Read(p)
+}
+
+func (b *gzipBody) Close() error {
+	if b.zr != nil {
+		b.zr.Close()
+	}
+	return b.body.Close()
+}
+
+// cancelBody releases the call's deadline once the response is consumed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// limitResponse makes reading past maxResponseBytes of resp's body fail
+// with errResponseTooLarge, after the bytes up to the limit.
+func limitResponse(resp *http.Response) {
+	if maxResponseBytes > 0 {
+		resp.Body = &limitedBody{ReadCloser: resp.Body, left: maxResponseBytes}
+	}
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	// Read one byte past the limit, to tell a body that ends on it from one
+	// that goes on.
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.left {
+		n = int(b.left)
+		b.left = 0
+		return n, errResponseTooLarge
+	}
+	b.left -= int64(n)
+	return n, err
+}
+
+// writeResponseTooLarge reports an answer longer than maxResponseBytes.
+func writeResponseTooLarge(w http.ResponseWriter) {
+	writeJSON(w, http.StatusBadGateway, map[string]any{
+		"error":  errResponseTooLarge.Error(),
+		"status": http.StatusBadGateway,
+		"limit":  maxResponseBytes,
+	})
+}
+
+// writeTimeout reports that the supervisor did not answer within d.
+func writeTimeout(w http.ResponseWriter, d time.Duration) {
+	writeJSON(w, http.StatusGatewayTimeout, map[string]any{
+		"error":   "upstream timeout",
+		"status":  http.StatusGatewayTimeout,
+		"timeout": d.String(),
+	})
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
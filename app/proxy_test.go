@@ -0,0 +1,883 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRunTimeoutDefaultsToAMinute(t *testing.T) {
+	testGateway(t)
+	if runTimeout != time.Minute {
+		t.Errorf("runTimeout = %v, want 1m", runTimeout)
+	}
+}
+
+func TestRunTimeoutAnswers504(t *testing.T) {
+	sup := fakeSupervisor(t, slow(2*time.Second))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "RUN_TIMEOUT", "100ms", "MAX_RETRIES", "0")
+
+	start := time.Now()
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"})
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want 504", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("answered after %v, want about RUN_TIMEOUT", elapsed)
+	}
+	body := decode(t, resp)
+	if body["error"] != "upstream timeout" || body["timeout"] != "100ms" {
+		t.Errorf("body = %v, want upstream timeout after 100ms", body)
+	}
+}
+
+func TestRunBodyOverLimit(t *testing.T) {
+	gw := testGateway(t, "MAX_BODY_BYTES", "64")
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": strings.Repeat("x", 100)})
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want 413", resp.StatusCode)
+	}
+	body := decode(t, resp)
+	if body["error"] != "request body too large" || body["limit"] != float64(64) {
+		t.Errorf("body = %v, want the limit of 64", body)
+	}
+
+	req, _ := http.NewRequest(http.MethodOptions, gw.URL+"/api/run", strings.NewReader(strings.Repeat("x", 100)))
+	pre, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pre.Body.Close()
+	if pre.StatusCode != http.StatusNoContent {
+		t.Errorf("preflight status = %d, want 204", pre.StatusCode)
+	}
+}
+
+// post sends body to url with the given Content-Type, none when empty.
+func post(t *testing.T, url, contentType, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestRunContentType(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	for _, tc := range []struct {
+		contentType string
+		want        int
+	}{
+		{"application/json", http.StatusOK},
+		{"application/json; charset=utf-8", http.StatusOK},
+		{"", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+	} {
+		resp := post(t, gw.URL+"/api/run", tc.contentType, `{"goal":"list buckets"}`)
+		if resp.StatusCode != tc.want {
+			t.Errorf("Content-Type %q: status = %d, want %d", tc.contentType, resp.StatusCode, tc.want)
+			continue
+		}
+		if tc.want == http.StatusUnsupportedMediaType && decode(t, resp)["error"] != "unsupported media type" {
+			t.Errorf("Content-Type %q: no unsupported media type error", tc.contentType)
+		}
+	}
+}
+
+func TestRunStreamsLargeBody(t *testing.T) {
+	const size = 10 << 20
+	payload := make([]byte, size)
+	for i := range payload {
+		payload[i] = 'a' + byte(i%26)
+	}
+	head, tail := []byte(`{"ok":true,"answer":"`), []byte(`"}`)
+	release := make(chan struct{})
+	streamed := make(chan bool, 1)
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(head)
+		w.Write(payload[:size/2])
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+			streamed <- true
+		case <-time.After(5 * time.Second):
+			streamed <- false
+		}
+		w.Write(payload[size/2:])
+		w.Write(tail)
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	c := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := c.Post(gw.URL+"/api/run", "application/json", strings.NewReader(`{"goal":"export plan"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	first := make([]byte, 1<<20)
+	if _, err := io.ReadFull(resp.Body, first); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if !<-streamed {
+		t.Fatal("the first half never reached the client before the supervisor finished")
+	}
+	rest, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := append(first, rest...)
+	want := slices.Concat([]byte(`{"run_id":"`+resp.Header.Get("X-Run-ID")+`",`), head[1:], payload, tail)
+	if !bytes.Equal(got, want) {
+		t.Errorf("body differs: got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestRunRelaysSupervisorErrors(t *testing.T) {
+	page := "<html><body>" + strings.Repeat("Internal Server Error ", 100) + "</body></html>"
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		if goalOf(r) == "bad goal" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"error":"unknown region","region":"mars-1"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(page))
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_RETRIES", "0")
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "bad goal"})
+	if got := body(t, resp); resp.StatusCode != http.StatusUnprocessableEntity || got != `{"error":"unknown region","region":"mars-1"}` {
+		t.Errorf("JSON error = %d %s, want the supervisor's 422 unchanged", resp.StatusCode, got)
+	}
+
+	resp = postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list zones"})
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("HTML error status = %d, want 500", resp.StatusCode)
+	}
+	out := decode(t, resp)
+	detail, _ := out["detail"].(string)
+	if out["error"] != "supervisor error" || out["status"] != float64(http.StatusInternalServerError) {
+		t.Errorf("HTML error = %v, want it wrapped", out)
+	}
+	if !strings.HasPrefix(detail, "<html><body>Internal") || len(detail) > maxErrorDetail+3 {
+		t.Errorf("detail = %q (%d bytes), want the page truncated to %d", detail, len(detail), maxErrorDetail)
+	}
+}
+
+func TestUpstreamH2C(t *testing.T) {
+	protos := make(chan string, 10)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/run" {
+			protos <- r.Proto
+		}
+		answer(http.StatusOK, map[string]any{"ok": true})(w, r)
+	}))
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	for _, tc := range []struct{ h2c, want string }{{"", "HTTP/1.1"}, {"true", "HTTP/2.0"}} {
+		gw := testGateway(t, "SUPERVISOR_URL", srv.URL+"/run", "UPSTREAM_H2C", tc.h2c)
+		statuses := concurrentRuns(t, gw.URL, 3)
+		if n := count(statuses, http.StatusOK); n != 3 {
+			t.Fatalf("UPSTREAM_H2C=%q: %d of 3 runs succeeded: %v", tc.h2c, n, statuses)
+		}
+		for range 3 {
+			if got := <-protos; got != tc.want {
+				t.Errorf("UPSTREAM_H2C=%q: supervisor saw %s, want %s", tc.h2c, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestRunWrongMethodAnswersJSON(t *testing.T) {
+	gw := testGateway(t)
+
+	resp := get(t, gw.URL+"/api/run")
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET /api/run status = %d, want 405", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("Content-Type = %q, want JSON", ct)
+	}
+	if out := decode(t, resp); out["error"] != "method not allowed" || out["status"] != float64(http.StatusMethodNotAllowed) {
+		t.Errorf("body = %v, want the JSON error envelope", out)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "delete the staging VPC", "dry_run": true})
+	resp.Body.Close()
+	if got := nextRequest(t, seen).header.Get("X-Dry-Run"); got != "true" {
+		t.Errorf("X-Dry-Run = %q, want true", got)
+	}
+	resp = postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list VPCs"})
+	resp.Body.Close()
+	if got := nextRequest(t, seen).header.Get("X-Dry-Run"); got != "" {
+		t.Errorf("X-Dry-Run = %q on a normal run, want none", got)
+	}
+}
+
+func TestDryRunFallsBackWhenUnsupported(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusNotImplemented, map[string]any{"error": "dry runs not supported"}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "delete the staging VPC", "dry_run": true})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	out := decode(t, resp)
+	if out["dry_run"] != true || out["validated"] != true || out["goal"] != "delete the staging VPC" {
+		t.Errorf("body = %v, want the gateway's own dry-run answer", out)
+	}
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "", "dry_run": true}); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("empty goal dry run status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestRunTimeoutHeader(t *testing.T) {
+	sup := fakeSupervisor(t, slow(5*time.Second))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "RUN_TIMEOUT", "1500ms", "MAX_RETRIES", "0")
+
+	for _, tc := range []struct{ header, want string }{
+		{"10ms", "1s"}, // raised to minRunTimeout
+		{"1h", "1.5s"}, // capped at RUN_TIMEOUT
+	} {
+		resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, "X-Run-Timeout", tc.header)
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Fatalf("X-Run-Timeout %s: status = %d, want 504", tc.header, resp.StatusCode)
+		}
+		if got := decode(t, resp)["timeout"]; got != tc.want {
+			t.Errorf("X-Run-Timeout %s: timeout = %v, want %s", tc.header, got, tc.want)
+		}
+	}
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, "X-Run-Timeout", "soon"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid X-Run-Timeout status = %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestRunFormBody(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "SUPERVISOR_AWS", sup)
+	form := "application/x-www-form-urlencoded"
+
+	resp := post(t, gw.URL+"/api/run", form, "goal=list+buckets+in+eu-west-1&provider=aws")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	r := nextRequest(t, seen)
+	if ct := r.header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("supervisor Content-Type = %q, want application/json", ct)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(r.body, &got); err != nil {
+		t.Fatalf("supervisor body %q: %v", r.body, err)
+	}
+	if got["message"] != "list buckets in eu-west-1" || got["provider"] != "aws" {
+		t.Errorf("supervisor body = %v, want the form's goal and provider", got)
+	}
+
+	if resp := post(t, gw.URL+"/api/run", form, "provider=aws"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("form without goal status = %d, want 400", resp.StatusCode)
+	} else if msg := decode(t, resp)["error"]; msg != "goal is required" {
+		t.Errorf("error = %v, want goal is required", msg)
+	}
+}
+
+func TestStreamRequestBody(t *testing.T) {
+	head := `{"goal":"import the inventory","inventory":"`
+	gotHead, whole := make(chan struct{}), make(chan []byte, 1)
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		first := make([]byte, len(head))
+		if _, err := io.ReadFull(r.Body, first); err != nil {
+			whole <- nil
+			return
+		}
+		close(gotHead)
+		rest, _ := io.ReadAll(r.Body)
+		whole <- append(first, rest...)
+		answer(http.StatusOK, map[string]any{"ok": true})(w, r)
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "STREAM_REQUEST_BODY", "true", "MAX_RETRIES", "0")
+
+	// A raw connection, so nothing on the client side buffers the body.
+	conn, err := net.Dial("tcp", strings.TrimPrefix(gw.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	chunk := func(s string) { fmt.Fprintf(conn, "%x\r\n%s\r\n", len(s), s) }
+	fmt.Fprint(conn, "POST /api/run HTTP/1.1\r\nHost: gw\r\nContent-Type: application/json\r\nTransfer-Encoding: chunked\r\n\r\n")
+	chunk(head)
+	select {
+	case <-gotHead:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor saw nothing until the client finished its body")
+	}
+	tail := strings.Repeat("vm,", 1000) + `"}`
+	chunk(tail)
+	fmt.Fprint(conn, "0\r\n\r\n")
+	if got := <-whole; string(got) != head+tail {
+		t.Errorf("supervisor got %d bytes, want the %d sent", len(got), len(head+tail))
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("response = %v, %v, want 200", resp, err)
+	}
+}
+
+func TestValidateResponse(t *testing.T) {
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch goalOf(r) {
+		case "object":
+			w.Write([]byte(`{"status":"done","steps":[]}`))
+		case "array":
+			w.Write([]byte(`["not","an","object"]`))
+		default:
+			w.Write([]byte(`{"status":"done",`))
+		}
+	})
+
+	for _, tc := range []struct {
+		validate, goal string
+		want           int
+	}{
+		{"true", "object", http.StatusOK},
+		{"true", "broken", http.StatusBadGateway},
+		{"true", "array", http.StatusBadGateway},
+		{"", "broken", http.StatusOK},
+	} {
+		gw := testGateway(t, "SUPERVISOR_URL", sup, "VALIDATE_RESPONSE", tc.validate)
+		resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": tc.goal})
+		if resp.StatusCode != tc.want {
+			t.Errorf("VALIDATE_RESPONSE=%q, %s answer: status = %d, want %d", tc.validate, tc.goal, resp.StatusCode, tc.want)
+			continue
+		}
+		if tc.want == http.StatusBadGateway && decode(t, resp)["error"] != "invalid supervisor response" {
+			t.Errorf("%s answer: no invalid supervisor response error", tc.goal)
+		}
+	}
+}
+
+func TestRunDisconnectCancelsUpstream(t *testing.T) {
+	started, canceled := make(chan struct{}), make(chan struct{})
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		close(started)
+		<-r.Context().Done()
+		close(canceled)
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+	logs := captureLogs(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, gw.URL+"/api/run", strings.NewReader(`{"goal":"resize the cluster"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", "leaving-early")
+	errc := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		errc <- err
+	}()
+	<-started
+	cancel()
+	if err := <-errc; err == nil {
+		t.Error("request succeeded after its context was canceled")
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor request not canceled after the client left")
+	}
+	waitFor(t, func() bool { return logs.find("client disconnected, upstream call canceled") != nil })
+	if id := logs.find("client disconnected, upstream call canceled")["request_id"]; id != "leaving-early" {
+		t.Errorf("cancellation logged with request_id %v, want leaving-early", id)
+	}
+}
+
+func TestRunForwardsUnknownFields(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	extra := map[string]string{
+		"context":  `{"account":"prod","nested":[1,2.50,{"x":null}]}`,
+		"tags":     `["team:cost","run:nightly"]`,
+		"budget":   `12345678901234567890`,
+		"dry_note": `"keep é as sent"`,
+	}
+	body := `{"goal":"  resize the cluster  "`
+	for k, v := range extra {
+		body += `,"` + k + `":` + v
+	}
+	resp := post(t, gw.URL+"/api/run", "application/json", body+"}")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	var sent map[string]json.RawMessage
+	if err := json.Unmarshal(nextRequest(t, seen).body, &sent); err != nil {
+		t.Fatalf("supervisor got invalid JSON: %v", err)
+	}
+	if string(sent["goal"]) != `"resize the cluster"` {
+		t.Errorf("goal = %s, want it trimmed", sent["goal"])
+	}
+	for k, v := range extra {
+		if string(sent[k]) != v {
+			t.Errorf("%s = %s, want %s as sent", k, sent[k], v)
+		}
+	}
+}
+
+func TestRunAnswersPlainText(t *testing.T) {
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch goalOf(r) {
+		case "output":
+			w.Write([]byte(`{"output":"3 buckets tagged","message":"ignored"}`))
+		case "message":
+			w.Write([]byte(`{"message":"nothing to do\n"}`))
+		case "large":
+			w.Write([]byte(`{"output":"` + strings.Repeat("x", maxValidatedBody) + `"}`))
+		default:
+			w.Write([]byte(`{"status":"done","steps":[1,2]}`))
+		}
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+	text := func(goal string) *http.Response {
+		return postJSON(t, gw.URL+"/api/run", map[string]any{"goal": goal}, "Accept", "text/plain")
+	}
+
+	for goal, want := range map[string]string{
+		"output":  "3 buckets tagged\n",
+		"message": "nothing to do\n",
+		"other":   "{\n  \"status\": \"done\",\n  \"steps\": [\n    1,\n    2\n  ]\n}\n",
+	} {
+		resp := text(goal)
+		if ct := resp.Header.Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+			t.Errorf("%s: Content-Type = %q, want text/plain", goal, ct)
+		}
+		if got := body(t, resp); got != want {
+			t.Errorf("%s: body = %q, want %q", goal, got, want)
+		}
+	}
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "output"})
+	if got := body(t, resp); !strings.Contains(got, `"output":"3 buckets tagged"`) {
+		t.Errorf("JSON client got %q, want the answer passed through", got)
+	}
+
+	logs := captureLogs(t)
+	if resp := text("large"); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("oversized answer: status = %d, want 502 rather than a cut text", resp.StatusCode)
+	}
+	if logs.find("upstream answer too large for text") == nil {
+		t.Error("oversized answer not logged")
+	}
+}
+
+// serverTiming parses a Server-Timing header into durations by metric.
+func serverTiming(t *testing.T, header string) map[string]float64 {
+	t.Helper()
+	out := map[string]float64{}
+	for _, metric := range strings.Split(header, ",") {
+		name, dur, ok := strings.Cut(strings.TrimSpace(metric), ";dur=")
+		v, err := strconv.ParseFloat(dur, 64)
+		if !ok || err != nil {
+			t.Fatalf("Server-Timing %q: bad metric %q", header, metric)
+		}
+		out[name] = v
+	}
+	return out
+}
+
+func TestRunServerTiming(t *testing.T) {
+	sup := fakeSupervisor(t, slow(100*time.Millisecond))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"})
+	timing := serverTiming(t, resp.Header.Get("Server-Timing"))
+	for _, name := range []string{"queue", "upstream", "gateway"} {
+		if _, ok := timing[name]; !ok {
+			t.Errorf("Server-Timing has no %s metric", name)
+		}
+	}
+	if timing["upstream"] < 100 {
+		t.Errorf("upstream;dur=%v, want at least the supervisor's 100ms", timing["upstream"])
+	}
+	if timing["gateway"] > timing["upstream"] {
+		t.Errorf("gateway;dur=%v above upstream;dur=%v", timing["gateway"], timing["upstream"])
+	}
+}
+
+func TestRunServerTimingCancelable(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	// The headers are flushed before the supervisor is called, so the
+	// timing follows the body.
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, "X-Cancelable", "true")
+	body(t, resp)
+	timing := serverTiming(t, resp.Trailer.Get("Server-Timing"))
+	for _, name := range []string{"queue", "upstream", "gateway"} {
+		if _, ok := timing[name]; !ok {
+			t.Errorf("Server-Timing trailer has no %s metric", name)
+		}
+	}
+}
+
+func TestRunHead(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "API_KEYS", "key-one")
+	head := func(body string, header ...string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodHead, gw.URL+"/api/run", strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	auth := []string{"Authorization", "Bearer key-one"}
+
+	for _, tc := range []struct {
+		name, body string
+		header     []string
+		want       int
+	}{
+		{"valid, no body", "", auth, http.StatusOK},
+		{"valid body", `{"goal":"list buckets"}`, auth, http.StatusOK},
+		{"missing auth", `{"goal":"list buckets"}`, nil, http.StatusUnauthorized},
+		{"wrong key", "", []string{"Authorization", "Bearer key-two"}, http.StatusUnauthorized},
+		{"missing goal", `{"goal":""}`, auth, http.StatusBadRequest},
+		{"bad tags", `{"goal":"list buckets","tags":["urgent"]}`, auth, http.StatusBadRequest},
+		{"bad timeout", "", append([]string{"X-Run-Timeout", "soon"}, auth...), http.StatusBadRequest},
+	} {
+		resp := head(tc.body, tc.header...)
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, resp.StatusCode, tc.want)
+		}
+	}
+	if len(seen) != 0 {
+		t.Error("a HEAD reached the supervisor")
+	}
+}
+
+func TestGetRun(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "ALLOW_GET_RUN", "true", "MAX_GOAL_LEN", "40")
+
+	resp := get(t, gw.URL+"/api/run?goal=list+buckets+in+eu-west-1")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if w := resp.Header.Get("Warning"); !strings.HasPrefix(w, "299 ") || !strings.Contains(w, "neither safe nor idempotent") {
+		t.Errorf("Warning = %q, want the side-effect caveat", w)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "no-store" {
+		t.Errorf("Cache-Control = %q, want no-store", cc)
+	}
+	fwd := nextRequest(t, seen)
+	if fwd.header.Get("Content-Type") != "application/json" {
+		t.Errorf("forwarded Content-Type = %q, want application/json", fwd.header.Get("Content-Type"))
+	}
+	var sent map[string]any
+	if err := json.Unmarshal(fwd.body, &sent); err != nil {
+		t.Fatalf("forwarded body %q is not JSON: %v", fwd.body, err)
+	}
+	if goal := cmp.Or(sent["goal"], sent["message"]); goal != "list buckets in eu-west-1" {
+		t.Errorf("forwarded %s, want the query goal", fwd.body)
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  int
+	}{
+		{"", http.StatusBadRequest},
+		{"?goal=", http.StatusBadRequest},
+		{"?goal=" + strings.Repeat("x", 41), http.StatusUnprocessableEntity},
+	} {
+		if resp := get(t, gw.URL+"/api/run"+tc.query); resp.StatusCode != tc.want {
+			t.Errorf("GET /api/run%s: status = %d, want %d", tc.query, resp.StatusCode, tc.want)
+		}
+	}
+	if len(seen) != 0 {
+		t.Error("an invalid GET reached the supervisor")
+	}
+
+	gw = testGateway(t, "SUPERVISOR_URL", sup, "ALLOW_GET_RUN", "")
+	if resp := get(t, gw.URL+"/api/run?goal=list+buckets"); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("with ALLOW_GET_RUN off: status = %d, want 405", resp.StatusCode)
+	}
+	if len(seen) != 0 {
+		t.Error("a GET reached the supervisor with ALLOW_GET_RUN off")
+	}
+}
+
+func TestRunDeadlineHeaders(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "RUN_TIMEOUT", "20s")
+
+	for _, tc := range []struct {
+		header []string
+		budget time.Duration
+	}{
+		{nil, 20 * time.Second},
+		{[]string{"X-Run-Timeout", "5s"}, 5 * time.Second}, // the client's own timeout
+	} {
+		sent := time.Now()
+		postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, tc.header...)
+		h := nextRequest(t, seen).header
+
+		deadline, err := time.Parse(time.RFC3339, h.Get("X-Deadline"))
+		if err != nil {
+			t.Fatalf("X-Deadline = %q: %v", h.Get("X-Deadline"), err)
+		}
+		if want := sent.Add(tc.budget); deadline.Sub(want).Abs() > time.Second {
+			t.Errorf("%v: X-Deadline = %v, want about %v", tc.header, deadline, want)
+		}
+		ms, err := strconv.ParseInt(h.Get("X-Timeout-Ms"), 10, 64)
+		if left := time.Duration(ms) * time.Millisecond; err != nil || left > tc.budget || left < tc.budget-time.Second {
+			t.Errorf("%v: X-Timeout-Ms = %q, want just under %v", tc.header, h.Get("X-Timeout-Ms"), tc.budget)
+		}
+	}
+}
+
+// sized is a supervisor answering a JSON object of exactly n bytes, sent
+// with a Content-Length unless chunked.
+func sized(n int, chunked bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		body := `{"data":"` + strings.Repeat("x", n-11) + `"}`
+		w.Header().Set("Content-Type", "application/json")
+		if chunked {
+			w.(http.Flusher).Flush()
+		} else {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		io.WriteString(w, body)
+	}
+}
+
+func TestResponseSizeLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		size    int
+		chunked bool
+		env     []string
+		want    int
+	}{
+		{"at the limit", 1000, false, nil, http.StatusOK},
+		{"just over", 1001, false, nil, http.StatusBadGateway},
+		{"chunked at the limit", 1000, true, []string{"VALIDATE_RESPONSE", "true"}, http.StatusOK},
+		{"chunked just over", 1001, true, []string{"VALIDATE_RESPONSE", "true"}, http.StatusBadGateway},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sup := fakeSupervisor(t, sized(tc.size, tc.chunked))
+			gw := testGateway(t, append([]string{"SUPERVISOR_URL", sup, "MAX_RESPONSE_BYTES", "1000"}, tc.env...)...)
+
+			resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "dump the inventory"})
+			got := decode(t, resp)
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tc.want)
+			}
+			if tc.want == http.StatusOK && len(got["data"].(string)) != tc.size-11 {
+				t.Errorf("answer cut short: %d bytes of data", len(got["data"].(string)))
+			}
+			if tc.want == http.StatusBadGateway && (got["error"] != "upstream response too large" || got["limit"] != float64(1000)) {
+				t.Errorf("body = %v, want the too-large error with limit 1000", got)
+			}
+		})
+	}
+}
+
+func TestResponseSizeLimitCutsStreams(t *testing.T) {
+	sup := fakeSupervisor(t, sized(1001, true))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_RESPONSE_BYTES", "1000")
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "dump the inventory"}, "Accept", "text/event-stream")
+	if got := body(t, resp); !strings.HasSuffix(got, "event: error\ndata: {\"error\":\"upstream response too large\",\"limit\":1000}\n\n") {
+		t.Errorf("stream ends with %q, want the too-large error event", got[max(len(got)-100, 0):])
+	}
+
+	ndjson := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.(http.Flusher).Flush()
+		for range 100 {
+			io.WriteString(w, "{\"progress\":\"still going\"}\n")
+		}
+	})
+	gw = testGateway(t, "SUPERVISOR_URL", ndjson, "MAX_RESPONSE_BYTES", "1000")
+	got := body(t, postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "dump the inventory"}))
+	if !strings.HasSuffix(got, "\n{\"error\":\"upstream response too large\"}\n") || len(got) > 1100 {
+		t.Errorf("ndjson: %d bytes ending %q, want it cut at the limit with an error line", len(got), got[max(len(got)-60, 0):])
+	}
+}
+
+// unresponsiveAddr returns a loopback address that never completes a TCP
+// handshake, like an unroutable one: its listen backlog is full, so the
+// kernel drops further SYNs and a dial hangs until it times out.
+func unresponsiveAddr(t *testing.T) string {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(sa.(*syscall.SockaddrInet4).Port))
+	filler, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { filler.Close() })
+	if conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond); err == nil {
+		conn.Close()
+		t.Skip("this kernel accepts past a full backlog")
+	}
+	return addr
+}
+
+func TestConnectTimeoutFailsFast(t *testing.T) {
+	addr := unresponsiveAddr(t)
+	gw := testGateway(t, "SUPERVISOR_URL", "http://"+addr+"/run",
+		"UPSTREAM_CONNECT_TIMEOUT", "200ms", "RUN_TIMEOUT", "30s", "MAX_RETRIES", "0")
+
+	start := time.Now()
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"})
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("run took %v against a dead supervisor, want the 200ms connect timeout", took)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("status = %d, want 502", resp.StatusCode)
+	}
+	if got, _ := decode(t, resp)["error"].(string); !strings.Contains(got, "connect timeout after 200ms") {
+		t.Errorf("error = %q, want it to name the connect timeout", got)
+	}
+}
+
+func TestTLSHandshakeTimeoutFailsFast(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		// Accept, then never answer the ClientHello.
+		var held []net.Conn
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				for _, c := range held {
+					c.Close()
+				}
+				return
+			}
+			held = append(held, conn)
+		}
+	}()
+	gw := testGateway(t, "SUPERVISOR_URL", "https://"+ln.Addr().String()+"/run",
+		"UPSTREAM_TLS_HANDSHAKE_TIMEOUT", "200ms", "RUN_TIMEOUT", "30s", "MAX_RETRIES", "0")
+
+	start := time.Now()
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"})
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("run took %v against a silent TLS peer, want the 200ms handshake timeout", took)
+	}
+	if resp.StatusCode == http.StatusOK {
+		t.Error("status = 200 without a handshake")
+	}
+}
+
+// BenchmarkSupervisorClient compares a client made per run, as the gateway
+// once did, with the shared one, by the connections each opens to the
+// supervisor.
+func BenchmarkSupervisorClient(b *testing.B) {
+	for _, perRequest := range []bool{true, false} {
+		name := "shared"
+		if perRequest {
+			name = "per-request"
+		}
+		b.Run(name, func(b *testing.B) {
+			var conns atomic.Int64
+			sup := httptest.NewUnstartedServer(answer(http.StatusOK, map[string]any{"ok": true}))
+			sup.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+				if s == http.StateNew {
+					conns.Add(1)
+				}
+			}
+			sup.Start()
+			defer sup.Close()
+
+			shared := &http.Client{Transport: newTransport(10, false)}
+			defer shared.CloseIdleConnections()
+			for b.Loop() {
+				c := shared
+				if perRequest {
+					c = &http.Client{Transport: newTransport(10, false)}
+				}
+				resp, err := c.Post(sup.URL, "application/json", strings.NewReader(`{"goal":"list buckets"}`))
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if perRequest {
+					c.CloseIdleConnections()
+				}
+			}
+			b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// bucketIdleTTL is how long an unused per-client bucket is kept around.
+const bucketIdleTTL = 3 * time.Minute
+
+// rateSetting is a token bucket's refill rate and size.
+type rateSetting struct {
+	limit rate.Limit
+	burst int
+}
+
+// clientRate is RATE_LIMIT requests/sec per client, in buckets of
+// RATE_BURST; a zero limit disables it. A reload may replace it.
+var clientRate atomic.Pointer[rateSetting]
+
+var (
+	// TENANT_RATE_LIMIT and TENANT_RATE_BURST apply to tenants whose
+	// TENANTS entry sets no "rate"; 0 leaves them unlimited.
+	tenantRateLimit rate.Limit
+	tenantRateBurst int
+)
+
+// tenantLimiters holds each rate-limited tenant's token bucket; the set of
+// tenants is fixed by TENANTS, so they are never evicted.
+var tenantLimiters = map[string]*rate.Limiter{}
+
+// tenantUsage counts each tenant's admitted and refused runs for /api/stats.
+var tenantUsage = map[string]*tenantCounters{}
+
+type tenantCounters struct {
+	allowed, limited atomic.Int64
+}
+
+type bucket struct {
+	lim      *rate.Limiter
+	lastSeen time.Time
+}
+
+// bucketSet holds a token bucket per client IP.
+type bucketSet struct {
+	sync.Mutex
+	byIP map[string]*bucket
+}
+
+// buckets are the RATE_LIMIT buckets and adminBuckets the ADMIN_RATE_LIMIT
+// ones, kept apart so admin calls and runs don't drain each other.
+var (
+	buckets      = &bucketSet{byIP: map[string]*bucket{}}
+	adminBuckets = &bucketSet{byIP: map[string]*bucket{}}
+)
+
+// rateLimited applies the per-client token bucket, then the tenant's,
+// answering 429 with a Retry-After hint once a bucket is empty. Each request
+// costs one token.
+func rateLimited(next http.HandlerFunc) http.HandlerFunc {
+	return rateLimitedBy(func(*http.Request) int { return 1 }, next)
+}
+
+// rateLimitedBy is rateLimited for requests that cost more than one token,
+// such as a batch charged per goal by batchCost. A request refused spends
+// nothing.
+func rateLimitedBy(cost func(*http.Request) int, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			next(w, r)
+			return
+		}
+		n := cost(r)
+		if clientRate.Load().limit > 0 {
+			if delay := take(clientBucket(clientIP(r)), n); delay > 0 {
+				writeRateLimited(w, r, delay, "rate limit exceeded")
+				return
+			}
+		}
+		id := tenantOf(r)
+		if usage, ok := tenantUsage[id]; ok {
+			if lim := tenantLimiters[id]; lim != nil {
+				if delay := take(lim, n); delay > 0 {
+					usage.limited.Add(int64(n))
+					writeRateLimited(w, r, delay, "tenant rate limit exceeded")
+					return
+				}
+			}
+			usage.allowed.Add(int64(n))
+		}
+		next(w, r)
+	}
+}
+
+// batchCost is a batch's number of goals. It reads the body ahead of the
+// handler and puts it back; a body that doesn't parse, or is past the JSON
+// shape limits, costs one token and is refused by the handler. This runs
+// before auth, so the goals are counted without being decoded.
+func batchCost(r *http.Request) int {
+	if r.Method != http.MethodPost {
+		return 1
+	}
+	head, _ := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+	if checkJSONShape(head) != nil {
+		return 1
+	}
+	return max(countGoals(head), 1)
+}
+
+// countGoals counts the elements of a batch body's "goals" array token by
+// token, or returns 0 for a body that isn't a JSON object.
+func countGoals(body []byte) int {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return 0
+	}
+	n := 0
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return 0
+		}
+		if k, _ := key.(string); !strings.EqualFold(k, "goals") {
+			if skipJSONValue(dec) != nil {
+				return 0
+			}
+			continue
+		}
+		// Like json.Unmarshal, the last "goals" wins.
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			return 0
+		}
+		for n = 0; dec.More(); n++ {
+			if skipJSONValue(dec) != nil {
+				return 0
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return 0
+		}
+	}
+	return n
+}
+
+// skipJSONValue reads past the next value in dec, however deeply nested.
+func skipJSONValue(dec *json.Decoder) error {
+	depth := 0
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// take spends n tokens from lim, or reports how long until they are
+// available without spending any. More tokens than the bucket holds cost
+// all of them, so a large batch needs a full bucket rather than never
+// passing.
+func take(lim *rate.Limiter, n int) time.Duration {
+	res := lim.ReserveN(time.Now(), min(n, lim.Burst()))
+	delay := res.Delay()
+	if delay > 0 {
+		res.Cancel()
+	}
+	return delay
+}
+
+func writeRateLimited(w http.ResponseWriter, r *http.Request, delay time.Duration, msg string) {
+	enableCORS(w, r)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, msg)
+}
+
+// addTenantLimiter sets up a tenant's bucket from its TENANTS entry, falling
+// back to TENANT_RATE_LIMIT/TENANT_RATE_BURST.
+func addTenantLimiter(id string, limit *float64, burst *int) {
+	tenantUsage[id] = &tenantCounters{}
+	l, b := tenantRateLimit, tenantRateBurst
+	if limit != nil {
+		l, b = rate.Limit(*limit), max(1, int(math.Ceil(*limit)))
+	}
+	if burst != nil {
+		b = *burst
+	}
+	if l > 0 {
+		tenantLimiters[id] = rate.NewLimiter(l, b)
+	}
+}
+
+// tenantStats reports each tenant's run counters and limit for /api/stats.
+func tenantStats() map[string]any {
+	out := map[string]any{}
+	for id, usage := range tenantUsage {
+		entry := map[string]any{"allowed": usage.allowed.Load(), "limited": usage.limited.Load()}
+		if lim := tenantLimiters[id]; lim != nil {
+			entry["rate"] = float64(lim.Limit())
+			entry["burst"] = lim.Burst()
+		}
+		out[id] = entry
+	}
+	return out
+}
+
+func clientBucket(ip string) *rate.Limiter {
+	return buckets.get(ip, clientRate.Load())
+}
+
+// get returns ip's bucket, creating it with setting.
+func (s *bucketSet) get(ip string, setting *rateSetting) *rate.Limiter {
+	s.Lock()
+	defer s.Unlock()
+	b, ok := s.byIP[ip]
+	if !ok {
+		b = &bucket{lim: rate.NewLimiter(setting.limit, setting.burst)}
+		s.byIP[ip] = b
+	}
+	b.lastSeen = time.Now()
+	return b.lim
+}
+
+// loadClientRate sets clientRate from RATE_LIMIT and RATE_BURST, resizing
+// the buckets clients already have.
+func loadClientRate() {
+	limit := rate.Limit(getenvFloat("RATE_LIMIT", 0))
+	burst := getenvInt("RATE_BURST", max(1, int(math.Ceil(float64(limit)))))
+	buckets.Lock()
+	defer buckets.Unlock()
+	clientRate.Store(&rateSetting{limit: limit, burst: burst})
+	for _, b := range buckets.byIP {
+		b.lim.SetLimit(limit)
+		b.lim.SetBurst(burst)
+	}
+}
+
+// evictBuckets forgets clients that have been quiet for bucketIdleTTL.
+func evictBuckets(ctx context.Context) {
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		cutoff := time.Now().Add(-bucketIdleTTL)
+		buckets.evict(cutoff)
+		adminBuckets.evict(cutoff)
+	}
+}
+
+// evict drops the buckets last used before cutoff.
+func (s *bucketSet) evict(cutoff time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	for ip, b := range s.byIP {
+		if b.lastSeen.Before(cutoff) {
+			delete(s.byIP, ip)
+		}
+	}
+}
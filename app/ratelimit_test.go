@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitPerClient(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "RATE_LIMIT", "0.1", "RATE_BURST", "2", "TRUST_PROXY", "true")
+
+	run := func(header ...string) *http.Response {
+		t.Helper()
+		resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list zones"}, header...)
+		resp.Body.Close()
+		return resp
+	}
+	for i := range 2 {
+		if resp := run(); resp.StatusCode != http.StatusOK {
+			t.Fatalf("run %d status = %d, want 200", i+1, resp.StatusCode)
+		}
+	}
+	resp := run()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("third run status = %d, want 429", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("429 has no Retry-After")
+	}
+	if resp := run("X-Forwarded-For", "203.0.113.7"); resp.StatusCode != http.StatusOK {
+		t.Errorf("another forwarded client status = %d, want its own bucket", resp.StatusCode)
+	}
+	if resp := get(t, gw.URL+"/api/health"); resp.StatusCode == http.StatusTooManyRequests {
+		t.Error("/api/health is rate limited")
+	}
+
+	buckets.evict(time.Now().Add(time.Second))
+	if resp := run(); resp.StatusCode != http.StatusOK {
+		t.Errorf("run after eviction status = %d, want a fresh bucket", resp.StatusCode)
+	}
+}
+
+func TestTenantRateLimit(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "TENANTS", fmt.Sprintf(
+		`{"team-a": {"supervisors": %q, "rate": 0.1, "burst": 2}, "team-b": %q}`, sup, sup))
+	run := func(tenant string) *http.Response {
+		return postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list zones"}, "X-Tenant", tenant)
+	}
+
+	for i := range 2 {
+		if resp := run("team-a"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("team-a run %d: status = %d, want 200", i+1, resp.StatusCode)
+		}
+	}
+	resp := run("team-a")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "10" {
+		t.Fatalf("team-a third run: status = %d, Retry-After %q, want 429 after 10s", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if got := decode(t, resp)["error"]; got != "tenant rate limit exceeded" {
+		t.Errorf("error = %v, want the tenant's limit", got)
+	}
+	for i := range 5 {
+		if resp := run("team-b"); resp.StatusCode != http.StatusOK {
+			t.Errorf("team-b run %d: status = %d, want it unaffected", i+1, resp.StatusCode)
+		}
+	}
+
+	tenants, _ := decode(t, get(t, gw.URL+"/api/stats"))["tenants"].(map[string]any)
+	a, _ := tenants["team-a"].(map[string]any)
+	b, _ := tenants["team-b"].(map[string]any)
+	if a["allowed"] != float64(2) || a["limited"] != float64(1) || a["rate"] != 0.1 || a["burst"] != float64(2) {
+		t.Errorf("team-a stats = %v, want 2 allowed, 1 limited at 0.1/s burst 2", a)
+	}
+	if b["allowed"] != float64(5) || b["limited"] != float64(0) {
+		t.Errorf("team-b stats = %v, want 5 allowed", b)
+	}
+}
+
+func TestRateLimitCoversEveryRunRoute(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "RATE_LIMIT", "0.1", "RATE_BURST", "3", "TRUST_PROXY", "true")
+	goals := map[string]any{"goals": []string{"list zones", "list buckets"}}
+
+	// A batch costs a token per goal: 2 of 3, then 2 more don't fit.
+	for i, path := range []string{"/api/run/batch", "/api/run/stream"} {
+		client := []string{"X-Forwarded-For", "203.0.113." + strconv.Itoa(i+1)}
+		if resp := postJSON(t, gw.URL+path, goals, client...); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: first batch status = %d, want 200", path, resp.StatusCode)
+		}
+		if resp := postJSON(t, gw.URL+path, goals, client...); resp.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("%s: second batch status = %d, want 429", path, resp.StatusCode)
+		}
+		if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list zones"}, client...); resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: run with the last token: status = %d, want 200", path, resp.StatusCode)
+		}
+	}
+
+	// A batch larger than the bucket needs it full.
+	big := map[string]any{"goals": []string{"a", "b", "c", "d", "e"}}
+	if resp := postJSON(t, gw.URL+"/api/run/batch", big, "X-Forwarded-For", "198.51.100.1"); resp.StatusCode != http.StatusOK {
+		t.Errorf("batch over the burst with a full bucket: status = %d, want 200", resp.StatusCode)
+	}
+
+	for i, path := range []string{"/api/jobs", "/api/run/ws"} {
+		client := []string{"X-Forwarded-For", "192.0.2." + strconv.Itoa(i+1)}
+		for range 3 {
+			postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list zones"}, client...)
+		}
+		var resp *http.Response
+		if path == "/api/jobs" {
+			resp = postJSON(t, gw.URL+path, map[string]any{"goal": "list zones"}, client...)
+		} else {
+			resp = get(t, gw.URL+path, append(client, "Connection", "Upgrade", "Upgrade", "websocket",
+				"Sec-WebSocket-Version", "13", "Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")...)
+		}
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("%s with an empty bucket: status = %d, want 429", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestBatchCost(t *testing.T) {
+	testGateway(t, "JSON_MAX_ELEMENTS", "8")
+	for _, tc := range []struct {
+		name, body string
+		want       int
+	}{
+		{"goals", `{"goals":["list zones","list buckets",{"goal":"tag"}],"dry_run":true}`, 3},
+		{"goals after other fields", `{"tags":{"team":["infra"]},"goals":["a","b"]}`, 2},
+		{"no goals", `{"goal":"list zones"}`, 1},
+		{"not an object", `["a","b"]`, 1},
+		{"not JSON", `goals`, 1},
+		{"past JSON_MAX_ELEMENTS", `{"goals":["a","b","c","d","e","f","g","h","i"]}`, 1},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/api/run/batch", strings.NewReader(tc.body))
+		if got := batchCost(r); got != tc.want {
+			t.Errorf("%s: cost = %d, want %d", tc.name, got, tc.want)
+		}
+		if b, _ := io.ReadAll(r.Body); string(b) != tc.body {
+			t.Errorf("%s: body left for the handler = %q", tc.name, b)
+		}
+	}
+}
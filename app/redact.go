@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// redactPatterns are the REDACT_PATTERNS masked out of goals before they are
+// logged or kept in history. The goal sent to the supervisor is unchanged.
+var redactPatterns []*regexp.Regexp
+
+// loadRedactPatterns compiles a comma-separated list of regexes. Commas
+// inside {m,n} repetitions don't split the list.
+func loadRedactPatterns(val string) error {
+	redactPatterns = nil
+	for _, expr := range splitPatterns(val) {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("REDACT_PATTERNS: %w", err)
+		}
+		redactPatterns = append(redactPatterns, re)
+	}
+	return nil
+}
+
+func splitPatterns(val string) []string {
+	var out []string
+	depth, start := 0, 0
+	flush := func(end int) {
+		if p := strings.TrimSpace(val[start:end]); p != "" {
+			out = append(out, p)
+		}
+	}
+	for i := 0; i < len(val); i++ {
+		switch val[i] {
+		case '\\':
+			i++ // skip the escaped character
+		case '{':
+			depth++
+		case '}':
+			depth = max(depth-1, 0)
+		case ',':
+			if depth == 0 {
+				flush(i)
+				start = i + 1
+			}
+		}
+	}
+	flush(len(val))
+	return out
+}
+
+// loggableGoal is goal as it may appear in logs: redacted, then cut to n
+// characters.
+func loggableGoal(goal string, n int) string {
+	for _, re := range redactPatterns {
+		goal = re.ReplaceAllLiteralString(goal, "***")
+	}
+	return truncateRunes(goal, n)
+}
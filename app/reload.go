@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+)
+
+// reloadable lists the settings a reload applies to the running gateway.
+// Every other setting, the listen address and TLS among them, only takes
+// effect on restart.
+var reloadable = []string{"CORS_ORIGINS", "GOAL_ALLOWLIST", "LOG_LEVEL", "MAINTENANCE", "RATE_BURST", "RATE_LIMIT"}
+
+// reloadMu serializes reloads.
+var reloadMu sync.Mutex
+
+// watchReload reloads CONFIG_FILE on every SIGHUP.
+func watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if _, err := reloadConfig(); err != nil {
+				logger.Error("config reload failed, keeping the current settings", "err", err)
+			}
+		}
+	}()
+}
+
+// reloadConfig re-reads CONFIG_FILE and applies the reloadable settings
+// whose effective value changed, logging each one, and returns their names.
+// Other settings that changed keep their current value, with a warning.
+// Since the environment can't change under a running process, a setting
+// given there keeps winning over the file.
+func reloadConfig() ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	cfg := Config{}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		var err error
+		if cfg, err = readConfigFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	configMu.Lock()
+	old := fileConfig
+	for _, k := range settings {
+		if slices.Contains(reloadable, k) || cfg[k] == old[k] {
+			continue
+		}
+		if os.Getenv(k) == "" {
+			logger.Warn("setting changed in CONFIG_FILE but needs a restart, ignored", "name", k)
+		}
+		if v, ok := old[k]; ok {
+			cfg[k] = v
+		} else {
+			delete(cfg, k)
+		}
+	}
+	fileConfig = cfg
+	configMu.Unlock()
+
+	changed := []string{}
+	for _, k := range reloadable {
+		before, after := old[k], cfg[k]
+		if os.Getenv(k) != "" || before == after {
+			continue
+		}
+		logger.Info("setting reloaded", "name", k, "old", before, "new", after)
+		changed = append(changed, k)
+	}
+	for _, k := range changed {
+		switch k {
+		case "CORS_ORIGINS":
+			loadCORSOrigins(getenv("CORS_ORIGINS", "*"))
+		case "GOAL_ALLOWLIST":
+			loadGoalAllowlist(getenv("GOAL_ALLOWLIST", ""))
+		case "LOG_LEVEL":
+			if err := setLogLevel(getenv("LOG_LEVEL", "info")); err != nil {
+				logger.Warn("invalid setting, keeping the current level", "name", k, "err", err)
+			}
+		case "MAINTENANCE":
+			maintenance.Store(getenv("MAINTENANCE", "") == "true")
+		case "RATE_BURST", "RATE_LIMIT":
+			loadClientRate()
+		}
+	}
+	return changed, nil
+}
+
+// handleReload serves POST /api/admin/reload, the SIGHUP reload on demand.
+// It answers with the settings it applied.
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	changed, err := reloadConfig()
+	if err != nil {
+		logger.Error("config reload failed, keeping the current settings", "err", err)
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"reloaded": changed})
+}
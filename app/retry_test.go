@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// hangUp is a supervisor that reads each run and drops the connection
+// without answering, a failure after the run was delivered. It counts the
+// runs it got.
+func hangUp(hits *atomic.Int32) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.Copy(io.Discard, r.Body)
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err == nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestUnsentAttemptsAreAlwaysRetried(t *testing.T) {
+	dead := "http://127.0.0.1:1/run"
+	gw := testGateway(t, "SUPERVISOR_URL", dead, "MAX_RETRIES", "1")
+	logs := captureLogs(t)
+
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "provision cluster"}); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", resp.StatusCode)
+	}
+	if logs.find("upstream unreachable, retrying") == nil {
+		t.Error("a connection refused before sending was not retried")
+	}
+
+	live := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"status": "done"}))
+	gw = testGateway(t, "SUPERVISOR_URL", dead+","+live, "MAX_RETRIES", "0")
+	for i := range 2 { // round-robin starts on each backend once
+		if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": fmt.Sprintf("provision cluster %d", i)}); resp.StatusCode != http.StatusOK {
+			t.Errorf("run %d: status = %d, want 200 from the live backend", i, resp.StatusCode)
+		}
+	}
+}
+
+func TestDeliveredAttemptsRetryOnlyWhenIdempotent(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		body   map[string]any
+		header []string
+		hits   int32
+	}{
+		{"not idempotent", map[string]any{"goal": "provision cluster"}, nil, 1},
+		{"idempotent flag", map[string]any{"goal": "provision cluster", "idempotent": true}, nil, 2},
+		{"idempotency key", map[string]any{"goal": "provision cluster"}, []string{"Idempotency-Key", "deploy-42"}, 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var hits atomic.Int32
+			sup := fakeSupervisor(t, hangUp(&hits))
+			gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_RETRIES", "1")
+
+			if resp := postJSON(t, gw.URL+"/api/run", tc.body, tc.header...); resp.StatusCode != http.StatusBadGateway {
+				t.Errorf("status = %d, want 502", resp.StatusCode)
+			}
+			if got := hits.Load(); got != tc.hits {
+				t.Errorf("supervisor got the run %d times, want %d", got, tc.hits)
+			}
+		})
+	}
+}
+
+func TestRetriedStatuses(t *testing.T) {
+	for _, tc := range []struct {
+		status     int
+		idempotent bool
+		hits       int32
+	}{
+		{http.StatusServiceUnavailable, false, 1},
+		{http.StatusServiceUnavailable, true, 2},
+		{http.StatusBadGateway, false, 1},
+		{http.StatusTooManyRequests, false, 2},
+	} {
+		t.Run(fmt.Sprintf("%d idempotent %v", tc.status, tc.idempotent), func(t *testing.T) {
+			var hits atomic.Int32
+			sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+				hits.Add(1)
+				answer(tc.status, map[string]any{"error": "busy"})(w, r)
+			})
+			gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_RETRIES", "1")
+
+			postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "provision cluster", "idempotent": tc.idempotent})
+			if got := hits.Load(); got != tc.hits {
+				t.Errorf("supervisor got the run %d times, want %d", got, tc.hits)
+			}
+		})
+	}
+}
+
+// throttled answers the first fails runs 429 with retryAfter, then ok, and
+// records when each run arrived.
+func throttled(fails int, retryAfter string, arrived chan<- time.Time) http.HandlerFunc {
+	var hits atomic.Int32
+	return func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		arrived <- time.Now()
+		if int(hits.Add(1)) <= fails {
+			w.Header().Set("Retry-After", retryAfter)
+			writeJSON(w, http.StatusTooManyRequests, map[string]any{"error": "slow down"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"status": "done"})
+	}
+}
+
+func TestRetryAfterIsRelayed(t *testing.T) {
+	arrived := make(chan time.Time, 10)
+	sup := fakeSupervisor(t, throttled(10, "7", arrived))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_RETRIES", "0")
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "provision cluster"}, "Idempotency-Key", "relay-1")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "7" {
+		t.Errorf("status = %d, Retry-After %q, want 429 with 7", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// A wait past the run's deadline is not sat out; the client gets it.
+	gw = testGateway(t, "SUPERVISOR_URL", sup, "MAX_RETRIES", "2", "RUN_TIMEOUT", "2s")
+	start := time.Now()
+	resp = postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "provision cluster"}, "Idempotency-Key", "relay-2")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "7" {
+		t.Errorf("past the deadline: status = %d, Retry-After %q, want 429 with 7", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("past the deadline: answered after %v, want at once", d)
+	}
+}
+
+func TestRetryAfterReplacesBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		retryAfter string
+		min, max   time.Duration
+	}{
+		{"1", time.Second, 3 * time.Second},
+		{"0", 0, retryBackoff / 2}, // shorter than the fixed backoff
+	} {
+		t.Run("Retry-After "+tc.retryAfter, func(t *testing.T) {
+			arrived := make(chan time.Time, 10)
+			sup := fakeSupervisor(t, throttled(1, tc.retryAfter, arrived))
+			gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_RETRIES", "1")
+
+			resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "provision cluster"}, "Idempotency-Key", "backoff-"+tc.retryAfter)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200 after the retry", resp.StatusCode)
+			}
+			if len(arrived) != 2 {
+				t.Fatalf("supervisor got %d runs, want 2", len(arrived))
+			}
+			first, second := <-arrived, <-arrived
+			if gap := second.Sub(first); gap < tc.min || gap > tc.max {
+				t.Errorf("retried after %v, want between %v and %v", gap, tc.min, tc.max)
+			}
+		})
+	}
+}
+
+func TestRetriesOfCancelableRun(t *testing.T) {
+	arrived := make(chan time.Time, 10)
+	sup := fakeSupervisor(t, throttled(1, "0", arrived))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_RETRIES", "1")
+
+	// The 200 and the token go out before the supervisor is called, so the
+	// attempt count can only follow the body.
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "provision cluster", "idempotent": true}, "X-Cancelable", "1")
+	if resp.Header.Get("X-Cancel-Token") == "" {
+		t.Fatal("X-Cancelable: 1 got no cancel token")
+	}
+	if got := body(t, resp); !strings.Contains(got, "done") {
+		t.Errorf("body = %q, want the retried run's answer", got)
+	}
+	if got := resp.Trailer.Get("X-Proxy-Retries"); got != "2" {
+		t.Errorf("X-Proxy-Retries trailer = %q, want 2", got)
+	}
+	if resp.Trailer.Get("Server-Timing") == "" {
+		t.Error("no Server-Timing trailer")
+	}
+}
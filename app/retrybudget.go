@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// retryBudgetMin is how many calls a window needs before the budget
+// applies, so a couple of early failures don't switch retries off.
+const retryBudgetMin = 10
+
+// retryBudget caps retries at a fraction of all supervisor calls over a
+// sliding window, kept as one bucket per second. During a broad outage
+// retries then stop instead of multiplying the load.
+type retryBudget struct {
+	mu      sync.Mutex
+	ratio   float64 // RETRY_BUDGET; zero disables the budget
+	buckets []budgetBucket
+}
+
+type budgetBucket struct {
+	sec            int64
+	calls, retries int
+}
+
+var retries = &retryBudget{}
+
+// bucket returns the current second's bucket, recycling a stale one.
+func (b *retryBudget) bucket(now int64) *budgetBucket {
+	bk := &b.buckets[now%int64(len(b.buckets))]
+	if bk.sec != now {
+		*bk = budgetBucket{sec: now}
+	}
+	return bk
+}
+
+// totals sums the buckets still inside the window.
+func (b *retryBudget) totals(now int64) (calls, retried int) {
+	for _, bk := range b.buckets {
+		if now-bk.sec < int64(len(b.buckets)) {
+			calls += bk.calls
+			retried += bk.retries
+		}
+	}
+	return calls, retried
+}
+
+func (b *retryBudget) recordCall() {
+	if len(b.buckets) == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.bucket(time.Now().Unix()).calls++
+}
+
+// allowRetry reports whether one more retry fits the budget, and if so
+// counts it.
+func (b *retryBudget) allowRetry() bool {
+	if len(b.buckets) == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now().Unix()
+	calls, retried := b.totals(now)
+	if b.ratio > 0 && calls >= retryBudgetMin && float64(retried+1) > b.ratio*float64(calls) {
+		logger.Warn("retry budget exhausted, failing fast", "retries", retried, "calls", calls)
+		return false
+	}
+	b.bucket(now).retries++
+	return true
+}
+
+// currentRatio is retries per call over the window, for /api/stats.
+func (b *retryBudget) currentRatio() float64 {
+	if len(b.buckets) == 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	calls, retried := b.totals(time.Now().Unix())
+	if calls == 0 {
+		return 0
+	}
+	return float64(retried) / float64(calls)
+}
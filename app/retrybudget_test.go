@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRetryBudgetSuppressesRetries(t *testing.T) {
+	var attempts atomic.Int32
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_RETRIES", "1", "RETRY_BUDGET", "0.2", "CB_THRESHOLD", "0")
+	logs := captureLogs(t)
+
+	// Until retryBudgetMin calls are in the window every failure is retried;
+	// from then on 9 retries in at most 20 calls is far over a 0.2 budget.
+	for i := range 20 {
+		resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": fmt.Sprintf("list buckets %d", i)})
+		want := "2"
+		if i >= retryBudgetMin-1 {
+			want = "1"
+		}
+		if got := resp.Header.Get("X-Proxy-Retries"); got != want {
+			t.Errorf("run %d: X-Proxy-Retries = %s, want %s", i+1, got, want)
+		}
+	}
+	if got := attempts.Load(); got != 20+retryBudgetMin-1 {
+		t.Errorf("supervisor saw %d attempts, want %d", got, 20+retryBudgetMin-1)
+	}
+	if logs.find("retry budget exhausted, failing fast") == nil {
+		t.Error("exhausted budget not logged")
+	}
+	if got := decode(t, get(t, gw.URL+"/api/stats"))["retry_ratio"]; got != 9.0/20 {
+		t.Errorf("retry_ratio = %v, want %v", got, 9.0/20)
+	}
+}
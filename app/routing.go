@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// providers are the clouds a run may name in its "provider" field.
+var providers = []string{"aws", "gcp", "azure"}
+
+// providerBackends maps a provider to its SUPERVISOR_<PROVIDER> backends.
+// Providers whose variable is unset are absent.
+var providerBackends = map[string][]string{}
+
+// providerRegions holds each provider's ALLOWED_REGIONS_<PROVIDER>, in
+// lower case. Providers without a list accept any region.
+var providerRegions = map[string][]string{}
+
+// providerDisabled holds each provider's off switch, flipped through
+// /api/admin/providers/{name}/disable and /enable to stop new runs to a
+// cloud during an incident without a redeploy.
+var providerDisabled = func() map[string]*atomic.Bool {
+	m := map[string]*atomic.Bool{}
+	for _, p := range providers {
+		m[p] = new(atomic.Bool)
+	}
+	return m
+}()
+
+// providerTimeouts holds each configured provider's RUN_TIMEOUT_<PROVIDER>,
+// runTimeout when unset.
+var providerTimeouts = map[string]time.Duration{}
+
+// readonlyBackends serve "readonly" runs; they fall back to supervisors when
+// SUPERVISOR_READONLY_URL is unset.
+var readonlyBackends []string
+
+// supervisorRunPath is the run endpoint under each SUPERVISOR_BASE URL;
+// SUPERVISOR_RUN_PATH.
+var supervisorRunPath string
+
+// defaultBackends builds the default backend list: SUPERVISOR_BASE URLs joined
+// with supervisorRunPath, else the full run URLs of SUPERVISOR_URL.
+func defaultBackends() []string {
+	bases := splitList(getenv("SUPERVISOR_BASE", ""))
+	if len(bases) == 0 {
+		return splitList(getenv("SUPERVISOR_URL", "http://127.0.0.1:9000/run"))
+	}
+	urls := make([]string, len(bases))
+	for i, base := range bases {
+		urls[i] = joinPath(base, supervisorRunPath)
+	}
+	return urls
+}
+
+// joinPath appends p to base with exactly one slash between them, whatever
+// slashes either side brings.
+func joinPath(base, p string) string {
+	base = strings.TrimRight(base, "/")
+	p = strings.TrimLeft(p, "/")
+	if p == "" {
+		return base
+	}
+	return base + "/" + p
+}
+
+func loadProviders() {
+	providerBackends, providerTimeouts, providerRegions = map[string][]string{}, map[string]time.Duration{}, map[string][]string{}
+	for _, p := range providers {
+		if urls := splitList(getenv("SUPERVISOR_"+strings.ToUpper(p), "")); len(urls) > 0 {
+			providerBackends[p] = urls
+			providerTimeouts[p] = getenvDuration("RUN_TIMEOUT_"+strings.ToUpper(p), runTimeout)
+		}
+		for _, region := range splitList(getenv("ALLOWED_REGIONS_"+strings.ToUpper(p), "")) {
+			providerRegions[p] = append(providerRegions[p], strings.ToLower(region))
+		}
+	}
+}
+
+// defaultProvider is DEFAULT_PROVIDER, the provider of runs that name none.
+// Unset, they go to the default supervisors.
+var defaultProvider string
+
+// initDefaultProvider sets defaultProvider, which must be a provider with
+// SUPERVISOR_<PROVIDER> set. It runs after loadProviders.
+func initDefaultProvider(val string) error {
+	p := strings.ToLower(strings.TrimSpace(val))
+	if _, ok := providerBackends[p]; p != "" && !ok {
+		return fmt.Errorf("DEFAULT_PROVIDER: %q is not a configured provider", val)
+	}
+	defaultProvider = p
+	return nil
+}
+
+// applyDefaultProvider gives a run without a provider defaultProvider.
+// Readonly runs keep none, as they go to the read-only supervisors, and so
+// does every run in safe mode.
+func applyDefaultProvider(req *runReq) {
+	if defaultProvider != "" && !req.ReadOnly && !safeMode && strings.TrimSpace(req.Provider) == "" {
+		req.Provider = defaultProvider
+	}
+}
+
+// runTimeoutFor is the timeout of req once routed to backends: its
+// provider's when it went to that provider's supervisors, else runTimeout.
+func runTimeoutFor(req runReq, backends []string) time.Duration {
+	p := strings.ToLower(strings.TrimSpace(req.Provider))
+	if d, ok := providerTimeouts[p]; ok && slices.Equal(backends, providerBackends[p]) {
+		return d
+	}
+	return runTimeout
+}
+
+// longestRunTimeout is the largest timeout any run may be given.
+func longestRunTimeout() time.Duration {
+	d := runTimeout
+	for _, t := range providerTimeouts {
+		d = max(d, t)
+	}
+	return d
+}
+
+// upstreamCall is a validated run ready to be forwarded.
+type upstreamCall struct {
+	backends   []string
+	body       []byte
+	header     http.Header
+	timeout    time.Duration // bounds the whole call, retries included
+	priority   string        // the run's "priority", see acquireRun
+	idempotent bool          // safe to resend once delivered, see mayRetry
+	goalHash   string        // see goalHash; empty for streamed bodies
+
+	file   *os.File  // body spooled to disk, see spool
+	stream io.Reader // client body passed through unread, see streamedCall
+	size   int64
+}
+
+// prepareRun validates a run body and works out where and how to forward it.
+func prepareRun(r *http.Request, body []byte) (runReq, *upstreamCall, *validationError) {
+	req, body, verr := normalizeRun(body)
+	if verr != nil {
+		return req, nil, verr
+	}
+	call, verr := newCall(r, req, body)
+	if verr != nil {
+		return req, nil, verr
+	}
+	call.compress()
+	return req, call, nil
+}
+
+// newCall works out where and how to forward a validated run.
+func newCall(r *http.Request, req runReq, body []byte) (*upstreamCall, *validationError) {
+	var backends []string
+	var verr *validationError
+	if !safeMode {
+		backends, verr = supervisorOverride(r)
+	}
+	if verr == nil && backends == nil {
+		backends, verr = route(tenantOf(r), req)
+	}
+	if verr != nil {
+		return nil, verr
+	}
+	if rc := requestContext(r.Context()); rc != nil {
+		rc.Provider = strings.ToLower(strings.TrimSpace(req.Provider))
+	}
+	call := &upstreamCall{backends: backends, body: body, header: forwardedHeaders(r), timeout: runTimeoutFor(req, backends),
+		priority: strings.ToLower(strings.TrimSpace(req.Priority))}
+	call.idempotent = req.Idempotent || r.Header.Get("Idempotency-Key") != ""
+	call.goalHash = goalHash(req.Provider, tenantOf(r), req.goal())
+	if req.DryRun {
+		call.header.Set("X-Dry-Run", "true")
+	}
+	return call, nil
+}
+
+// goalHash identifies a logical run for caching, dedup and the audit log:
+// the hex SHA-256 of the provider and tenant, trimmed and lowercased, and
+// the goal, only trimmed since its case may matter to the supervisor.
+func goalHash(provider, tenant, goal string) string {
+	h := sha256.New()
+	for _, s := range []string{strings.ToLower(strings.TrimSpace(provider)), strings.ToLower(strings.TrimSpace(tenant)), strings.TrimSpace(goal)} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// route picks the backends for a run: the tenant's supervisors when an
+// X-Tenant is given, else the read-only ones for a readonly run, else the
+// named provider's, else the default SUPERVISOR_URL list when no known
+// provider is given. In safe mode every run is readonly and tenants are
+// ignored. A disabled provider is refused whichever way it would go.
+func route(tenant string, req runReq) ([]string, *validationError) {
+	p := strings.ToLower(strings.TrimSpace(req.Provider))
+	if off, ok := providerDisabled[p]; ok && off.Load() {
+		return nil, fieldInvalid(http.StatusServiceUnavailable, "provider", "provider_disabled", "provider temporarily disabled")
+	}
+	if tenant != "" && !safeMode {
+		if urls, ok := tenantBackends[tenant]; ok {
+			return urls, nil
+		}
+		return nil, fieldInvalid(http.StatusForbidden, "tenant", "unknown_tenant", "unknown tenant")
+	}
+	if req.ReadOnly {
+		if len(readonlyBackends) > 0 {
+			return readonlyBackends, nil
+		}
+		return supervisors, nil
+	}
+	if p == "" {
+		return supervisors, nil
+	}
+	if urls, ok := providerBackends[p]; ok {
+		return urls, nil
+	}
+	for _, known := range providers {
+		if p == known {
+			verr := fieldInvalid(http.StatusBadRequest, "provider", "provider_not_configured", "provider not configured").withAllowed(configuredProviders())
+			verr.Extra = map[string]any{"provider": p, "configured": configuredProviders()}
+			return nil, verr
+		}
+	}
+	return supervisors, nil
+}
+
+// disabledProviders lists the providers switched off by the admin API, in
+// the order of providers.
+func disabledProviders() []string {
+	out := []string{}
+	for _, p := range providers {
+		if providerDisabled[p].Load() {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// configuredProviders lists the providers that have SUPERVISOR_<PROVIDER>
+// backends, in the order of providers.
+func configuredProviders() []string {
+	out := []string{}
+	for _, p := range providers {
+		if _, ok := providerBackends[p]; ok {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProviderRouting(t *testing.T) {
+	def, defSeen := recordingSupervisor(t)
+	aws, awsSeen := recordingSupervisor(t)
+	gcp, gcpSeen := recordingSupervisor(t)
+	azure, azureSeen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", def, "SUPERVISOR_AWS", aws, "SUPERVISOR_GCP", gcp, "SUPERVISOR_AZURE", azure)
+
+	for _, tc := range []struct {
+		provider string
+		seen     chan seenRequest
+	}{
+		{"aws", awsSeen},
+		{"GCP", gcpSeen},
+		{"azure", azureSeen},
+		{"", defSeen},
+		{"oci", defSeen},
+	} {
+		t.Run("provider "+tc.provider, func(t *testing.T) {
+			resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets", "provider": tc.provider})
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			nextRequest(t, tc.seen)
+		})
+	}
+	for _, seen := range []chan seenRequest{defSeen, awsSeen, gcpSeen, azureSeen} {
+		if len(seen) != 0 {
+			t.Error("a run reached more than one supervisor")
+		}
+	}
+}
+
+func TestUnconfiguredProviderIsRefused(t *testing.T) {
+	def, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", def, "SUPERVISOR_AWS", def, "SUPERVISOR_GCP", def)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list vms", "provider": "azure"})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", resp.StatusCode)
+	}
+	body := decode(t, resp)
+	if body["error"] != "provider not configured" || body["provider"] != "azure" || fmt.Sprint(body["configured"]) != "[aws gcp]" {
+		t.Errorf("body = %v, want the provider and the configured ones", body)
+	}
+	if len(seen) != 0 {
+		t.Error("the run reached the default supervisor")
+	}
+	if got := fmt.Sprint(decode(t, get(t, gw.URL+"/api/health"))["providers"]); got != "[aws gcp]" {
+		t.Errorf("health providers = %s, want [aws gcp]", got)
+	}
+}
+
+func TestReadOnlyRouting(t *testing.T) {
+	main, mainSeen := recordingSupervisor(t)
+	light, lightSeen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", main, "SUPERVISOR_READONLY_URL", light, "SUPERVISOR_AWS", main)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list my clusters", "readonly": true})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("readonly status = %d, want 200", resp.StatusCode)
+	}
+	nextRequest(t, lightSeen)
+	resp = postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "create a cluster"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	nextRequest(t, mainSeen)
+
+	resp = postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "create a cluster", "readonly": true, "provider": "aws"})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("readonly run with a provider status = %d, want 400", resp.StatusCode)
+	}
+	if len(mainSeen)+len(lightSeen) != 0 {
+		t.Error("a run reached the wrong supervisor, or the refused one went out")
+	}
+}
+
+func TestJoinPath(t *testing.T) {
+	for _, tc := range []struct{ base, p, want string }{
+		{"http://sup:9000", "/run", "http://sup:9000/run"},
+		{"http://sup:9000/", "/run", "http://sup:9000/run"},
+		{"http://sup:9000//", "run", "http://sup:9000/run"},
+		{"http://sup:9000/api", "v2/run", "http://sup:9000/api/v2/run"},
+		{"http://sup:9000/api/", "//execute/", "http://sup:9000/api/execute/"},
+		{"http://sup:9000/api", "", "http://sup:9000/api"},
+		{"http://sup:9000/api", "/", "http://sup:9000/api"},
+	} {
+		if got := joinPath(tc.base, tc.p); got != tc.want {
+			t.Errorf("joinPath(%q, %q) = %q, want %q", tc.base, tc.p, got, tc.want)
+		}
+	}
+}
+
+func TestSupervisorBaseAndRunPath(t *testing.T) {
+	paths := make(chan string, 10)
+	sup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	}))
+	t.Cleanup(sup.Close)
+	gw := testGateway(t, "SUPERVISOR_BASE", sup.URL+"/api/", "SUPERVISOR_RUN_PATH", "/v2/execute")
+
+	postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"})
+	if got := <-paths; got != "/api/v2/execute" {
+		t.Errorf("run went to %s, want /api/v2/execute", got)
+	}
+	get(t, gw.URL+"/api/health")
+	if got := <-paths; got != "/api/health" {
+		t.Errorf("health probe went to %s, want /api/health under the base", got)
+	}
+}
+
+func TestSupervisorURLStillWorks(t *testing.T) {
+	paths := make(chan string, 10)
+	sup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	}))
+	t.Cleanup(sup.Close)
+	gw := testGateway(t, "SUPERVISOR_URL", sup.URL+"/gw/run")
+
+	postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"})
+	if got := <-paths; got != "/gw/run" {
+		t.Errorf("run went to %s, want the full SUPERVISOR_URL", got)
+	}
+	get(t, gw.URL+"/api/health")
+	if got := <-paths; got != "/gw/health" {
+		t.Errorf("health probe went to %s, want /gw/health", got)
+	}
+}
+
+func TestProviderRunTimeouts(t *testing.T) {
+	aws, awsSeen := recordingSupervisor(t)
+	gcp, gcpSeen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_AWS", aws, "SUPERVISOR_GCP", gcp,
+		"RUN_TIMEOUT", "10s", "RUN_TIMEOUT_AWS", "2m")
+
+	for _, tc := range []struct {
+		provider string
+		seen     chan seenRequest
+		want     time.Duration
+	}{
+		{"aws", awsSeen, 2 * time.Minute},
+		{"gcp", gcpSeen, 10 * time.Second},
+	} {
+		postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets", "provider": tc.provider})
+		ms, err := strconv.Atoi(nextRequest(t, tc.seen).header.Get("X-Timeout-Ms"))
+		if got := time.Duration(ms) * time.Millisecond; err != nil || got > tc.want || got < tc.want-time.Second {
+			t.Errorf("%s: X-Timeout-Ms = %v, want about %v", tc.provider, got, tc.want)
+		}
+	}
+
+	// X-Run-Timeout is clamped to the provider's timeout, not the global one.
+	postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets", "provider": "aws"}, "X-Run-Timeout", "1m")
+	if ms, _ := strconv.Atoi(nextRequest(t, awsSeen).header.Get("X-Timeout-Ms")); ms > 60000 || ms < 59000 {
+		t.Errorf("aws with X-Run-Timeout 1m: X-Timeout-Ms = %d, want about 60000", ms)
+	}
+}
+
+func TestProviderRunTimeoutIsEnforced(t *testing.T) {
+	aws := fakeSupervisor(t, slow(time.Second))
+	gcp := fakeSupervisor(t, slow(300*time.Millisecond))
+	gw := testGateway(t, "SUPERVISOR_AWS", aws, "SUPERVISOR_GCP", gcp,
+		"RUN_TIMEOUT", "5s", "RUN_TIMEOUT_AWS", "100ms")
+
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets", "provider": "aws"}); resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("aws: status = %d, want 504 after its 100ms", resp.StatusCode)
+	}
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets", "provider": "gcp"}); resp.StatusCode != http.StatusOK {
+		t.Errorf("gcp: status = %d, want 200 under the global 5s", resp.StatusCode)
+	}
+}
+
+func TestGoalHash(t *testing.T) {
+	base := goalHash("aws", "team-a", "list buckets")
+	if len(base) != 64 {
+		t.Fatalf("goalHash = %q, want hex SHA-256", base)
+	}
+	for _, same := range [][3]string{
+		{"AWS", "team-a", "list buckets"},
+		{" aws ", "Team-A", "list buckets"},
+		{"aws", "team-a", "  list buckets\n"},
+	} {
+		if got := goalHash(same[0], same[1], same[2]); got != base {
+			t.Errorf("goalHash(%q) differs from the same logical run", same)
+		}
+	}
+	for _, other := range [][3]string{
+		{"gcp", "team-a", "list buckets"},
+		{"aws", "team-b", "list buckets"},
+		{"aws", "", "list buckets"},
+		{"aws", "team-a", "List buckets"}, // the goal's case may matter
+		{"aws", "team-a", "list  buckets"},
+		{"awsteam-a", "", "list buckets"}, // fields don't run together
+	} {
+		if got := goalHash(other[0], other[1], other[2]); got == base {
+			t.Errorf("goalHash(%q) collides with another run", other)
+		}
+	}
+}
+
+func TestAuditRecordsGoalHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	aws := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", aws, "SUPERVISOR_AWS", aws, "AUDIT_LOG_PATH", path)
+
+	postJSON(t, gw.URL+"/api/run", map[string]any{"goal": " list buckets ", "provider": "AWS"})
+	var entries []auditEntry
+	waitFor(t, func() bool { entries = auditLines(t, path); return len(entries) == 1 })
+	if want := goalHash("aws", "", "list buckets"); entries[0].GoalHash != want {
+		t.Errorf("goal_hash = %q, want %q", entries[0].GoalHash, want)
+	}
+}
+
+// forwardedRegion is the region the supervisor got with a run.
+func forwardedRegion(t *testing.T, seen chan seenRequest) any {
+	t.Helper()
+	var sent map[string]any
+	if err := json.Unmarshal(nextRequest(t, seen).body, &sent); err != nil {
+		t.Fatal(err)
+	}
+	return sent["region"]
+}
+
+func TestRegionAllowlist(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "SUPERVISOR_AWS", sup, "SUPERVISOR_GCP", sup,
+		"ALLOWED_REGIONS_AWS", "us-east-1, EU-West-1")
+	run := func(provider, region string) *http.Response {
+		return postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets", "provider": provider, "region": region})
+	}
+
+	if resp := run("aws", " EU-west-1 "); resp.StatusCode != http.StatusOK {
+		t.Fatalf("allowed region: status = %d, want 200", resp.StatusCode)
+	}
+	if got := forwardedRegion(t, seen); got != "eu-west-1" {
+		t.Errorf("forwarded region = %v, want eu-west-1", got)
+	}
+
+	resp := run("aws", "mars-1")
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("unknown region: status = %d, want 422", resp.StatusCode)
+	}
+	if got := decode(t, resp); got["error"] != "region not allowed for provider" || got["region"] != "mars-1" || fmt.Sprint(got["allowed"]) != "[us-east-1 eu-west-1]" {
+		t.Errorf("unknown region: body = %v", got)
+	}
+	if len(seen) != 0 {
+		t.Error("a rejected region reached the supervisor")
+	}
+
+	// GCP has no list, so any region passes through as given.
+	if resp := run("gcp", "mars-1"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("provider without a list: status = %d, want 200", resp.StatusCode)
+	}
+	if got := forwardedRegion(t, seen); got != "mars-1" {
+		t.Errorf("forwarded region = %v, want mars-1", got)
+	}
+}
+
+func TestDefaultProvider(t *testing.T) {
+	def, defSeen := recordingSupervisor(t)
+	aws, awsSeen := recordingSupervisor(t)
+	gcp, gcpSeen := recordingSupervisor(t)
+	light, lightSeen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", def, "SUPERVISOR_AWS", aws, "SUPERVISOR_GCP", gcp,
+		"SUPERVISOR_READONLY_URL", light, "DEFAULT_PROVIDER", " AWS ")
+	logs := captureLogs(t)
+
+	for _, tc := range []struct {
+		name string
+		run  map[string]any
+		seen chan seenRequest
+	}{
+		{"no provider", map[string]any{"goal": "list buckets"}, awsSeen},
+		{"blank provider", map[string]any{"goal": "list buckets", "provider": " "}, awsSeen},
+		{"override", map[string]any{"goal": "list buckets", "provider": "gcp"}, gcpSeen},
+		{"readonly", map[string]any{"goal": "list buckets", "readonly": true}, lightSeen},
+	} {
+		resp := postJSON(t, gw.URL+"/api/run", tc.run)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", tc.name, resp.StatusCode)
+		}
+		nextRequest(t, tc.seen)
+	}
+	if len(defSeen)+len(awsSeen)+len(gcpSeen)+len(lightSeen) != 0 {
+		t.Error("a run reached the wrong supervisor")
+	}
+	waitFor(t, func() bool { return logs.find("request") != nil })
+	if got := logs.find("request")["provider"]; got != "aws" {
+		t.Errorf("logged provider = %v, want the default aws", got)
+	}
+
+	gw = testGateway(t, "SUPERVISOR_URL", def, "SUPERVISOR_AWS", aws, "SUPERVISOR_GCP", gcp,
+		"SUPERVISOR_READONLY_URL", light, "DEFAULT_PROVIDER", "")
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("without DEFAULT_PROVIDER: status = %d, want 200", resp.StatusCode)
+	}
+	nextRequest(t, defSeen)
+
+	t.Setenv("DEFAULT_PROVIDER", "azure")
+	resetState()
+	if err := configure(); err == nil || !strings.Contains(err.Error(), "DEFAULT_PROVIDER") {
+		t.Errorf("unconfigured DEFAULT_PROVIDER: err = %v, want it refused", err)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// runIDPeek bounds how far into a body injectRunID looks for the opening
+// brace of a JSON object.
+const runIDPeek = 512
+
+// injectRunID adds a "run_id" field to a JSON object body, as its first
+// key, without buffering the rest of it. Other bodies, NDJSON streams
+// included, are left alone.
+func injectRunID(resp *http.Response, runID string) {
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ct == "application/x-ndjson" {
+		return
+	}
+	br := bufio.NewReader(resp.Body)
+	var rest io.Reader = br
+	defer func() {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{rest, resp.Body}
+	}()
+	head, _ := br.Peek(runIDPeek)
+	open := skipJSONSpace(head, 0)
+	if open >= len(head) || head[open] != '{' {
+		return
+	}
+	next := skipJSONSpace(head, open+1)
+	if next >= len(head) {
+		return
+	}
+	prefix := `{"run_id":` + strconv.Quote(runID)
+	if head[next] != '}' {
+		prefix += ","
+	}
+	br.Discard(open + 1)
+	rest = io.MultiReader(strings.NewReader(prefix), br)
+	if resp.ContentLength >= 0 {
+		resp.ContentLength += int64(len(prefix) - (open + 1))
+		resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+}
+
+// skipJSONSpace returns the index of the first non-whitespace byte of b at
+// or after i.
+func skipJSONSpace(b []byte, i int) int {
+	for i < len(b) && (b[i] == ' ' || b[i] == '\t' || b[i] == '\n' || b[i] == '\r') {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+)
+
+var uuidFormat = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRunIDInHeaderAndBody(t *testing.T) {
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		switch goalOf(r) {
+		case "empty":
+			writeJSON(w, http.StatusOK, map[string]any{})
+		case "list":
+			writeJSON(w, http.StatusOK, []string{"a", "b"})
+		default:
+			writeJSON(w, http.StatusOK, map[string]any{"ok": true, "answer": "3 buckets"})
+		}
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "count buckets"})
+	id := resp.Header.Get("X-Run-ID")
+	if !uuidFormat.MatchString(id) {
+		t.Fatalf("X-Run-ID = %q, want a UUID", id)
+	}
+	if got := decode(t, resp); got["run_id"] != id || got["answer"] != "3 buckets" {
+		t.Errorf("body = %v, want run_id %s merged into the answer", got, id)
+	}
+
+	resp = postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "empty"})
+	if other := resp.Header.Get("X-Run-ID"); other == id || len(decode(t, resp)) != 1 {
+		t.Errorf("second run: X-Run-ID %q, want a new ID as the only field", other)
+	}
+
+	// Only objects get the field; other answers pass through as sent.
+	resp = postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list"})
+	if got := body(t, resp); resp.Header.Get("X-Run-ID") == "" || got != "[\"a\",\"b\"]\n" {
+		t.Errorf("array answer: X-Run-ID %q, body %q, want the header and the body unchanged", resp.Header.Get("X-Run-ID"), got)
+	}
+}
+
+func TestRunIDIsRetrievable(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "SUPERVISOR_AWS", sup)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "count buckets", "provider": "aws"}, "X-Request-ID", "run-lookup")
+	id := resp.Header.Get("X-Run-ID")
+	got := decode(t, get(t, gw.URL+"/api/runs/"+id))
+	if got["run_id"] != id || got["request_id"] != "run-lookup" || got["goal"] != "count buckets" ||
+		got["provider"] != "aws" || got["status"] != float64(http.StatusOK) {
+		t.Errorf("GET /api/runs/%s = %v, want the run's history entry", id, got)
+	}
+	if resp := get(t, gw.URL+"/api/runs/"+newUUID()); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown run: status = %d, want 404", resp.StatusCode)
+	}
+}
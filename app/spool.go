@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+)
+
+// spoolThreshold is the body size above which a run is kept in a temp file,
+// rather than in memory, for as long as it may be retried. Zero disables
+// spooling.
+var spoolThreshold int64
+
+// spoolsBody reports whether /api/run reads r's body with spooledRun: a
+// JSON POST in UTF-8, which needs no transcoding, while spooling is on.
+func spoolsBody(r *http.Request) bool {
+	return spoolThreshold > 0 && r.Method == http.MethodPost && isJSON(r) && bodyCharset(r) == ""
+}
+
+// spooledRun reads and prepares a JSON run body without ever holding more
+// than spoolThreshold bytes of it in memory. A body past the threshold is
+// copied straight to a temp file as it arrives, validated from there, and
+// sent from there on every attempt. Only a body the gateway has to rewrite
+// (see sentAsIs) is read back into memory.
+func spooledRun(w http.ResponseWriter, r *http.Request) (runReq, *upstreamCall, *validationError) {
+	src := http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	head, err := io.ReadAll(io.LimitReader(src, spoolThreshold+1))
+	if err != nil {
+		return runReq{}, nil, bodyError(err)
+	}
+	if int64(len(head)) <= spoolThreshold {
+		if verr := checkJSONShape(head); verr != nil {
+			return runReq{}, nil, verr
+		}
+		return prepareRun(r, head)
+	}
+	f, err := os.CreateTemp("", "mcp-run-*.json")
+	if err != nil {
+		logger.Warn("spool failed, reading body into memory", "err", err)
+		rest, err := io.ReadAll(src)
+		if err != nil {
+			return runReq{}, nil, bodyError(err)
+		}
+		body := append(head, rest...)
+		if verr := checkJSONShape(body); verr != nil {
+			return runReq{}, nil, verr
+		}
+		return prepareRun(r, body)
+	}
+	held := &upstreamCall{file: f}
+	keep := false
+	defer func() {
+		if !keep {
+			held.removeFile()
+		}
+	}()
+	_, err = f.Write(head)
+	var rest int64
+	if err == nil {
+		rest, err = io.Copy(f, src)
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		logger.Warn("spool failed", "err", err)
+		return runReq{}, nil, &validationError{Status: http.StatusInternalServerError, Msg: "spool failed"}
+	} else if err != nil {
+		return runReq{}, nil, bodyError(err)
+	}
+	held.size = int64(len(head)) + rest
+
+	if verr := checkJSONShapeFrom(held.section()); verr != nil {
+		return runReq{}, nil, verr
+	}
+	req, verr := parseRunFrom(held.decode)
+	if verr != nil {
+		return req, nil, verr
+	}
+	var sent runReq
+	held.decode(&sent)
+	if !sentAsIs(req, sent) {
+		body, err := io.ReadAll(held.section())
+		if err != nil {
+			return req, nil, &validationError{Status: http.StatusInternalServerError, Msg: "spool failed"}
+		}
+		return prepareRun(r, body)
+	}
+	call, verr := newCall(r, req, nil)
+	if verr != nil {
+		return req, nil, verr
+	}
+	call.file, call.size = held.file, held.size
+	keep = true
+	return req, call, nil
+}
+
+// sentAsIs reports whether normalizeRun would forward the run sent, parsed
+// as req, unchanged apart from formatting, so its spooled copy can go as it
+// is. Spooled bodies are not COMPRESS_UPSTREAM'ed.
+func sentAsIs(req, sent runReq) bool {
+	_, identity := transformer.(identityTransformer)
+	return identity && goalTemplate == nil && !safeMode &&
+		req.Goal == sent.Goal && req.Message == sent.Message &&
+		req.Region == sent.Region && req.Provider == sent.Provider
+}
+
+// bodyError is the answer to a request body that could not be read.
+func bodyError(err error) *validationError {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &validationError{Status: http.StatusRequestEntityTooLarge, Msg: "request body too large",
+			Extra: map[string]any{"limit": tooLarge.Limit}}
+	}
+	return &validationError{Status: http.StatusBadRequest, Msg: "bad request"}
+}
+
+// spool moves a large call body to a temp file, unless it is there already.
+// The returned func removes the file and must always be called; on failure
+// the body simply stays in memory.
+func (c *upstreamCall) spool() func() {
+	if c.file != nil {
+		return c.removeFile
+	}
+	if spoolThreshold <= 0 || int64(len(c.body)) <= spoolThreshold {
+		return func() {}
+	}
+	f, err := os.CreateTemp("", "mcp-run-*.json")
+	if err != nil {
+		logger.Warn("spool failed, keeping body in memory", "err", err)
+		return func() {}
+	}
+	if _, err := f.Write(c.body); err != nil {
+		logger.Warn("spool failed, keeping body in memory", "err", err)
+		f.Close()
+		os.Remove(f.Name())
+		return func() {}
+	}
+	c.file, c.size, c.body = f, int64(len(c.body)), nil
+	return c.removeFile
+}
+
+func (c *upstreamCall) removeFile() {
+	c.file.Close()
+	os.Remove(c.file.Name())
+}
+
+// section reads the spooled body from the start.
+func (c *upstreamCall) section() *io.SectionReader {
+	return io.NewSectionReader(c.file, 0, c.size)
+}
+
+// decode unmarshals the spooled body into v, which it must hold entirely.
+func (c *upstreamCall) decode(v any) error {
+	dec := json.NewDecoder(c.section())
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid character after top-level value")
+	}
+	return nil
+}
+
+// bodySum is the SHA-256 of the body sent upstream, wherever it is kept.
+func (c *upstreamCall) bodySum() [32]byte {
+	if c.file == nil {
+		return sha256.Sum256(c.body)
+	}
+	h := sha256.New()
+	io.Copy(h, c.section())
+	return [32]byte(h.Sum(nil))
+}
+
+// reader returns a fresh reader over the body for each attempt.
+func (c *upstreamCall) reader() (io.Reader, int64) {
+	if c.stream != nil {
+		return c.stream, c.size
+	}
+	if c.file != nil {
+		return c.section(), c.size
+	}
+	return bytes.NewReader(c.body), int64(len(c.body))
+}
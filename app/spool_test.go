@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSpooledBodySurvivesRetry(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	spooled := func() int {
+		files, _ := filepath.Glob(filepath.Join(tmp, "mcp-run-*"))
+		return len(files)
+	}
+	var mu sync.Mutex
+	var bodies []string
+	var files []int
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies, files = append(bodies, string(b)), append(files, spooled())
+		first := len(bodies) == 1
+		mu.Unlock()
+		if first {
+			answer(http.StatusServiceUnavailable, map[string]any{"error": "warming up"})(w, r)
+			return
+		}
+		answer(http.StatusOK, map[string]any{"ok": true})(w, r)
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "SPOOL_THRESHOLD", "1024", "MAX_RETRIES", "1")
+
+	// Spacing and key order only survive if the spooled bytes go out as sent.
+	sent := `{ "inventory" : "` + strings.Repeat("vm-0042,", 8<<10) + `",  "goal": "import the inventory", "idempotent" :true }`
+	resp := post(t, gw.URL+"/api/run", "application/json", sent)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200 after a retry", resp.StatusCode)
+	}
+	resp.Body.Close()
+	if len(bodies) != 2 {
+		t.Fatalf("supervisor got %d attempts, want 2", len(bodies))
+	}
+	for i, b := range bodies {
+		if b != sent {
+			t.Errorf("attempt %d body differs from what was sent (%d bytes, want %d)", i+1, len(b), len(sent))
+		}
+		if files[i] != 1 {
+			t.Errorf("attempt %d: %d spool files, want the body on disk", i+1, files[i])
+		}
+	}
+	if n := spooled(); n != 0 {
+		t.Errorf("%d spool files left after the run", n)
+	}
+
+	// A goal the gateway trims has to be rewritten, from memory.
+	bodies = nil
+	resp = post(t, gw.URL+"/api/run", "application/json", `{"goal":"  import again  ","inventory":"`+strings.Repeat("x", 4096)+`"}`)
+	resp.Body.Close()
+	if len(bodies) == 0 {
+		t.Fatal("rewritten body never reached the supervisor")
+	}
+	var got map[string]any
+	if err := json.Unmarshal([]byte(bodies[len(bodies)-1]), &got); err != nil || got["goal"] != "import again" {
+		t.Errorf("rewritten body goal = %v (%v), want it trimmed", got["goal"], err)
+	}
+	if n := spooled(); n != 0 {
+		t.Errorf("%d spool files left after the rewritten run", n)
+	}
+}
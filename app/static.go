@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// embeddedWeb is the UI built into the binary, served when WEB_DIR is unset
+// so a bare binary or minimal container needs no ./web next to it.
+//
+//go:embed web
+var embeddedWeb embed.FS
+
+// webRoot is the UI filesystem: WEB_DIR on disk when set, so edits show up
+// without a rebuild, else embeddedWeb.
+func webRoot(dir string) http.FileSystem {
+	if dir != "" {
+		return http.Dir(dir)
+	}
+	sub, err := fs.Sub(embeddedWeb, "web")
+	if err != nil {
+		panic(err) // the embed pattern guarantees web/ exists
+	}
+	return http.FS(sub)
+}
+
+// handleUnknownAPI answers API paths no route matches with a JSON 404, so
+// a mistyped one never reaches the UI's file server.
+func handleUnknownAPI(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	writeJSON(w, http.StatusNotFound, map[string]any{"error": "not found", "status": http.StatusNotFound, "path": r.URL.Path})
+}
+
+// spaHandler serves files from root and answers client-side routes such as
+// /runs/123 with index.html. Paths with an extension (missing assets) and
+// /api paths keep their real 404.
+func spaHandler(root http.FileSystem) http.Handler {
+	files := http.FileServer(root)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean("/" + r.URL.Path)
+		if p != "/api" && !strings.HasPrefix(p, "/api/") && path.Ext(p) == "" {
+			if f, err := root.Open(p); errors.Is(err, fs.ErrNotExist) {
+				r = r.Clone(r.Context())
+				r.URL.Path = "/"
+				p = "/"
+			} else if err == nil {
+				f.Close()
+			}
+		}
+		setCacheHeaders(w, root, p)
+		files.ServeHTTP(w, r)
+	})
+}
+
+// setCacheHeaders marks fingerprinted assets as cacheable forever and
+// everything else, index.html included, as revalidate-on-use. The weak ETag
+// lets http.FileServer answer If-None-Match with 304. Embedded files have no
+// modification time, so theirs comes from a hash of the content.
+func setCacheHeaders(w http.ResponseWriter, root http.FileSystem, p string) {
+	f, err := root.Open(p)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if info.IsDir() {
+		if f, err = root.Open(path.Join(p, "index.html")); err != nil {
+			return
+		}
+		defer f.Close()
+		if info, err = f.Stat(); err != nil {
+			return
+		}
+	}
+	h := w.Header()
+	if info.ModTime().IsZero() {
+		sum := sha256.New()
+		if _, err := io.Copy(sum, f); err != nil {
+			return
+		}
+		h.Set("ETag", fmt.Sprintf(`W/"%x"`, sum.Sum(nil)[:8]))
+	} else {
+		h.Set("ETag", fmt.Sprintf(`W/"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+	}
+	if fingerprinted(info.Name()) {
+		h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		h.Set("Cache-Control", "no-cache")
+	}
+}
+
+// fingerprinted reports whether a file name carries a content hash, as in
+// app.3f9a1c2b.js or index-BfD3kJ9a.css: a part after the first, at least
+// six letters and digits long with at least one digit.
+func fingerprinted(name string) bool {
+	stem := strings.TrimSuffix(name, path.Ext(name))
+	parts := strings.FieldsFunc(stem, func(r rune) bool { return r == '.' || r == '-' })
+	for _, part := range parts[min(1, len(parts)):] {
+		if len(part) >= 6 && isAlnum(part) && strings.ContainsAny(part, "0123456789") {
+			return true
+		}
+	}
+	return false
+}
+
+func isAlnum(s string) bool {
+	for _, c := range s {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
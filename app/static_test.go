@@ -0,0 +1,206 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// webDir writes files, name then content, to a temporary WEB_DIR.
+func webDir(t *testing.T, files ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for i := 0; i+1 < len(files); i += 2 {
+		if err := os.WriteFile(filepath.Join(dir, files[i]), []byte(files[i+1]), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// body reads a response body as a string.
+func body(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestServesWebDir(t *testing.T) {
+	dir := webDir(t, "index.html", "<h1>from WEB_DIR</h1>")
+	gw := testGateway(t, "WEB_DIR", dir)
+
+	resp := get(t, gw.URL+"/")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if got := body(t, resp); got != "<h1>from WEB_DIR</h1>" {
+		t.Errorf("body = %q, want WEB_DIR's index.html", got)
+	}
+}
+
+func TestSPAFallback(t *testing.T) {
+	dir := webDir(t, "index.html", "<h1>app</h1>", "app.css", "body{}")
+	gw := testGateway(t, "WEB_DIR", dir)
+
+	for _, tc := range []struct {
+		path string
+		want int
+		body string
+	}{
+		{"/app.css", http.StatusOK, "body{}"},
+		{"/runs/123", http.StatusOK, "<h1>app</h1>"},
+		{"/app.js", http.StatusNotFound, ""},
+	} {
+		resp := get(t, gw.URL+tc.path)
+		got := body(t, resp)
+		if resp.StatusCode != tc.want || tc.body != "" && got != tc.body {
+			t.Errorf("%s = %d %q, want %d %q", tc.path, resp.StatusCode, got, tc.want, tc.body)
+		}
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	dir := webDir(t, "index.html", "<h1>mounted</h1>", "app.js", "console.log(1)")
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "BASE_PATH", "/mcp", "WEB_DIR", dir)
+	logs := captureLogs(t)
+
+	if resp := get(t, gw.URL+"/mcp/api/health"); resp.StatusCode != http.StatusOK {
+		t.Errorf("/mcp/api/health status = %d, want 200", resp.StatusCode)
+	}
+	resp := postJSON(t, gw.URL+"/mcp/api/run", map[string]any{"goal": "list buckets"})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("/mcp/api/run status = %d, CORS %q, want 200 with CORS", resp.StatusCode, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+	if got := body(t, get(t, gw.URL+"/mcp/app.js")); got != "console.log(1)" {
+		t.Errorf("/mcp/app.js = %q, want the asset", got)
+	}
+	if got := body(t, get(t, gw.URL+"/mcp/")); got != "<h1>mounted</h1>" {
+		t.Errorf("/mcp/ = %q, want index.html", got)
+	}
+
+	for _, path := range []string{"/api/health", "/api/run", "/app.js"} {
+		if resp := get(t, gw.URL+path); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("unprefixed %s status = %d, want 404", path, resp.StatusCode)
+		}
+	}
+	waitFor(t, func() bool { return logs.find("request") != nil })
+	if l := logs.find("request"); l["path"] != "/mcp/api/health" {
+		t.Errorf("first logged path = %v, want /mcp/api/health", l["path"])
+	}
+}
+
+func TestStaticCacheHeaders(t *testing.T) {
+	dir := webDir(t, "index.html", "<h1>console</h1>", "app.3f9a1c2b.js", "run()", "index-BfD3kJ9a.css", "body{}", "app.js", "run()", "logo.png", "png")
+	gw := testGateway(t, "WEB_DIR", dir)
+
+	for path, want := range map[string]string{
+		"/":                   "no-cache",
+		"/index.html":         "no-cache",
+		"/app.3f9a1c2b.js":    "public, max-age=31536000, immutable",
+		"/index-BfD3kJ9a.css": "public, max-age=31536000, immutable",
+		"/app.js":             "no-cache",
+		"/logo.png":           "no-cache",
+	} {
+		resp := get(t, gw.URL+path)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: status = %d, want 200", path, resp.StatusCode)
+			continue
+		}
+		if got := resp.Header.Get("Cache-Control"); got != want {
+			t.Errorf("%s: Cache-Control = %q, want %q", path, got, want)
+		}
+		etag := resp.Header.Get("ETag")
+		if etag == "" {
+			t.Errorf("%s: no ETag", path)
+			continue
+		}
+		if again := get(t, gw.URL+path, "If-None-Match", etag); again.StatusCode != http.StatusNotModified {
+			t.Errorf("%s: If-None-Match: status = %d, want 304", path, again.StatusCode)
+		}
+	}
+}
+
+func TestEmbeddedAssetsGetETags(t *testing.T) {
+	gw := testGateway(t)
+
+	resp := get(t, gw.URL+"/")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" || resp.Header.Get("Cache-Control") != "no-cache" {
+		t.Fatalf("embedded index: status %d, ETag %q, Cache-Control %q", resp.StatusCode, etag, resp.Header.Get("Cache-Control"))
+	}
+	if again := get(t, gw.URL+"/", "If-None-Match", etag); again.StatusCode != http.StatusNotModified {
+		t.Errorf("If-None-Match: status = %d, want 304", again.StatusCode)
+	}
+}
+
+func TestServesEmbeddedUIWithoutWebDir(t *testing.T) {
+	want, err := embeddedWeb.ReadFile("web/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing on disk to fall back on: the binary is all there is.
+	t.Chdir(t.TempDir())
+	gw := testGateway(t, "WEB_DIR", "")
+
+	for _, p := range []string{"/", "/index.html", "/runs/42"} {
+		resp := get(t, gw.URL+p)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", p, resp.StatusCode)
+		}
+		if got := body(t, resp); got != string(want) {
+			t.Errorf("%s: body is not the embedded index.html", p)
+		}
+	}
+}
+
+func TestUnknownAPIRouteIsJSON404(t *testing.T) {
+	dir := webDir(t, "index.html", "<h1>app</h1>")
+	gw := testGateway(t, "WEB_DIR", dir)
+
+	for _, tc := range []struct{ method, path string }{
+		{http.MethodGet, "/api/foo"},
+		{http.MethodGet, "/api/"},
+		{http.MethodPost, "/api/runn"},
+		{http.MethodGet, "/api/runs/abc/extra"},
+	} {
+		req, err := http.NewRequest(tc.method, gw.URL+tc.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusNotFound || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+			t.Errorf("%s %s = %d %s, want a JSON 404", tc.method, tc.path, resp.StatusCode, resp.Header.Get("Content-Type"))
+		}
+		if got := decode(t, resp); got["error"] != "not found" || got["path"] != tc.path {
+			t.Errorf("%s %s body = %v, want not found with its path", tc.method, tc.path, got)
+		}
+	}
+	if resp := postJSON(t, gw.URL+"/api/history", map[string]any{}); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /api/history = %d, want a known route to keep its 405", resp.StatusCode)
+	}
+
+	// Paths outside /api keep the SPA and file rules.
+	resp := get(t, gw.URL+"/runs/foo")
+	if got := body(t, resp); resp.StatusCode != http.StatusOK || got != "<h1>app</h1>" {
+		t.Errorf("/runs/foo = %d %q, want index.html", resp.StatusCode, got)
+	}
+	resp = get(t, gw.URL+"/foo.js")
+	if resp.StatusCode != http.StatusNotFound || strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		t.Errorf("/foo.js = %d %s, want the file server's 404", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	gw = testGateway(t, "WEB_DIR", dir, "BASE_PATH", "/mcp")
+	if got := decode(t, get(t, gw.URL+"/mcp/api/foo")); got["path"] != "/mcp/api/foo" {
+		t.Errorf("under BASE_PATH: body = %v, want a JSON 404 for /mcp/api/foo", got)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var startedAt = time.Now()
+
+// runStats are the /api/run counters behind /api/stats.
+var runStats struct {
+	total, ok, failed atomic.Int64
+	durationUS        atomic.Int64 // summed over all runs
+}
+
+// coalesceStats count the runs the cache and DEDUP_INFLIGHT saved the
+// supervisor. They only move while the feature is on.
+var coalesceStats struct {
+	cacheHits, cacheMisses, collapsed atomic.Int64
+}
+
+// latencyWindow is how many of the latest upstream answers the latency
+// percentiles in /api/stats cover.
+const latencyWindow = 1024
+
+// upstreamLatency is a ring of the last latencyWindow upstream latencies,
+// in milliseconds, so older answers age out and memory stays fixed.
+var upstreamLatency struct {
+	sync.Mutex
+	ms [latencyWindow]float64
+	n  int // answers recorded so far; the ring is full once n ≥ latencyWindow
+}
+
+// recordLatency notes how long the supervisor took to answer an attempt.
+func recordLatency(d time.Duration) {
+	upstreamLatency.Lock()
+	upstreamLatency.ms[upstreamLatency.n%latencyWindow] = float64(d.Microseconds()) / 1000
+	upstreamLatency.n++
+	upstreamLatency.Unlock()
+}
+
+// latencyPercentiles returns the nearest-rank p50, p90 and p99 over the
+// window, or nil before the first answer.
+func latencyPercentiles() map[string]any {
+	upstreamLatency.Lock()
+	n := min(upstreamLatency.n, latencyWindow)
+	sorted := slices.Clone(upstreamLatency.ms[:n])
+	upstreamLatency.Unlock()
+	if n == 0 {
+		return nil
+	}
+	slices.Sort(sorted)
+	rank := func(pct int) float64 {
+		return sorted[max((pct*n+99)/100-1, 0)]
+	}
+	return map[string]any{"p50": rank(50), "p90": rank(90), "p99": rank(99), "samples": n}
+}
+
+func recordRun(status int, elapsed time.Duration) {
+	runStats.total.Add(1)
+	if status >= 200 && status < 300 {
+		runStats.ok.Add(1)
+	} else {
+		runStats.failed.Add(1)
+	}
+	runStats.durationUS.Add(elapsed.Microseconds())
+}
+
+// handleStats serves GET /api/stats, a JSON snapshot for those without
+// Prometheus.
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	total := runStats.total.Load()
+	var avg float64
+	if total > 0 {
+		avg = float64(runStats.durationUS.Load()) / float64(total) / 1000
+	}
+	stats := map[string]any{
+		"uptime_seconds":  int64(time.Since(startedAt).Seconds()),
+		"total_runs":      total,
+		"successful_runs": runStats.ok.Load(),
+		"failed_runs":     runStats.failed.Load(),
+		"inflight":        inflightRuns(),
+		"queued":          queuedRuns(),
+		"avg_duration_ms": avg,
+		"retry_ratio":     retries.currentRatio(),
+		"tenants":         tenantStats(),
+	}
+	if latency := latencyPercentiles(); latency != nil {
+		stats["latency_ms"] = latency
+	}
+	if clientWriteTimeout > 0 {
+		stats["slow_client_disconnects"] = slowClients.Load()
+	}
+	if cacheTTL > 0 {
+		stats["cache_hits"] = coalesceStats.cacheHits.Load()
+		stats["cache_misses"] = coalesceStats.cacheMisses.Load()
+	}
+	if dedupInflight {
+		stats["dedup_collapsed"] = coalesceStats.collapsed.Load()
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsCountRuns(t *testing.T) {
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		if goalOf(r) == "break it" {
+			answer(http.StatusInternalServerError, map[string]any{"error": "boom"})(w, r)
+			return
+		}
+		answer(http.StatusOK, map[string]any{"ok": true})(w, r)
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_RETRIES", "0")
+	counters := func() (total, ok, failed float64) {
+		s := decode(t, get(t, gw.URL+"/api/stats"))
+		return s["total_runs"].(float64), s["successful_runs"].(float64), s["failed_runs"].(float64)
+	}
+
+	total, ok, failed := counters()
+	for _, goal := range []string{"list buckets", "break it"} {
+		postJSON(t, gw.URL+"/api/run", map[string]any{"goal": goal}).Body.Close()
+	}
+	// The counters are process-wide, so compare against what they were.
+	var total2, ok2, failed2 float64
+	waitFor(t, func() bool {
+		total2, ok2, failed2 = counters()
+		return total2 == total+2
+	})
+	if ok2 != ok+1 || failed2 != failed+1 {
+		t.Errorf("successful_runs +%v, failed_runs +%v, want +1 each", ok2-ok, failed2-failed)
+	}
+	s := decode(t, get(t, gw.URL+"/api/stats"))
+	if s["inflight"] != float64(0) || s["avg_duration_ms"].(float64) <= 0 {
+		t.Errorf("stats = %v, want nothing in flight and an average duration", s)
+	}
+	if _, ok := s["uptime_seconds"].(float64); !ok {
+		t.Errorf("stats = %v, want uptime_seconds", s)
+	}
+}
+
+// coalesceCounters reads the cache and dedup counters from /metrics, where
+// they are always exported, and from /api/stats, which omits those of a
+// feature that is off.
+func coalesceCounters(t *testing.T, gw string) (metrics map[string]float64, stats map[string]any) {
+	t.Helper()
+	b, err := io.ReadAll(get(t, gw+"/metrics").Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics = map[string]float64{}
+	for _, l := range strings.Split(string(b), "\n") {
+		name, val, ok := strings.Cut(l, " ")
+		if ok && strings.HasPrefix(name, "mcp_gateway_") && (strings.Contains(name, "cache") || strings.Contains(name, "dedup")) {
+			metrics[name], _ = strconv.ParseFloat(val, 64)
+		}
+	}
+	return metrics, decode(t, get(t, gw+"/api/stats"))
+}
+
+func TestCoalesceCounters(t *testing.T) {
+	sup, _ := countingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "CACHE_TTL", "1m")
+	describe := map[string]any{"goal": "describe vpc-7", "cacheable": true}
+
+	before, _ := coalesceCounters(t, gw.URL)
+	postJSON(t, gw.URL+"/api/run", describe)
+	postJSON(t, gw.URL+"/api/run", describe)
+	after, stats := coalesceCounters(t, gw.URL)
+	for name, want := range map[string]float64{"mcp_gateway_cache_hits_total": 1, "mcp_gateway_cache_misses_total": 1} {
+		if got := after[name] - before[name]; got != want {
+			t.Errorf("%s went up by %v, want %v", name, got, want)
+		}
+	}
+	if stats["cache_hits"] != after["mcp_gateway_cache_hits_total"] || stats["cache_misses"] != after["mcp_gateway_cache_misses_total"] {
+		t.Errorf("stats cache_hits %v, cache_misses %v, want what /metrics says", stats["cache_hits"], stats["cache_misses"])
+	}
+	if _, ok := stats["dedup_collapsed"]; ok {
+		t.Error("stats report dedup_collapsed with DEDUP_INFLIGHT off")
+	}
+
+	held, calls, release := heldSupervisor(t)
+	gw = testGateway(t, "SUPERVISOR_URL", held, "CACHE_TTL", "0", "DEDUP_INFLIGHT", "true")
+	before, _ = coalesceCounters(t, gw.URL)
+	runsTogether(t, gw.URL, calls, release, nil, nil, nil)
+	after, stats = coalesceCounters(t, gw.URL)
+	if got := after["mcp_gateway_dedup_collapsed_total"] - before["mcp_gateway_dedup_collapsed_total"]; got != 2 {
+		t.Errorf("mcp_gateway_dedup_collapsed_total went up by %v, want 2", got)
+	}
+	if stats["dedup_collapsed"] != after["mcp_gateway_dedup_collapsed_total"] {
+		t.Errorf("stats dedup_collapsed = %v, want what /metrics says", stats["dedup_collapsed"])
+	}
+	if _, ok := stats["cache_hits"]; ok {
+		t.Error("stats report cache_hits with CACHE_TTL 0")
+	}
+}
+
+// resetLatency empties the latency window.
+func resetLatency() {
+	upstreamLatency.Lock()
+	upstreamLatency.n = 0
+	upstreamLatency.Unlock()
+}
+
+func TestLatencyPercentiles(t *testing.T) {
+	gw := testGateway(t)
+	resetLatency()
+	t.Cleanup(resetLatency)
+	latency := func() map[string]any {
+		l, _ := decode(t, get(t, gw.URL+"/api/stats"))["latency_ms"].(map[string]any)
+		return l
+	}
+	if l := latency(); l != nil {
+		t.Errorf("latency_ms = %v before any answer, want none", l)
+	}
+
+	// 1ms to 1000ms, shuffled so order can't matter.
+	for _, i := range rand.Perm(1000) {
+		recordLatency(time.Duration(i+1) * time.Millisecond)
+	}
+	l := latency()
+	for k, want := range map[string]float64{"p50": 500, "p90": 900, "p99": 990, "samples": 1000} {
+		if got, _ := l[k].(float64); got < want-2 || got > want+2 {
+			t.Errorf("%s = %v, want about %v", k, l[k], want)
+		}
+	}
+
+	// A full window of fast answers pushes every slow one out.
+	for range latencyWindow {
+		recordLatency(5 * time.Millisecond)
+	}
+	l = latency()
+	for k, want := range map[string]float64{"p50": 5, "p99": 5, "samples": latencyWindow} {
+		if l[k] != want {
+			t.Errorf("after the window moved on: %s = %v, want %v", k, l[k], want)
+		}
+	}
+}
+
+func TestLatencyPercentilesTrackRuns(t *testing.T) {
+	sup := fakeSupervisor(t, slow(50*time.Millisecond))
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+	resetLatency()
+	t.Cleanup(resetLatency)
+
+	for range 3 {
+		postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"})
+	}
+	l, _ := decode(t, get(t, gw.URL+"/api/stats"))["latency_ms"].(map[string]any)
+	if p50, _ := l["p50"].(float64); l["samples"] != float64(3) || p50 < 50 || p50 > 1000 {
+		t.Errorf("latency_ms = %v, want 3 samples of about 50ms", l)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// successStatuses is SUCCESS_STATUSES, the supervisor statuses that count as
+// a successful run, as inclusive ranges. Any other status is an error: it is
+// normalized into an error answer and, unless it is a 4xx the caller caused,
+// counts against the circuit breaker.
+var successStatuses = [][2]int{{200, 299}}
+
+// loadSuccessStatuses parses a comma-separated list of statuses and
+// inclusive ranges, e.g. "200,202,204-206".
+func loadSuccessStatuses(val string) error {
+	var out [][2]int
+	for _, part := range splitList(val) {
+		lo, hi, isRange := strings.Cut(part, "-")
+		from, err := strconv.Atoi(strings.TrimSpace(lo))
+		to := from
+		if err == nil && isRange {
+			to, err = strconv.Atoi(strings.TrimSpace(hi))
+		}
+		if err != nil || from < 100 || to > 599 || from > to {
+			return fmt.Errorf("SUCCESS_STATUSES: invalid status or range %q", part)
+		}
+		out = append(out, [2]int{from, to})
+	}
+	if len(out) == 0 {
+		return fmt.Errorf("SUCCESS_STATUSES: no statuses in %q", val)
+	}
+	successStatuses = out
+	return nil
+}
+
+// upstreamSuccess reports whether a supervisor status is in SUCCESS_STATUSES.
+func upstreamSuccess(code int) bool {
+	for _, r := range successStatuses {
+		if code >= r[0] && code <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// upstreamHealthy reports whether an answer with code shows the supervisor
+// working, for the circuit breaker: a success, or a 4xx refusing the
+// request the caller sent.
+func upstreamHealthy(code int) bool {
+	return upstreamSuccess(code) || code >= 400 && code < 500
+}
+
+// markAsync sets X-Async-Accepted on a 202 the supervisor answered as a
+// success, telling the client the run was accepted but has not finished.
+func markAsync(w http.ResponseWriter, resp *http.Response) {
+	if resp.StatusCode == http.StatusAccepted && upstreamSuccess(resp.StatusCode) {
+		w.Header().Set("X-Async-Accepted", "true")
+	}
+}
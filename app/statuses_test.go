@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAcceptedIsSuccess(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusAccepted, map[string]any{"accepted": true, "ticket": "t-1"}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "CB_THRESHOLD", "2", "MAX_RETRIES", "0")
+
+	for range 3 {
+		resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "rebuild the search index"})
+		if resp.StatusCode != http.StatusAccepted {
+			t.Fatalf("status = %d, want 202", resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-Async-Accepted"); got != "true" {
+			t.Errorf("X-Async-Accepted = %q, want true", got)
+		}
+		if got := decode(t, resp)["ticket"]; got != "t-1" {
+			t.Errorf("ticket = %v, want the supervisor's answer relayed", got)
+		}
+	}
+	if breaker.State() != circuitClosed {
+		t.Errorf("breaker = %s after three 202s, want closed", breaker.State())
+	}
+
+	sup = fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true}))
+	gw = testGateway(t, "SUPERVISOR_URL", sup)
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}); resp.Header.Get("X-Async-Accepted") != "" {
+		t.Error("X-Async-Accepted set on a 200")
+	}
+}
+
+func TestServerErrorIsFailure(t *testing.T) {
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "CB_THRESHOLD", "2", "MAX_RETRIES", "0")
+
+	for range 2 {
+		resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "rebuild the search index"})
+		if resp.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("status = %d, want 500", resp.StatusCode)
+		}
+		if resp.Header.Get("X-Async-Accepted") != "" {
+			t.Error("X-Async-Accepted set on a 500")
+		}
+		if got := decode(t, resp); got["error"] != "supervisor error" || got["detail"] != "internal error" {
+			t.Errorf("body = %v, want the error normalized", got)
+		}
+	}
+	if breaker.State() != circuitOpen {
+		t.Errorf("breaker = %s after two 500s, want open", breaker.State())
+	}
+}
+
+func TestSuccessStatusesSetting(t *testing.T) {
+	sup := fakeSupervisor(t, answer(http.StatusAccepted, map[string]any{"accepted": true}))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "SUCCESS_STATUSES", "200", "CB_THRESHOLD", "2", "MAX_RETRIES", "0")
+
+	for range 2 {
+		resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "rebuild the search index"})
+		if resp.StatusCode != http.StatusBadGateway || resp.Header.Get("X-Async-Accepted") != "" {
+			t.Fatalf("202 outside SUCCESS_STATUSES: status = %d, X-Async-Accepted = %q, want a plain 502",
+				resp.StatusCode, resp.Header.Get("X-Async-Accepted"))
+		}
+		if got := decode(t, resp); got["error"] != "unexpected supervisor status" || got["status"] != float64(202) {
+			t.Errorf("body = %v, want the unexpected status named", got)
+		}
+	}
+	if breaker.State() != circuitOpen {
+		t.Errorf("breaker = %s, want a 202 outside SUCCESS_STATUSES to count as a failure", breaker.State())
+	}
+
+	if err := loadSuccessStatuses("200, 202,204-206"); err != nil {
+		t.Fatal(err)
+	}
+	for code, want := range map[int]bool{200: true, 201: false, 202: true, 204: true, 206: true, 207: false, 500: false} {
+		if got := upstreamSuccess(code); got != want {
+			t.Errorf("upstreamSuccess(%d) = %v, want %v", code, got, want)
+		}
+	}
+	for _, bad := range []string{"ok", "299-200", "99", "200-600", ","} {
+		if err := loadSuccessStatuses(bad); err == nil {
+			t.Errorf("SUCCESS_STATUSES=%q: no error", bad)
+		}
+	}
+}
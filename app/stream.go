@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// clientWriteTimeout is CLIENT_WRITE_TIMEOUT: how long an SSE frame may take
+// to reach the client. A client that can't keep up has its stream torn
+// down, and the upstream call canceled, instead of backing data up in the
+// gateway. Zero disables the check.
+var clientWriteTimeout time.Duration
+
+// slowClients counts the streams torn down by clientWriteTimeout.
+var slowClients atomic.Int64
+
+// wantsEventStream reports whether the client asked for a Server-Sent Events response.
+func wantsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// streamSSE relays the supervisor body to the client as it arrives, one SSE
+// "data:" frame per chunk read. It stops as soon as the client goes away or
+// falls clientWriteTimeout behind, with a final "shutdown" event when the
+// gateway is shutting down, and with an "error" event when the supervisor
+// connection breaks before the body ends.
+func streamSSE(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	rc := http.NewResponseController(w)
+	defer trackStream()()
+	stopped := make(chan struct{})
+	defer close(stopped)
+	// Taken here, since the watcher can outlive the handler.
+	shutdown := streamShutdown
+	go func() {
+		select {
+		case <-shutdown:
+			resp.Body.Close() // unblocks the read below
+		case <-stopped:
+		}
+	}()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Upstream-Status", strconv.Itoa(resp.StatusCode))
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	buf := make([]byte, 4096)
+	var relayed int64
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		default:
+		}
+
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if werr := deliverSSE(rc, func() error { return writeSSEData(w, buf[:n]) }); werr != nil {
+				if errors.Is(werr, os.ErrDeadlineExceeded) {
+					dropSlowClient(w, rc, r)
+				}
+				return
+			}
+			relayed += int64(n)
+		}
+		if err == io.EOF {
+			io.WriteString(w, "event: done\ndata: {}\n\n")
+			flusher.Flush()
+			return
+		}
+		if err != nil {
+			if shuttingDownStreams() {
+				io.WriteString(w, "event: shutdown\ndata: {\"shutdown\":true}\n\n")
+				flusher.Flush()
+				return
+			}
+			if r.Context().Err() == nil {
+				logger.Warn("stream: upstream read failed, stream cut short", "request_id", requestID(r.Context()), "bytes", relayed, "err", err)
+				if errors.Is(err, errResponseTooLarge) {
+					io.WriteString(w, "event: error\ndata: {\"error\":\"upstream response too large\",\"limit\":"+strconv.FormatInt(maxResponseBytes, 10)+"}\n\n")
+				} else {
+					io.WriteString(w, "event: error\ndata: {\"error\":\"stream interrupted\",\"bytes\":"+strconv.FormatInt(relayed, 10)+"}\n\n")
+				}
+				flusher.Flush()
+			}
+			return
+		}
+	}
+}
+
+// deliverSSE writes and flushes one frame, within clientWriteTimeout when
+// it is set.
+func deliverSSE(rc *http.ResponseController, write func() error) error {
+	if clientWriteTimeout > 0 {
+		rc.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// dropSlowClient ends a stream whose client fell clientWriteTimeout behind,
+// with an "error" event should the connection still take it.
+func dropSlowClient(w http.ResponseWriter, rc *http.ResponseController, r *http.Request) {
+	slowClients.Add(1)
+	logger.Warn("stream: client too slow, closing", "request_id", requestID(r.Context()), "client_write_timeout", clientWriteTimeout.String())
+	rc.SetWriteDeadline(time.Now().Add(time.Second))
+	io.WriteString(w, "event: error\ndata: {\"error\":\"client too slow\"}\n\n")
+	rc.Flush()
+}
+
+// writeSSEData writes chunk as a single SSE event, splitting embedded newlines
+// into separate "data:" lines as the SSE framing requires.
+func writeSSEData(w io.Writer, chunk []byte) error {
+	var frame bytes.Buffer
+	for _, line := range bytes.Split(bytes.TrimRight(chunk, "\n"), []byte("\n")) {
+		frame.WriteString("data: ")
+		frame.Write(bytes.TrimRight(line, "\r"))
+		frame.WriteByte('\n')
+	}
+	frame.WriteByte('\n')
+	_, err := w.Write(frame.Bytes())
+	return err
+}
+
+// relayBody copies a pass-through body to the client once the status is
+// out. Should the supervisor connection break first, or the body run past
+// maxResponseBytes, a chunked NDJSON body gets a final {"error":...} line,
+// on a line of its own even when the cut fell mid-line, so the client can
+// tell it from one that ended; other bodies are simply left short.
+func relayBody(w http.ResponseWriter, r *http.Request, resp *http.Response) {
+	src := &readErrRecorder{Reader: resp.Body}
+	n, err := io.Copy(w, src)
+	if err == nil {
+		return
+	}
+	logger.Warn("upstream body cut", "request_id", requestID(r.Context()), "bytes", n, "err", err)
+	if src.err == nil || resp.ContentLength >= 0 || r.Context().Err() != nil {
+		return
+	}
+	if ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); ct == "application/x-ndjson" {
+		if n > 0 && src.last != '\n' {
+			io.WriteString(w, "\n")
+		}
+		if errors.Is(src.err, errResponseTooLarge) {
+			io.WriteString(w, "{\"error\":\"upstream response too large\"}\n")
+		} else {
+			io.WriteString(w, "{\"error\":\"stream interrupted\"}\n")
+		}
+	}
+}
+
+// readErrRecorder remembers the error its Reader failed with, other than
+// io.EOF, telling a failed read from a failed write after an io.Copy, and
+// the last byte it read.
+type readErrRecorder struct {
+	io.Reader
+	err  error
+	last byte
+}
+
+func (r *readErrRecorder) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.last = p[n-1]
+	}
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// streamShutdown is closed STREAM_DRAIN_TIMEOUT into a shutdown. SSE and
+// WebSocket streams still open then send a final {"shutdown":true} and
+// close, instead of holding the process for the whole SHUTDOWN_TIMEOUT.
+var streamShutdown = make(chan struct{})
+
+// openStreams counts SSE and WebSocket streams in progress. Hijacked
+// WebSocket connections are invisible to srv.Shutdown, so main waits on
+// this as well.
+var openStreams atomic.Int64
+
+// trackStream counts a stream as open until the returned func is called.
+func trackStream() func() {
+	openStreams.Add(1)
+	return func() { openStreams.Add(-1) }
+}
+
+func shuttingDownStreams() bool {
+	select {
+	case <-streamShutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeStreamsAfter tells open streams to wrap up once d has passed.
+func closeStreamsAfter(d time.Duration) {
+	time.AfterFunc(d, func() { close(streamShutdown) })
+}
+
+// waitStreams blocks until every stream has finished or ctx is done.
+func waitStreams(ctx context.Context) {
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+	for openStreams.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
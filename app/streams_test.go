@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownClosesStreams(t *testing.T) {
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, `{"progress":"planning"}`)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done() // a run that never ends on its own
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "watch the fleet"}, "Accept", "text/event-stream")
+	events := bufio.NewReader(resp.Body)
+	for {
+		line, err := events.ReadString('\n')
+		if err != nil {
+			t.Fatalf("stream ended before its first frame: %v", err)
+		}
+		if strings.Contains(line, "planning") {
+			break
+		}
+	}
+
+	const drain = 100 * time.Millisecond
+	start := time.Now()
+	closeStreamsAfter(drain)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := gw.Config.Shutdown(ctx); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if took := time.Since(start); took > drain+time.Second {
+		t.Errorf("shutdown took %v, want about the %v drain timeout", took, drain)
+	}
+	rest, _ := io.ReadAll(events)
+	if !strings.Contains(string(rest), "event: shutdown\ndata: {\"shutdown\":true}\n\n") {
+		t.Errorf("stream ended with %q, want a shutdown event", rest)
+	}
+	if openStreams.Load() != 0 {
+		t.Errorf("%d streams still open", openStreams.Load())
+	}
+}
+
+func TestSlowStreamClientIsDropped(t *testing.T) {
+	canceled := make(chan struct{})
+	chunk := strings.Repeat("x", 32<<10)
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		defer close(canceled)
+		for r.Context().Err() == nil { // a fast supervisor with plenty to say
+			if _, err := io.WriteString(w, chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "CLIENT_WRITE_TIMEOUT", "200ms")
+	logs := captureLogs(t)
+	before := slowClients.Load()
+
+	// A client that asks for a stream and then never reads it.
+	conn, err := net.Dial("tcp", strings.TrimPrefix(gw.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.(*net.TCPConn).SetReadBuffer(4 << 10)
+	run := `{"goal":"tail the fleet logs"}`
+	fmt.Fprintf(conn, "POST /api/run HTTP/1.1\r\nHost: gateway\r\nAccept: text/event-stream\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(run), run)
+
+	select {
+	case <-canceled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the upstream run was not canceled for the slow client")
+	}
+	waitFor(t, func() bool { return slowClients.Load() == before+1 })
+	if logs.find("stream: client too slow, closing") == nil {
+		t.Error("no slow-client warning logged")
+	}
+	metrics := body(t, get(t, gw.URL+"/metrics"))
+	if want := "mcp_gateway_slow_client_disconnects_total " + strconv.FormatInt(before+1, 10); !strings.Contains(metrics, want) {
+		t.Errorf("/metrics has no %q", want)
+	}
+}
+
+// cutMidStream is a supervisor that sends first as a chunked body of
+// contentType and then drops the connection before the body ends.
+func cutMidStream(contentType, first string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", contentType)
+		io.WriteString(w, first)
+		w.(http.Flusher).Flush()
+		if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestStreamCutShortEndsWithErrorEvent(t *testing.T) {
+	sup := fakeSupervisor(t, cutMidStream("application/json", `{"progress":"planning"}`))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_RETRIES", "0")
+	logs := captureLogs(t)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "watch the fleet"}, "Accept", "text/event-stream")
+	got := body(t, resp)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(got, "data: {\"progress\":\"planning\"}\n\n") {
+		t.Fatalf("status = %d, stream = %q, want the first frame relayed", resp.StatusCode, got)
+	}
+	if want := "event: error\ndata: {\"error\":\"stream interrupted\",\"bytes\":23}\n\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("stream = %q, want it to end with %q", got, want)
+	}
+	if l := logs.find("stream: upstream read failed, stream cut short"); l == nil || l["bytes"] != float64(23) {
+		t.Errorf("log = %v, want the partial failure with the bytes relayed", l)
+	}
+}
+
+func TestNDJSONCutShortEndsWithErrorLine(t *testing.T) {
+	sup := fakeSupervisor(t, cutMidStream("application/x-ndjson", "{\"progress\":1}\n"))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_RETRIES", "0")
+	logs := captureLogs(t)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "watch the fleet"})
+	if got := body(t, resp); resp.StatusCode != http.StatusOK || got != "{\"progress\":1}\n{\"error\":\"stream interrupted\"}\n" {
+		t.Errorf("status = %d, body = %q, want the line relayed and an error line after it", resp.StatusCode, got)
+	}
+	if l := logs.find("upstream body cut"); l == nil || l["bytes"] != float64(15) {
+		t.Errorf("log = %v, want the partial failure with the bytes relayed", l)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/time/rate"
+)
+
+// tenantBackends maps an X-Tenant ID to its supervisor backends, from TENANTS.
+var tenantBackends = map[string][]string{}
+
+// tenantSpec is a TENANTS entry in its object form.
+type tenantSpec struct {
+	Supervisors json.RawMessage `json:"supervisors"` // "url,url" or ["url", ...]
+	Rate        *float64        `json:"rate"`        // runs/sec; TENANT_RATE_LIMIT when unset
+	Burst       *int            `json:"burst"`       // TENANT_RATE_BURST when unset
+}
+
+// loadTenants reads TENANTS, either inline JSON or a path to a JSON file,
+// mapping tenant IDs to supervisor URLs (comma-separated for several), or to
+// an object that also sets the tenant's rate limit:
+//
+//	{"team-a": "http://a:9000/run", "team-b": {"supervisors": "http://b:9000/run", "rate": 2, "burst": 5}}
+func loadTenants(val string) error {
+	tenantBackends, tenantLimiters, tenantUsage = map[string][]string{}, map[string]*rate.Limiter{}, map[string]*tenantCounters{}
+	if val == "" {
+		return nil
+	}
+	raw := []byte(val)
+	if !strings.HasPrefix(strings.TrimSpace(val), "{") {
+		var err error
+		if raw, err = os.ReadFile(val); err != nil {
+			return err
+		}
+	}
+	var byID map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &byID); err != nil {
+		return fmt.Errorf("TENANTS: %w", err)
+	}
+	for id, entry := range byID {
+		var spec tenantSpec
+		if err := json.Unmarshal(entry, &spec); err != nil || len(spec.Supervisors) == 0 {
+			spec = tenantSpec{Supervisors: entry}
+		}
+		list, err := tenantURLs(spec.Supervisors)
+		if err != nil {
+			return fmt.Errorf("TENANTS: tenant %q: %w", id, err)
+		}
+		if len(list) == 0 {
+			return fmt.Errorf("TENANTS: tenant %q has no supervisor URL", id)
+		}
+		tenantBackends[id] = list
+		addTenantLimiter(id, spec.Rate, spec.Burst)
+	}
+	return nil
+}
+
+// tenantURLs accepts a comma-separated string or a list of URLs.
+func tenantURLs(raw json.RawMessage) ([]string, error) {
+	var list []string
+	if err := json.Unmarshal(raw, &list); err == nil {
+		return list, nil
+	}
+	var urls string
+	if err := json.Unmarshal(raw, &urls); err != nil {
+		return nil, errors.New(`want a URL string, a list of URLs or {"supervisors": ...}`)
+	}
+	return splitList(urls), nil
+}
+
+// tenantOf returns the X-Tenant header, or "" for the default tenant.
+func tenantOf(r *http.Request) string {
+	if rc := requestContext(r.Context()); rc != nil {
+		return rc.Tenant
+	}
+	return strings.TrimSpace(r.Header.Get("X-Tenant"))
+}
+
+// tenantLabel is the tenant as reported in logs and metrics; unknown IDs are
+// folded together so arbitrary headers can't blow up label cardinality.
+func tenantLabel(r *http.Request) string {
+	t := tenantOf(r)
+	if _, ok := tenantBackends[t]; ok || t == "" {
+		return t
+	}
+	return "unknown"
+}
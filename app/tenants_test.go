@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTenantRouting(t *testing.T) {
+	def := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true, "answer": "default"}))
+	teamA := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true, "answer": "team-a"}))
+	gw := testGateway(t, "SUPERVISOR_URL", def, "TENANTS", fmt.Sprintf(`{"team-a": %q}`, teamA))
+	logs := captureLogs(t)
+	goal := map[string]any{"goal": "list clusters"}
+
+	if got := decode(t, postJSON(t, gw.URL+"/api/run", goal, "X-Tenant", "team-a"))["answer"]; got != "team-a" {
+		t.Errorf("team-a answered by %v, want its own supervisor", got)
+	}
+	if got := decode(t, postJSON(t, gw.URL+"/api/run", goal))["answer"]; got != "default" {
+		t.Errorf("no X-Tenant answered by %v, want the default supervisor", got)
+	}
+	if resp := postJSON(t, gw.URL+"/api/run", goal, "X-Tenant", "team-z"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("unknown tenant status = %d, want 403", resp.StatusCode)
+	}
+
+	var logged bool
+	for _, l := range logs.lines() {
+		logged = logged || l["msg"] == "request" && l["tenant"] == "team-a"
+	}
+	if !logged {
+		t.Error("request log has no tenant=team-a line")
+	}
+	b, _ := io.ReadAll(get(t, gw.URL+"/metrics").Body)
+	if want := `mcp_gateway_requests_total{path="/api/run",status="200",tenant="team-a"}`; !strings.Contains(string(b), want) {
+		t.Errorf("no %s in:\n%s", want, grepLines(string(b), "mcp_gateway_requests_total"))
+	}
+}
+
+func TestTenantsFromFile(t *testing.T) {
+	teamB := fakeSupervisor(t, answer(http.StatusOK, map[string]any{"ok": true, "answer": "team-b"}))
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	if err := os.WriteFile(path, []byte(fmt.Sprintf(`{"team-b": {"supervisors": [%q]}}`, teamB)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	gw := testGateway(t, "TENANTS", path)
+
+	if got := decode(t, postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list clusters"}, "X-Tenant", "team-b"))["answer"]; got != "team-b" {
+		t.Errorf("team-b answered by %v, want its supervisor from the file", got)
+	}
+}
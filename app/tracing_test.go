@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// recordSpans points tracer at an in-memory recorder for the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	prevTracer, prevProp := tracer, otel.GetTextMapPropagator()
+	tracer = tp.Tracer("mcpgui")
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		tracer = prevTracer
+		otel.SetTextMapPropagator(prevProp)
+	})
+	return rec
+}
+
+// intAttr returns the int attribute key of span, or -1.
+func intAttr(span sdktrace.ReadOnlySpan, key string) int64 {
+	for _, kv := range span.Attributes() {
+		if kv.Key == attribute.Key(key) {
+			return kv.Value.AsInt64()
+		}
+	}
+	return -1
+}
+
+func TestRunIsTraced(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+	rec := recordSpans(t)
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}, "traceparent", parent)
+	sent := nextRequest(t, seen).header.Get("traceparent")
+
+	var server, client sdktrace.ReadOnlySpan
+	waitFor(t, func() bool { return len(rec.Ended()) == 2 })
+	for _, s := range rec.Ended() {
+		switch s.SpanKind() {
+		case trace.SpanKindServer:
+			server = s
+		case trace.SpanKindClient:
+			client = s
+		}
+	}
+	if server == nil || client == nil {
+		t.Fatalf("spans = %v, want a server and a client span", rec.Ended())
+	}
+	if server.Name() != "POST /api/run" || intAttr(server, "http.response.status_code") != http.StatusOK {
+		t.Errorf("server span %q with status %d, want POST /api/run and 200", server.Name(), intAttr(server, "http.response.status_code"))
+	}
+	if intAttr(client, "http.response.status_code") != http.StatusOK {
+		t.Errorf("client span status = %d, want the upstream's 200", intAttr(client, "http.response.status_code"))
+	}
+	if got := server.SpanContext().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" || client.SpanContext().TraceID().String() != got {
+		t.Errorf("trace IDs %s and %s, want both to continue the caller's trace", got, client.SpanContext().TraceID())
+	}
+	if client.Parent().SpanID() != server.SpanContext().SpanID() {
+		t.Error("client span is not a child of the server span")
+	}
+	if !strings.Contains(sent, client.SpanContext().TraceID().String()) || !strings.Contains(sent, client.SpanContext().SpanID().String()) {
+		t.Errorf("supervisor got traceparent %q, want the client span's context", sent)
+	}
+}
+
+func TestNoopTracerByDefault(t *testing.T) {
+	testGateway(t)
+	if _, span := tracer.Start(t.Context(), "x"); span.SpanContext().IsValid() {
+		t.Error("tracer records spans without OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+}
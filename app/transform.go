@@ -0,0 +1,45 @@
+package main
+
+import "fmt"
+
+// RequestTransformer adapts a validated run body to the shape a particular
+// supervisor version expects, just before it is forwarded.
+type RequestTransformer interface {
+	Transform(goal string, raw map[string]any) (map[string]any, error)
+}
+
+// transformers are the TRANSFORMER choices.
+var transformers = map[string]RequestTransformer{
+	"identity": identityTransformer{},
+	"legacy":   legacyTransformer{},
+}
+
+// transformer is the selected TRANSFORMER, "identity" by default.
+var transformer RequestTransformer = identityTransformer{}
+
+func selectTransformer(name string) error {
+	t, ok := transformers[name]
+	if !ok {
+		return fmt.Errorf("TRANSFORMER: unknown transformer %q", name)
+	}
+	transformer = t
+	return nil
+}
+
+// identityTransformer forwards the body unchanged.
+type identityTransformer struct{}
+
+func (identityTransformer) Transform(_ string, raw map[string]any) (map[string]any, error) {
+	return raw, nil
+}
+
+// legacyTransformer serves older supervisors that read the instruction
+// from "prompt" rather than "goal" or "message".
+type legacyTransformer struct{}
+
+func (legacyTransformer) Transform(goal string, raw map[string]any) (map[string]any, error) {
+	delete(raw, "goal")
+	delete(raw, "message")
+	raw["prompt"] = goal
+	return raw, nil
+}
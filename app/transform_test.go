@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestTransformers(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body map[string]any
+		want map[string]any
+	}{
+		{"identity", map[string]any{"goal": "list buckets", "region": "eu-west-1"},
+			map[string]any{"goal": "list buckets", "region": "eu-west-1"}},
+		{"legacy", map[string]any{"goal": "list buckets", "region": "eu-west-1"},
+			map[string]any{"prompt": "list buckets", "region": "eu-west-1"}},
+		{"legacy", map[string]any{"message": "list buckets", "thread_id": "t-1"},
+			map[string]any{"prompt": "list buckets", "thread_id": "t-1"}},
+	} {
+		sup, seen := recordingSupervisor(t)
+		gw := testGateway(t, "SUPERVISOR_URL", sup, "TRANSFORMER", tc.name)
+
+		if resp := postJSON(t, gw.URL+"/api/run", tc.body); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", tc.name, resp.StatusCode)
+		}
+		var got map[string]any
+		json.Unmarshal(nextRequest(t, seen).body, &got)
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: supervisor got %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for k, v := range tc.want {
+			if got[k] != v {
+				t.Errorf("%s: supervisor got %v, want %v", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func TestUnknownTransformer(t *testing.T) {
+	if err := selectTransformer("v3"); err == nil {
+		t.Error("selectTransformer accepted an unknown name")
+	}
+}
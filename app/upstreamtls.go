@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// upstreamTLS builds the client TLS config for supervisor calls from
+// UPSTREAM_CLIENT_CERT/UPSTREAM_CLIENT_KEY (a keypair for mutual TLS) and
+// UPSTREAM_CA_CERT (a PEM bundle replacing the system roots). It returns nil
+// when none are set, keeping Go's defaults.
+func upstreamTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil, nil
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("UPSTREAM_CLIENT_CERT and UPSTREAM_CLIENT_KEY must be set together")
+	}
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if certFile != "" {
+		pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("UPSTREAM_CLIENT_CERT: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{pair}
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("UPSTREAM_CA_CERT: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("UPSTREAM_CA_CERT: no certificates in %s", caFile)
+		}
+		conf.RootCAs = pool
+	}
+	return conf, nil
+}
+
+// upstreamProxy picks the proxy for supervisor calls: UPSTREAM_PROXY when
+// set, for a supervisor hop that goes out differently from everything else,
+// or else the usual HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func upstreamProxy(raw string) (func(*http.Request) (*url.URL, error), error) {
+	if raw == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, errors.New("UPSTREAM_PROXY: not a valid URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" || u.Host == "" {
+		return nil, fmt.Errorf("UPSTREAM_PROXY: %q is not an http, https or socks5 proxy URL", u.Redacted())
+	}
+	return http.ProxyURL(u), nil
+}
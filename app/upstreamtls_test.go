@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeClientCert writes a self-signed client certificate and its key to
+// dir and returns their paths and the parsed certificate.
+func writeClientCert(t *testing.T, dir, name string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile, cert
+}
+
+func writePEM(t *testing.T, path, kind string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpstreamMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, clientCert := writeClientCert(t, dir, "gateway")
+	clients := x509.NewCertPool()
+	clients.AddCert(clientCert)
+
+	var peer string
+	sup := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peer = r.TLS.PeerCertificates[0].Subject.CommonName
+		writeJSON(w, http.StatusOK, map[string]any{"status": "done"})
+	}))
+	sup.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clients}
+	sup.StartTLS()
+	t.Cleanup(sup.Close)
+	caFile := filepath.Join(dir, "ca.crt")
+	writePEM(t, caFile, "CERTIFICATE", sup.Certificate().Raw)
+
+	gw := testGateway(t, "SUPERVISOR_URL", sup.URL+"/run",
+		"UPSTREAM_CLIENT_CERT", certFile, "UPSTREAM_CLIENT_KEY", keyFile, "UPSTREAM_CA_CERT", caFile)
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}); resp.StatusCode != http.StatusOK {
+		t.Fatalf("with a client certificate: status = %d, want 200", resp.StatusCode)
+	}
+	if peer != "gateway" {
+		t.Errorf("supervisor saw client certificate %q, want gateway", peer)
+	}
+
+	gw = testGateway(t, "SUPERVISOR_URL", sup.URL+"/run", "UPSTREAM_CLIENT_CERT", "", "UPSTREAM_CLIENT_KEY", "")
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}); resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("without a client certificate: status = %d, want 502", resp.StatusCode)
+	}
+}
+
+func TestUpstreamTLSFailsFast(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeClientCert(t, dir, "gateway")
+	_, otherKey, _ := writeClientCert(t, dir, "other")
+	garbage := filepath.Join(dir, "garbage.pem")
+	os.WriteFile(garbage, []byte("not a certificate"), 0o600)
+
+	for _, tc := range []struct {
+		name, cert, key, ca, want string
+	}{
+		{"cert without key", certFile, "", "", "must be set together"},
+		{"unreadable cert", filepath.Join(dir, "missing.crt"), keyFile, "", "UPSTREAM_CLIENT_CERT"},
+		{"mismatched key", certFile, otherKey, "", "UPSTREAM_CLIENT_CERT"},
+		{"unreadable CA", "", "", filepath.Join(dir, "missing.crt"), "UPSTREAM_CA_CERT"},
+		{"CA without certificates", "", "", garbage, "no certificates"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := upstreamTLS(tc.cert, tc.key, tc.ca)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("err = %v, want it to mention %q", err, tc.want)
+			}
+		})
+	}
+	if conf, err := upstreamTLS("", "", ""); conf != nil || err != nil {
+		t.Errorf("unset: got %v, %v, want the default transport config", conf, err)
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	proxied := make(chan string, 10)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy sees the absolute URL of the supervisor.
+		if r.URL.IsAbs() {
+			proxied <- r.Method + " " + r.URL.String()
+		}
+		io.Copy(io.Discard, r.Body)
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true, "via": "proxy"})
+	}))
+	t.Cleanup(proxy.Close)
+	// Only reachable through the proxy: the name does not resolve.
+	gw := testGateway(t, "SUPERVISOR_URL", "http://supervisor.invalid:8000/run", "UPSTREAM_PROXY", proxy.URL)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"})
+	if resp.StatusCode != http.StatusOK || decode(t, resp)["via"] != "proxy" {
+		t.Fatalf("status = %d, want the proxy's 200", resp.StatusCode)
+	}
+	select {
+	case got := <-proxied:
+		if got != "POST http://supervisor.invalid:8000/run" {
+			t.Errorf("proxy got %q, want the supervisor run", got)
+		}
+	default:
+		t.Error("the run did not go through UPSTREAM_PROXY")
+	}
+}
+
+func TestUpstreamProxyFailsFast(t *testing.T) {
+	for _, raw := range []string{"://nope", "ftp://proxy:21", "proxy.internal:3128"} {
+		if _, err := upstreamProxy(raw); err == nil {
+			t.Errorf("UPSTREAM_PROXY=%q accepted", raw)
+		}
+	}
+	t.Setenv("SUPERVISOR_URL", "http://127.0.0.1:1/run")
+	t.Setenv("UPSTREAM_PROXY", "ftp://proxy:21")
+	if err := configure(); err == nil || !strings.Contains(err.Error(), "UPSTREAM_PROXY") {
+		t.Errorf("configure = %v, want an UPSTREAM_PROXY error", err)
+	}
+
+}
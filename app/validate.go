@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxGoalLen caps the goal length in characters.
+var maxGoalLen int
+
+// validationError is a request the gateway refuses before contacting the
+// supervisor.
+type validationError struct {
+	Status int
+	Msg    string
+	Extra  map[string]any // added to the error body, e.g. the configured providers
+	// Errors lists the failed field checks, reported as "errors" so a UI
+	// can point at each bad field.
+	Errors []fieldError
+}
+
+// fieldError is one failed check of a request field. Code is stable and
+// meant for machines; Message is for people and may change.
+type fieldError struct {
+	Field   string   `json:"field"`
+	Code    string   `json:"code"`
+	Message string   `json:"message"`
+	Limit   int      `json:"limit,omitempty"`
+	Allowed []string `json:"allowed,omitempty"`
+}
+
+// fieldInvalid is a validationError for one failed field check.
+func fieldInvalid(status int, field, code, msg string) *validationError {
+	return &validationError{Status: status, Msg: msg, Errors: []fieldError{{Field: field, Code: code, Message: msg}}}
+}
+
+// withLimit and withAllowed add the bound a field broke to its error.
+func (e *validationError) withLimit(limit int) *validationError {
+	e.Errors[0].Limit = limit
+	return e
+}
+
+func (e *validationError) withAllowed(allowed []string) *validationError {
+	e.Errors[0].Allowed = allowed
+	return e
+}
+
+// joinValidation merges the failed checks of one request into a single
+// error with the most severe status of them, nil when all passed.
+func joinValidation(errs ...*validationError) *validationError {
+	var out *validationError
+	var msgs []string
+	for _, e := range errs {
+		if e == nil {
+			continue
+		}
+		msgs = append(msgs, e.Msg)
+		if out == nil {
+			out = &validationError{Status: e.Status}
+		} else if severity(e.Status) > severity(out.Status) {
+			out.Status = e.Status
+		}
+		out.Errors = append(out.Errors, e.Errors...)
+		for k, v := range e.Extra {
+			if out.Extra == nil {
+				out.Extra = map[string]any{}
+			}
+			out.Extra[k] = v
+		}
+	}
+	if out != nil {
+		out.Msg = strings.Join(msgs, "; ")
+	}
+	return out
+}
+
+// severity ranks validation statuses: a goal the policy forbids outranks a
+// well-formed but unacceptable request, which outranks a malformed one.
+func severity(status int) int {
+	switch status {
+	case http.StatusForbidden:
+		return 3
+	case http.StatusUnprocessableEntity:
+		return 2
+	case http.StatusBadRequest:
+		return 1
+	}
+	return 0
+}
+
+func (e *validationError) write(w http.ResponseWriter) {
+	if len(e.Extra) == 0 && len(e.Errors) == 0 {
+		writeError(w, e.Status, e.Msg)
+		return
+	}
+	body := map[string]any{"error": e.Msg, "status": e.Status}
+	for k, v := range e.Extra {
+		body[k] = v
+	}
+	if len(e.Errors) > 0 {
+		body["errors"] = e.Errors
+	}
+	writeJSON(w, e.Status, body)
+}
+
+// goal returns the run's instruction. The bundled UI and supervisor call it
+// "message"; "goal" is accepted as well.
+func (req *runReq) goal() string {
+	if req.Goal != "" {
+		return req.Goal
+	}
+	return req.Message
+}
+
+func (req *runReq) setGoal(goal string) {
+	if req.Goal != "" {
+		req.Goal = goal
+	} else {
+		req.Message = goal
+	}
+}
+
+// parseRun decodes and checks a run request, trimming the goal in place.
+// Every failed check is reported, not just the first.
+func parseRun(body []byte) (runReq, *validationError) {
+	return parseRunFrom(func(v any) error { return json.Unmarshal(body, v) })
+}
+
+// parseRunFrom is parseRun over a body that decode unmarshals into v, once
+// for each value it is called with.
+func parseRunFrom(decode func(v any) error) (runReq, *validationError) {
+	var req runReq
+	if err := decode(&req); err != nil {
+		return req, fieldInvalid(http.StatusBadRequest, "", "invalid_json", "invalid JSON body")
+	}
+	applyDefaultProvider(&req)
+	goal := sanitizeGoal(strings.TrimSpace(req.goal()))
+	goalErr := checkGoalEncodingFrom(decode)
+	if goalErr == nil {
+		goalErr = checkGoal(goal)
+	}
+	if verr := joinValidation(goalErr, checkReadOnly(req), checkPriority(req.Priority), checkRegion(req), checkTags(req.Tags)); verr != nil {
+		return req, verr
+	}
+	req.Region = strings.ToLower(strings.TrimSpace(req.Region))
+	req.setGoal(goal)
+	return req, nil
+}
+
+// checkGoalEncoding rejects a goal that isn't valid UTF-8 as sent. It looks
+// at the raw JSON, because decoding quietly turns bad bytes into U+FFFD and
+// the supervisor would get a goal the caller never wrote.
+func checkGoalEncoding(body []byte) *validationError {
+	return checkGoalEncodingFrom(func(v any) error { return json.Unmarshal(body, v) })
+}
+
+func checkGoalEncodingFrom(decode func(v any) error) *validationError {
+	var raw struct {
+		Goal    json.RawMessage `json:"goal"`
+		Message json.RawMessage `json:"message"`
+	}
+	if decode(&raw) != nil || utf8.Valid(raw.Goal) && utf8.Valid(raw.Message) {
+		return nil
+	}
+	return fieldInvalid(http.StatusUnprocessableEntity, "goal", "invalid_encoding", "goal is not valid UTF-8")
+}
+
+// checkReadOnly rejects readonly runs that also pick a provider: the
+// provider supervisors are the provisioning ones.
+func checkReadOnly(req runReq) *validationError {
+	if req.ReadOnly && strings.TrimSpace(req.Provider) != "" {
+		return fieldInvalid(http.StatusBadRequest, "provider", "readonly_provider", "readonly runs cannot set provider")
+	}
+	return nil
+}
+
+// checkPriority accepts an empty priority, meaning normal, or one of
+// priorityLevels.
+func checkPriority(p string) *validationError {
+	p = strings.ToLower(strings.TrimSpace(p))
+	if p != "" && !slices.Contains(priorityLevels, p) {
+		return fieldInvalid(http.StatusBadRequest, "priority", "invalid_priority", "priority must be high, normal or low").withAllowed(priorityLevels)
+	}
+	return nil
+}
+
+// checkRegion rejects a region missing from its provider's
+// ALLOWED_REGIONS_<PROVIDER>. Runs without a provider, or whose provider has
+// no list, may name any region.
+func checkRegion(req runReq) *validationError {
+	region := strings.ToLower(strings.TrimSpace(req.Region))
+	allowed, ok := providerRegions[strings.ToLower(strings.TrimSpace(req.Provider))]
+	if region == "" || !ok || slices.Contains(allowed, region) {
+		return nil
+	}
+	verr := fieldInvalid(http.StatusUnprocessableEntity, "region", "region_not_allowed", "region not allowed for provider").withAllowed(allowed)
+	verr.Extra = map[string]any{"region": region, "allowed": allowed}
+	return verr
+}
+
+// maxTags and maxTagLen bound the tags one run may carry.
+const (
+	maxTags   = 10
+	maxTagLen = 100
+)
+
+// tagFormat is "key:value", e.g. "team:infra" or "env:staging".
+var tagFormat = regexp.MustCompile(`^[A-Za-z0-9_.-]+:[A-Za-z0-9_.:/-]+$`)
+
+// checkTags accepts up to maxTags tags in tagFormat.
+func checkTags(tags []string) *validationError {
+	if len(tags) > maxTags {
+		return fieldInvalid(http.StatusBadRequest, "tags", "too_many", "too many tags").withLimit(maxTags)
+	}
+	for _, t := range tags {
+		if len(t) > maxTagLen || !tagFormat.MatchString(t) {
+			return fieldInvalid(http.StatusBadRequest, "tags", "invalid_tag", "tags must be key:value")
+		}
+	}
+	return nil
+}
+
+// checkGoal reports every rule a goal breaks.
+func checkGoal(goal string) *validationError {
+	if goal == "" {
+		return fieldInvalid(http.StatusBadRequest, "goal", "required", "goal is required")
+	}
+	var errs []*validationError
+	if hasControlChars(goal) {
+		errs = append(errs, fieldInvalid(http.StatusUnprocessableEntity, "goal", "invalid_characters", "goal contains invalid characters"))
+	}
+	if maxGoalLen > 0 && utf8.RuneCountInString(goal) > maxGoalLen {
+		errs = append(errs, fieldInvalid(http.StatusUnprocessableEntity, "goal", "too_long", "goal is too long").withLimit(maxGoalLen))
+	}
+	if !goalAllowed(goal) {
+		errs = append(errs, fieldInvalid(http.StatusForbidden, "goal", "not_permitted", "goal not permitted"))
+	}
+	return joinValidation(errs...)
+}
+
+// sanitizeGoals is SANITIZE_GOALS: "strip" removes control characters and
+// ANSI escape sequences from goals; otherwise checkGoal rejects them.
+var sanitizeGoals string
+
+// ansiEscape matches ANSI CSI sequences such as the color code "\x1b[31m".
+var ansiEscape = regexp.MustCompile(`\x1b\[[0-9;?]*[ -/]*[@-~]`)
+
+// sanitizeGoal applies SANITIZE_GOALS=strip; in the default mode it returns
+// goal unchanged.
+func sanitizeGoal(goal string) string {
+	if sanitizeGoals != "strip" || !hasControlChars(goal) {
+		return goal
+	}
+	goal = ansiEscape.ReplaceAllString(goal, "")
+	goal = strings.Map(func(r rune) rune {
+		if isControlChar(r) {
+			return -1
+		}
+		return r
+	}, goal)
+	return strings.TrimSpace(goal)
+}
+
+// isControlChar reports non-printable control characters other than newline
+// and tab.
+func isControlChar(r rune) bool {
+	return unicode.IsControl(r) && r != '\n' && r != '\t'
+}
+
+func hasControlChars(s string) bool {
+	return strings.ContainsFunc(s, isControlChar)
+}
+
+// normalizeRun validates body and re-encodes it the way it is forwarded,
+// after the selected transformer has had its say. Only the goal is
+// rewritten, through GOAL_TEMPLATE when set; fields the gateway doesn't
+// model are passed through to the supervisor untouched.
+func normalizeRun(body []byte) (runReq, []byte, *validationError) {
+	req, verr := parseRun(body)
+	if verr != nil {
+		return req, nil, verr
+	}
+	var fields map[string]any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber() // keep numbers exactly as sent
+	if err := dec.Decode(&fields); err != nil || fields == nil {
+		return req, nil, &validationError{Status: http.StatusBadRequest, Msg: "invalid JSON body"}
+	}
+	key := "message"
+	if req.Goal != "" {
+		key = "goal"
+	}
+	goal, err := renderGoal(req.goal())
+	if err != nil {
+		return req, nil, &validationError{Status: http.StatusInternalServerError, Msg: "goal template failed"}
+	}
+	fields[key] = goal
+	if req.Region != "" {
+		fields["region"] = req.Region
+	}
+	if p, _ := fields["provider"].(string); strings.TrimSpace(p) == "" && req.Provider != "" {
+		fields["provider"] = req.Provider // DEFAULT_PROVIDER
+	}
+	if safeMode {
+		req.ReadOnly, req.DryRun = true, true
+		fields["readonly"], fields["dry_run"] = true, true
+	}
+	fields, err = transformer.Transform(goal, fields)
+	if err != nil {
+		return req, nil, &validationError{Status: http.StatusBadRequest, Msg: err.Error()}
+	}
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return req, nil, &validationError{Status: http.StatusBadRequest, Msg: "invalid JSON body"}
+	}
+	return req, out, nil
+}
+
+// handleValidate serves POST /api/run/validate: the /api/run checks without
+// contacting the supervisor, so the UI can lint a goal as it is typed.
+func handleValidate(w http.ResponseWriter, r *http.Request) {
+	enableCORS(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	body, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	errs := validateRun(tenantOf(r), body)
+	if len(errs) > 0 {
+		writeJSON(w, http.StatusOK, map[string]any{"valid": false, "errors": errs})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"valid": true})
+}
+
+// validateRun lists everything wrong with a run body rather than stopping at
+// the first problem. Unlike route, it flags an unrecognized provider.
+func validateRun(tenant string, body []byte) []fieldError {
+	var req runReq
+	if err := json.Unmarshal(body, &req); err != nil {
+		return fieldInvalid(http.StatusBadRequest, "", "invalid_json", "invalid JSON body").Errors
+	}
+	applyDefaultProvider(&req)
+	var providerErr *validationError
+	p := strings.ToLower(strings.TrimSpace(req.Provider))
+	if p != "" && !slices.Contains(providers, p) {
+		providerErr = fieldInvalid(http.StatusBadRequest, "provider", "unknown_provider", "unknown provider").withAllowed(providers)
+	} else if _, verr := route(tenant, req); verr != nil {
+		providerErr = verr
+	}
+	verr := joinValidation(checkGoalEncoding(body), checkGoal(sanitizeGoal(strings.TrimSpace(req.goal()))),
+		checkReadOnly(req), checkPriority(req.Priority), checkRegion(req), checkTags(req.Tags), providerErr)
+	if verr == nil {
+		return nil
+	}
+	return verr.Errors
+}
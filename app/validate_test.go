@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestGoalValidation(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_GOAL_LEN", "20")
+
+	for _, tc := range []struct {
+		name, goal string
+		want       int
+		msg        string
+	}{
+		{"empty", "", http.StatusBadRequest, "goal is required"},
+		{"whitespace", " \t\n ", http.StatusBadRequest, "goal is required"},
+		{"over-length", strings.Repeat("x", 21), http.StatusUnprocessableEntity, "goal is too long"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": tc.goal})
+			if resp.StatusCode != tc.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tc.want)
+			}
+			if got := decode(t, resp)["error"]; got != tc.msg {
+				t.Errorf("error = %v, want %q", got, tc.msg)
+			}
+		})
+	}
+	if len(seen) != 0 {
+		t.Fatal("an invalid goal reached the supervisor")
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "  list buckets  "})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		var fwd map[string]any
+		if err := json.Unmarshal(nextRequest(t, seen).body, &fwd); err != nil {
+			t.Fatal(err)
+		}
+		if fwd["goal"] != "list buckets" {
+			t.Errorf("forwarded goal = %q, want it trimmed", fwd["goal"])
+		}
+	})
+}
+
+func TestValidateEndpoint(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_GOAL_LEN", "20")
+
+	for _, tc := range []struct {
+		name string
+		body map[string]any
+		code string // "" for valid
+	}{
+		{"valid", map[string]any{"goal": "list buckets"}, ""},
+		{"empty", map[string]any{"goal": ""}, "required"},
+		{"over-length", map[string]any{"goal": strings.Repeat("x", 21)}, "too_long"},
+		{"bad provider", map[string]any{"goal": "list buckets", "provider": "oci"}, "unknown_provider"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := postJSON(t, gw.URL+"/api/run/validate", tc.body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			var out struct {
+				Valid  bool         `json:"valid"`
+				Errors []fieldError `json:"errors"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+				t.Fatal(err)
+			}
+			if tc.code == "" {
+				if !out.Valid || len(out.Errors) != 0 {
+					t.Errorf("got %+v, want valid", out)
+				}
+				return
+			}
+			if out.Valid || len(out.Errors) != 1 || out.Errors[0].Code != tc.code {
+				t.Errorf("got %+v, want one %q error", out, tc.code)
+			}
+		})
+	}
+	if len(seen) != 0 {
+		t.Error("validation reached the supervisor")
+	}
+}
+
+func TestGoalControlCharacters(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	for _, goal := range []string{"list\x00 buckets", "\x1b[31mlist buckets\x1b[0m"} {
+		resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": goal})
+		if resp.StatusCode != http.StatusUnprocessableEntity {
+			t.Fatalf("goal %q: status = %d, want 422", goal, resp.StatusCode)
+		}
+		if got := decode(t, resp)["error"]; got != "goal contains invalid characters" {
+			t.Errorf("goal %q: error = %v", goal, got)
+		}
+	}
+	if len(seen) != 0 {
+		t.Fatal("a goal with control characters reached the supervisor")
+	}
+	if resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets\n\tin every region"}); resp.StatusCode != http.StatusOK {
+		t.Errorf("newline and tab: status = %d, want 200", resp.StatusCode)
+	}
+	nextRequest(t, seen)
+
+	gw = testGateway(t, "SUPERVISOR_URL", sup, "SANITIZE_GOALS", "strip")
+	for goal, want := range map[string]string{
+		"list\x00 buckets":                "list buckets",
+		"\x1b[31mlist buckets\x1b[0m":     "list buckets",
+		"\x07\x00":                        "",
+		"list buckets\n\tin every region": "list buckets\n\tin every region",
+	} {
+		resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": goal})
+		if want == "" {
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("goal %q: status = %d, want 400 once stripped to nothing", goal, resp.StatusCode)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("goal %q: status = %d, want 200", goal, resp.StatusCode)
+		}
+		var fwd map[string]any
+		if err := json.Unmarshal(nextRequest(t, seen).body, &fwd); err != nil {
+			t.Fatal(err)
+		}
+		if fwd["goal"] != want {
+			t.Errorf("goal %q forwarded as %q, want %q", goal, fwd["goal"], want)
+		}
+	}
+}
+
+func TestGoalEncoding(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	for _, spool := range []string{"0", "16"} {
+		gw := testGateway(t, "SUPERVISOR_URL", sup, "SPOOL_THRESHOLD", spool)
+		for _, raw := range []string{"{\"goal\":\"list buckets \xff\xfe\"}", "{\"message\":\"caf\xe9\"}"} {
+			resp := post(t, gw.URL+"/api/run", "application/json", raw)
+			if got := decode(t, resp); resp.StatusCode != http.StatusUnprocessableEntity || got["error"] != "goal is not valid UTF-8" {
+				t.Errorf("SPOOL_THRESHOLD=%s %q: status = %d, body = %v, want 422", spool, raw, resp.StatusCode, got)
+			}
+		}
+	}
+	if len(seen) != 0 {
+		t.Error("a goal with invalid UTF-8 reached the supervisor")
+	}
+
+	// A declared charset is transcoded instead.
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "SPOOL_THRESHOLD", "0")
+	if resp := post(t, gw.URL+"/api/run", "application/json; charset=windows-1252", "{\"goal\":\"caf\xe9 menu\"}"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("windows-1252 goal: status = %d, want 200", resp.StatusCode)
+	}
+	if got := goalOf(httptest.NewRequest(http.MethodPost, "/run", bytes.NewReader(nextRequest(t, seen).body))); got != "café menu" {
+		t.Errorf("forwarded goal = %q, want it in UTF-8", got)
+	}
+	if resp := post(t, gw.URL+"/api/run", "application/json; charset=klingon", `{"goal":"list buckets"}`); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("unknown charset: status = %d, want 415", resp.StatusCode)
+	}
+}
+
+func TestValidationReportsEveryField(t *testing.T) {
+	sup, seen := recordingSupervisor(t)
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_GOAL_LEN", "20")
+	run := func(body map[string]any) (int, []fieldError) {
+		t.Helper()
+		resp := postJSON(t, gw.URL+"/api/run", body)
+		defer resp.Body.Close()
+		var out struct {
+			Errors []fieldError `json:"errors"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, out.Errors
+	}
+	codes := func(errs []fieldError) []string {
+		var out []string
+		for _, e := range errs {
+			out = append(out, e.Field+"/"+e.Code)
+		}
+		return out
+	}
+
+	status, errs := run(map[string]any{
+		"goal":     "delete\x07 " + strings.Repeat("x", 30),
+		"readonly": true,
+		"provider": "aws",
+		"priority": "asap",
+		"tags":     []string{"no colon"},
+	})
+	if status != http.StatusUnprocessableEntity {
+		t.Errorf("status = %d, want 422, the most severe of 422 and 400", status)
+	}
+	want := []string{"goal/invalid_characters", "goal/too_long", "provider/readonly_provider", "priority/invalid_priority", "tags/invalid_tag"}
+	if got := codes(errs); !slices.Equal(got, want) {
+		t.Fatalf("errors = %v, want %v", got, want)
+	}
+	for _, e := range errs {
+		if e.Message == "" {
+			t.Errorf("%s/%s has no message", e.Field, e.Code)
+		}
+	}
+	if errs[1].Limit != 20 {
+		t.Errorf("too_long limit = %d, want 20", errs[1].Limit)
+	}
+	if !slices.Equal(errs[3].Allowed, priorityLevels) {
+		t.Errorf("invalid_priority allowed = %v, want %v", errs[3].Allowed, priorityLevels)
+	}
+
+	status, errs = run(map[string]any{"priority": "asap", "tags": []string{"no colon"}})
+	if want := []string{"goal/required", "priority/invalid_priority", "tags/invalid_tag"}; status != http.StatusBadRequest || !slices.Equal(codes(errs), want) {
+		t.Errorf("all 400s: status = %d, errors = %v, want 400 with %v", status, codes(errs), want)
+	}
+
+	gw = testGateway(t, "SUPERVISOR_URL", sup, "MAX_GOAL_LEN", "20", "GOAL_ALLOWLIST", "list *")
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": strings.Repeat("x", 30), "priority": "asap"})
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("with a forbidden goal: status = %d, want 403 to outrank the rest", resp.StatusCode)
+	}
+	if len(seen) != 0 {
+		t.Error("an invalid run reached the supervisor")
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import "net/http"
+
+// Build metadata, set with -ldflags "-X main.version=... -X main.commit=... -X main.buildTime=...".
+var (
+	version   = "dev"
+	commit    = "dev"
+	buildTime = "dev"
+)
+
+// responseSchema versions the envelope the gateway puts around /api/run
+// answers: the added run_id, its own headers and error bodies. It is sent as
+// X-Gateway-Schema and bumped whenever that envelope changes; the
+// supervisor's own fields don't count.
+const responseSchema = "v1"
+
+// withSchema sends X-Gateway-Schema on every /api/run answer, the 401s,
+// 429s and 503s of the checks in front of handleRun included.
+func withSchema(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Gateway-Schema", responseSchema)
+		next(w, r)
+	}
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(w, http.StatusOK, map[string]string{
+		"version":   version,
+		"commit":    commit,
+		"buildTime": buildTime,
+		"schema":    responseSchema,
+	})
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestVersionDefaults(t *testing.T) {
+	gw := testGateway(t)
+
+	resp := get(t, gw.URL+"/api/version")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	body := decode(t, resp)
+	for _, k := range []string{"version", "commit", "buildTime"} {
+		if body[k] != "dev" {
+			t.Errorf("%s = %v, want dev", k, body[k])
+		}
+	}
+}
+
+func TestRunResponsesCarrySchema(t *testing.T) {
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		if goalOf(r) == "fail" {
+			writeJSON(w, http.StatusInternalServerError, map[string]any{"detail": "boom"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true, "schema": "supervisor-3"})
+	})
+	check := func(name string, resp *http.Response, want int) map[string]any {
+		t.Helper()
+		if resp.StatusCode != want {
+			t.Errorf("%s: status = %d, want %d", name, resp.StatusCode, want)
+		}
+		if got := resp.Header.Get("X-Gateway-Schema"); got != responseSchema {
+			t.Errorf("%s: X-Gateway-Schema = %q, want %q", name, got, responseSchema)
+		}
+		return decode(t, resp)
+	}
+
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "MAX_RETRIES", "0")
+	if body := check("ok", postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}), http.StatusOK); body["schema"] != "supervisor-3" {
+		t.Errorf("body schema = %v, want the supervisor's own field untouched", body["schema"])
+	}
+	check("supervisor error", postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "fail"}), http.StatusInternalServerError)
+	check("invalid", postJSON(t, gw.URL+"/api/run", map[string]any{"goal": ""}), http.StatusBadRequest)
+
+	gw = testGateway(t, "SUPERVISOR_URL", sup, "API_KEYS", "key-one")
+	check("unauthorized", postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}), http.StatusUnauthorized)
+
+	gw = testGateway(t, "SUPERVISOR_URL", sup, "API_KEYS", "", "RATE_LIMIT", "0.001", "RATE_BURST", "1")
+	postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"})
+	check("rate limited", postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}), http.StatusTooManyRequests)
+
+	gw = testGateway(t, "SUPERVISOR_URL", sup, "RATE_LIMIT", "0", "MAINTENANCE", "true")
+	check("maintenance", postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "list buckets"}), http.StatusServiceUnavailable)
+
+	if got := get(t, gw.URL+"/api/health").Header.Get("X-Gateway-Schema"); got != "" {
+		t.Errorf("/api/health X-Gateway-Schema = %q, want it on /api/run only", got)
+	}
+	if got := decode(t, get(t, gw.URL+"/api/version"))["schema"]; got != responseSchema {
+		t.Errorf("/api/version schema = %v, want %q", got, responseSchema)
+	}
+}
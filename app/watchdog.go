@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// hardDeadline is HARD_DEADLINE, the absolute limit on a run. Every run is
+// meant to end on its RUN_TIMEOUT, so one still going this long has leaked
+// and watchRun cancels it. Zero disables the watchdog.
+var hardDeadline time.Duration
+
+// errHardDeadline is the cause of a run canceled by the watchdog.
+var errHardDeadline = errors.New("run exceeded HARD_DEADLINE")
+
+// initHardDeadline sets hardDeadline from HARD_DEADLINE, which must exceed
+// the longest RUN_TIMEOUT[_<PROVIDER>]. Unset, it defaults to a minute past
+// that timeout, or off when runs have none.
+func initHardDeadline(val string) error {
+	hardDeadline = 0
+	longest := longestRunTimeout()
+	if val == "" {
+		if longest > 0 {
+			hardDeadline = longest + time.Minute
+		}
+		return nil
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d < 0 {
+		return fmt.Errorf("HARD_DEADLINE: invalid duration %q", val)
+	}
+	if d > 0 && longest > 0 && d <= longest {
+		return fmt.Errorf("HARD_DEADLINE %s must be longer than the longest RUN_TIMEOUT (%s)", d, longest)
+	}
+	hardDeadline = d
+	return nil
+}
+
+// watchRun derives the context a run works under, canceled with
+// errHardDeadline once the run has taken hardDeadline. The returned func
+// ends the watch and must be called when the run returns.
+func watchRun(ctx context.Context) (context.Context, func()) {
+	if hardDeadline <= 0 {
+		return ctx, func() {}
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	timer := time.AfterFunc(hardDeadline, func() {
+		logger.Error("run still going past HARD_DEADLINE, canceling it; a goroutine may have leaked",
+			"request_id", requestID(ctx), "hard_deadline", hardDeadline.String(), "goroutines", runtime.NumGoroutine())
+		cancel(errHardDeadline)
+	})
+	return ctx, func() {
+		timer.Stop()
+		cancel(nil)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// stuckOn is a supervisor that never answers goal, as if its connection had
+// hung, and answers any other goal ok.
+func stuckOn(goal string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if goalOf(r) == goal {
+			<-r.Context().Done()
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	}
+}
+
+// ignoreSoftTimeout lowers the watchdog below the RUN_TIMEOUT configure
+// insisted on, so a stuck run outlives its hard deadline first, the way a
+// run that ignored its soft timeout would.
+func ignoreSoftTimeout(t *testing.T) {
+	prev := hardDeadline
+	hardDeadline = 100 * time.Millisecond
+	t.Cleanup(func() { hardDeadline = prev })
+}
+
+func TestWatchRun(t *testing.T) {
+	testGateway(t)
+	logs := captureLogs(t)
+	ignoreSoftTimeout(t)
+
+	ctx, unwatch := watchRun(context.WithValue(context.Background(), requestContextKey, &RequestContext{RequestID: "stuck-1"}))
+	defer unwatch()
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("hard deadline never fired")
+	}
+	if got := context.Cause(ctx); got != errHardDeadline {
+		t.Errorf("cause = %v, want errHardDeadline", got)
+	}
+	l := logs.find("run still going past HARD_DEADLINE, canceling it; a goroutine may have leaked")
+	if l == nil || l["level"] != "ERROR" || l["request_id"] != "stuck-1" || l["goroutines"] == nil {
+		t.Errorf("log = %v, want an error with the request ID and goroutine count", l)
+	}
+
+	ctx, unwatch = watchRun(context.Background())
+	unwatch()
+	time.Sleep(150 * time.Millisecond)
+	if context.Cause(ctx) == errHardDeadline {
+		t.Error("a run that returned in time was still canceled by the watchdog")
+	}
+}
+
+func TestHardDeadlineStopsStuckRuns(t *testing.T) {
+	sup := fakeSupervisor(t, stuckOn("stuck"))
+	gw := testGateway(t, "SUPERVISOR_URL", sup, "RUN_TIMEOUT", "30s", "MAX_RETRIES", "0")
+	ignoreSoftTimeout(t)
+
+	resp := postJSON(t, gw.URL+"/api/run", map[string]any{"goal": "stuck"})
+	if resp.StatusCode != http.StatusGatewayTimeout || decode(t, resp)["error"] != errHardDeadline.Error() {
+		t.Errorf("run: status = %d, want 504 from the watchdog", resp.StatusCode)
+	}
+
+	// Each goal of a batch has its own deadline: the stuck one fails while
+	// the others finish.
+	want := map[string]int{"stuck": http.StatusGatewayTimeout, "ok": http.StatusOK}
+	resp = postJSON(t, gw.URL+"/api/run/batch", map[string]any{"goals": []string{"stuck", "ok"}})
+	var out struct {
+		Results []batchResult `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range out.Results {
+		if res.Status != want[res.Goal] {
+			t.Errorf("batch %s: status = %d, want %d", res.Goal, res.Status, want[res.Goal])
+		}
+	}
+
+	resp = postJSON(t, gw.URL+"/api/run/stream", map[string]any{"goals": []string{"stuck", "ok"}})
+	lines := bufio.NewScanner(resp.Body)
+	for seen := 0; seen < 2 && lines.Scan(); seen++ {
+		var res batchResult
+		json.Unmarshal(lines.Bytes(), &res)
+		if res.Status != want[res.Goal] {
+			t.Errorf("stream %s: status = %d, want %d", res.Goal, res.Status, want[res.Goal])
+		}
+	}
+}
+
+func TestHardDeadlineSetting(t *testing.T) {
+	for _, tc := range []struct {
+		env  []string
+		want time.Duration
+	}{
+		{[]string{"RUN_TIMEOUT", "10s"}, 10*time.Second + time.Minute},
+		{[]string{"RUN_TIMEOUT", "10s", "HARD_DEADLINE", "20s"}, 20 * time.Second},
+		{[]string{"RUN_TIMEOUT", "10s", "HARD_DEADLINE", "0"}, 0},
+	} {
+		testGateway(t, append([]string{"HARD_DEADLINE", ""}, tc.env...)...)
+		if hardDeadline != tc.want {
+			t.Errorf("%v: hardDeadline = %v, want %v", tc.env, hardDeadline, tc.want)
+		}
+	}
+	t.Setenv("SUPERVISOR_URL", "http://127.0.0.1:1/run")
+	t.Setenv("RUN_TIMEOUT", "10s")
+	for _, val := range []string{"5s", "10s", "soon", "-1s"} {
+		t.Setenv("HARD_DEADLINE", val)
+		if err := configure(); err == nil {
+			t.Errorf("HARD_DEADLINE=%s accepted", val)
+		}
+	}
+}
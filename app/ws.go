@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{CheckOrigin: checkWSOrigin}
+
+// checkWSOrigin applies the CORS_ORIGINS policy to WebSocket handshakes.
+func checkWSOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	origins := corsOrigins.Load()
+	return origin == "" || origins == nil || slices.Contains(*origins, origin)
+}
+
+// handleRunWS serves /api/run/ws. The client sends the run request as its
+// first message; every line the supervisor emits is relayed back as a JSON
+// message, followed by a final {"done":true}. Closing the socket cancels the
+// upstream call.
+func handleRunWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade already answered the client
+	}
+	defer conn.Close()
+	defer trackStream()()
+	// The server's read/write timeouts would otherwise kill long runs.
+	conn.NetConn().SetDeadline(time.Time{})
+	conn.SetReadLimit(maxBodyBytes)
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		return
+	}
+	verr := checkJSONShape(msg)
+	var call *upstreamCall
+	if verr == nil {
+		_, call, verr = prepareRun(r, msg)
+	}
+	if verr == nil {
+		relayRun(r.Context(), conn, call)
+		return
+	}
+	out := map[string]any{"error": verr.Msg, "status": verr.Status, "done": true}
+	if len(verr.Errors) > 0 {
+		out["errors"] = verr.Errors
+	}
+	conn.WriteJSON(out)
+	closeWS(conn)
+}
+
+func relayRun(ctx context.Context, conn *websocket.Conn, call *upstreamCall) {
+	ctx, unwatch := watchRun(ctx)
+	defer unwatch()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Reading is the only way to notice the client going away.
+	go func() {
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+	// Taken here, since the watcher can outlive the handler.
+	shutdown := streamShutdown
+	go func() {
+		select {
+		case <-shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	release, err := acquireRun(ctx, call.backends, call.priority)
+	if err != nil {
+		if shuttingDownStreams() {
+			writeWSShutdown(conn)
+			return
+		}
+		conn.WriteJSON(map[string]any{"error": err.Error(), "done": true})
+		closeWS(conn)
+		return
+	}
+	defer release()
+
+	resp, _, err := forward(ctx, call)
+	if err != nil {
+		if shuttingDownStreams() {
+			writeWSShutdown(conn)
+		} else if ctx.Err() == nil {
+			conn.WriteJSON(map[string]any{"error": err.Error(), "done": true})
+			closeWS(conn)
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	br := bufio.NewReader(resp.Body)
+	for {
+		line, err := br.ReadBytes('\n')
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if werr := writeWSLine(conn, line); werr != nil {
+				return
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if shuttingDownStreams() {
+				writeWSShutdown(conn)
+			} else if ctx.Err() == nil {
+				logger.Warn("ws: upstream read failed", "request_id", requestID(ctx), "err", err)
+				conn.WriteJSON(map[string]any{"error": "upstream read failed", "done": true})
+				closeWS(conn)
+			}
+			return
+		}
+	}
+	conn.WriteJSON(map[string]any{"done": true, "status": resp.StatusCode})
+	closeWS(conn)
+}
+
+// writeWSLine sends JSON lines verbatim and wraps anything else.
+func writeWSLine(conn *websocket.Conn, line []byte) error {
+	if json.Valid(line) {
+		return conn.WriteMessage(websocket.TextMessage, line)
+	}
+	return conn.WriteJSON(map[string]any{"line": string(line)})
+}
+
+// writeWSShutdown ends a stream cut short by the gateway shutting down.
+func writeWSShutdown(conn *websocket.Conn) {
+	conn.WriteJSON(map[string]any{"shutdown": true, "done": true})
+	closeWS(conn)
+}
+
+func closeWS(conn *websocket.Conn) {
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
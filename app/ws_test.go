@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialWS opens a WebSocket to the gateway's /api/run/ws.
+func dialWS(t *testing.T, gw string) *websocket.Conn {
+	t.Helper()
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(gw, "http")+"/api/run/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v (response %v)", err, resp)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestRunWSRelaysEvents(t *testing.T) {
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for _, line := range []string{`{"step":"plan"}`, `{"step":"apply"}`, `applied 3 changes`} {
+			w.Write([]byte(line + "\n"))
+			w.(http.Flusher).Flush()
+		}
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	conn := dialWS(t, gw.URL)
+	if err := conn.WriteJSON(map[string]any{"goal": "resize the cluster"}); err != nil {
+		t.Fatal(err)
+	}
+	var got []map[string]any
+	for {
+		var msg map[string]any
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("read after %v: %v", got, err)
+		}
+		got = append(got, msg)
+		if msg["done"] == true {
+			break
+		}
+	}
+	want := []string{`map[step:plan]`, `map[step:apply]`, `map[line:applied 3 changes]`, `map[done:true status:200]`}
+	if len(got) != len(want) {
+		t.Fatalf("messages = %v, want %v", got, want)
+	}
+	for i, msg := range got {
+		if s := fmt.Sprint(msg); s != want[i] {
+			t.Errorf("message %d = %s, want %s", i, s, want[i])
+		}
+	}
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("after done: %v, want a normal close", err)
+	}
+}
+
+func TestRunWSDisconnectCancelsUpstream(t *testing.T) {
+	started, canceled := make(chan struct{}), make(chan struct{})
+	sup := fakeSupervisor(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"step":"plan"}` + "\n"))
+		w.(http.Flusher).Flush()
+		close(started)
+		<-r.Context().Done()
+		close(canceled)
+	})
+	gw := testGateway(t, "SUPERVISOR_URL", sup)
+
+	conn := dialWS(t, gw.URL)
+	conn.WriteJSON(map[string]any{"goal": "resize the cluster"})
+	<-started
+	conn.Close()
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("supervisor request not canceled after the client left")
+	}
+}